@@ -0,0 +1,579 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/existingvolumebroker"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	vmo "code.cloudfoundry.org/volume-mount-options"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const redacted = "*REDACTED*"
+
+// SecretOptions are the instance and binding options the admin API never
+// shows.
+var SecretOptions = []string{PasswordKey}
+
+// AdminInstance is how the admin API shows a service instance.
+type AdminInstance struct {
+	ID        string                 `json:"id"`
+	ServiceID string                 `json:"service_id"`
+	PlanID    string                 `json:"plan_id"`
+	OrgGUID   string                 `json:"organization_guid"`
+	SpaceGUID string                 `json:"space_guid"`
+	Host      string                 `json:"host"`
+	Share     string                 `json:"share"`
+	Options   map[string]interface{} `json:"options"`
+	Bindings  []string               `json:"bindings"`
+}
+
+// AdminBinding is how the admin API shows a binding.
+type AdminBinding struct {
+	ID           string                 `json:"id"`
+	InstanceID   string                 `json:"instance_id"`
+	AppGUID      string                 `json:"app_guid"`
+	ServiceID    string                 `json:"service_id"`
+	PlanID       string                 `json:"plan_id"`
+	ContainerDir string                 `json:"container_dir,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+	Orphaned     bool                   `json:"orphaned"`
+
+	// LegacyVolumeID is set for bindings whose volume ID is the MD5 of
+	// their mount options rather than keyed.
+	LegacyVolumeID bool `json:"legacy_volume_id"`
+}
+
+// InstanceFilter selects service instances. Empty fields match every
+// instance.
+type InstanceFilter struct {
+	OrgGUID   string
+	SpaceGUID string
+	Host      string
+	PlanID    string
+}
+
+// BindingFilter selects bindings. Orphaned only matches bindings whose
+// service instance no longer exists, LegacyVolumeID only bindings that
+// still have a legacy volume ID.
+type BindingFilter struct {
+	InstanceID     string
+	AppGUID        string
+	Orphaned       bool
+	LegacyVolumeID bool
+}
+
+// AdminValidation lists the problems found when re-running option
+// validation for a record.
+type AdminValidation struct {
+	Valid    bool     `json:"valid"`
+	Problems []string `json:"problems"`
+}
+
+// adminError is an admin operation failure that is the caller's fault.
+type adminError struct {
+	status int
+	err    error
+}
+
+func (e *adminError) Error() string {
+	return e.err.Error()
+}
+
+// AdminAPI lets operators inspect and repair the records of the broker. It
+// is served on its own listener with its own credentials.
+type AdminAPI struct {
+	Health *HealthMonitor
+
+	logger lager.Logger
+	store  *IndexedStore
+	broker *Broker
+	router *mux.Router
+
+	maskMutex sync.RWMutex
+	mask      vmo.MountOptsMask
+}
+
+func NewAdminAPI(logger lager.Logger, store *IndexedStore, broker *Broker, mask vmo.MountOptsMask) *AdminAPI {
+	a := &AdminAPI{
+		logger: logger.Session("admin-api"),
+		store:  store,
+		broker: broker,
+		mask:   mask,
+		router: mux.NewRouter(),
+	}
+
+	a.router.HandleFunc("/instances", a.listInstances).Methods(http.MethodGet)
+	a.router.HandleFunc("/instances/{id}", a.getInstance).Methods(http.MethodGet)
+	a.router.HandleFunc("/instances/{id}", a.deleteInstance).Methods(http.MethodDelete)
+	a.router.HandleFunc("/instances/{id}/validate", a.validateInstance).Methods(http.MethodPost)
+	a.router.HandleFunc("/bindings", a.listBindings).Methods(http.MethodGet)
+	a.router.HandleFunc("/bindings/{id}", a.getBinding).Methods(http.MethodGet)
+	a.router.HandleFunc("/bindings/{id}", a.deleteBinding).Methods(http.MethodDelete)
+	a.router.HandleFunc("/bindings/{id}/validate", a.validateBinding).Methods(http.MethodPost)
+	a.router.HandleFunc("/health", a.health).Methods(http.MethodGet)
+	return a
+}
+
+// SetMask replaces the mount option mask instances and bindings are
+// validated against.
+func (a *AdminAPI) SetMask(mask vmo.MountOptsMask) {
+	if a == nil {
+		return
+	}
+	a.maskMutex.Lock()
+	defer a.maskMutex.Unlock()
+	a.mask = mask
+}
+
+func (a *AdminAPI) optionMask() vmo.MountOptsMask {
+	a.maskMutex.RLock()
+	defer a.maskMutex.RUnlock()
+	return a.mask
+}
+
+// maskFor returns the mount option mask of a plan of a service, which is
+// the one of its volume settings if they have one.
+func (a *AdminAPI) maskFor(serviceID, planID string) vmo.MountOptsMask {
+	settings := a.broker.volumeSettings(serviceID, planID)
+	if len(settings.AllowedOptions) > 0 {
+		if mask, err := settings.Mask(a.broker.Flavor); err == nil {
+			return mask
+		}
+	}
+	return a.optionMask()
+}
+
+func (a *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.router.ServeHTTP(w, r)
+}
+
+// Instances lists the service instances accepted by filter, ordered by ID.
+func (a *AdminAPI) Instances(filter InstanceFilter) ([]AdminInstance, error) {
+	host := strings.ToLower(filter.Host)
+	instances, err := a.store.Instances(func(_ string, details brokerstore.ServiceInstance) bool {
+		if (filter.OrgGUID != "" && details.OrganizationGUID != filter.OrgGUID) ||
+			(filter.SpaceGUID != "" && details.SpaceGUID != filter.SpaceGUID) ||
+			(filter.PlanID != "" && details.PlanID != filter.PlanID) {
+			return false
+		}
+		if host == "" {
+			return true
+		}
+		share, err := instanceShare(details)
+		return err == nil && share.Host == host
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	views := []AdminInstance{}
+	for id, details := range instances {
+		view, err := a.instanceView(id, details)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, view)
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].ID < views[j].ID })
+	return views, nil
+}
+
+func (a *AdminAPI) Instance(id string) (AdminInstance, error) {
+	details, err := a.instance(id)
+	if err != nil {
+		return AdminInstance{}, err
+	}
+	return a.instanceView(id, details)
+}
+
+// DeleteInstance removes the instance record without involving the volume
+// broker. Instances that still have bindings are only deleted, together
+// with their bindings, when force is set.
+func (a *AdminAPI) DeleteInstance(id string, force bool) error {
+	if _, err := a.instance(id); err != nil {
+		return err
+	}
+
+	bindings, err := a.store.BindingsByInstance(id)
+	if err != nil {
+		return err
+	}
+	if len(bindings) > 0 && !force {
+		return &adminError{http.StatusConflict, fmt.Errorf("instance %q has %d bindings; force the deletion to delete them as well", id, len(bindings))}
+	}
+
+	a.broker.lock(context.Background())
+	defer a.broker.unlock()
+
+	for bindingID := range bindings {
+		if err := a.store.DeleteBindingDetails(bindingID); err != nil {
+			return err
+		}
+	}
+	if err := a.store.DeleteInstanceDetails(id); err != nil {
+		return err
+	}
+
+	a.logger.Info("instance-deleted", lager.Data{"instanceID": id, "bindings": len(bindings)})
+	return nil
+}
+
+func (a *AdminAPI) ValidateInstance(id string) (AdminValidation, error) {
+	details, err := a.instance(id)
+	if err != nil {
+		return AdminValidation{}, err
+	}
+
+	opts := instanceOptions(details)
+	var problems []string
+	if share, err := instanceShare(details); err != nil {
+		problems = append(problems, err.Error())
+	} else if err := a.broker.ServerPolicy.Check(share.Host, details.OrganizationGUID, details.SpaceGUID); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := mountParameter(opts, a.broker.ForbiddenMountPaths); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	request := MountPolicyRequest{OrgGUID: details.OrganizationGUID, SpaceGUID: details.SpaceGUID, PlanID: details.PlanID, ServiceID: details.ServiceID}
+	if err := a.broker.MountPolicy.CheckForbidden(request, opts); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := vmo.NewMountOpts(opts, a.maskFor(details.ServiceID, details.PlanID)); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	return validation(problems), nil
+}
+
+// Bindings lists the bindings accepted by filter, ordered by ID.
+func (a *AdminAPI) Bindings(filter BindingFilter) ([]AdminBinding, error) {
+	bindings, err := a.store.RetrieveAllBindingDetails()
+	if err != nil {
+		return nil, err
+	}
+
+	views := []AdminBinding{}
+	for id, details := range bindings {
+		view, err := a.bindingView(id, details)
+		if err != nil {
+			return nil, err
+		}
+		if (filter.InstanceID != "" && view.InstanceID != filter.InstanceID) ||
+			(filter.AppGUID != "" && view.AppGUID != filter.AppGUID) ||
+			(filter.Orphaned && !view.Orphaned) ||
+			(filter.LegacyVolumeID && !view.LegacyVolumeID) {
+			continue
+		}
+		views = append(views, view)
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].ID < views[j].ID })
+	return views, nil
+}
+
+func (a *AdminAPI) Binding(id string) (AdminBinding, error) {
+	details, err := a.binding(id)
+	if err != nil {
+		return AdminBinding{}, err
+	}
+	return a.bindingView(id, details)
+}
+
+func (a *AdminAPI) DeleteBinding(id string) error {
+	if _, err := a.binding(id); err != nil {
+		return err
+	}
+
+	a.broker.lock(context.Background())
+	defer a.broker.unlock()
+
+	if err := a.store.DeleteBindingDetails(id); err != nil {
+		return err
+	}
+
+	a.logger.Info("binding-deleted", lager.Data{"bindingID": id})
+	return nil
+}
+
+// ValidateBinding re-runs the bind time validation of the options that
+// result from the instance options and the binding's parameters.
+func (a *AdminAPI) ValidateBinding(id string) (AdminValidation, error) {
+	details, err := a.binding(id)
+	if err != nil {
+		return AdminValidation{}, err
+	}
+
+	instanceID, err := a.store.InstanceForBinding(id)
+	if err != nil {
+		return AdminValidation{}, err
+	}
+	instance, err := a.store.RetrieveInstanceDetails(instanceID)
+	if instanceID == "" || err != nil {
+		return validation([]string{"binding does not belong to an existing service instance"}), nil
+	}
+
+	opts := instanceOptions(instance)
+	var problems []string
+	if len(details.RawParameters) > 0 {
+		params, err := bindingParameters(details.RawParameters)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("binding parameters are not a JSON object: %s", err.Error()))
+		}
+		for k, v := range params {
+			opts[k] = v
+		}
+	}
+
+	if err := mountParameter(opts, a.broker.ForbiddenMountPaths); err != nil {
+		problems = append(problems, err.Error())
+	}
+	request := MountPolicyRequest{OrgGUID: instance.OrganizationGUID, SpaceGUID: instance.SpaceGUID, PlanID: instance.PlanID, ServiceID: instance.ServiceID}
+	if _, err := a.broker.MountPolicy.Apply(request, opts); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := vmo.NewMountOpts(opts, a.maskFor(instance.ServiceID, instance.PlanID)); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	return validation(problems), nil
+}
+
+func (a *AdminAPI) listInstances(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	instances, err := a.Instances(InstanceFilter{
+		OrgGUID:   query.Get("org"),
+		SpaceGUID: query.Get("space"),
+		Host:      query.Get("host"),
+		PlanID:    query.Get("plan"),
+	})
+	a.result(w, instances, err)
+}
+
+func (a *AdminAPI) getInstance(w http.ResponseWriter, r *http.Request) {
+	instance, err := a.Instance(mux.Vars(r)["id"])
+	a.result(w, instance, err)
+}
+
+func (a *AdminAPI) deleteInstance(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	record := a.broker.target(AuditRecord{Operation: "admin-delete-instance", InstanceID: id})
+	force := r.URL.Query().Get("force") == "true"
+	record.Parameters = map[string]interface{}{"force": force}
+
+	err := a.DeleteInstance(id, force)
+	a.broker.record(adminIdentity(r), record, err)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminAPI) validateInstance(w http.ResponseWriter, r *http.Request) {
+	validation, err := a.ValidateInstance(mux.Vars(r)["id"])
+	a.result(w, validation, err)
+}
+
+func (a *AdminAPI) listBindings(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	bindings, err := a.Bindings(BindingFilter{
+		InstanceID:     query.Get("instance"),
+		AppGUID:        query.Get("app"),
+		Orphaned:       query.Get("orphaned") == "true",
+		LegacyVolumeID: query.Get("legacy_volume_id") == "true",
+	})
+	a.result(w, bindings, err)
+}
+
+func (a *AdminAPI) getBinding(w http.ResponseWriter, r *http.Request) {
+	binding, err := a.Binding(mux.Vars(r)["id"])
+	a.result(w, binding, err)
+}
+
+func (a *AdminAPI) deleteBinding(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	record := a.broker.target(AuditRecord{Operation: "admin-delete-binding", BindingID: id})
+
+	err := a.DeleteBinding(id)
+	a.broker.record(adminIdentity(r), record, err)
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminAPI) validateBinding(w http.ResponseWriter, r *http.Request) {
+	validation, err := a.ValidateBinding(mux.Vars(r)["id"])
+	a.result(w, validation, err)
+}
+
+func (a *AdminAPI) health(w http.ResponseWriter, r *http.Request) {
+	if a.Health == nil {
+		a.fail(w, &adminError{http.StatusNotFound, fmt.Errorf("the health monitor is not enabled")})
+		return
+	}
+	a.Health.ServeHTTP(w, r)
+}
+
+// adminIdentity attributes an admin API request to the operator it was
+// authenticated as.
+func adminIdentity(r *http.Request) context.Context {
+	user, _, _ := r.BasicAuth()
+	return ContextWithIdentity(r.Context(), Identity{Platform: "admin-api", User: user})
+}
+
+func (a *AdminAPI) instance(id string) (brokerstore.ServiceInstance, error) {
+	instances, err := a.store.Instances(func(instanceID string, _ brokerstore.ServiceInstance) bool { return instanceID == id })
+	if err != nil {
+		return brokerstore.ServiceInstance{}, err
+	}
+	details, ok := instances[id]
+	if !ok {
+		return brokerstore.ServiceInstance{}, &adminError{http.StatusNotFound, fmt.Errorf("instance %q does not exist", id)}
+	}
+	return details, nil
+}
+
+func (a *AdminAPI) binding(id string) (brokerapi.BindDetails, error) {
+	bindings, err := a.store.RetrieveAllBindingDetails()
+	if err != nil {
+		return brokerapi.BindDetails{}, err
+	}
+	details, ok := bindings[id]
+	if !ok {
+		return brokerapi.BindDetails{}, &adminError{http.StatusNotFound, fmt.Errorf("binding %q does not exist", id)}
+	}
+	return details, nil
+}
+
+func (a *AdminAPI) instanceView(id string, details brokerstore.ServiceInstance) (AdminInstance, error) {
+	opts := instanceOptions(details)
+	view := AdminInstance{
+		ID:        id,
+		ServiceID: details.ServiceID,
+		PlanID:    details.PlanID,
+		OrgGUID:   details.OrganizationGUID,
+		SpaceGUID: details.SpaceGUID,
+		Options:   maskSecrets(opts),
+		Bindings:  []string{},
+	}
+	view.Share, _ = opts[existingvolumebroker.SHARE_KEY].(string)
+	if share, err := parseInstanceShare(view.Share); err == nil {
+		view.Host = share.Host
+	}
+
+	bindings, err := a.store.BindingsByInstance(id)
+	if err != nil {
+		return AdminInstance{}, err
+	}
+	for bindingID := range bindings {
+		view.Bindings = append(view.Bindings, bindingID)
+	}
+	sort.Strings(view.Bindings)
+	return view, nil
+}
+
+func (a *AdminAPI) bindingView(id string, details brokerapi.BindDetails) (AdminBinding, error) {
+	instanceID, err := a.store.InstanceForBinding(id)
+	if err != nil {
+		return AdminBinding{}, err
+	}
+
+	view := AdminBinding{
+		ID:         id,
+		InstanceID: instanceID,
+		AppGUID:    details.AppGUID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		Orphaned:   true,
+	}
+
+	if instanceID != "" {
+		if _, err := a.store.RetrieveInstanceDetails(instanceID); err == nil {
+			view.Orphaned = false
+		}
+	}
+
+	apps, err := a.store.BindingsByApp(details.AppGUID)
+	if err != nil {
+		return AdminBinding{}, err
+	}
+	view.ContainerDir = apps[id].ContainerDir
+	view.LegacyVolumeID = apps[id].VolumeIDScheme == ""
+
+	if len(details.RawParameters) > 0 {
+		if params, err := bindingParameters(details.RawParameters); err == nil {
+			view.Parameters = maskSecrets(params)
+		}
+	}
+	return view, nil
+}
+
+func (a *AdminAPI) respond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		a.logger.Error("failed-to-encode-response", err)
+	}
+}
+
+func (a *AdminAPI) result(w http.ResponseWriter, body interface{}, err error) {
+	if err != nil {
+		a.fail(w, err)
+		return
+	}
+	a.respond(w, http.StatusOK, body)
+}
+
+func (a *AdminAPI) fail(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if adminErr, ok := err.(*adminError); ok {
+		status = adminErr.status
+	} else {
+		a.logger.Error("request-failed", err)
+	}
+	a.respond(w, status, brokerapi.ErrorResponse{Description: err.Error()})
+}
+
+func validation(problems []string) AdminValidation {
+	if problems == nil {
+		problems = []string{}
+	}
+	return AdminValidation{Valid: len(problems) == 0, Problems: problems}
+}
+
+func maskSecrets(opts map[string]interface{}) map[string]interface{} {
+	masked := map[string]interface{}{}
+	for k, v := range opts {
+		masked[k] = v
+		if contains(SecretOptions, k) {
+			masked[k] = redacted
+		}
+	}
+	return masked
+}
+
+// IsLoopbackAddress reports whether the host:port address only listens on
+// the loopback interface. An empty host listens on every interface.
+func IsLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
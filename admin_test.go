@@ -0,0 +1,178 @@
+package main_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/lager"
+	vmo "code.cloudfoundry.org/volume-mount-options"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AdminAPI", func() {
+	var (
+		credhub *fakeCredhub
+		store   *IndexedStore
+		admin   *AdminAPI
+	)
+
+	BeforeEach(func() {
+		credhub = newFakeCredhub()
+		credhub.SetJSON("/smbbroker/instance-1", map[string]interface{}{
+			"service_id": "service", "plan_id": "plan-1", "organization_guid": "org-1", "space_guid": "space-1",
+			"ServiceFingerPrint": map[string]interface{}{"share": "//server-a/share", "username": "alice", "password": "secret"},
+		})
+		credhub.SetJSON("/smbbroker/instance-2", map[string]interface{}{
+			"service_id": "service", "plan_id": "plan-2", "organization_guid": "org-1", "space_guid": "space-2",
+			"ServiceFingerPrint": map[string]interface{}{"share": "//server-b/share", "mount": "/etc"},
+		})
+		credhub.SetJSON("/smbbroker/binding-1", map[string]interface{}{"app_guid": "app-1", "parameters": map[string]interface{}{"mount": "/data"}})
+		credhub.SetJSON("/smbbroker/binding-2", map[string]interface{}{"app_guid": "app-2", "parameters": map[string]interface{}{"password": "override"}})
+		credhub.SetJSON("/smbbroker/binding-3", map[string]interface{}{"app_guid": "app-3"})
+		credhub.SetJSON("/smbbroker/index/binding-1", map[string]interface{}{"instance_id": "instance-1", "container_dir": "/data", "volume_id_scheme": "hmac-sha256"})
+		credhub.SetJSON("/smbbroker/index/binding-2", map[string]interface{}{"instance_id": "instance-1"})
+		credhub.SetJSON("/smbbroker/index/binding-3", map[string]interface{}{"instance_id": "instance-gone"})
+
+		logger := lager.NewLogger("admin")
+		store = NewIndexedStore(logger, credhub, "smbbroker")
+
+		mask, err := vmo.NewMountOptsMask([]string{"source", "mount", "ro", "username", "password", "domain", "version"},
+			map[string]interface{}{}, map[string]string{"readonly": "ro", "share": "source"}, []string{}, []string{"source"})
+		Expect(err).NotTo(HaveOccurred())
+
+		admin = NewAdminAPI(logger, store, NewBroker(logger, nil, store), mask)
+	})
+
+	request := func(method, path string, body interface{}) int {
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		if body != nil {
+			Expect(json.Unmarshal(recorder.Body.Bytes(), body)).To(Succeed())
+		}
+		return recorder.Code
+	}
+
+	Describe("instances", func() {
+		It("lists instances with secrets masked", func() {
+			var instances []AdminInstance
+			Expect(request(http.MethodGet, "/instances", &instances)).To(Equal(http.StatusOK))
+			Expect(instances).To(HaveLen(2))
+			Expect(instances[0].ID).To(Equal("instance-1"))
+			Expect(instances[0].Host).To(Equal("server-a"))
+			Expect(instances[0].Options).To(HaveKeyWithValue("password", "*REDACTED*"))
+			Expect(instances[0].Options).To(HaveKeyWithValue("username", "alice"))
+			Expect(instances[0].Bindings).To(Equal([]string{"binding-1", "binding-2"}))
+		})
+
+		It("filters instances", func() {
+			for query, expected := range map[string]string{
+				"org=org-1&space=space-2": "instance-2",
+				"host=SERVER-A":           "instance-1",
+				"plan=plan-2":             "instance-2",
+			} {
+				var instances []AdminInstance
+				Expect(request(http.MethodGet, "/instances?"+query, &instances)).To(Equal(http.StatusOK))
+				Expect(instances).To(HaveLen(1), query)
+				Expect(instances[0].ID).To(Equal(expected), query)
+			}
+		})
+
+		It("shows a single instance", func() {
+			var instance AdminInstance
+			Expect(request(http.MethodGet, "/instances/instance-2", &instance)).To(Equal(http.StatusOK))
+			Expect(instance.SpaceGUID).To(Equal("space-2"))
+
+			var failure map[string]string
+			Expect(request(http.MethodGet, "/instances/missing", &failure)).To(Equal(http.StatusNotFound))
+			Expect(failure).To(HaveKeyWithValue("description", `instance "missing" does not exist`))
+		})
+
+		It("only deletes instances with bindings when forced", func() {
+			Expect(request(http.MethodDelete, "/instances/instance-1", nil)).To(Equal(http.StatusConflict))
+
+			Expect(request(http.MethodDelete, "/instances/instance-1?force=true", nil)).To(Equal(http.StatusNoContent))
+			Expect(credhub.has("/smbbroker/instance-1")).To(BeFalse())
+			Expect(credhub.has("/smbbroker/binding-1")).To(BeFalse())
+			Expect(credhub.has("/smbbroker/index/binding-2")).To(BeFalse())
+			Expect(credhub.has("/smbbroker/binding-3")).To(BeTrue())
+
+			Expect(request(http.MethodDelete, "/instances/instance-2", nil)).To(Equal(http.StatusNoContent))
+		})
+
+		It("re-runs option validation", func() {
+			var validation AdminValidation
+			Expect(request(http.MethodPost, "/instances/instance-1/validate", &validation)).To(Equal(http.StatusOK))
+			Expect(validation.Valid).To(BeTrue())
+			Expect(validation.Problems).To(BeEmpty())
+
+			Expect(request(http.MethodPost, "/instances/instance-2/validate", &validation)).To(Equal(http.StatusOK))
+			Expect(validation.Valid).To(BeFalse())
+			Expect(validation.Problems).To(Equal([]string{`mount path "/etc" is not allowed: "/etc" is reserved`}))
+		})
+	})
+
+	Describe("bindings", func() {
+		It("lists bindings with secrets masked", func() {
+			var bindings []AdminBinding
+			Expect(request(http.MethodGet, "/bindings?instance=instance-1", &bindings)).To(Equal(http.StatusOK))
+			Expect(bindings).To(HaveLen(2))
+			Expect(bindings[0].ContainerDir).To(Equal("/data"))
+			Expect(bindings[1].Parameters).To(HaveKeyWithValue("password", "*REDACTED*"))
+		})
+
+		It("lists orphaned bindings", func() {
+			var bindings []AdminBinding
+			Expect(request(http.MethodGet, "/bindings?orphaned=true", &bindings)).To(Equal(http.StatusOK))
+			Expect(bindings).To(HaveLen(1))
+			Expect(bindings[0].ID).To(Equal("binding-3"))
+			Expect(bindings[0].Orphaned).To(BeTrue())
+		})
+
+		It("lists bindings with legacy volume IDs", func() {
+			var bindings []AdminBinding
+			Expect(request(http.MethodGet, "/bindings?legacy_volume_id=true", &bindings)).To(Equal(http.StatusOK))
+			Expect(bindings).To(HaveLen(2))
+			Expect(bindings[0].ID).To(Equal("binding-2"))
+			Expect(bindings[1].ID).To(Equal("binding-3"))
+			Expect(bindings[0].LegacyVolumeID).To(BeTrue())
+		})
+
+		It("shows and deletes a binding", func() {
+			var binding AdminBinding
+			Expect(request(http.MethodGet, "/bindings/binding-3", &binding)).To(Equal(http.StatusOK))
+			Expect(binding.AppGUID).To(Equal("app-3"))
+
+			Expect(request(http.MethodDelete, "/bindings/binding-3", nil)).To(Equal(http.StatusNoContent))
+			Expect(request(http.MethodGet, "/bindings/binding-3", nil)).To(Equal(http.StatusNotFound))
+			Expect(credhub.has("/smbbroker/index/binding-3")).To(BeFalse())
+		})
+
+		It("re-runs option validation", func() {
+			var validation AdminValidation
+			Expect(request(http.MethodPost, "/bindings/binding-1/validate", &validation)).To(Equal(http.StatusOK))
+			Expect(validation.Valid).To(BeTrue())
+
+			Expect(request(http.MethodPost, "/bindings/binding-3/validate", &validation)).To(Equal(http.StatusOK))
+			Expect(validation.Problems).To(Equal([]string{"binding does not belong to an existing service instance"}))
+		})
+	})
+
+	It("reports a disabled health monitor", func() {
+		Expect(request(http.MethodGet, "/health", nil)).To(Equal(http.StatusNotFound))
+	})
+
+	It("tells loopback addresses from the others", func() {
+		Expect(IsLoopbackAddress("127.0.0.1:8998")).To(BeTrue())
+		Expect(IsLoopbackAddress("[::1]:8998")).To(BeTrue())
+		Expect(IsLoopbackAddress("localhost:8998")).To(BeTrue())
+
+		Expect(IsLoopbackAddress(":8998")).To(BeFalse())
+		Expect(IsLoopbackAddress("0.0.0.0:8998")).To(BeFalse())
+		Expect(IsLoopbackAddress("10.0.0.5:8998")).To(BeFalse())
+		Expect(IsLoopbackAddress("localhost")).To(BeFalse())
+	})
+})
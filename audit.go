@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// originatingIdentityKey is the context key brokerapi stores the
+// X-Broker-API-Originating-Identity header under.
+const originatingIdentityKey = "originatingIdentity"
+
+// auditGenesisHash is the previous hash of the first record of a log.
+var auditGenesisHash = strings.Repeat("0", sha256.Size*2)
+
+// auditHashField is how the hash of a record is appended to its JSON.
+const auditHashField = `,"hash":"`
+
+// AuditRecord is one line of the audit log.
+type AuditRecord struct {
+	Sequence   uint64                 `json:"seq"`
+	Time       time.Time              `json:"time"`
+	Operation  string                 `json:"operation"`
+	Result     string                 `json:"result"`
+	Error      string                 `json:"error,omitempty"`
+	InstanceID string                 `json:"instance_id"`
+	BindingID  string                 `json:"binding_id,omitempty"`
+	ServiceID  string                 `json:"service_id,omitempty"`
+	PlanID     string                 `json:"plan_id,omitempty"`
+	OrgGUID    string                 `json:"organization_guid,omitempty"`
+	SpaceGUID  string                 `json:"space_guid,omitempty"`
+	AppGUID    string                 `json:"app_guid,omitempty"`
+	Share      string                 `json:"share,omitempty"`
+	Platform   string                 `json:"platform,omitempty"`
+	User       string                 `json:"user_id,omitempty"`
+	TraceID    string                 `json:"trace_id,omitempty"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	PrevHash   string                 `json:"prev_hash"`
+	Hash       string                 `json:"-"`
+}
+
+// Identity is the user on whose behalf an operation ran.
+type Identity struct {
+	Platform string
+	User     string
+}
+
+type identityKey struct{}
+
+// ContextWithIdentity returns a copy of ctx that attributes the operations
+// run with it to identity instead of the originating identity header.
+func ContextWithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity set with ContextWithIdentity or
+// decoded from the originating identity header, which has the form
+// "<platform> <base64 encoded JSON>". The user is the user_id of that JSON.
+func IdentityFromContext(ctx context.Context) Identity {
+	if identity, ok := ctx.Value(identityKey{}).(Identity); ok {
+		return identity
+	}
+
+	header, _ := ctx.Value(originatingIdentityKey).(string)
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	identity := Identity{Platform: parts[0]}
+	if len(parts) < 2 {
+		return identity
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return identity
+	}
+	var value struct {
+		UserID string `json:"user_id"`
+	}
+	if err := json.Unmarshal(decoded, &value); err == nil {
+		identity.User = value.UserID
+	}
+	return identity
+}
+
+// AuditLog appends a record for every mutating operation to a JSON lines
+// file. Every record holds the hash of the previous one and its own hash,
+// an HMAC-SHA256 keyed with a secret that is kept apart from the file,
+// covers its content and that previous hash. Without the key, editing,
+// inserting, reordering or removing records, or writing a new chain in
+// place of the file, breaks the chain. Removing records from the end or the
+// whole file does not; the broker therefore also logs the sequence number
+// and hash of every record, which the last record of the file can be
+// compared with. Only one process may write to a log.
+type AuditLog struct {
+	logger lager.Logger
+	key    []byte
+
+	mutex    sync.Mutex
+	file     *os.File
+	sequence uint64
+	lastHash string
+}
+
+// OpenAuditLog opens the log at path for appending, creating it if needed,
+// and continues the chain of the records already in it with key.
+func OpenAuditLog(logger lager.Logger, path, key string) (*AuditLog, error) {
+	if len(key) < MinKeyLength {
+		return nil, fmt.Errorf("audit log key must be at least %d bytes long", MinKeyLength)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &AuditLog{logger: logger.Session("audit-log"), key: []byte(key), file: file, lastHash: auditGenesisHash}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		record, _, err := parseAuditLine(scanner.Bytes())
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("cannot continue audit log %q: %s", path, err.Error())
+		}
+		a.sequence, a.lastHash = record.Sequence, record.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Record appends record with the result of the operation and the identity
+// found in ctx. Failures to write are logged and do not fail the operation.
+func (a *AuditLog) Record(ctx context.Context, record AuditRecord, opErr error) {
+	if a == nil {
+		return
+	}
+
+	identity := IdentityFromContext(ctx)
+	record.Platform, record.User = identity.Platform, identity.User
+	if span := SpanFromContext(ctx); span != nil {
+		record.TraceID = span.TraceID.String()
+	}
+	record.Result = "success"
+	if opErr != nil {
+		record.Result, record.Error = "failure", opErr.Error()
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	record.Sequence = a.sequence + 1
+	record.Time = time.Now().UTC()
+	record.PrevHash = a.lastHash
+	line, hash, err := encodeAuditRecord(a.key, record)
+	if err == nil {
+		_, err = a.file.Write(line)
+	}
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		a.logger.Error("failed-to-write-audit-record", err, lager.Data{"operation": record.Operation, "instanceID": record.InstanceID, "bindingID": record.BindingID})
+		return
+	}
+	a.sequence, a.lastHash = record.Sequence, hash
+	a.logger.Info("recorded", lager.Data{"seq": record.Sequence, "hash": hash})
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.file.Close()
+}
+
+// VerifyAuditLog checks the hash chain of the log read from r with the key
+// it was written with and returns the number of records in it. The error
+// names the first line that does not belong to the chain.
+func VerifyAuditLog(r io.Reader, key string) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	count, lineNumber := 0, 0
+	previous := AuditRecord{Hash: auditGenesisHash}
+	for scanner.Scan() {
+		lineNumber++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		record, body, err := parseAuditLine(scanner.Bytes())
+		if err != nil {
+			return count, fmt.Errorf("line %d: %s", lineNumber, err.Error())
+		}
+		if !hmac.Equal([]byte(record.Hash), []byte(auditHash([]byte(key), body))) {
+			return count, fmt.Errorf("line %d: hash does not match the record", lineNumber)
+		}
+		if record.PrevHash != previous.Hash {
+			return count, fmt.Errorf("line %d: previous hash does not match the hash of the record before", lineNumber)
+		}
+		if record.Sequence != previous.Sequence+1 {
+			return count, fmt.Errorf("line %d: sequence %d follows sequence %d", lineNumber, record.Sequence, previous.Sequence)
+		}
+		previous = record
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// encodeAuditRecord returns the line for record and its hash. The hash is
+// taken over the JSON of the record without the hash, which is then added
+// as the last field.
+func encodeAuditRecord(key []byte, record AuditRecord) ([]byte, string, error) {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return nil, "", err
+	}
+	hash := auditHash(key, body)
+
+	line := make([]byte, 0, len(body)+len(auditHashField)+len(hash)+3)
+	line = append(line, body[:len(body)-1]...)
+	line = append(line, auditHashField...)
+	line = append(line, hash...)
+	line = append(line, "\"}\n"...)
+	return line, hash, nil
+}
+
+// parseAuditLine decodes a line of the log and returns the record and the
+// JSON its hash was taken over.
+func parseAuditLine(line []byte) (AuditRecord, []byte, error) {
+	line = bytes.TrimSpace(line)
+	i := bytes.LastIndex(line, []byte(auditHashField))
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return AuditRecord{}, nil, fmt.Errorf("record has no hash")
+	}
+
+	body := append(append([]byte{}, line[:i]...), '}')
+	var record AuditRecord
+	if err := json.Unmarshal(body, &record); err != nil {
+		return AuditRecord{}, nil, err
+	}
+	record.Hash = string(line[i+len(auditHashField) : len(line)-2])
+	return record, body, nil
+}
+
+func auditHash(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditParameters returns the parameters of a request with the secret
+// options masked.
+func auditParameters(raw json.RawMessage) map[string]interface{} {
+	parameters, err := decodeParameters(raw)
+	if err != nil || len(parameters) == 0 {
+		return nil
+	}
+	return maskSecrets(parameters)
+}
@@ -0,0 +1,302 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/existingvolumebroker"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	vmo "code.cloudfoundry.org/volume-mount-options"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/pivotal-cf/brokerapi/domain"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const auditLogKey = "0123456789abcdef0123456789abcdef"
+
+var _ = Describe("AuditLog", func() {
+	var (
+		dir    string
+		path   string
+		logger lager.Logger
+		logs   *gbytes.Buffer
+		audit  *AuditLog
+		broker *Broker
+		ctx    context.Context
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "audit")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "audit.log")
+
+		logger = lager.NewLogger("audit")
+		logs = gbytes.NewBuffer()
+		logger.RegisterSink(lager.NewWriterSink(logs, lager.INFO))
+		audit, err = OpenAuditLog(logger, path, auditLogKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		store := NewIndexedStore(logger, newFakeCredhub(), "smbbroker")
+		services, err := NewServicesFromConfig("./default_services.json")
+		Expect(err).NotTo(HaveOccurred())
+		mask, err := vmo.NewMountOptsMask([]string{"source", "mount", "ro", "username", "password", "domain", "version"},
+			map[string]interface{}{}, map[string]string{"readonly": "ro", "share": "source"}, []string{}, []string{"source"})
+		Expect(err).NotTo(HaveOccurred())
+
+		delegate := existingvolumebroker.New(existingvolumebroker.BrokerTypeSMB, logger, services, &osshim.OsShim{}, clock.NewClock(), store, mask)
+		broker = NewBroker(logger, delegate, store)
+		broker.Audit = audit
+
+		identity := base64.StdEncoding.EncodeToString([]byte(`{"user_id":"user-guid"}`))
+		ctx = context.WithValue(context.Background(), "originatingIdentity", "cloudfoundry "+identity)
+	})
+
+	AfterEach(func() {
+		Expect(audit.Close()).To(Succeed())
+		os.RemoveAll(dir)
+	})
+
+	records := func() []map[string]interface{} {
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		var result []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+			var record map[string]interface{}
+			Expect(json.Unmarshal([]byte(line), &record)).To(Succeed())
+			result = append(result, record)
+		}
+		return result
+	}
+
+	verify := func() (int, error) {
+		file, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+		return VerifyAuditLog(file, auditLogKey)
+	}
+
+	provision := func(params string) error {
+		_, err := broker.Provision(ctx, "instance-id", domain.ProvisionDetails{
+			ServiceID:        "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+			PlanID:           "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+			OrganizationGUID: "org-guid",
+			SpaceGUID:        "space-guid",
+			RawParameters:    json.RawMessage(params),
+		}, false)
+		return err
+	}
+
+	lifecycle := func() {
+		Expect(provision(`{"share": "//server/share", "username": "alice", "password": "secret"}`)).To(Succeed())
+		_, err := broker.Bind(ctx, "instance-id", "binding-id", domain.BindDetails{
+			ServiceID: "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+			PlanID:    "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+			AppGUID:   "app-guid",
+		}, false)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = broker.Unbind(ctx, "instance-id", "binding-id", domain.UnbindDetails{}, false)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = broker.Deprovision(ctx, "instance-id", domain.DeprovisionDetails{}, false)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("records every mutating operation with the originating user", func() {
+		lifecycle()
+
+		logged := records()
+		Expect(logged).To(HaveLen(4))
+		for i, operation := range []string{"provision", "bind", "unbind", "deprovision"} {
+			Expect(logged[i]).To(HaveKeyWithValue("operation", operation))
+			Expect(logged[i]).To(HaveKeyWithValue("seq", BeNumerically("==", i+1)))
+			Expect(logged[i]).To(HaveKeyWithValue("result", "success"))
+			Expect(logged[i]).To(HaveKeyWithValue("instance_id", "instance-id"))
+			Expect(logged[i]).To(HaveKeyWithValue("organization_guid", "org-guid"))
+			Expect(logged[i]).To(HaveKeyWithValue("space_guid", "space-guid"))
+			Expect(logged[i]).To(HaveKeyWithValue("share", "//server/share"))
+			Expect(logged[i]).To(HaveKeyWithValue("platform", "cloudfoundry"))
+			Expect(logged[i]).To(HaveKeyWithValue("user_id", "user-guid"))
+		}
+		Expect(logged[1]).To(HaveKeyWithValue("binding_id", "binding-id"))
+		Expect(logged[1]).To(HaveKeyWithValue("app_guid", "app-guid"))
+		Expect(logged[2]).To(HaveKeyWithValue("app_guid", "app-guid"))
+	})
+
+	It("masks secrets in the parameters", func() {
+		Expect(provision(`{"share": "//server/share", "username": "alice", "password": "secret"}`)).To(Succeed())
+
+		parameters := records()[0]["parameters"]
+		Expect(parameters).To(HaveKeyWithValue("username", "alice"))
+		Expect(parameters).To(HaveKeyWithValue("password", "*REDACTED*"))
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).NotTo(ContainSubstring("secret"))
+	})
+
+	It("records the canonical share", func() {
+		Expect(provision(`{"share": "\\\\server\\share"}`)).To(Succeed())
+
+		Expect(records()[0]).To(HaveKeyWithValue("share", "//server/share"))
+	})
+
+	It("records failed operations", func() {
+		Expect(provision(`{"share": "//server/"}`)).NotTo(Succeed())
+
+		record := records()[0]
+		Expect(record).To(HaveKeyWithValue("result", "failure"))
+		Expect(record).To(HaveKeyWithValue("error", ContainSubstring("missing share name")))
+	})
+
+	It("prefers an identity set on the context", func() {
+		ctx = ContextWithIdentity(ctx, Identity{Platform: "admin-api", User: "operator"})
+		Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+
+		Expect(records()[0]).To(HaveKeyWithValue("platform", "admin-api"))
+		Expect(records()[0]).To(HaveKeyWithValue("user_id", "operator"))
+	})
+
+	It("writes a chain that verifies", func() {
+		lifecycle()
+
+		count, err := verify()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(4))
+	})
+
+	It("continues the chain when the log is reopened", func() {
+		Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+		Expect(audit.Close()).To(Succeed())
+
+		var err error
+		audit, err = OpenAuditLog(logger, path, auditLogKey)
+		Expect(err).NotTo(HaveOccurred())
+		broker.Audit = audit
+		_, err = broker.Deprovision(ctx, "instance-id", domain.DeprovisionDetails{}, false)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(records()[1]).To(HaveKeyWithValue("seq", BeNumerically("==", 2)))
+		count, err := verify()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(2))
+	})
+
+	It("detects edited records", func() {
+		lifecycle()
+
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		edited := strings.Replace(string(contents), `"app_guid":"app-guid"`, `"app_guid":"other-app"`, 1)
+		Expect(ioutil.WriteFile(path, []byte(edited), 0600)).To(Succeed())
+
+		count, err := verify()
+		Expect(err).To(MatchError("line 2: hash does not match the record"))
+		Expect(count).To(Equal(1))
+	})
+
+	It("detects deleted records", func() {
+		lifecycle()
+
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		lines := strings.SplitAfter(string(contents), "\n")
+		Expect(ioutil.WriteFile(path, []byte(lines[0]+lines[2]+lines[3]), 0600)).To(Succeed())
+
+		_, err = verify()
+		Expect(err).To(MatchError("line 2: previous hash does not match the hash of the record before"))
+	})
+
+	It("detects a chain written without the key", func() {
+		lifecycle()
+		Expect(audit.Close()).To(Succeed())
+		Expect(os.Remove(path)).To(Succeed())
+
+		var err error
+		audit, err = OpenAuditLog(logger, path, "fedcba9876543210fedcba9876543210")
+		Expect(err).NotTo(HaveOccurred())
+		broker.Audit = audit
+		Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+
+		count, err := verify()
+		Expect(err).To(MatchError("line 1: hash does not match the record"))
+		Expect(count).To(Equal(0))
+	})
+
+	It("logs the sequence number and hash of every record", func() {
+		Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+
+		hash := records()[0]["hash"].(string)
+		Expect(logs).To(gbytes.Say(`"message":"audit.audit-log.recorded".*"hash":"` + hash + `","seq":1`))
+	})
+
+	It("rejects short keys", func() {
+		_, err := OpenAuditLog(logger, filepath.Join(dir, "other.log"), "secret")
+		Expect(err).To(MatchError("audit log key must be at least 32 bytes long"))
+	})
+
+	It("refuses to continue a log it cannot read", func() {
+		Expect(ioutil.WriteFile(path, []byte("not a record\n"), 0600)).To(Succeed())
+
+		_, err := OpenAuditLog(logger, path, auditLogKey)
+		Expect(err).To(MatchError(ContainSubstring("record has no hash")))
+	})
+
+	Describe("AuditCommand", func() {
+		BeforeEach(func() {
+			Expect(os.Setenv("AUDIT_LOG_KEY", auditLogKey)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.Unsetenv("AUDIT_LOG_KEY")).To(Succeed())
+			Expect(flag.CommandLine.Set("auditLog", "")).To(Succeed())
+		})
+
+		It("verifies the log", func() {
+			lifecycle()
+
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			Expect(AuditCommand([]string{"verify", "-auditLog", path}, stdout, stderr)).To(Equal(0))
+			Expect(stdout.String()).To(Equal("audit log is intact: 4 records\n"))
+		})
+
+		It("fails for a broken log", func() {
+			lifecycle()
+			contents, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			lines := strings.SplitAfter(string(contents), "\n")
+			Expect(ioutil.WriteFile(path, []byte(lines[0]+lines[1]+lines[3]), 0600)).To(Succeed())
+
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			Expect(AuditCommand([]string{"verify", "-auditLog", path}, stdout, stderr)).To(Equal(1))
+			Expect(stdout.String()).To(Equal("audit log is broken after 2 valid records: line 3: previous hash does not match the hash of the record before\n"))
+		})
+
+		It("requires the log", func() {
+			Expect(flag.CommandLine.Set("auditLog", "")).To(Succeed())
+
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			Expect(AuditCommand([]string{"verify"}, stdout, stderr)).To(Equal(2))
+			Expect(stderr.String()).To(ContainSubstring("auditLog parameter must be provided"))
+		})
+
+		It("requires the key", func() {
+			Expect(os.Unsetenv("AUDIT_LOG_KEY")).To(Succeed())
+
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			Expect(AuditCommand([]string{"verify", "-auditLog", path}, stdout, stderr)).To(Equal(2))
+			Expect(stderr.String()).To(ContainSubstring("AUDIT_LOG_KEY must be set"))
+		})
+	})
+})
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pivotal-cf/brokerapi/middlewares"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	notAuthorized = "Not Authorized"
+	bearerPrefix  = "Bearer "
+)
+
+// BrokerCredential is a username and bcrypt password hash the broker API
+// accepts. Principal names the credential in logs and metrics and defaults
+// to the username, so that two passwords of the same user can be told apart
+// while rotating.
+type BrokerCredential struct {
+	Principal    string `json:"principal"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+}
+
+type credentialsConfig struct {
+	Credentials []BrokerCredential `json:"credentials"`
+}
+
+// Authenticator checks the basic auth credentials of broker API requests
+// against the USERNAME and PASSWORD of the environment and the entries of a
+// credentials file, which is read again when it changes. When Tokens is set,
+// UAA bearer tokens are accepted as well. Every request is logged with the
+// principal it authenticated as.
+type Authenticator struct {
+	Tokens *TokenVerifier
+
+	logger   lager.Logger
+	username string
+	password string
+	path     string
+
+	mutex       sync.RWMutex
+	credentials []BrokerCredential
+	verified    map[[sha256.Size]byte]string
+	requests    map[string]uint64
+}
+
+func NewAuthenticator(logger lager.Logger, username, password string) *Authenticator {
+	return &Authenticator{
+		logger:   logger.Session("auth"),
+		username: username,
+		password: password,
+		verified: map[[sha256.Size]byte]string{},
+		requests: map[string]uint64{},
+	}
+}
+
+// NewAuthenticatorFromFile also accepts the credentials listed in the file
+// at path.
+func NewAuthenticatorFromFile(logger lager.Logger, path, username, password string) (*Authenticator, error) {
+	a := NewAuthenticator(logger, username, password)
+	a.path = path
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// LoadBrokerCredentials reads and validates a credentials file.
+func LoadBrokerCredentials(path string) ([]BrokerCredential, error) {
+	/* #nosec */
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config credentialsConfig
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return nil, err
+	}
+
+	principals := map[string]bool{}
+	for i := range config.Credentials {
+		credential := &config.Credentials[i]
+		if credential.Username == "" {
+			return nil, fmt.Errorf("credential %d has no username", i)
+		}
+		if credential.Principal == "" {
+			credential.Principal = credential.Username
+		}
+		if principals[credential.Principal] {
+			return nil, fmt.Errorf("principal %q is used by more than one credential", credential.Principal)
+		}
+		principals[credential.Principal] = true
+
+		if _, err := bcrypt.Cost([]byte(credential.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("credential %q: password_hash is not a bcrypt hash: %s", credential.Principal, err.Error())
+		}
+	}
+	return config.Credentials, nil
+}
+
+// Reload reads the credentials file again. The previous credentials stay in
+// use when that fails.
+func (a *Authenticator) Reload() error {
+	credentials, err := LoadBrokerCredentials(a.path)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.credentials = credentials
+	a.verified = map[[sha256.Size]byte]string{}
+	return nil
+}
+
+// Watch reloads the credentials file whenever it changes, until stop is
+// closed.
+func (a *Authenticator) Watch(logger lager.Logger, stop <-chan struct{}) error {
+	logger = logger.Session("credentials-file")
+	return WatchFile(logger, a.path, stop, func() {
+		if err := a.Reload(); err != nil {
+			logger.Error("reload-failed", err)
+			return
+		}
+		logger.Info("reloaded", lager.Data{"principals": a.Principals()})
+	})
+}
+
+// Principals lists the principals of the credentials file.
+func (a *Authenticator) Principals() []string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	principals := []string{}
+	for _, credential := range a.credentials {
+		principals = append(principals, credential.Principal)
+	}
+	return principals
+}
+
+// Authenticate returns the principal that username and password match.
+// Successful bcrypt comparisons are remembered until the next reload, so
+// that only the first request of a client pays for them.
+func (a *Authenticator) Authenticate(username, password string) (string, bool) {
+	if a.username != "" || a.password != "" {
+		u, p := sha256.Sum256([]byte(username)), sha256.Sum256([]byte(password))
+		wantU, wantP := sha256.Sum256([]byte(a.username)), sha256.Sum256([]byte(a.password))
+		if subtle.ConstantTimeCompare(u[:], wantU[:])&subtle.ConstantTimeCompare(p[:], wantP[:]) == 1 {
+			return a.username, true
+		}
+	}
+
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	a.mutex.RLock()
+	principal, ok := a.verified[key]
+	credentials := a.credentials
+	a.mutex.RUnlock()
+	if ok {
+		return principal, true
+	}
+
+	for _, credential := range credentials {
+		if credential.Username != username {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(credential.PasswordHash), []byte(password)) == nil {
+			a.mutex.Lock()
+			a.verified[key] = credential.Principal
+			a.mutex.Unlock()
+			return credential.Principal, true
+		}
+	}
+	return "", false
+}
+
+// Wrap rejects requests without accepted credentials like brokerapi's basic
+// auth does.
+func (a *Authenticator) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, principal, err := a.authenticateRequest(r)
+		if err != nil {
+			a.logger.Info("not-authorized", lager.Data{"auth-method": method, "reason": err.Error(), "path": r.URL.Path})
+			http.Error(w, notAuthorized, http.StatusUnauthorized)
+			return
+		}
+
+		a.mutex.Lock()
+		a.requests[principal]++
+		a.mutex.Unlock()
+
+		correlationID, _ := r.Context().Value(middlewares.CorrelationIDKey).(string)
+		a.logger.Info("authenticated", lager.Data{"principal": principal, "auth-method": method, "path": r.URL.Path, "correlation-id": correlationID})
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// authenticateRequest returns the auth method of r and the principal it
+// authenticated as.
+func (a *Authenticator) authenticateRequest(r *http.Request) (string, string, error) {
+	header := r.Header.Get("Authorization")
+	if a.Tokens != nil && len(header) > len(bearerPrefix) && strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		claims, err := a.Tokens.Verify(strings.TrimSpace(header[len(bearerPrefix):]))
+		if err != nil {
+			return "bearer", "", err
+		}
+		return "bearer", claims.Principal(), nil
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return "none", "", fmt.Errorf("no credentials")
+	}
+	principal, ok := a.Authenticate(username, password)
+	if !ok {
+		return "basic", "", fmt.Errorf("credentials of %q are not accepted", username)
+	}
+	return "basic", principal, nil
+}
+
+// countedPrincipals returns the principals requests authenticated as, in order.
+func (a *Authenticator) countedPrincipals() []string {
+	principals := make([]string, 0, len(a.requests))
+	for principal := range a.requests {
+		principals = append(principals, principal)
+	}
+	sort.Strings(principals)
+	return principals
+}
+
+func (a *Authenticator) WriteMetrics(out io.Writer) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	fmt.Fprintln(out, "# HELP smbbroker_authenticated_requests_total Broker API requests by the principal they authenticated as.")
+	fmt.Fprintln(out, "# TYPE smbbroker_authenticated_requests_total counter")
+	for _, principal := range a.countedPrincipals() {
+		fmt.Fprintf(out, "smbbroker_authenticated_requests_total{principal=%s} %d\n", labelValue(principal), a.requests[principal])
+	}
+}
+
+// NewBrokerHandler serves the OSBAPI routes of broker like brokerapi.New,
+// but authenticates requests with authenticator.
+func NewBrokerHandler(broker domain.ServiceBroker, logger lager.Logger, authenticator *Authenticator) http.Handler {
+	router := mux.NewRouter()
+	brokerapi.AttachRoutes(router, broker, logger)
+
+	apiVersionMiddleware := middlewares.APIVersionMiddleware{LoggerFactory: logger}
+
+	router.Use(middlewares.AddCorrelationIDToContext)
+	router.Use(authenticator.Wrap)
+	router.Use(middlewares.AddOriginatingIdentityToContext)
+	router.Use(apiVersionMiddleware.ValidateAPIVersionHdr)
+	router.Use(middlewares.AddInfoLocationToContext)
+
+	return router
+}
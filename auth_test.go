@@ -0,0 +1,215 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/existingvolumebroker"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	vmo "code.cloudfoundry.org/volume-mount-options"
+	"github.com/onsi/gomega/gbytes"
+	"golang.org/x/crypto/bcrypt"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Authenticator", func() {
+	var (
+		dir    string
+		path   string
+		logger lager.Logger
+		logs   *gbytes.Buffer
+	)
+
+	hash := func(password string) string {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		Expect(err).NotTo(HaveOccurred())
+		return string(h)
+	}
+
+	writeCredentials := func(entries ...string) {
+		contents := `{"credentials": [` + strings.Join(entries, ",") + `]}`
+		Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "auth")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "credentials.json")
+
+		logger = lager.NewLogger("auth")
+		logs = gbytes.NewBuffer()
+		logger.RegisterSink(lager.NewWriterSink(logs, lager.INFO))
+
+		writeCredentials(
+			`{"principal": "cc-2020", "username": "cc", "password_hash": "`+hash("old-password")+`"}`,
+			`{"principal": "cc-2021", "username": "cc", "password_hash": "`+hash("new-password")+`"}`,
+			`{"username": "operator", "password_hash": "`+hash("operator-password")+`"}`,
+		)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("accepts the environment credentials", func() {
+		authenticator := NewAuthenticator(logger, "admin", "secret")
+
+		principal, ok := authenticator.Authenticate("admin", "secret")
+		Expect(ok).To(BeTrue())
+		Expect(principal).To(Equal("admin"))
+
+		_, ok = authenticator.Authenticate("admin", "wrong")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("accepts every credential of the file", func() {
+		authenticator, err := NewAuthenticatorFromFile(logger, path, "admin", "secret")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(authenticator.Principals()).To(Equal([]string{"cc-2020", "cc-2021", "operator"}))
+
+		for _, c := range [][3]string{
+			{"cc", "old-password", "cc-2020"},
+			{"cc", "new-password", "cc-2021"},
+			{"operator", "operator-password", "operator"},
+			{"admin", "secret", "admin"},
+		} {
+			principal, ok := authenticator.Authenticate(c[0], c[1])
+			Expect(ok).To(BeTrue(), c[2])
+			Expect(principal).To(Equal(c[2]))
+
+			principal, ok = authenticator.Authenticate(c[0], c[1])
+			Expect(ok).To(BeTrue(), c[2])
+			Expect(principal).To(Equal(c[2]))
+		}
+
+		_, ok := authenticator.Authenticate("cc", "operator-password")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("picks up removed credentials when the file changes", func() {
+		authenticator, err := NewAuthenticatorFromFile(logger, path, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		stop := make(chan struct{})
+		defer close(stop)
+		Expect(authenticator.Watch(logger, stop)).To(Succeed())
+
+		_, ok := authenticator.Authenticate("cc", "old-password")
+		Expect(ok).To(BeTrue())
+
+		writeCredentials(`{"principal": "cc-2021", "username": "cc", "password_hash": "` + hash("new-password") + `"}`)
+
+		Eventually(func() bool {
+			_, ok := authenticator.Authenticate("cc", "old-password")
+			return ok
+		}).Should(BeFalse())
+		_, ok = authenticator.Authenticate("cc", "new-password")
+		Expect(ok).To(BeTrue())
+	})
+
+	It("keeps the credentials when the file becomes invalid", func() {
+		authenticator, err := NewAuthenticatorFromFile(logger, path, "", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		writeCredentials(`{"username": "cc", "password_hash": "plain"}`)
+		Expect(authenticator.Reload()).To(MatchError(ContainSubstring(`credential "cc": password_hash is not a bcrypt hash`)))
+
+		_, ok := authenticator.Authenticate("cc", "new-password")
+		Expect(ok).To(BeTrue())
+	})
+
+	It("rejects invalid files", func() {
+		writeCredentials(`{"password_hash": "` + hash("x") + `"}`)
+		_, err := LoadBrokerCredentials(path)
+		Expect(err).To(MatchError("credential 0 has no username"))
+
+		writeCredentials(`{"username": "cc", "password_hash": "`+hash("x")+`"}`, `{"username": "cc", "password_hash": "`+hash("y")+`"}`)
+		_, err = LoadBrokerCredentials(path)
+		Expect(err).To(MatchError(`principal "cc" is used by more than one credential`))
+	})
+
+	Describe("the broker handler", func() {
+		var handler http.Handler
+		var authenticator *Authenticator
+
+		BeforeEach(func() {
+			var err error
+			authenticator, err = NewAuthenticatorFromFile(logger, path, "", "")
+			Expect(err).NotTo(HaveOccurred())
+
+			store := NewIndexedStore(logger, newFakeCredhub(), "smbbroker")
+			services, err := NewServicesFromConfig("./default_services.json")
+			Expect(err).NotTo(HaveOccurred())
+			mask, err := vmo.NewMountOptsMask([]string{"source"}, map[string]interface{}{}, map[string]string{}, []string{}, []string{"source"})
+			Expect(err).NotTo(HaveOccurred())
+			delegate := existingvolumebroker.New(existingvolumebroker.BrokerTypeSMB, logger, services, &osshim.OsShim{}, clock.NewClock(), store, mask)
+
+			handler = NewBrokerHandler(NewBroker(logger, delegate, store), logger, authenticator)
+		})
+
+		catalog := func(username, password string) int {
+			request := httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+			request.Header.Set("X-Broker-API-Version", "2.14")
+			request.SetBasicAuth(username, password)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			return recorder.Code
+		}
+
+		It("logs the principal of every request", func() {
+			Expect(catalog("cc", "new-password")).To(Equal(http.StatusOK))
+			Expect(logs).To(gbytes.Say(`"message":"auth.auth.authenticated".*"principal":"cc-2021"`))
+		})
+
+		It("rejects unknown credentials", func() {
+			Expect(catalog("cc", "wrong")).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("counts the requests of every principal", func() {
+			Expect(catalog("cc", "old-password")).To(Equal(http.StatusOK))
+			Expect(catalog("cc", "new-password")).To(Equal(http.StatusOK))
+			Expect(catalog("cc", "new-password")).To(Equal(http.StatusOK))
+
+			output := &bytes.Buffer{}
+			authenticator.WriteMetrics(output)
+			Expect(output.String()).To(ContainSubstring(`smbbroker_authenticated_requests_total{principal="cc-2020"} 1`))
+			Expect(output.String()).To(ContainSubstring(`smbbroker_authenticated_requests_total{principal="cc-2021"} 2`))
+		})
+
+		It("escapes the principals like the other metric labels", func() {
+			writeCredentials(`{"principal": "ops\t\"east\"", "username": "ops", "password_hash": "` + hash("ops-password") + `"}`)
+			Expect(authenticator.Reload()).To(Succeed())
+			Expect(catalog("ops", "ops-password")).To(Equal(http.StatusOK))
+
+			output := &bytes.Buffer{}
+			authenticator.WriteMetrics(output)
+			Expect(output.String()).To(ContainSubstring("smbbroker_authenticated_requests_total{principal=\"ops\t\\\"east\\\"\"} 1"))
+		})
+	})
+
+	Describe("CredentialsCommand", func() {
+		It("prints the bcrypt hash of the password on stdin", func() {
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			Expect(CredentialsCommand([]string{"hash", "-cost", "4"}, strings.NewReader("new-password\n"), stdout, stderr)).To(Equal(0))
+
+			hashed := strings.TrimSpace(stdout.String())
+			Expect(bcrypt.CompareHashAndPassword([]byte(hashed), []byte("new-password"))).To(Succeed())
+		})
+
+		It("requires a password", func() {
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			Expect(CredentialsCommand([]string{"hash"}, strings.NewReader(""), stdout, stderr)).To(Equal(1))
+			Expect(stderr.String()).To(Equal("ERROR: no password on stdin\n"))
+		})
+	})
+})
@@ -0,0 +1,748 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/existingvolumebroker"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"code.cloudfoundry.org/smbbroker/smbclient"
+	vmo "code.cloudfoundry.org/volume-mount-options"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+// Broker wraps the existing volume broker and applies smbbroker specific
+// checks before handing requests over to it.
+type Broker struct {
+	delegate      domain.ServiceBroker
+	delegates     map[string]domain.ServiceBroker
+	delegateMutex sync.RWMutex
+	logger        lager.Logger
+	store         *IndexedStore
+	mutex         sync.Mutex
+
+	ServerPolicy *ServerPolicy
+	Quotas       *Quotas
+	MountPolicy  *MountPolicy
+	ShareProbe   *ShareProbe
+	Negotiator   *VersionNegotiator
+	Credentials  *CredentialCheck
+
+	ForbiddenMountPaths []string
+
+	// Flavor parses the shares of new instances; SMB shares when nil.
+	Flavor *Flavor
+
+	// Catalog and NewDelegate give the services of the catalog their own
+	// volume settings; without them every instance and binding uses the
+	// delegate's. LoadDelegates builds the volume brokers of the catalog.
+	Catalog     Services
+	NewDelegate func(mask vmo.MountOptsMask) domain.ServiceBroker
+
+	// VolumeIDs derives the volume IDs of new bindings; the volume broker's
+	// legacy IDs are kept when nil.
+	VolumeIDs *VolumeIDs
+
+	// Tracer records the store calls of requests; Scope hands the context
+	// of the request being served to the volume brokers, which have to be
+	// created with its logger and a store wrapped by Tracer.Store.
+	Tracer *Tracer
+	Scope  *Scope
+
+	Metrics  *Metrics
+	Audit    *AuditLog
+	Webhooks *Webhooks
+}
+
+func NewBroker(logger lager.Logger, delegate domain.ServiceBroker, store *IndexedStore) *Broker {
+	return &Broker{
+		delegate: delegate,
+		logger:   logger,
+		store:    store,
+
+		ForbiddenMountPaths: DefaultForbiddenMountPaths,
+	}
+}
+
+// SetDelegate hands the requests that arrive from now on to delegate, e.g.
+// after the mount option mask changed. Requests that are already being
+// handled finish with the previous delegate.
+func (b *Broker) SetDelegate(delegate domain.ServiceBroker) {
+	b.delegateMutex.Lock()
+	defer b.delegateMutex.Unlock()
+	b.delegate = delegate
+}
+
+func (b *Broker) current() domain.ServiceBroker {
+	b.delegateMutex.RLock()
+	defer b.delegateMutex.RUnlock()
+	return b.delegate
+}
+
+// volumeSettings returns the volume settings of a plan of a service.
+func (b *Broker) volumeSettings(serviceID, planID string) VolumeSettings {
+	if b.Catalog == nil {
+		return VolumeSettings{}
+	}
+	return b.Catalog.VolumeSettings(serviceID, planID)
+}
+
+// LoadDelegates builds a volume broker for every distinct mount option mask
+// of the volume settings of the catalog, replacing those of the previous
+// catalog. It is called when the catalog is loaded and whenever it changes.
+func (b *Broker) LoadDelegates() error {
+	if b.Catalog == nil || b.NewDelegate == nil {
+		return nil
+	}
+
+	delegates := map[string]domain.ServiceBroker{}
+	add := func(settings VolumeSettings) error {
+		key := delegateKey(settings)
+		if key == "" || delegates[key] != nil {
+			return nil
+		}
+		mask, err := settings.Mask(b.Flavor)
+		if err != nil {
+			return err
+		}
+		delegates[key] = b.NewDelegate(mask)
+		return nil
+	}
+	for _, service := range b.Catalog.List() {
+		if err := add(b.Catalog.VolumeSettings(service.ID, "")); err != nil {
+			return err
+		}
+		for _, plan := range service.Plans {
+			if err := add(b.Catalog.VolumeSettings(service.ID, plan.ID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	b.delegateMutex.Lock()
+	defer b.delegateMutex.Unlock()
+	b.delegates = delegates
+	return nil
+}
+
+// delegateFor returns the volume broker of the mount option mask of
+// settings, or the current one if they do not have their own. A mask the
+// catalog gained after LoadDelegates last ran gets its volume broker here.
+func (b *Broker) delegateFor(settings VolumeSettings) (domain.ServiceBroker, error) {
+	key := delegateKey(settings)
+	if key == "" || b.NewDelegate == nil {
+		return b.current(), nil
+	}
+
+	b.delegateMutex.RLock()
+	delegate := b.delegates[key]
+	b.delegateMutex.RUnlock()
+	if delegate != nil {
+		return delegate, nil
+	}
+
+	mask, err := settings.Mask(b.Flavor)
+	if err != nil {
+		return nil, err
+	}
+
+	b.delegateMutex.Lock()
+	defer b.delegateMutex.Unlock()
+	if b.delegates == nil {
+		b.delegates = map[string]domain.ServiceBroker{}
+	}
+	if b.delegates[key] == nil {
+		b.delegates[key] = b.NewDelegate(mask)
+	}
+	return b.delegates[key], nil
+}
+
+// delegateKey identifies the mount option mask of settings, empty when they
+// do not have their own.
+func delegateKey(settings VolumeSettings) string {
+	return strings.Join(settings.AllowedOptions, ",")
+}
+
+func (b *Broker) Services(ctx context.Context) ([]domain.Service, error) {
+	b.lock(ctx)
+	defer b.unlock()
+	return b.current().Services(ctx)
+}
+
+func (b *Broker) Provision(ctx context.Context, instanceID string, details domain.ProvisionDetails, asyncAllowed bool) (domain.ProvisionedServiceSpec, error) {
+	spec, share, err := b.provision(ctx, instanceID, details, asyncAllowed)
+
+	record := AuditRecord{Operation: "provision", InstanceID: instanceID, ServiceID: details.ServiceID, PlanID: details.PlanID, OrgGUID: details.OrganizationGUID, SpaceGUID: details.SpaceGUID, Parameters: auditParameters(details.RawParameters)}
+	if share.Host != "" {
+		record.Share = share.Source()
+	} else if raw, ok := record.Parameters[existingvolumebroker.SHARE_KEY].(string); ok {
+		record.Share = raw
+	}
+	b.record(ctx, record, err)
+	return spec, err
+}
+
+// provision returns the share that was asked for along with the result, so
+// that the audit record and webhooks carry its canonical form. The share is
+// empty when it could not be parsed.
+func (b *Broker) provision(ctx context.Context, instanceID string, details domain.ProvisionDetails, asyncAllowed bool) (domain.ProvisionedServiceSpec, Share, error) {
+	logger := b.logger.Session("provision", traceData(ctx)).WithData(lager.Data{"instanceID": instanceID})
+
+	if len(details.RawParameters) == 0 {
+		return domain.ProvisionedServiceSpec{}, Share{}, apiresponses.ErrRawParamsInvalid
+	}
+
+	configuration, err := decodeParameters(details.RawParameters)
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, Share{}, apiresponses.ErrRawParamsInvalid
+	}
+
+	share, err := b.normalizeShareParameter(configuration)
+	if err != nil {
+		logger.Error("invalid-share", err)
+		return domain.ProvisionedServiceSpec{}, Share{}, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "invalid-share")
+	}
+
+	if err := b.ServerPolicy.Check(share.Host, details.OrganizationGUID, details.SpaceGUID); err != nil {
+		logger.Error("server-not-allowed", err)
+		return domain.ProvisionedServiceSpec{}, share, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "server-not-allowed")
+	}
+
+	if err := mountParameter(configuration, b.ForbiddenMountPaths); err != nil {
+		logger.Error("invalid-mount-path", err)
+		return domain.ProvisionedServiceSpec{}, share, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "invalid-mount-path")
+	}
+
+	request := MountPolicyRequest{OrgGUID: details.OrganizationGUID, SpaceGUID: details.SpaceGUID, PlanID: details.PlanID, ServiceID: details.ServiceID}
+	if err := b.MountPolicy.CheckForbidden(request, configuration); err != nil {
+		logger.Error("mount-policy-violation", err)
+		return domain.ProvisionedServiceSpec{}, share, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "mount-policy-violation")
+	}
+
+	if err := b.ShareProbe.Check(ctx, share.Host, details.PlanID); err != nil {
+		return domain.ProvisionedServiceSpec{}, share, shareCheckFailure(logger, err)
+	}
+
+	if err := b.Negotiator.Negotiate(ctx, share.Host, details.PlanID, configuration); err != nil {
+		return domain.ProvisionedServiceSpec{}, share, shareCheckFailure(logger, err)
+	}
+
+	if err := b.Credentials.Check(ctx, share, details.PlanID, configuration); err == smbclient.ErrSMB1 {
+		logger.Info("credentials-not-verified", lager.Data{"reason": err.Error()})
+	} else if err != nil {
+		return domain.ProvisionedServiceSpec{}, share, shareCheckFailure(logger, err)
+	}
+
+	b.lock(ctx)
+	defer b.unlock()
+
+	if b.Quotas != nil {
+		if err := b.Tracer.traceStore(ctx, "Refresh", b.store.Refresh); err != nil {
+			logger.Error("failed-to-refresh-store", err)
+			return domain.ProvisionedServiceSpec{}, share, err
+		}
+	}
+
+	if err := b.Quotas.CheckProvision(b.store, instanceID, details.OrganizationGUID, details.SpaceGUID, share.Host); err != nil {
+		return domain.ProvisionedServiceSpec{}, share, quotaFailure(logger, err)
+	}
+
+	details.RawParameters, err = json.Marshal(configuration)
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, share, err
+	}
+
+	delegate, err := b.delegateFor(b.volumeSettings(details.ServiceID, details.PlanID))
+	if err != nil {
+		logger.Error("invalid-volume-settings", err)
+		return domain.ProvisionedServiceSpec{}, share, err
+	}
+	spec, err := delegate.Provision(ctx, instanceID, details, asyncAllowed)
+	return spec, share, err
+}
+
+func (b *Broker) Deprovision(ctx context.Context, instanceID string, details domain.DeprovisionDetails, asyncAllowed bool) (domain.DeprovisionServiceSpec, error) {
+	record := b.target(AuditRecord{Operation: "deprovision", InstanceID: instanceID})
+	spec, err := b.deprovision(ctx, instanceID, details, asyncAllowed)
+	b.record(ctx, record, err)
+	return spec, err
+}
+
+func (b *Broker) deprovision(ctx context.Context, instanceID string, details domain.DeprovisionDetails, asyncAllowed bool) (domain.DeprovisionServiceSpec, error) {
+	delegate, err := b.instanceDelegate(ctx, instanceID, details.ServiceID, details.PlanID)
+	if err != nil {
+		b.logger.Session("deprovision", traceData(ctx)).Error("invalid-volume-settings", err, lager.Data{"instanceID": instanceID})
+		return domain.DeprovisionServiceSpec{}, err
+	}
+
+	b.lock(ctx)
+	defer b.unlock()
+	return delegate.Deprovision(ctx, instanceID, details, asyncAllowed)
+}
+
+func (b *Broker) GetInstance(ctx context.Context, instanceID string) (domain.GetInstanceDetailsSpec, error) {
+	return b.current().GetInstance(ctx, instanceID)
+}
+
+func (b *Broker) Update(ctx context.Context, instanceID string, details domain.UpdateDetails, asyncAllowed bool) (domain.UpdateServiceSpec, error) {
+	record := b.target(AuditRecord{Operation: "update", InstanceID: instanceID})
+	spec, err := b.update(ctx, instanceID, details, asyncAllowed)
+
+	if details.PlanID != "" {
+		record.PlanID = details.PlanID
+	}
+	record.Parameters = auditParameters(details.RawParameters)
+	b.record(ctx, record, err)
+	return spec, err
+}
+
+// update hands the update to the volume broker of the instance's plan. The
+// volume brokers refuse every update, so the share is neither checked
+// against the server policy nor probed.
+func (b *Broker) update(ctx context.Context, instanceID string, details domain.UpdateDetails, asyncAllowed bool) (domain.UpdateServiceSpec, error) {
+	logger := b.logger.Session("update", traceData(ctx)).WithData(lager.Data{"instanceID": instanceID})
+
+	delegate, err := b.instanceDelegate(ctx, instanceID, details.ServiceID, details.PlanID)
+	if err != nil {
+		logger.Error("invalid-volume-settings", err)
+		return domain.UpdateServiceSpec{}, err
+	}
+
+	b.lock(ctx)
+	defer b.unlock()
+	return delegate.Update(ctx, instanceID, details, asyncAllowed)
+}
+
+// instanceDelegate returns the volume broker of the plan of an instance. The
+// service and plan the platform sent take precedence over those recorded
+// for the instance, which are only read when one of them is missing.
+func (b *Broker) instanceDelegate(ctx context.Context, instanceID, serviceID, planID string) (domain.ServiceBroker, error) {
+	if serviceID == "" || planID == "" {
+		var instance brokerstore.ServiceInstance
+		_ = b.Tracer.traceStore(ctx, "RetrieveInstanceDetails", func() (err error) {
+			instance, err = b.store.RetrieveInstanceDetails(instanceID)
+			return err
+		})
+		if serviceID == "" {
+			serviceID = instance.ServiceID
+		}
+		if planID == "" {
+			planID = instance.PlanID
+		}
+	}
+	return b.delegateFor(b.volumeSettings(serviceID, planID))
+}
+
+func (b *Broker) LastOperation(ctx context.Context, instanceID string, details domain.PollDetails) (domain.LastOperation, error) {
+	b.lock(ctx)
+	defer b.unlock()
+	return b.current().LastOperation(ctx, instanceID, details)
+}
+
+func (b *Broker) Bind(ctx context.Context, instanceID, bindingID string, details domain.BindDetails, asyncAllowed bool) (domain.Binding, error) {
+	binding, err := b.bind(ctx, instanceID, bindingID, details, asyncAllowed)
+
+	record := b.target(AuditRecord{Operation: "bind", InstanceID: instanceID, BindingID: bindingID})
+	record.AppGUID = details.AppGUID
+	record.Parameters = auditParameters(details.RawParameters)
+	b.record(ctx, record, err)
+	return binding, err
+}
+
+func (b *Broker) bind(ctx context.Context, instanceID, bindingID string, details domain.BindDetails, asyncAllowed bool) (domain.Binding, error) {
+	logger := b.logger.Session("bind", traceData(ctx)).WithData(lager.Data{"instanceID": instanceID, "bindingID": bindingID})
+
+	if err := b.checkServerPolicy(ctx, instanceID); err != nil {
+		logger.Error("server-not-allowed", err)
+		return domain.Binding{}, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "server-not-allowed")
+	}
+
+	b.lock(ctx)
+	defer b.unlock()
+
+	if b.Quotas != nil {
+		if err := b.Tracer.traceStore(ctx, "Refresh", b.store.Refresh); err != nil {
+			logger.Error("failed-to-refresh-store", err)
+			return domain.Binding{}, err
+		}
+	}
+
+	var instance brokerstore.ServiceInstance
+	instanceErr := b.Tracer.traceStore(ctx, "RetrieveInstanceDetails", func() (err error) {
+		instance, err = b.store.RetrieveInstanceDetails(instanceID)
+		return err
+	})
+
+	serviceID, planID := details.ServiceID, details.PlanID
+	if serviceID == "" {
+		serviceID = instance.ServiceID
+	}
+	if planID == "" {
+		planID = instance.PlanID
+	}
+	settings := b.volumeSettings(serviceID, planID)
+
+	var containerDir string
+	if instanceErr == nil {
+		var err error
+		if err := b.Quotas.CheckBind(b.store, instanceID, bindingID, instance.OrganizationGUID, instance.SpaceGUID); err != nil {
+			return domain.Binding{}, quotaFailure(logger, err)
+		}
+
+		if details, err = b.applyMountPolicy(logger, instance, details); err != nil {
+			return domain.Binding{}, err
+		}
+
+		if containerDir, err = b.checkContainerPath(ctx, logger, instanceID, bindingID, instance, details, settings); err != nil {
+			return domain.Binding{}, err
+		}
+	}
+
+	delegate, err := b.delegateFor(settings)
+	if err != nil {
+		logger.Error("invalid-volume-settings", err)
+		return domain.Binding{}, err
+	}
+
+	binding, err := delegate.Bind(ctx, instanceID, bindingID, details, asyncAllowed)
+	if err != nil {
+		return binding, err
+	}
+	settings.apply(&binding, containerDir)
+
+	index := BindingIndex{InstanceID: instanceID, ContainerDir: containerDir}
+	if b.keyVolumeIDs(logger, instanceID) {
+		if err := b.VolumeIDs.apply(&binding, instanceID); err != nil {
+			logger.Error("failed-to-derive-volume-id", err)
+			return domain.Binding{}, err
+		}
+		index.VolumeIDScheme = VolumeIDSchemeHMAC
+	}
+
+	err = b.Tracer.traceStore(ctx, "IndexBinding", func() error {
+		return b.store.IndexBinding(bindingID, index)
+	})
+	if err != nil {
+		logger.Error("failed-to-index-binding", err)
+	}
+	return binding, nil
+}
+
+// checkServerPolicy checks the server of an instance against the server
+// policy. It looks the instance up and resolves the server itself, so that
+// it is called before the broker mutex is taken; instances that cannot be
+// read are left to the volume broker.
+func (b *Broker) checkServerPolicy(ctx context.Context, instanceID string) error {
+	if b.ServerPolicy == nil {
+		return nil
+	}
+
+	var instance brokerstore.ServiceInstance
+	err := b.Tracer.traceStore(ctx, "RetrieveInstanceDetails", func() (err error) {
+		instance, err = b.store.RetrieveInstanceDetails(instanceID)
+		return err
+	})
+	if err != nil {
+		return nil
+	}
+
+	share, err := instanceShare(instance)
+	if err != nil {
+		return err
+	}
+	return b.ServerPolicy.Check(share.Host, instance.OrganizationGUID, instance.SpaceGUID)
+}
+
+// keyVolumeIDs reports whether a new binding of instanceID gets a keyed
+// volume ID rather than the volume broker's legacy one.
+func (b *Broker) keyVolumeIDs(logger lager.Logger, instanceID string) bool {
+	if b.VolumeIDs == nil {
+		return false
+	}
+	if !b.VolumeIDs.KeepLegacy {
+		return true
+	}
+
+	legacy, err := b.store.LegacyVolumeIDs(instanceID)
+	if err != nil {
+		logger.Error("failed-to-find-legacy-volume-ids", err)
+		return false
+	}
+	if legacy {
+		logger.Info("keeping-legacy-volume-id")
+	}
+	return !legacy
+}
+
+func (b *Broker) Unbind(ctx context.Context, instanceID, bindingID string, details domain.UnbindDetails, asyncAllowed bool) (domain.UnbindSpec, error) {
+	record := b.target(AuditRecord{Operation: "unbind", InstanceID: instanceID, BindingID: bindingID})
+	spec, err := b.unbind(ctx, instanceID, bindingID, details, asyncAllowed)
+	b.record(ctx, record, err)
+	return spec, err
+}
+
+func (b *Broker) unbind(ctx context.Context, instanceID, bindingID string, details domain.UnbindDetails, asyncAllowed bool) (domain.UnbindSpec, error) {
+	delegate, err := b.instanceDelegate(ctx, instanceID, details.ServiceID, details.PlanID)
+	if err != nil {
+		b.logger.Session("unbind", traceData(ctx)).Error("invalid-volume-settings", err, lager.Data{"instanceID": instanceID, "bindingID": bindingID})
+		return domain.UnbindSpec{}, err
+	}
+
+	b.lock(ctx)
+	defer b.unlock()
+	return delegate.Unbind(ctx, instanceID, bindingID, details, asyncAllowed)
+}
+
+func (b *Broker) GetBinding(ctx context.Context, instanceID, bindingID string) (domain.GetBindingSpec, error) {
+	return b.current().GetBinding(ctx, instanceID, bindingID)
+}
+
+func (b *Broker) LastBindingOperation(ctx context.Context, instanceID, bindingID string, details domain.PollDetails) (domain.LastOperation, error) {
+	return b.current().LastBindingOperation(ctx, instanceID, bindingID, details)
+}
+
+// record writes the audit record of an operation and, if it succeeded,
+// notifies the webhooks about it.
+func (b *Broker) record(ctx context.Context, record AuditRecord, err error) {
+	b.Audit.Record(ctx, record, err)
+	if err == nil {
+		b.Webhooks.Publish(record)
+	}
+}
+
+// target fills in the app of the binding, if the record is about one, and
+// the organization, space and share of the instance a record is about.
+// Nothing is looked up when neither auditing nor webhooks are on.
+func (b *Broker) target(record AuditRecord) AuditRecord {
+	if (b.Audit == nil && b.Webhooks == nil) || b.store == nil {
+		return record
+	}
+
+	if record.BindingID != "" {
+		if bindings, err := b.store.RetrieveAllBindingDetails(); err == nil {
+			record.AppGUID = bindings[record.BindingID].AppGUID
+		}
+		if record.InstanceID == "" {
+			record.InstanceID, _ = b.store.InstanceForBinding(record.BindingID)
+		}
+	}
+
+	instances, err := b.store.Instances(func(id string, _ brokerstore.ServiceInstance) bool { return id == record.InstanceID })
+	if err != nil {
+		return record
+	}
+	if instance, ok := instances[record.InstanceID]; ok {
+		record.ServiceID, record.PlanID = instance.ServiceID, instance.PlanID
+		record.OrgGUID, record.SpaceGUID = instance.OrganizationGUID, instance.SpaceGUID
+		if share, err := instanceShare(instance); err == nil {
+			record.Share = share.Source()
+		}
+	}
+	return record
+}
+
+// lock takes the broker mutex, records how long that took and enters the
+// scope of the request of ctx.
+func (b *Broker) lock(ctx context.Context) {
+	start := time.Now()
+	b.mutex.Lock()
+	b.Metrics.ObserveMutexWait(time.Since(start))
+	b.Scope.enter(ctx)
+}
+
+func (b *Broker) unlock() {
+	b.Scope.leave()
+	b.mutex.Unlock()
+}
+
+// applyMountPolicy evaluates the mount policy against the instance and bind
+// options and adds the options it forces or defaults to the bind parameters.
+func (b *Broker) applyMountPolicy(logger lager.Logger, instance brokerstore.ServiceInstance, details domain.BindDetails) (domain.BindDetails, error) {
+	bindOpts, err := decodeParameters(details.RawParameters)
+	if err != nil {
+		return details, apiresponses.ErrRawParamsInvalid
+	}
+
+	opts := instanceOptions(instance)
+	for k, v := range bindOpts {
+		opts[k] = v
+	}
+
+	request := MountPolicyRequest{OrgGUID: instance.OrganizationGUID, SpaceGUID: instance.SpaceGUID, PlanID: details.PlanID, ServiceID: details.ServiceID}
+	changes, err := b.MountPolicy.Apply(request, opts)
+	if err != nil {
+		logger.Error("mount-policy-violation", err)
+		return details, apiresponses.NewFailureResponse(err, http.StatusBadRequest, "mount-policy-violation")
+	}
+	if len(changes) == 0 {
+		return details, nil
+	}
+
+	logger.Info("mount-policy-applied", lager.Data{"options": sortedKeys(changes)})
+	for k, v := range changes {
+		bindOpts[k] = v
+	}
+	details.RawParameters, err = json.Marshal(bindOpts)
+	return details, err
+}
+
+// checkContainerPath validates the mount path of a new binding and makes
+// sure no other binding of the same app is mounted at the same directory.
+func (b *Broker) checkContainerPath(ctx context.Context, logger lager.Logger, instanceID, bindingID string, instance brokerstore.ServiceInstance, details domain.BindDetails, settings VolumeSettings) (string, error) {
+	bindOpts, err := decodeParameters(details.RawParameters)
+	if err != nil {
+		return "", apiresponses.ErrRawParamsInvalid
+	}
+
+	opts := instanceOptions(instance)
+	for k, v := range bindOpts {
+		opts[k] = v
+	}
+
+	if err := mountParameter(opts, b.ForbiddenMountPaths); err != nil {
+		logger.Error("invalid-mount-path", err)
+		return "", apiresponses.NewFailureResponse(err, http.StatusBadRequest, "invalid-mount-path")
+	}
+
+	containerDir := settings.ContainerDir(opts, instanceID)
+	if details.AppGUID == "" {
+		return containerDir, nil
+	}
+
+	// Default mount paths are unique to the instance, so only a binding with
+	// an explicit mount path can collide with a binding another broker
+	// instance just created. The index was refreshed for the quotas already
+	// when they are on.
+	if _, explicit := opts[MountKey]; explicit && b.Quotas == nil {
+		if err := b.Tracer.traceStore(ctx, "Refresh", b.store.Refresh); err != nil {
+			logger.Error("failed-to-refresh-store", err)
+			return "", err
+		}
+	}
+
+	appBindings, err := b.store.BindingsByApp(details.AppGUID)
+	if err != nil {
+		return "", err
+	}
+	for id, index := range appBindings {
+		if id != bindingID && index.ContainerDir == containerDir {
+			err := fmt.Errorf("app %q already has binding %q mounted at %q; choose a different \"mount\" path", details.AppGUID, id, containerDir)
+			logger.Error("mount-path-collision", err)
+			return "", apiresponses.NewFailureResponse(err, http.StatusBadRequest, "mount-path-collision")
+		}
+	}
+
+	return containerDir, nil
+}
+
+// normalizeShareParameter replaces the user supplied share with its canonical
+// source form and merges any options carried in an smb:// URL.
+func (b *Broker) normalizeShareParameter(configuration map[string]interface{}) (Share, error) {
+	raw, ok := configuration[existingvolumebroker.SHARE_KEY].(string)
+	if !ok || raw == "" {
+		return Share{}, fmt.Errorf("config requires a \"share\" key")
+	}
+
+	parse := ParseShare
+	if b.Flavor != nil {
+		parse = b.Flavor.ParseShare
+	}
+	share, err := parse(raw)
+	if err != nil {
+		return Share{}, err
+	}
+
+	for k, v := range share.Options {
+		if existing, ok := configuration[k]; ok && fmt.Sprintf("%v", existing) != v {
+			return Share{}, fmt.Errorf("option %q is set to %q in the share URL but to %q in the parameters", k, v, fmt.Sprintf("%v", existing))
+		}
+		configuration[k] = v
+	}
+	configuration[existingvolumebroker.SHARE_KEY] = share.Source()
+
+	return share, nil
+}
+
+// instanceShare parses the share recorded for a service instance. Legacy
+// instances store the bare share string as their fingerprint.
+func instanceShare(instance brokerstore.ServiceInstance) (Share, error) {
+	raw, _ := instanceOptions(instance)[existingvolumebroker.SHARE_KEY].(string)
+	return parseInstanceShare(raw)
+}
+
+// instanceOptions returns a copy of the options recorded for a service
+// instance. Legacy instances store the bare share string as their
+// fingerprint.
+func instanceOptions(instance brokerstore.ServiceInstance) map[string]interface{} {
+	opts := map[string]interface{}{}
+	switch fingerprint := instance.ServiceFingerPrint.(type) {
+	case map[string]interface{}:
+		for k, v := range fingerprint {
+			opts[k] = v
+		}
+	case string:
+		opts[existingvolumebroker.SHARE_KEY] = fingerprint
+	}
+	return opts
+}
+
+func quotaFailure(logger lager.Logger, err error) error {
+	if _, ok := err.(*QuotaError); !ok {
+		logger.Error("failed-to-check-quota", err)
+		return err
+	}
+
+	logger.Error("quota-exceeded", err)
+	return apiresponses.NewFailureResponse(err, http.StatusForbidden, "quota-exceeded")
+}
+
+// shareCheckFailure maps a failed check against the share host to a 400
+// when the host does not resolve, does not support the requested SMB
+// version or rejects the credentials, and to a 422 when it does not accept
+// connections.
+func shareCheckFailure(logger lager.Logger, err error) error {
+	if credentialErr, ok := err.(*CredentialError); ok {
+		logger.Error(credentialErr.key(), credentialErr)
+		return apiresponses.NewFailureResponse(credentialErr, http.StatusBadRequest, credentialErr.key())
+	}
+
+	if versionErr, ok := err.(*VersionError); ok {
+		logger.Error("unsupported-smb-version", versionErr)
+		return apiresponses.NewFailureResponse(versionErr, http.StatusBadRequest, "unsupported-smb-version")
+	}
+
+	probeErr, ok := err.(*ShareProbeError)
+	if !ok {
+		logger.Error("share-probe-failed", err)
+		return err
+	}
+
+	if probeErr.Unresolved {
+		logger.Error("share-host-unknown", err)
+		return apiresponses.NewFailureResponse(err, http.StatusBadRequest, "share-host-unknown")
+	}
+	logger.Error("share-unreachable", err)
+	return apiresponses.NewFailureResponse(err, http.StatusUnprocessableEntity, "share-unreachable")
+}
+
+func decodeParameters(raw json.RawMessage) (map[string]interface{}, error) {
+	configuration := map[string]interface{}{}
+	if len(raw) == 0 {
+		return configuration, nil
+	}
+
+	if err := json.Unmarshal(raw, &configuration); err != nil {
+		return nil, err
+	}
+	if configuration == nil {
+		configuration = map[string]interface{}{}
+	}
+	return configuration, nil
+}
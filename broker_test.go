@@ -0,0 +1,893 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/existingvolumebroker"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	vmo "code.cloudfoundry.org/volume-mount-options"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+	"golang.org/x/crypto/bcrypt"
+
+	. "code.cloudfoundry.org/smbbroker"
+	"code.cloudfoundry.org/smbbroker/smbclient/smbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Broker", func() {
+	var (
+		credhub  *fakeCredhub
+		store    *IndexedStore
+		broker   *Broker
+		delegate *existingvolumebroker.Broker
+		ctx      context.Context
+	)
+
+	BeforeEach(func() {
+		logger := lager.NewLogger("broker")
+		credhub = newFakeCredhub()
+		store = NewIndexedStore(logger, credhub, "smbbroker")
+		ctx = context.Background()
+
+		services, err := NewServicesFromConfig("./default_services.json")
+		Expect(err).NotTo(HaveOccurred())
+
+		mask, err := vmo.NewMountOptsMask([]string{"source", "mount", "ro", "username", "password", "domain", "version", "mfsymlinks"},
+			map[string]interface{}{}, map[string]string{"readonly": "ro", "share": "source"}, []string{}, []string{"source"})
+		Expect(err).NotTo(HaveOccurred())
+
+		delegate = existingvolumebroker.New(existingvolumebroker.BrokerTypeSMB, logger, services, &osshim.OsShim{}, clock.NewClock(), store, mask)
+		broker = NewBroker(logger, delegate, store)
+	})
+
+	provisionIn := func(instanceID, org, space, params string) error {
+		_, err := broker.Provision(ctx, instanceID, domain.ProvisionDetails{
+			ServiceID:        "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+			PlanID:           "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+			OrganizationGUID: org,
+			SpaceGUID:        space,
+			RawParameters:    json.RawMessage(params),
+		}, false)
+		return err
+	}
+
+	provision := func(params string) error {
+		return provisionIn("instance-id", "org-guid", "space-guid", params)
+	}
+
+	bind := func(instanceID, bindingID string) error {
+		_, err := broker.Bind(ctx, instanceID, bindingID, domain.BindDetails{
+			ServiceID: "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+			PlanID:    "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+			AppGUID:   "app-guid",
+		}, false)
+		return err
+	}
+
+	Describe("Provision", func() {
+		It("stores the canonical share", func() {
+			Expect(provision(`{"share": "\\\\Server\\share\\"}`)).To(Succeed())
+
+			instance, err := store.RetrieveInstanceDetails("instance-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instance.ServiceFingerPrint).To(HaveKeyWithValue("share", "//server/share"))
+		})
+
+		It("merges options from the share URL", func() {
+			Expect(provision(`{"share": "smb://server/share?vers=3.0"}`)).To(Succeed())
+
+			instance, err := store.RetrieveInstanceDetails("instance-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instance.ServiceFingerPrint).To(HaveKeyWithValue("version", "3.0"))
+		})
+
+		It("rejects options that disagree with the share URL", func() {
+			err := provision(`{"share": "smb://server/share?vers=3.0", "version": "2.1"}`)
+			Expect(err).To(MatchError(ContainSubstring(`option "version" is set to "3.0" in the share URL but to "2.1"`)))
+		})
+
+		It("rejects an invalid share with a 400", func() {
+			err := provision(`{"share": "//server/"}`)
+			Expect(err).To(BeAssignableToTypeOf(&apiresponses.FailureResponse{}))
+			Expect(err.(*apiresponses.FailureResponse).ValidatedStatusCode(nil)).To(Equal(400))
+			Expect(err).To(MatchError(ContainSubstring("missing share name")))
+			Expect(credhub.count()).To(Equal(0))
+		})
+
+		It("requires a share", func() {
+			Expect(provision(`{"version": "3.0"}`)).To(MatchError(ContainSubstring(`config requires a "share" key`)))
+		})
+
+		It("rejects missing parameters", func() {
+			Expect(provision(``)).To(Equal(apiresponses.ErrRawParamsInvalid))
+		})
+	})
+
+	Describe("SetDelegate", func() {
+		It("validates new bindings against the mask of the new delegate", func() {
+			Expect(provision(`{"share": "//server/share", "version": "3.0"}`)).To(Succeed())
+			Expect(bind("instance-id", "binding-1")).To(Succeed())
+			_, err := broker.Unbind(ctx, "instance-id", "binding-1", domain.UnbindDetails{}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			mask, err := vmo.NewMountOptsMask([]string{"source", "mount", "ro"},
+				map[string]interface{}{}, map[string]string{"readonly": "ro", "share": "source"}, []string{}, []string{"source"})
+			Expect(err).NotTo(HaveOccurred())
+			services, err := NewServicesFromConfig("./default_services.json")
+			Expect(err).NotTo(HaveOccurred())
+			broker.SetDelegate(existingvolumebroker.New(existingvolumebroker.BrokerTypeSMB, lager.NewLogger("broker"), services, &osshim.OsShim{}, clock.NewClock(), store, mask))
+
+			Expect(bind("instance-id", "binding-2")).To(MatchError(ContainSubstring("version")))
+		})
+	})
+
+	Describe("NFS", func() {
+		BeforeEach(func() {
+			logger := lager.NewLogger("broker")
+			services, err := NewServicesFromConfig("./default_nfs_services.json")
+			Expect(err).NotTo(HaveOccurred())
+			mask, err := NFSFlavor.Mask(NFSFlavor.AllowedOptions)
+			Expect(err).NotTo(HaveOccurred())
+
+			broker = NewBroker(logger, existingvolumebroker.New(existingvolumebroker.BrokerTypeNFS, logger, services, &osshim.OsShim{}, clock.NewClock(), store, mask), store)
+			broker.Flavor = NFSFlavor
+		})
+
+		It("provisions and binds NFS exports", func() {
+			Expect(provision(`{"share": "nfs-server:/export/data", "uid": "1000", "gid": "1000"}`)).To(Succeed())
+
+			instance, err := store.RetrieveInstanceDetails("instance-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instance.ServiceFingerPrint).To(HaveKeyWithValue("share", "nfs-server/export/data"))
+
+			binding, err := broker.Bind(ctx, "instance-id", "binding-id", domain.BindDetails{AppGUID: "app-guid"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts[0].Driver).To(Equal("nfsv3driver"))
+			Expect(binding.VolumeMounts[0].Device.MountConfig).To(HaveKeyWithValue("source", "nfs://nfs-server/export/data"))
+			Expect(binding.VolumeMounts[0].Device.MountConfig).To(HaveKeyWithValue("uid", "1000"))
+		})
+
+		It("rejects SMB shares", func() {
+			Expect(provision(`{"share": "//server/share"}`)).To(MatchError(ContainSubstring("expected server/export")))
+		})
+
+		It("applies the server policy to the NFS server", func() {
+			broker.ServerPolicy = &ServerPolicy{Deny: []ServerRule{{Server: "nfs-server"}}}
+			Expect(provision(`{"share": "nfs://nfs-server/export"}`)).To(MatchError(ContainSubstring("nfs-server")))
+		})
+	})
+
+	Describe("server policy", func() {
+		BeforeEach(func() {
+			broker.ServerPolicy = &ServerPolicy{
+				Deny: []ServerRule{{Server: "denied.example.com"}},
+			}
+		})
+
+		It("rejects provisioning against a denied server", func() {
+			err := provision(`{"share": "//Denied.example.com/share"}`)
+			Expect(err).To(BeAssignableToTypeOf(&apiresponses.FailureResponse{}))
+			Expect(err.(*apiresponses.FailureResponse).ValidatedStatusCode(nil)).To(Equal(400))
+			Expect(err).To(MatchError(`server "denied.example.com" is denied by broker policy (rule "denied.example.com")`))
+		})
+
+		It("rejects new bindings once the server is denied", func() {
+			broker.ServerPolicy = nil
+			Expect(provision(`{"share": "//denied.example.com/share"}`)).To(Succeed())
+
+			broker.ServerPolicy = &ServerPolicy{Deny: []ServerRule{{Server: "denied.example.com"}}}
+			_, err := broker.Bind(ctx, "instance-id", "binding-id", domain.BindDetails{AppGUID: "app-guid"}, false)
+			Expect(err).To(MatchError(ContainSubstring("is denied by broker policy")))
+			Expect(credhub.has("/smbbroker/binding-id")).To(BeFalse())
+		})
+
+		It("resolves the server of a binding without holding the broker mutex", func() {
+			broker.ServerPolicy = nil
+			Expect(provision(`{"share": "//10.0.0.1/share"}`)).To(Succeed())
+
+			served := false
+			broker.ServerPolicy = &ServerPolicy{Deny: []ServerRule{{Server: "retired.example.com"}}}
+			broker.ServerPolicy.LookupHost = func(host string) ([]string, error) {
+				done := make(chan struct{})
+				go func() {
+					_, _ = broker.Services(ctx)
+					close(done)
+				}()
+				select {
+				case <-done:
+					served = true
+				case <-time.After(time.Second):
+				}
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+
+			_, err := broker.Bind(ctx, "instance-id", "binding-id", domain.BindDetails{AppGUID: "app-guid"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(served).To(BeTrue())
+		})
+
+		It("leaves updates to the volume broker, which refuses them", func() {
+			broker.ServerPolicy = nil
+			Expect(provision(`{"share": "//allowed.example.com/share"}`)).To(Succeed())
+
+			broker.ServerPolicy = &ServerPolicy{Deny: []ServerRule{{Server: "denied.example.com"}}}
+			_, err := broker.Update(ctx, "instance-id", domain.UpdateDetails{RawParameters: json.RawMessage(`{"share": "//denied.example.com/share"}`)}, false)
+			Expect(err).To(MatchError(ContainSubstring("does not support instance updates")))
+		})
+
+	})
+
+	Describe("quotas", func() {
+		expectQuotaError := func(err error, message string) {
+			Expect(err).To(BeAssignableToTypeOf(&apiresponses.FailureResponse{}))
+			Expect(err.(*apiresponses.FailureResponse).ValidatedStatusCode(nil)).To(Equal(403))
+			Expect(err).To(MatchError(message))
+		}
+
+		It("limits instances per org", func() {
+			broker.Quotas = &Quotas{QuotaLimits: QuotaLimits{MaxInstancesPerOrg: 1}}
+
+			Expect(provisionIn("instance-1", "org-guid", "space-1", `{"share": "//server/share"}`)).To(Succeed())
+			expectQuotaError(provisionIn("instance-2", "org-guid", "space-2", `{"share": "//server/share"}`),
+				`org "org-guid" has reached its limit of 1 service instances`)
+			Expect(provisionIn("instance-3", "other-org", "space-3", `{"share": "//server/share"}`)).To(Succeed())
+		})
+
+		It("does not count a repeated provision of the same instance", func() {
+			broker.Quotas = &Quotas{QuotaLimits: QuotaLimits{MaxInstancesPerSpace: 1}}
+
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+		})
+
+		It("limits instances per space with org and space overrides", func() {
+			broker.Quotas = &Quotas{
+				QuotaLimits: QuotaLimits{MaxInstancesPerSpace: 1},
+				Spaces:      map[string]QuotaLimits{"big-space": {MaxInstancesPerSpace: -1}},
+			}
+
+			Expect(provisionIn("instance-1", "org-guid", "space-guid", `{"share": "//server/share"}`)).To(Succeed())
+			expectQuotaError(provisionIn("instance-2", "org-guid", "space-guid", `{"share": "//server/share"}`),
+				`space "space-guid" has reached its limit of 1 service instances`)
+
+			Expect(provisionIn("instance-3", "org-guid", "big-space", `{"share": "//server/share"}`)).To(Succeed())
+			Expect(provisionIn("instance-4", "org-guid", "big-space", `{"share": "//server/share"}`)).To(Succeed())
+		})
+
+		It("limits distinct servers per org", func() {
+			broker.Quotas = &Quotas{QuotaLimits: QuotaLimits{MaxServersPerOrg: 1}}
+
+			Expect(provisionIn("instance-1", "org-guid", "space-guid", `{"share": "//server/share"}`)).To(Succeed())
+			Expect(provisionIn("instance-2", "org-guid", "space-guid", `{"share": "//SERVER/other"}`)).To(Succeed())
+			expectQuotaError(provisionIn("instance-3", "org-guid", "space-guid", `{"share": "//another-server/share"}`),
+				`org "org-guid" has reached its limit of 1 distinct servers`)
+		})
+
+		It("counts the instances other broker instances created", func() {
+			broker.Quotas = &Quotas{QuotaLimits: QuotaLimits{MaxInstancesPerOrg: 2}}
+
+			Expect(provisionIn("instance-1", "org-guid", "space-1", `{"share": "//server/share"}`)).To(Succeed())
+			credhub.SetJSON("/smbbroker/instance-2", map[string]interface{}{
+				"service_id": "service", "plan_id": "plan", "organization_guid": "org-guid", "space_guid": "space-2",
+				"ServiceFingerPrint": map[string]interface{}{"share": "//server/share"},
+			})
+			expectQuotaError(provisionIn("instance-3", "org-guid", "space-3", `{"share": "//server/share"}`),
+				`org "org-guid" has reached its limit of 2 service instances`)
+		})
+
+		It("limits bindings per instance", func() {
+			broker.Quotas = &Quotas{QuotaLimits: QuotaLimits{MaxBindingsPerInstance: 1}}
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+
+			Expect(bind("instance-id", "binding-1")).To(Succeed())
+			expectQuotaError(bind("instance-id", "binding-2"),
+				`service instance "instance-id" has reached its limit of 1 bindings`)
+
+			_, err := broker.Unbind(ctx, "instance-id", "binding-1", domain.UnbindDetails{}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bind("instance-id", "binding-2")).To(Succeed())
+		})
+	})
+
+	Describe("mount policy", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "broker-mount-policy")
+			Expect(err).NotTo(HaveOccurred())
+
+			path := filepath.Join(dir, "mount-policy.json")
+			Expect(ioutil.WriteFile(path, []byte(`{"rules": [
+				{"name": "read-only", "match": {"exclude_orgs": ["finance-org"]}, "force": {"readonly": true}},
+				{"name": "no-smb1", "forbid": {"version": ["1.0"]}}
+			]}`), 0600)).To(Succeed())
+
+			broker.MountPolicy, err = NewMountPolicyFromConfig(path)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("rejects forbidden options at provision time", func() {
+			err := provision(`{"share": "//server/share", "version": "1.0"}`)
+			Expect(err).To(MatchError(`mount option "version=1.0" is forbidden by mount policy rule "no-smb1"`))
+		})
+
+		It("forces options on bindings", func() {
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+
+			binding, err := broker.Bind(ctx, "instance-id", "binding-id", domain.BindDetails{AppGUID: "app-guid"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts[0].Mode).To(Equal("r"))
+		})
+
+		It("does not apply rules for other orgs", func() {
+			Expect(provisionIn("instance-id", "finance-org", "space-guid", `{"share": "//server/share"}`)).To(Succeed())
+
+			binding, err := broker.Bind(ctx, "instance-id", "binding-id", domain.BindDetails{AppGUID: "app-guid"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts[0].Mode).To(Equal("rw"))
+		})
+
+		It("rejects forbidden options passed at bind time", func() {
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+
+			_, err := broker.Bind(ctx, "instance-id", "binding-id", domain.BindDetails{AppGUID: "app-guid", RawParameters: json.RawMessage(`{"version": "1.0"}`)}, false)
+			Expect(err).To(MatchError(ContainSubstring("is forbidden by mount policy rule")))
+		})
+	})
+
+	Describe("mount paths", func() {
+		bindApp := func(instanceID, bindingID, appGUID, params string) error {
+			_, err := broker.Bind(ctx, instanceID, bindingID, domain.BindDetails{AppGUID: appGUID, RawParameters: json.RawMessage(params)}, false)
+			return err
+		}
+
+		It("rejects an invalid mount path at provision time", func() {
+			err := provision(`{"share": "//server/share", "mount": "/home/vcap/app"}`)
+			Expect(err).To(MatchError(`mount path "/home/vcap/app" is not allowed: "/home/vcap/app" is reserved`))
+		})
+
+		It("rejects an invalid mount path at bind time", func() {
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+			err := bindApp("instance-id", "binding-id", "app-guid", `{"mount": "relative"}`)
+			Expect(err).To(MatchError(`mount path "relative" must be absolute`))
+		})
+
+		It("rejects a second binding of the same app at the same directory", func() {
+			Expect(provisionIn("instance-1", "org-guid", "space-guid", `{"share": "//server/one"}`)).To(Succeed())
+			Expect(provisionIn("instance-2", "org-guid", "space-guid", `{"share": "//server/two"}`)).To(Succeed())
+
+			Expect(bindApp("instance-1", "binding-1", "app-guid", `{"mount": "/data"}`)).To(Succeed())
+			Expect(bindApp("instance-2", "binding-2", "other-app", `{"mount": "/data"}`)).To(Succeed())
+
+			err := bindApp("instance-2", "binding-3", "app-guid", `{"mount": "/data"}`)
+			Expect(err).To(MatchError(`app "app-guid" already has binding "binding-1" mounted at "/data"; choose a different "mount" path`))
+
+			Expect(bindApp("instance-2", "binding-3", "app-guid", `{"mount": "/data2"}`)).To(Succeed())
+		})
+
+		It("only refreshes the index for bindings with an explicit mount path", func() {
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+			Expect(bindApp("instance-id", "binding-1", "app-1", `{}`)).To(Succeed())
+			finds := credhub.finds
+
+			Expect(bindApp("instance-id", "binding-2", "app-2", `{}`)).To(Succeed())
+			Expect(credhub.finds).To(Equal(finds))
+
+			Expect(bindApp("instance-id", "binding-3", "app-3", `{"mount": "/data"}`)).To(Succeed())
+			Expect(credhub.finds).To(Equal(finds + 1))
+		})
+	})
+
+	Describe("volume settings", func() {
+		var (
+			dir     string
+			path    string
+			catalog *Catalog
+			masks   [][]string
+			logs    *gbytes.Buffer
+		)
+
+		writeCatalog := func(allowedOptions string) {
+			Expect(ioutil.WriteFile(path, []byte(`[{
+				"id": "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+				"name": "smb",
+				"description": "Existing SMB shares",
+				"bindable": true,
+				"requires": ["volume_mount"],
+				"volume": {"driver": "customsmbdriver", "device_type": "shared", "container_path": "/var/vcap/data/smb"},
+				"plans": [{
+					"id": "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+					"name": "existing",
+					"description": "A preexisting share",
+					"volume": {"allowed_options": `+allowedOptions+`}
+				}]
+			}]`), 0600)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "broker")
+			Expect(err).NotTo(HaveOccurred())
+			path = filepath.Join(dir, "services.json")
+			writeCatalog(`["source", "mount", "ro"]`)
+
+			catalog, err = NewCatalogFromConfig(path, "")
+			Expect(err).NotTo(HaveOccurred())
+			masks = nil
+			logs = gbytes.NewBuffer()
+			broker.Catalog = catalog
+			broker.NewDelegate = func(mask vmo.MountOptsMask) domain.ServiceBroker {
+				masks = append(masks, mask.Allowed)
+				logger := lager.NewLogger("plan-broker")
+				logger.RegisterSink(lager.NewWriterSink(logs, lager.INFO))
+				return existingvolumebroker.New(existingvolumebroker.BrokerTypeSMB, logger, catalog, &osshim.OsShim{}, clock.NewClock(), store, mask)
+			}
+			Expect(broker.LoadDelegates()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		bindWith := func(bindingID, params string) (domain.Binding, error) {
+			return broker.Bind(ctx, "instance-id", bindingID, domain.BindDetails{
+				ServiceID:     "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+				PlanID:        "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+				AppGUID:       "app-guid",
+				RawParameters: json.RawMessage(params),
+			}, false)
+		}
+
+		It("binds with the driver and container path of the service", func() {
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+
+			binding, err := bindWith("binding-1", `{}`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts).To(HaveLen(1))
+			Expect(binding.VolumeMounts[0].Driver).To(Equal("customsmbdriver"))
+			Expect(binding.VolumeMounts[0].DeviceType).To(Equal("shared"))
+			Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/var/vcap/data/smb/instance-id"))
+
+			binding, err = bindWith("binding-2", `{"mount": "/data"}`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts[0].ContainerDir).To(Equal("/data"))
+		})
+
+		It("keeps apps from binding twice to the default directory of the service", func() {
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+
+			_, err := bindWith("binding-1", `{}`)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = bindWith("binding-2", `{}`)
+			Expect(err).To(MatchError(ContainSubstring(`mounted at "/var/vcap/data/smb/instance-id"`)))
+		})
+
+		It("validates bindings against the mount option mask of the plan", func() {
+			Expect(provision(`{"share": "//server/share", "version": "3.0"}`)).To(Succeed())
+
+			_, err := bindWith("binding-1", `{}`)
+			Expect(err).To(MatchError(ContainSubstring("version")))
+		})
+
+		It("unbinds and deprovisions with the volume broker of the plan", func() {
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+			_, err := bindWith("binding-1", `{}`)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = broker.Unbind(ctx, "instance-id", "binding-1", domain.UnbindDetails{}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logs).To(gbytes.Say(`"message":"plan-broker\.unbind`))
+
+			_, err = broker.Deprovision(ctx, "instance-id", domain.DeprovisionDetails{
+				ServiceID: "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+				PlanID:    "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+			}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logs).To(gbytes.Say(`"message":"plan-broker\.deprovision`))
+		})
+
+		It("builds the volume broker of each mask once", func() {
+			Expect(masks).To(Equal([][]string{{"source", "mount", "ro"}}))
+
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+			_, err := bindWith("binding-1", `{}`)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = bindWith("binding-2", `{"mount": "/data"}`)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(masks).To(HaveLen(1))
+		})
+
+		It("provisions with the volume broker of the plan", func() {
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+			Expect(logs).To(gbytes.Say("plan-broker.provision.start"))
+		})
+
+		It("builds the volume brokers again when the catalog changes", func() {
+			catalog.OnChange = func() {
+				Expect(broker.LoadDelegates()).To(Succeed())
+			}
+			writeCatalog(`["source", "mount", "ro", "version"]`)
+			Expect(catalog.Reload()).To(Succeed())
+			Expect(masks).To(Equal([][]string{{"source", "mount", "ro"}, {"source", "mount", "ro", "version"}}))
+
+			Expect(provision(`{"share": "//server/share", "version": "3.0"}`)).To(Succeed())
+			_, err := bindWith("binding-1", `{}`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(masks).To(HaveLen(2))
+		})
+	})
+
+	Describe("volume IDs", func() {
+		const key = "0123456789abcdef0123456789abcdef"
+
+		BeforeEach(func() {
+			var err error
+			broker.VolumeIDs, err = NewVolumeIDs(key)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		bindApp := func(bindingID, appGUID string) (domain.Binding, error) {
+			return broker.Bind(ctx, "instance-id", bindingID, domain.BindDetails{
+				ServiceID: "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+				PlanID:    "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+				AppGUID:   appGUID,
+			}, false)
+		}
+
+		It("derives the volume ID from the key and the options without the password", func() {
+			Expect(provision(`{"share": "//server/share", "username": "alice", "password": "secret"}`)).To(Succeed())
+
+			binding, err := bindApp("binding-1", "app-1")
+			Expect(err).NotTo(HaveOccurred())
+			device := binding.VolumeMounts[0].Device
+			Expect(device.MountConfig).To(HaveKeyWithValue("password", "secret"))
+
+			expected, err := broker.VolumeIDs.ID("instance-id", map[string]interface{}{"source": "//server/share", "username": "alice"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(device.VolumeId).To(Equal(expected))
+
+			Expect(store.BindingsByApp("app-1")).To(HaveKeyWithValue("binding-1", BindingIndex{
+				InstanceID:     "instance-id",
+				ContainerDir:   "/var/vcap/data/instance-id",
+				VolumeIDScheme: VolumeIDSchemeHMAC,
+			}))
+		})
+
+		It("keeps the legacy volume ID without a key", func() {
+			broker.VolumeIDs = nil
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+
+			binding, err := bindApp("binding-1", "app-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts[0].Device.VolumeId).To(MatchRegexp(`^instance-id-[0-9a-f]{32}$`))
+			bindings, err := store.BindingsByApp("app-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bindings["binding-1"].VolumeIDScheme).To(BeEmpty())
+		})
+
+		Context("when legacy volume IDs are kept", func() {
+			BeforeEach(func() {
+				broker.VolumeIDs.KeepLegacy = true
+				Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+			})
+
+			It("gives new bindings the legacy volume ID while the instance has legacy bindings", func() {
+				keyed := broker.VolumeIDs
+				broker.VolumeIDs = nil
+				legacy, err := bindApp("binding-1", "app-1")
+				Expect(err).NotTo(HaveOccurred())
+
+				broker.VolumeIDs = keyed
+				binding, err := bindApp("binding-2", "app-2")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.VolumeId).To(Equal(legacy.VolumeMounts[0].Device.VolumeId))
+
+				_, err = broker.Unbind(ctx, "instance-id", "binding-1", domain.UnbindDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = broker.Unbind(ctx, "instance-id", "binding-2", domain.UnbindDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				binding, err = bindApp("binding-3", "app-1")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.VolumeId).NotTo(Equal(legacy.VolumeMounts[0].Device.VolumeId))
+			})
+
+			It("keys the volume IDs of instances without legacy bindings", func() {
+				binding, err := bindApp("binding-1", "app-1")
+				Expect(err).NotTo(HaveOccurred())
+
+				expected, err := broker.VolumeIDs.ID("instance-id", map[string]interface{}{"source": "//server/share"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.VolumeId).To(Equal(expected))
+			})
+		})
+	})
+
+	Describe("binding redaction", func() {
+		BeforeEach(func() {
+			var err error
+			store.Redaction, err = NewBindingRedaction("0123456789abcdef0123456789abcdef")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+		})
+
+		bindWith := func(params string) error {
+			_, err := broker.Bind(ctx, "instance-id", "binding-1", domain.BindDetails{
+				ServiceID:     "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+				PlanID:        "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+				AppGUID:       "app-guid",
+				RawParameters: json.RawMessage(params),
+			}, false)
+			return err
+		}
+
+		It("accepts a repeated bind with the same parameters in another order", func() {
+			Expect(bindWith(`{"username": "alice", "password": "secret"}`)).To(Succeed())
+			Expect(bindWith(`{"password": "secret", "username": "alice"}`)).To(Succeed())
+			Expect(bindWith(`{"password": "other", "username": "alice"}`)).To(Equal(apiresponses.ErrBindingAlreadyExists))
+		})
+
+		It("redacts bcrypt records on a repeated bind", func() {
+			hash, err := bcrypt.GenerateFromPassword([]byte(`{"password":"secret","username":"alice"}`), bcrypt.MinCost)
+			Expect(err).NotTo(HaveOccurred())
+			credhub.SetJSON("/smbbroker/binding-1", map[string]interface{}{
+				"app_guid": "app-guid", "plan_id": "0da18102-48dc-46d0-98b3-7a4ff6dc9c54", "service_id": "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+				"parameters": map[string]interface{}{"paramsHash": string(hash)},
+			})
+
+			Expect(bindWith(`{"username": "alice", "password": "secret"}`)).To(Succeed())
+
+			params := credhub.records["/smbbroker/binding-1"]["parameters"]
+			Expect(params).To(HaveKey(ParamsHMACKey))
+			Expect(params).NotTo(HaveKey("paramsHash"))
+			Expect(bindWith(`{"password": "secret", "username": "alice"}`)).To(Succeed())
+		})
+	})
+
+	Describe("share probe", func() {
+		var listener net.Listener
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+				}
+			}()
+
+			broker.ShareProbe = NewShareProbe(listener.Addr().(*net.TCPAddr).Port, time.Second)
+			broker.ShareProbe.LookupHost = func(_ context.Context, host string) ([]string, error) {
+				if host == "server" {
+					return []string{"127.0.0.1"}, nil
+				}
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("provisions shares on reachable hosts", func() {
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+		})
+
+		It("rejects hosts that do not resolve with a 400", func() {
+			err := provision(`{"share": "//typo/share"}`)
+			Expect(err).To(MatchError(`share host "typo" cannot be resolved: no such host`))
+			Expect(err.(*apiresponses.FailureResponse).ValidatedStatusCode(nil)).To(Equal(400))
+		})
+
+		It("rejects hosts that do not accept connections with a 422", func() {
+			listener.Close()
+
+			err := provision(`{"share": "//server/share"}`)
+			Expect(err).To(BeAssignableToTypeOf(&apiresponses.FailureResponse{}))
+			Expect(err.(*apiresponses.FailureResponse).ValidatedStatusCode(nil)).To(Equal(422))
+			_, err = store.RetrieveInstanceDetails("instance-id")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("can be turned off per plan", func() {
+			broker.ShareProbe.SkipPlans = []string{"0da18102-48dc-46d0-98b3-7a4ff6dc9c54"}
+			Expect(provision(`{"share": "//typo/share"}`)).To(Succeed())
+		})
+
+		It("does not probe shares on update, which the volume broker refuses", func() {
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+
+			_, err := broker.Update(ctx, "instance-id", domain.UpdateDetails{
+				ServiceID:     "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+				RawParameters: json.RawMessage(`{"share": "//typo/share"}`),
+			}, false)
+			Expect(err).To(BeAssignableToTypeOf(&apiresponses.FailureResponse{}))
+			Expect(err.(*apiresponses.FailureResponse).ValidatedStatusCode(nil)).To(Equal(422))
+		})
+	})
+
+	Describe("SMB version negotiation", func() {
+		var server *smbtest.Server
+
+		BeforeEach(func() {
+			var err error
+			server, err = smbtest.NewServer("2.0", "2.1")
+			Expect(err).NotTo(HaveOccurred())
+
+			broker.Negotiator = NewVersionNegotiator(server.Port(), time.Second)
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("records the highest common version when none is requested", func() {
+			Expect(provision(`{"share": "//127.0.0.1/share"}`)).To(Succeed())
+
+			instance, err := store.RetrieveInstanceDetails("instance-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instance.ServiceFingerPrint).To(HaveKeyWithValue("version", "2.1"))
+		})
+
+		It("keeps a supported version", func() {
+			Expect(provision(`{"share": "//127.0.0.1/share", "version": "2.0"}`)).To(Succeed())
+
+			instance, err := store.RetrieveInstanceDetails("instance-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instance.ServiceFingerPrint).To(HaveKeyWithValue("version", "2.0"))
+		})
+
+		It("rejects versions the server does not offer with a 400", func() {
+			err := provision(`{"share": "//127.0.0.1/share", "version": "3.0"}`)
+			Expect(err).To(MatchError(`share host "127.0.0.1" does not support SMB version 3.0`))
+			Expect(err.(*apiresponses.FailureResponse).ValidatedStatusCode(nil)).To(Equal(400))
+		})
+
+		It("rejects servers without a common version", func() {
+			server.Versions = []string{}
+
+			err := provision(`{"share": "//127.0.0.1/share"}`)
+			Expect(err).To(MatchError(`share host "127.0.0.1" supports none of the SMB versions 1.0, 2.0, 2.1, 3.0`))
+		})
+
+		It("reports servers that cannot be reached with a 422", func() {
+			server.Close()
+
+			err := provision(`{"share": "//127.0.0.1/share"}`)
+			Expect(err).To(BeAssignableToTypeOf(&apiresponses.FailureResponse{}))
+			Expect(err.(*apiresponses.FailureResponse).ValidatedStatusCode(nil)).To(Equal(422))
+		})
+
+		It("can be turned off per plan", func() {
+			broker.Negotiator.SkipPlans = []string{"0da18102-48dc-46d0-98b3-7a4ff6dc9c54"}
+
+			Expect(provision(`{"share": "//127.0.0.1/share", "version": "3.0"}`)).To(Succeed())
+			Expect(server.Requests()).To(BeEmpty())
+		})
+	})
+
+	Describe("credential verification", func() {
+		var (
+			server *smbtest.Server
+			logs   *gbytes.Buffer
+		)
+
+		BeforeEach(func() {
+			var err error
+			server, err = smbtest.NewServer("2.1", "3.0")
+			Expect(err).NotTo(HaveOccurred())
+			server.Users["alice"] = "s3cr3t-passw0rd"
+			server.Users["bob"] = "hunter2"
+			server.Shares["share"] = []string{"alice"}
+
+			logger := lager.NewLogger("broker")
+			logs = gbytes.NewBuffer()
+			logger.RegisterSink(lager.NewWriterSink(logs, lager.DEBUG))
+			broker = NewBroker(logger, delegate, store)
+			broker.Credentials = NewCredentialCheck(server.Port(), time.Second)
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		failure := func(params string) *apiresponses.FailureResponse {
+			err := provision(params)
+			Expect(err).To(BeAssignableToTypeOf(&apiresponses.FailureResponse{}))
+			Expect(err.(*apiresponses.FailureResponse).ValidatedStatusCode(nil)).To(Equal(400))
+			return err.(*apiresponses.FailureResponse)
+		}
+
+		It("provisions instances with valid credentials", func() {
+			Expect(provision(`{"share": "//127.0.0.1/share", "username": "alice", "password": "s3cr3t-passw0rd", "domain": "CORP"}`)).To(Succeed())
+			Expect(server.Requests()).To(ContainElement(`TREE_CONNECT \\127.0.0.1\share`))
+		})
+
+		It("rejects a wrong password", func() {
+			err := failure(`{"share": "//127.0.0.1/share", "username": "alice", "password": "wrong-passw0rd"}`)
+			Expect(err).To(MatchError(`logon to share host "127.0.0.1" failed: check username, password and domain`))
+			Expect(err.LoggerAction()).To(Equal("logon-failure"))
+		})
+
+		It("rejects unknown shares", func() {
+			err := failure(`{"share": "//127.0.0.1/typo", "username": "alice", "password": "s3cr3t-passw0rd"}`)
+			Expect(err).To(MatchError(`share "typo" does not exist on host "127.0.0.1"`))
+			Expect(err.LoggerAction()).To(Equal("bad-share-name"))
+		})
+
+		It("rejects users without access to the share", func() {
+			err := failure(`{"share": "//127.0.0.1/share", "username": "bob", "password": "hunter2"}`)
+			Expect(err).To(MatchError(`access to share "share" on host "127.0.0.1" is denied for the given user`))
+			Expect(err.LoggerAction()).To(Equal("access-denied"))
+		})
+
+		It("does not check instances without credentials", func() {
+			Expect(provision(`{"share": "//127.0.0.1/share"}`)).To(Succeed())
+			Expect(server.Requests()).To(BeEmpty())
+		})
+
+		It("never logs the credentials", func() {
+			provision(`{"share": "//127.0.0.1/share", "username": "alice", "password": "wrong-passw0rd"}`)
+			provision(`{"share": "//127.0.0.1/typo", "username": "alice", "password": "s3cr3t-passw0rd"}`)
+
+			Expect(logs.Contents()).NotTo(BeEmpty())
+			Expect(string(logs.Contents())).NotTo(ContainSubstring("passw0rd"))
+		})
+	})
+
+	Describe("observability", func() {
+		var logs *gbytes.Buffer
+
+		BeforeEach(func() {
+			logger := lager.NewLogger("broker")
+			logs = gbytes.NewBuffer()
+			logger.RegisterSink(lager.NewWriterSink(logs, lager.DEBUG))
+			broker = NewBroker(logger, delegate, store)
+		})
+
+		It("logs the trace ID of the request", func() {
+			var span *Span
+			ctx, span = NewTracer(nil).Start(ctx, "osbapi provision", SpanKindServer)
+
+			Expect(provision(`{"share": "//server/"}`)).NotTo(Succeed())
+			Expect(logs).To(gbytes.Say(`"trace-id":"` + span.TraceID.String() + `"`))
+		})
+
+		It("records the time spent waiting for the broker mutex", func() {
+			broker.Metrics = NewMetrics(store)
+			Expect(provision(`{"share": "//server/share"}`)).To(Succeed())
+			Expect(bind("instance-id", "binding-id")).To(Succeed())
+			_, err := broker.Unbind(ctx, "instance-id", "binding-id", domain.UnbindDetails{}, false)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = broker.Deprovision(ctx, "instance-id", domain.DeprovisionDetails{}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			output := &bytes.Buffer{}
+			broker.Metrics.WriteMetrics(output)
+			Expect(output.String()).To(ContainSubstring("smbbroker_broker_mutex_wait_seconds_count 4\n"))
+		})
+	})
+})
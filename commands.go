@@ -0,0 +1,658 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"code.cloudfoundry.org/debugserver"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagerflags"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// storeFlags are the server flags the commands that work on the store
+// accept as well.
+var storeFlags = []string{"credhubURL", "credhubCACertPath", "uaaClientID", "uaaClientSecret", "uaaCACertPath", "storeID", "brokerType"}
+
+// StoreOpener creates the store a command works on from the store flags.
+type StoreOpener func(logger lager.Logger) (*IndexedStore, error)
+
+// runCommand runs the operator subcommand named by the first argument, if
+// there is one, and exits with its status. It returns the arguments for
+// the server otherwise, which is what `smbbroker serve` and running the
+// binary without a command do.
+func runCommand(args []string) []string {
+	if len(args) == 0 {
+		return args
+	}
+
+	switch args[0] {
+	case "serve":
+		return args[1:]
+	case "policy":
+		os.Exit(PolicyCommand(args[1:], os.Stdout, os.Stderr))
+	case "instances":
+		os.Exit(InstancesCommand(args[1:], newStore, os.Stdout, os.Stderr))
+	case "bindings":
+		os.Exit(BindingsCommand(args[1:], newStore, os.Stdout, os.Stderr))
+	case "catalog":
+		os.Exit(CatalogCommand(args[1:], os.Stdout, os.Stderr))
+	case "config":
+		os.Exit(ConfigCommand(args[1:], os.Stdout, os.Stderr))
+	case "audit":
+		os.Exit(AuditCommand(args[1:], os.Stdout, os.Stderr))
+	case "credentials":
+		os.Exit(CredentialsCommand(args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	return args
+}
+
+// InstancesCommand implements `smbbroker instances list|show|delete`.
+// Records are changed in CredHub directly; a running broker sees deletions
+// when it next refreshes its index, before the next provision or bind or
+// after indexMaxAge at the latest.
+func InstancesCommand(args []string, open StoreOpener, stdout, stderr io.Writer) int {
+	usage := "usage: smbbroker instances list [-org <guid>] [-space <guid>] [-host <host>] [-plan <id>] | show <id> | delete [-force] <id>"
+	if len(args) == 0 || !contains([]string{"list", "show", "delete"}, args[0]) {
+		fmt.Fprintln(stderr, usage)
+		return 2
+	}
+
+	flags, output := storeCommandFlags("instances "+args[0], stderr)
+	org := flags.String("org", "", "Only list instances of this organization GUID")
+	space := flags.String("space", "", "Only list instances of this space GUID")
+	host := flags.String("host", "", "Only list instances of shares on this host")
+	plan := flags.String("plan", "", "Only list instances of this plan ID")
+	force := flags.Bool("force", false, "Delete the instance's bindings as well")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	admin, code := openAdmin(flags, args[0], open, *output, usage, stderr)
+	if admin == nil {
+		return code
+	}
+
+	switch args[0] {
+	case "list":
+		instances, err := admin.Instances(InstanceFilter{OrgGUID: *org, SpaceGUID: *space, Host: *host, PlanID: *plan})
+		if err != nil {
+			return commandError(stderr, err)
+		}
+		return writeOutput(stdout, *output, instances, func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "ID\tORG\tSPACE\tPLAN\tSHARE\tBINDINGS")
+			for _, i := range instances {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", i.ID, i.OrgGUID, i.SpaceGUID, i.PlanID, i.Share, len(i.Bindings))
+			}
+		})
+	case "show":
+		instance, err := admin.Instance(flags.Arg(0))
+		if err != nil {
+			return commandError(stderr, err)
+		}
+		return writeOutput(stdout, *output, instance, func(w *tabwriter.Writer) {
+			fmt.Fprintf(w, "id:\t%s\n", instance.ID)
+			fmt.Fprintf(w, "service:\t%s\n", instance.ServiceID)
+			fmt.Fprintf(w, "plan:\t%s\n", instance.PlanID)
+			fmt.Fprintf(w, "org:\t%s\n", instance.OrgGUID)
+			fmt.Fprintf(w, "space:\t%s\n", instance.SpaceGUID)
+			fmt.Fprintf(w, "share:\t%s\n", instance.Share)
+			writeOptions(w, instance.Options)
+			fmt.Fprintf(w, "bindings:\t%s\n", strings.Join(instance.Bindings, ", "))
+		})
+	default:
+		if err := admin.DeleteInstance(flags.Arg(0), *force); err != nil {
+			return commandError(stderr, err)
+		}
+		fmt.Fprintf(stdout, "deleted instance %q\n", flags.Arg(0))
+		return 0
+	}
+}
+
+// BindingsCommand implements `smbbroker bindings list|show|delete`. Like
+// InstancesCommand it changes CredHub directly.
+func BindingsCommand(args []string, open StoreOpener, stdout, stderr io.Writer) int {
+	usage := "usage: smbbroker bindings list [-instance <id>] [-app <guid>] [-orphaned] [-legacyVolumeIDs] | show <id> | delete <id>"
+	if len(args) == 0 || !contains([]string{"list", "show", "delete"}, args[0]) {
+		fmt.Fprintln(stderr, usage)
+		return 2
+	}
+
+	flags, output := storeCommandFlags("bindings "+args[0], stderr)
+	instance := flags.String("instance", "", "Only list bindings of this service instance ID")
+	app := flags.String("app", "", "Only list bindings of this app GUID")
+	orphaned := flags.Bool("orphaned", false, "Only list bindings whose service instance no longer exists")
+	legacyVolumeIDs := flags.Bool("legacyVolumeIDs", false, "Only list bindings that still have a legacy volume ID")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	admin, code := openAdmin(flags, args[0], open, *output, usage, stderr)
+	if admin == nil {
+		return code
+	}
+
+	switch args[0] {
+	case "list":
+		bindings, err := admin.Bindings(BindingFilter{InstanceID: *instance, AppGUID: *app, Orphaned: *orphaned, LegacyVolumeID: *legacyVolumeIDs})
+		if err != nil {
+			return commandError(stderr, err)
+		}
+		return writeOutput(stdout, *output, bindings, func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "ID\tINSTANCE\tAPP\tCONTAINER DIR\tORPHANED")
+			for _, b := range bindings {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\n", b.ID, b.InstanceID, b.AppGUID, b.ContainerDir, b.Orphaned)
+			}
+		})
+	case "show":
+		binding, err := admin.Binding(flags.Arg(0))
+		if err != nil {
+			return commandError(stderr, err)
+		}
+		return writeOutput(stdout, *output, binding, func(w *tabwriter.Writer) {
+			fmt.Fprintf(w, "id:\t%s\n", binding.ID)
+			fmt.Fprintf(w, "instance:\t%s\n", binding.InstanceID)
+			fmt.Fprintf(w, "app:\t%s\n", binding.AppGUID)
+			fmt.Fprintf(w, "service:\t%s\n", binding.ServiceID)
+			fmt.Fprintf(w, "plan:\t%s\n", binding.PlanID)
+			fmt.Fprintf(w, "container dir:\t%s\n", binding.ContainerDir)
+			fmt.Fprintf(w, "orphaned:\t%t\n", binding.Orphaned)
+			fmt.Fprintf(w, "legacy volume id:\t%t\n", binding.LegacyVolumeID)
+			writeOptions(w, binding.Parameters)
+		})
+	default:
+		if err := admin.DeleteBinding(flags.Arg(0)); err != nil {
+			return commandError(stderr, err)
+		}
+		fmt.Fprintf(stdout, "deleted binding %q\n", flags.Arg(0))
+		return 0
+	}
+}
+
+// CatalogCommand implements `smbbroker catalog validate`, which checks the
+// services config without starting the broker.
+func CatalogCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(stderr, "usage: smbbroker catalog validate -servicesConfig <path> [-output table|json]")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("catalog validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	addServerFlags(flags, "servicesConfig")
+	output := flags.String("output", "table", "Output format, table or json")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if code := checkOutput(*output, stderr); code != 0 {
+		return code
+	}
+
+	if *servicesConfig == "" {
+		fmt.Fprintln(stderr, "ERROR: servicesConfig parameter must be provided.")
+		return 2
+	}
+
+	var problems []string
+	services, settings, err := readCatalog(*servicesConfig)
+	if err != nil {
+		problems = []string{err.Error()}
+	} else {
+		problems = validateCatalog(services, settings)
+	}
+
+	result := validation(problems)
+	writeOutput(stdout, *output, result, func(w *tabwriter.Writer) {
+		for _, problem := range result.Problems {
+			fmt.Fprintln(w, problem)
+		}
+		if result.Valid {
+			fmt.Fprintln(w, "catalog is valid")
+		}
+	})
+	if !result.Valid {
+		return 1
+	}
+	return 0
+}
+
+// AuditCommand implements `smbbroker audit verify`, which checks the hash
+// chain of an audit log with the key of AUDIT_LOG_KEY.
+func AuditCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(stderr, "usage: smbbroker audit verify -auditLog <path>")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	addServerFlags(flags, "auditLog")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if *auditLogPath == "" {
+		fmt.Fprintln(stderr, "ERROR: auditLog parameter must be provided.")
+		return 2
+	}
+	parseEnvironment()
+	if auditLogKey == "" {
+		fmt.Fprintln(stderr, "ERROR: AUDIT_LOG_KEY must be set.")
+		return 2
+	}
+
+	file, err := os.Open(*auditLogPath)
+	if err != nil {
+		return commandError(stderr, err)
+	}
+	defer file.Close()
+
+	count, err := VerifyAuditLog(file, auditLogKey)
+	if err != nil {
+		fmt.Fprintf(stdout, "audit log is broken after %d valid records: %s\n", count, err.Error())
+		return 1
+	}
+	fmt.Fprintf(stdout, "audit log is intact: %d records\n", count)
+	return 0
+}
+
+// CredentialsCommand implements `smbbroker credentials hash`, which reads a
+// password from stdin and prints its bcrypt hash for the credentials file.
+func CredentialsCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "hash" {
+		fmt.Fprintln(stderr, "usage: smbbroker credentials hash [-cost <cost>] < password")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("credentials hash", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	cost := flags.Int("cost", bcrypt.DefaultCost, "bcrypt cost")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	password, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return commandError(stderr, err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return commandError(stderr, fmt.Errorf("no password on stdin"))
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), *cost)
+	if err != nil {
+		return commandError(stderr, err)
+	}
+	fmt.Fprintln(stdout, string(hash))
+	return 0
+}
+
+// ConfigCheck is the outcome of one check of `smbbroker config check`.
+type ConfigCheck struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// ConfigCommand implements `smbbroker config check`. It accepts the flags
+// and environment of the server and loads every configuration file they
+// name, without connecting to CredHub.
+func ConfigCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(stderr, "usage: smbbroker config check [server flags] [-output table|json]")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("config check", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) { flags.Var(f.Value, f.Name, f.Usage) })
+	lagerflags.AddFlags(flags)
+	debugserver.AddFlags(flags)
+	output := flags.String("output", "table", "Output format, table or json")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if code := checkOutput(*output, stderr); code != 0 {
+		return code
+	}
+
+	var checks []ConfigCheck
+	check := func(name string, err error) {
+		c := ConfigCheck{Name: name}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		checks = append(checks, c)
+	}
+	required := func(name, value string) error {
+		if value == "" {
+			return fmt.Errorf("%s must be provided", name)
+		}
+		return nil
+	}
+
+	if err := loadSettings(flags); err != nil || *configFile != "" {
+		check("config file", err)
+	}
+	check("broker type", applyBrokerType(flags))
+	check("credhub url", required("credhubURL", *credhubURL))
+	check("credhub ca cert", checkCACert(*credhubCACertPath))
+	check("uaa ca cert", checkCACert(*uaaCACertPath))
+
+	switch {
+	case countSet(*servicesConfig, *servicesURL, *servicesCredential) > 1:
+		check("services config", fmt.Errorf("only one of servicesConfig, servicesURL and servicesCredential may be provided"))
+	case *servicesURL != "":
+		logger := lager.NewLogger("smbbroker")
+		_, err := NewRemoteCatalogFromURL(logger, &http.Client{Timeout: 30 * time.Second}, *servicesURL, *serviceName)
+		check("services config", err)
+	case *servicesCredential != "":
+		// The credential is only fetched by the server, which connects to
+		// CredHub.
+	default:
+		if err := required("servicesConfig", *servicesConfig); err != nil {
+			check("services config", err)
+		} else {
+			_, err := NewCatalogFromConfig(*servicesConfig, *serviceName)
+			check("services config", err)
+		}
+	}
+
+	_, err := newConfigMask(*allowedOptions)
+	check("allowed options", err)
+
+	var pathErr error
+	for _, path := range splitList(*forbiddenMountPaths) {
+		if err := ValidateContainerPath(path, nil); err != nil && pathErr == nil {
+			pathErr = err
+		}
+	}
+	check("forbidden mount paths", pathErr)
+
+	if *serverPolicyConfig != "" {
+		_, err := NewServerPolicyFromConfig(*serverPolicyConfig)
+		check("server policy", err)
+	}
+	if *quotaConfig != "" {
+		_, err := NewQuotasFromConfig(*quotaConfig)
+		check("quota config", err)
+	}
+	if *mountPolicyConfig != "" {
+		_, err := NewMountPolicyFromConfig(*mountPolicyConfig)
+		check("mount policy", err)
+	}
+
+	if *tracingExporter != "" {
+		var err error
+		if *tracingExporter != "otlp" && *tracingExporter != "file" {
+			err = fmt.Errorf("tracingExporter must be otlp or file, not %q", *tracingExporter)
+		} else if *tracingExporter == "file" && *tracingFile == "" {
+			err = fmt.Errorf("tracingFile must be provided with tracingExporter file")
+		}
+		check("tracing exporter", err)
+	}
+
+	if *uaaTokenKeysURL != "" || *uaaJWKSPath != "" {
+		var err error
+		switch {
+		case *uaaTokenKeysURL != "" && *uaaJWKSPath != "":
+			err = fmt.Errorf("only one of uaaTokenKeysURL and uaaJWKSPath may be provided")
+		case *uaaIssuer == "":
+			err = fmt.Errorf("uaaIssuer must be provided")
+		case *uaaJWKSPath != "":
+			_, err = NewTokenKeysFromFile(*uaaJWKSPath)
+		}
+		check("uaa token auth", err)
+	}
+
+	if *credentialsFile != "" {
+		_, err := LoadBrokerCredentials(*credentialsFile)
+		check("credentials file", err)
+	}
+
+	if volumeIDKey != "" || *keepLegacyVolumeIDs {
+		var err error
+		if volumeIDKey == "" {
+			err = fmt.Errorf("VOLUME_ID_KEY must be set when keepLegacyVolumeIDs is provided")
+		} else {
+			_, err = NewVolumeIDs(volumeIDKey)
+		}
+		check("volume id key", err)
+	}
+
+	if bindingParamsKey != "" {
+		_, err := NewBindingRedaction(bindingParamsKey)
+		check("binding parameters key", err)
+	}
+
+	if *auditLogPath != "" || auditLogKey != "" {
+		err := required("AUDIT_LOG_KEY", auditLogKey)
+		if err == nil && len(auditLogKey) < MinKeyLength {
+			err = fmt.Errorf("audit log key must be at least %d bytes long", MinKeyLength)
+		}
+		check("audit log key", err)
+	}
+
+	if *tlsCertPath != "" || *tlsKeyPath != "" || *tlsClientCAPath != "" {
+		var err error
+		if *tlsCertPath == "" || *tlsKeyPath == "" {
+			err = fmt.Errorf("tlsCertPath and tlsKeyPath must be provided together")
+		} else {
+			_, err = newServerTLS()
+		}
+		check("tls", err)
+	}
+
+	if *webhookConfig != "" {
+		_, err := LoadWebhookConfig(*webhookConfig)
+		if err == nil && *webhookOutbox == "" {
+			err = fmt.Errorf("webhookOutbox must be provided")
+		}
+		check("webhook config", err)
+	}
+
+	if *adminAddress != "" {
+		var err error
+		if adminUsername == "" || adminPassword == "" {
+			err = fmt.Errorf("ADMIN_USERNAME and ADMIN_PASSWORD must be set")
+		}
+		check("admin api credentials", err)
+
+		err = nil
+		if *tlsCertPath == "" && !IsLoopbackAddress(*adminAddress) {
+			err = fmt.Errorf("tlsCertPath must be provided when adminAddress is not a loopback address")
+		}
+		check("admin api tls", err)
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if c.Error != "" {
+			failed++
+		}
+	}
+	writeOutput(stdout, *output, checks, func(w *tabwriter.Writer) {
+		for _, c := range checks {
+			if c.Error == "" {
+				fmt.Fprintf(w, "ok\t%s\n", c.Name)
+			} else {
+				fmt.Fprintf(w, "FAILED\t%s\t%s\n", c.Name, c.Error)
+			}
+		}
+	})
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// PolicyCommand implements `smbbroker policy test`, which shows the mount
+// policy rules that match a request and the options they result in.
+func PolicyCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "test" {
+		fmt.Fprintln(stderr, "usage: smbbroker policy test -mountPolicyConfig <path> [-org <guid>] [-space <guid>] [-plan <id>] [-service <id>] [-params <json>]")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("policy test", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	policyPath := flags.String("mountPolicyConfig", "", "[REQUIRED] - Path to the mount policy file")
+	org := flags.String("org", "", "Organization GUID of the request")
+	space := flags.String("space", "", "Space GUID of the request")
+	plan := flags.String("plan", "", "Plan ID of the request")
+	service := flags.String("service", "", "Service ID of the request")
+	params := flags.String("params", "{}", "Merged instance and bind parameters as JSON")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if *policyPath == "" {
+		fmt.Fprintln(stderr, "ERROR: mountPolicyConfig parameter must be provided.")
+		return 2
+	}
+
+	policy, err := NewMountPolicyFromConfig(*policyPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "ERROR: loading mount policy: %s\n", err.Error())
+		return 2
+	}
+
+	var opts map[string]interface{}
+	if err := json.Unmarshal([]byte(*params), &opts); err != nil {
+		fmt.Fprintf(stderr, "ERROR: params must be a JSON object: %s\n", err.Error())
+		return 2
+	}
+
+	request := MountPolicyRequest{OrgGUID: *org, SpaceGUID: *space, PlanID: *plan, ServiceID: *service}
+	matching := policy.Matching(request)
+	if len(matching) == 0 {
+		fmt.Fprintln(stdout, "no rules match")
+	}
+	for _, rule := range matching {
+		fmt.Fprintf(stdout, "matches rule %q\n", rule.Name)
+	}
+
+	changes, err := policy.Apply(request, opts)
+	if err != nil {
+		fmt.Fprintf(stdout, "denied: %s\n", err.Error())
+		return 1
+	}
+
+	for _, k := range sortedKeys(changes) {
+		fmt.Fprintf(stdout, "sets %s=%v\n", k, changes[k])
+	}
+	fmt.Fprintln(stdout, "allowed")
+	return 0
+}
+
+// storeCommandFlags returns a flag set with the store flags and -output.
+func storeCommandFlags(name string, stderr io.Writer) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	addServerFlags(flags, storeFlags...)
+	return flags, flags.String("output", "table", "Output format, table or json")
+}
+
+// addServerFlags registers the named server flags on flags, so that parsing
+// them sets the same variables the server reads.
+func addServerFlags(flags *flag.FlagSet, names ...string) {
+	for _, name := range names {
+		f := flag.CommandLine.Lookup(name)
+		flags.Var(f.Value, f.Name, f.Usage)
+	}
+}
+
+// openAdmin checks the parsed flags of a store command and opens the
+// store. It returns a nil AdminAPI and the exit code on failure.
+func openAdmin(flags *flag.FlagSet, command string, open StoreOpener, output, usage string, stderr io.Writer) (*AdminAPI, int) {
+	if code := checkOutput(output, stderr); code != 0 {
+		return nil, code
+	}
+	if command != "list" && flags.NArg() != 1 {
+		fmt.Fprintln(stderr, usage)
+		return nil, 2
+	}
+	if *credhubURL == "" {
+		fmt.Fprintln(stderr, "ERROR: credhubURL parameter must be provided.")
+		return nil, 2
+	}
+	if err := applyBrokerType(flags); err != nil {
+		fmt.Fprintf(stderr, "ERROR: %s.\n", err.Error())
+		return nil, 2
+	}
+
+	logger := lager.NewLogger("smbbroker")
+	logger.RegisterSink(lager.NewWriterSink(stderr, lager.ERROR))
+
+	store, err := open(logger)
+	if err != nil {
+		return nil, commandError(stderr, err)
+	}
+	mask, err := newConfigMask(*allowedOptions)
+	if err != nil {
+		return nil, commandError(stderr, err)
+	}
+	return NewAdminAPI(logger, store, NewBroker(logger, nil, store), mask), 0
+}
+
+func checkOutput(output string, stderr io.Writer) int {
+	if output != "table" && output != "json" {
+		fmt.Fprintf(stderr, "ERROR: output must be table or json, not %q.\n", output)
+		return 2
+	}
+	return 0
+}
+
+// writeOutput writes value as JSON, or as a table written by table.
+func writeOutput(stdout io.Writer, output string, value interface{}, table func(w *tabwriter.Writer)) int {
+	if output == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(value); err != nil {
+			return 1
+		}
+		return 0
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	if err := w.Flush(); err != nil {
+		return 1
+	}
+	return 0
+}
+
+func writeOptions(w io.Writer, opts map[string]interface{}) {
+	for _, k := range sortedKeys(opts) {
+		fmt.Fprintf(w, "%s:\t%v\n", k, opts[k])
+	}
+}
+
+func commandError(stderr io.Writer, err error) int {
+	fmt.Fprintf(stderr, "ERROR: %s\n", err.Error())
+	return 1
+}
+
+func checkCACert(path string) error {
+	if path == "" {
+		return nil
+	}
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+		return fmt.Errorf("%s contains no PEM encoded certificates", path)
+	}
+	return nil
+}
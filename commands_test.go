@@ -0,0 +1,270 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Commands", func() {
+	var (
+		credhub        *fakeCredhub
+		open           StoreOpener
+		stdout, stderr *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		credhub = newFakeCredhub()
+		credhub.SetJSON("/smbbroker/instance-1", map[string]interface{}{
+			"service_id": "service", "plan_id": "plan-1", "organization_guid": "org-1", "space_guid": "space-1",
+			"ServiceFingerPrint": map[string]interface{}{"share": "//server-a/share", "username": "alice", "password": "secret"},
+		})
+		credhub.SetJSON("/smbbroker/instance-2", map[string]interface{}{
+			"service_id": "service", "plan_id": "plan-2", "organization_guid": "org-2", "space_guid": "space-2",
+			"ServiceFingerPrint": map[string]interface{}{"share": "//server-b/share"},
+		})
+		credhub.SetJSON("/smbbroker/binding-1", map[string]interface{}{"app_guid": "app-1"})
+		credhub.SetJSON("/smbbroker/binding-2", map[string]interface{}{"app_guid": "app-2"})
+		credhub.SetJSON("/smbbroker/index/binding-1", map[string]interface{}{"instance_id": "instance-1", "container_dir": "/data", "volume_id_scheme": "hmac-sha256"})
+		credhub.SetJSON("/smbbroker/index/binding-2", map[string]interface{}{"instance_id": "instance-gone"})
+
+		open = func(logger lager.Logger) (*IndexedStore, error) {
+			return NewIndexedStore(logger, credhub, "smbbroker"), nil
+		}
+		stdout, stderr = &bytes.Buffer{}, &bytes.Buffer{}
+	})
+
+	storeArgs := func(args ...string) []string {
+		return append(args[:1:1], append([]string{"-credhubURL", "https://credhub.example.com"}, args[1:]...)...)
+	}
+
+	Describe("instances", func() {
+		It("lists instances as a table", func() {
+			Expect(InstancesCommand(storeArgs("list"), open, stdout, stderr)).To(Equal(0))
+			Expect(stdout.String()).To(Equal(
+				"ID          ORG    SPACE    PLAN    SHARE             BINDINGS\n" +
+					"instance-1  org-1  space-1  plan-1  //server-a/share  1\n" +
+					"instance-2  org-2  space-2  plan-2  //server-b/share  0\n"))
+		})
+
+		It("lists filtered instances as JSON", func() {
+			Expect(InstancesCommand(storeArgs("list", "-host", "server-b", "-output", "json"), open, stdout, stderr)).To(Equal(0))
+
+			var instances []AdminInstance
+			Expect(json.Unmarshal(stdout.Bytes(), &instances)).To(Succeed())
+			Expect(instances).To(HaveLen(1))
+			Expect(instances[0].ID).To(Equal("instance-2"))
+		})
+
+		It("shows an instance without its password", func() {
+			Expect(InstancesCommand(storeArgs("show", "instance-1"), open, stdout, stderr)).To(Equal(0))
+			Expect(stdout.String()).To(ContainSubstring("password:  *REDACTED*\n"))
+			Expect(stdout.String()).To(ContainSubstring("bindings:  binding-1\n"))
+			Expect(stdout.String()).NotTo(ContainSubstring("secret"))
+		})
+
+		It("refuses to delete instances with bindings unless forced", func() {
+			Expect(InstancesCommand(storeArgs("delete", "instance-1"), open, stdout, stderr)).To(Equal(1))
+			Expect(stderr.String()).To(ContainSubstring(`instance "instance-1" has 1 bindings`))
+			Expect(credhub.has("/smbbroker/instance-1")).To(BeTrue())
+
+			Expect(InstancesCommand(storeArgs("delete", "-force", "instance-1"), open, stdout, stderr)).To(Equal(0))
+			Expect(stdout.String()).To(Equal("deleted instance \"instance-1\"\n"))
+			Expect(credhub.has("/smbbroker/instance-1")).To(BeFalse())
+			Expect(credhub.has("/smbbroker/binding-1")).To(BeFalse())
+		})
+
+		It("reports unknown instances", func() {
+			Expect(InstancesCommand(storeArgs("show", "missing"), open, stdout, stderr)).To(Equal(1))
+			Expect(stderr.String()).To(Equal("ERROR: instance \"missing\" does not exist\n"))
+		})
+
+		It("checks its arguments", func() {
+			Expect(InstancesCommand([]string{"rename"}, open, stdout, stderr)).To(Equal(2))
+			Expect(InstancesCommand(storeArgs("show"), open, stdout, stderr)).To(Equal(2))
+			Expect(InstancesCommand(storeArgs("list", "-output", "yaml"), open, stdout, stderr)).To(Equal(2))
+			Expect(stderr.String()).To(ContainSubstring(`output must be table or json, not "yaml"`))
+		})
+	})
+
+	Describe("bindings", func() {
+		It("lists orphaned bindings", func() {
+			Expect(BindingsCommand(storeArgs("list", "-orphaned"), open, stdout, stderr)).To(Equal(0))
+			Expect(stdout.String()).To(Equal(
+				"ID         INSTANCE       APP    CONTAINER DIR  ORPHANED\n" +
+					"binding-2  instance-gone  app-2                 true\n"))
+		})
+
+		It("lists bindings with legacy volume IDs", func() {
+			Expect(BindingsCommand(storeArgs("list", "-legacyVolumeIDs", "-output", "json"), open, stdout, stderr)).To(Equal(0))
+
+			var bindings []AdminBinding
+			Expect(json.Unmarshal(stdout.Bytes(), &bindings)).To(Succeed())
+			Expect(bindings).To(HaveLen(1))
+			Expect(bindings[0].ID).To(Equal("binding-2"))
+		})
+
+		It("shows a binding as JSON", func() {
+			Expect(BindingsCommand(storeArgs("show", "-output", "json", "binding-1"), open, stdout, stderr)).To(Equal(0))
+
+			var binding AdminBinding
+			Expect(json.Unmarshal(stdout.Bytes(), &binding)).To(Succeed())
+			Expect(binding.InstanceID).To(Equal("instance-1"))
+			Expect(binding.ContainerDir).To(Equal("/data"))
+		})
+
+		It("deletes a binding", func() {
+			Expect(BindingsCommand(storeArgs("delete", "binding-2"), open, stdout, stderr)).To(Equal(0))
+			Expect(credhub.has("/smbbroker/binding-2")).To(BeFalse())
+			Expect(credhub.has("/smbbroker/index/binding-2")).To(BeFalse())
+		})
+	})
+
+	Describe("catalog validate", func() {
+		It("accepts the default catalog", func() {
+			Expect(CatalogCommand([]string{"validate", "-servicesConfig", "./default_services.json"}, stdout, stderr)).To(Equal(0))
+			Expect(stdout.String()).To(Equal("catalog is valid\n"))
+		})
+
+		It("lists the problems of a catalog", func() {
+			dir, err := ioutil.TempDir("", "catalog")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "services.json")
+			Expect(ioutil.WriteFile(path, []byte(`[
+				{"id": "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad", "name": "smb", "description": "SMB", "bindable": true, "requires": ["volume_mount"], "plans": []},
+				{"id": "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad", "name": "smb 2", "description": "SMB", "bindable": false, "plans": [{"id": "p", "description": "Share"}]}
+			]`), 0600)).To(Succeed())
+
+			Expect(CatalogCommand([]string{"validate", "-servicesConfig", path, "-output", "json"}, stdout, stderr)).To(Equal(1))
+
+			var result AdminValidation
+			Expect(json.Unmarshal(stdout.Bytes(), &result)).To(Succeed())
+			Expect(result.Valid).To(BeFalse())
+			Expect(result.Problems).To(Equal([]string{
+				`service smb has no plans`,
+				`service name "smb 2" may only contain letters, digits, periods and hyphens`,
+				`service id "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad" is used more than once`,
+				`service smb 2 is not bindable`,
+				`service smb 2 does not require volume_mount`,
+				`plan #1 of service smb 2 has no name`,
+				`plan id "p" is not a UUID`,
+			}))
+		})
+	})
+
+	Describe("config check", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+			os.Unsetenv("ALLOWED_OPTIONS")
+			for name, value := range map[string]string{"config": "", "quotaConfig": "", "serviceName": "", "allowedOptions": AllowedOptions(), "shareProbePort": "445", "brokerType": "smb", "servicesConfig": "", "keepLegacyVolumeIDs": "false", "adminAddress": ""} {
+				Expect(flag.CommandLine.Set(name, value)).To(Succeed())
+			}
+		})
+
+		writeConfig := func(name, contents string) string {
+			path := filepath.Join(dir, name)
+			Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+			return path
+		}
+
+		It("checks the configuration of the server", func() {
+			code := ConfigCommand([]string{"check", "-credhubURL", "https://credhub.example.com", "-servicesConfig", "./default_services.json", "-quotaConfig", "/does/not/exist"}, stdout, stderr)
+
+			Expect(code).To(Equal(1))
+			Expect(stdout.String()).To(ContainSubstring("ok      services config\n"))
+			Expect(stdout.String()).To(ContainSubstring("FAILED  quota config"))
+		})
+
+		It("reads the settings of the config file", func() {
+			path := writeConfig("config.yml", "store:\n  credhubURL: https://credhub.example.com\ncatalog:\n  servicesConfig: ./default_services.json\n  quotaConfig: /does/not/exist\n")
+			ConfigCommand([]string{"check", "-config", path}, stdout, stderr)
+
+			Expect(stdout.String()).To(MatchRegexp(`ok +config file\n`))
+			Expect(stdout.String()).To(MatchRegexp(`ok +services config\n`))
+			Expect(stdout.String()).To(MatchRegexp(`FAILED +quota config`))
+		})
+
+		It("lets flags and environment variables override the config file", func() {
+			path := writeConfig("config.yml", "servicesConfig: ./default_services.json\nallowedOptions: [ro]\nshareProbePort: many\n")
+
+			Expect(os.Setenv("ALLOWED_OPTIONS", "source,ro")).To(Succeed())
+			ConfigCommand([]string{"check", "-config", path, "-shareProbePort", "445"}, stdout, stderr)
+			Expect(stdout.String()).To(MatchRegexp(`ok +config file\n`))
+			Expect(stdout.String()).To(MatchRegexp(`ok +allowed options\n`))
+
+			stdout.Reset()
+			Expect(os.Unsetenv("ALLOWED_OPTIONS")).To(Succeed())
+			Expect(flag.CommandLine.Set("allowedOptions", AllowedOptions())).To(Succeed())
+			ConfigCommand([]string{"check", "-config", path, "-shareProbePort", "445", "-allowedOptions", "ro"}, stdout, stderr)
+			Expect(stdout.String()).To(MatchRegexp(`FAILED +allowed options +allowed options "ro" must include source`))
+		})
+
+		It("checks the NFS flavour with its default catalog and options", func() {
+			Expect(ConfigCommand([]string{"check", "-credhubURL", "https://credhub.example.com", "-brokerType", "nfs"}, stdout, stderr)).To(Equal(0))
+			Expect(stdout.String()).To(MatchRegexp(`ok +broker type\n`))
+			Expect(stdout.String()).To(MatchRegexp(`ok +services config\n`))
+			Expect(stdout.String()).To(MatchRegexp(`ok +allowed options\n`))
+
+			stdout.Reset()
+			Expect(ConfigCommand([]string{"check", "-credhubURL", "https://credhub.example.com", "-brokerType", "cifs", "-servicesConfig", "./default_services.json"}, stdout, stderr)).To(Equal(1))
+			Expect(stdout.String()).To(MatchRegexp(`FAILED +broker type +brokerType must be smb or nfs, not "cifs"`))
+		})
+
+		It("checks the volume ID key", func() {
+			path := writeConfig("config.yml", "servicesConfig: ./default_services.json\nvolumeIDKey: secret\n")
+			Expect(ConfigCommand([]string{"check", "-credhubURL", "https://credhub.example.com", "-config", path}, stdout, stderr)).To(Equal(1))
+			Expect(stdout.String()).To(MatchRegexp(`FAILED +volume id key +volume ID key must be at least 32 bytes long`))
+
+			stdout.Reset()
+			Expect(flag.CommandLine.Set("config", "")).To(Succeed())
+			Expect(ConfigCommand([]string{"check", "-credhubURL", "https://credhub.example.com", "-servicesConfig", "./default_services.json", "-keepLegacyVolumeIDs"}, stdout, stderr)).To(Equal(1))
+			Expect(stdout.String()).To(MatchRegexp(`FAILED +volume id key +VOLUME_ID_KEY must be set when keepLegacyVolumeIDs is provided`))
+		})
+
+		It("checks the audit log key", func() {
+			path := writeConfig("config.yml", "servicesConfig: ./default_services.json\nauditLogKey: secret\n")
+			Expect(ConfigCommand([]string{"check", "-credhubURL", "https://credhub.example.com", "-config", path}, stdout, stderr)).To(Equal(1))
+			Expect(stdout.String()).To(MatchRegexp(`FAILED +audit log key +audit log key must be at least 32 bytes long`))
+		})
+
+		It("checks the binding parameters key", func() {
+			path := writeConfig("config.yml", "servicesConfig: ./default_services.json\nbindingParamsKey: secret\n")
+			Expect(ConfigCommand([]string{"check", "-credhubURL", "https://credhub.example.com", "-config", path}, stdout, stderr)).To(Equal(1))
+			Expect(stdout.String()).To(MatchRegexp(`FAILED +binding parameters key +binding parameters key must be at least 32 bytes long`))
+		})
+
+		It("requires TLS for an admin API that is not on a loopback address", func() {
+			ConfigCommand([]string{"check", "-credhubURL", "https://credhub.example.com", "-servicesConfig", "./default_services.json", "-adminAddress", "0.0.0.0:8998"}, stdout, stderr)
+			Expect(stdout.String()).To(MatchRegexp(`FAILED +admin api tls +tlsCertPath must be provided when adminAddress is not a loopback address`))
+
+			stdout.Reset()
+			ConfigCommand([]string{"check", "-credhubURL", "https://credhub.example.com", "-servicesConfig", "./default_services.json", "-adminAddress", "127.0.0.1:8998"}, stdout, stderr)
+			Expect(stdout.String()).To(MatchRegexp(`ok +admin api tls\n`))
+		})
+
+		It("rejects unknown settings", func() {
+			path := writeConfig("config.json", `{"listenAddress": "0.0.0.0:8999"}`)
+			Expect(ConfigCommand([]string{"check", "-config", path}, stdout, stderr)).To(Equal(1))
+			Expect(stdout.String()).To(MatchRegexp(`FAILED +config file`))
+			Expect(stdout.String()).To(ContainSubstring(`config file: unknown setting "listenAddress"`))
+		})
+	})
+})
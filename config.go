@@ -1,5 +1,103 @@
 package main
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
 func AllowedOptions() string {
-	return "source,mount,ro,username,password,domain,version,mfsymlinks"
+	return SMBFlavor.AllowedOptions
+}
+
+// ConfigFile holds the settings of a YAML or JSON config file by the name
+// of the flag they stand for, e.g. listenAddr or credhubURL, with lists
+// joined by commas. The credentials of the environment are given as
+// username, password, adminUsername and adminPassword. Settings may be
+// grouped into sections such as store, auth or catalog; section names only
+// serve readability.
+type ConfigFile map[string]string
+
+func LoadConfigFile(path string) (ConfigFile, error) {
+	/* #nosec */
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(contents))
+		decoder.UseNumber()
+		err = decoder.Decode(&settings)
+	} else {
+		err = yaml.Unmarshal(contents, &settings)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config := ConfigFile{}
+	for name, value := range settings {
+		if err := config.add(name, value); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// Names returns the names of the settings in order.
+func (c ConfigFile) Names() []string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c ConfigFile) add(name string, value interface{}) error {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for k, v := range typed {
+			if err := c.add(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[interface{}]interface{}:
+		for k, v := range typed {
+			if err := c.add(fmt.Sprint(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if _, ok := c[name]; ok {
+		return fmt.Errorf("setting %q is given more than once", name)
+	}
+	switch typed := value.(type) {
+	case nil:
+		c[name] = ""
+	case []interface{}:
+		var items []string
+		for _, item := range typed {
+			switch item.(type) {
+			case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+				return fmt.Errorf("setting %q must be a list of values", name)
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		c[name] = strings.Join(items, ",")
+	default:
+		c[name] = fmt.Sprint(typed)
+	}
+	return nil
 }
@@ -1,6 +1,10 @@
 package main_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
 	. "code.cloudfoundry.org/smbbroker"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -12,4 +16,70 @@ var _ = Describe("Config", func() {
 		Expect(AllowedOptions()).To(Equal("source,mount,ro,username,password,domain,version,mfsymlinks"))
 	})
 
+	Describe("LoadConfigFile", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		load := func(name, contents string) (ConfigFile, error) {
+			path := filepath.Join(dir, name)
+			Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+			return LoadConfigFile(path)
+		}
+
+		It("flattens the sections of a YAML file", func() {
+			config, err := load("config.yml", `
+listenAddr: 0.0.0.0:8999
+store:
+  credhubURL: https://credhub.example.com
+  storeID: smbbroker
+auth:
+  username: broker
+catalog:
+  servicesConfig: services.json
+  allowedOptions: [source, ro, version]
+shareProbe: true
+shareProbePort: 445
+`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config).To(Equal(ConfigFile{
+				"listenAddr":     "0.0.0.0:8999",
+				"credhubURL":     "https://credhub.example.com",
+				"storeID":        "smbbroker",
+				"username":       "broker",
+				"servicesConfig": "services.json",
+				"allowedOptions": "source,ro,version",
+				"shareProbe":     "true",
+				"shareProbePort": "445",
+			}))
+		})
+
+		It("reads JSON files", func() {
+			config, err := load("config.json", "{\n\t\"store\": {\"credhubURL\": \"https://credhub.example.com\"},\n\t\"healthCheckInterval\": \"1m\",\n\t\"shareProbePort\": 1445\n}")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config).To(Equal(ConfigFile{
+				"credhubURL":          "https://credhub.example.com",
+				"healthCheckInterval": "1m",
+				"shareProbePort":      "1445",
+			}))
+		})
+
+		It("rejects settings that are given twice", func() {
+			_, err := load("config.yml", "storeID: a\nstore:\n  storeID: b\n")
+			Expect(err).To(MatchError(`setting "storeID" is given more than once`))
+		})
+
+		It("rejects nested lists", func() {
+			_, err := load("config.yml", "allowedOptions:\n- [source]\n")
+			Expect(err).To(MatchError(`setting "allowedOptions" must be a list of values`))
+		})
+	})
 })
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"code.cloudfoundry.org/existingvolumebroker"
+)
+
+const MountKey = "mount"
+
+// DefaultForbiddenMountPaths are container directories that must not be
+// mounted over, either directly or by mounting one of their parents.
+var DefaultForbiddenMountPaths = []string{
+	"/bin",
+	"/boot",
+	"/dev",
+	"/etc",
+	"/home/vcap/app",
+	"/home/vcap/deps",
+	"/lib",
+	"/lib64",
+	"/proc",
+	"/root",
+	"/sbin",
+	"/sys",
+	"/usr",
+	"/var/vcap/packages",
+}
+
+// ValidateContainerPath checks that a user supplied mount path is absolute,
+// normalized and does not cover any of the forbidden paths.
+func ValidateContainerPath(containerPath string, forbidden []string) error {
+	if containerPath == "" {
+		return fmt.Errorf("mount path must not be empty")
+	}
+	if !utf8.ValidString(containerPath) {
+		return fmt.Errorf("mount path %q is not valid UTF-8", containerPath)
+	}
+	for _, c := range containerPath {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("mount path %q contains invalid character %q", containerPath, c)
+		}
+	}
+	if !path.IsAbs(containerPath) {
+		return fmt.Errorf("mount path %q must be absolute", containerPath)
+	}
+	if cleaned := path.Clean(containerPath); cleaned != containerPath {
+		return fmt.Errorf("mount path %q is not normalized, use %q", containerPath, cleaned)
+	}
+	if containerPath == "/" {
+		return fmt.Errorf("mount path %q is not allowed", containerPath)
+	}
+
+	for _, f := range forbidden {
+		f = path.Clean(f)
+		if isPathWithin(containerPath, f) {
+			return fmt.Errorf("mount path %q is not allowed: %q is reserved", containerPath, f)
+		}
+		if isPathWithin(f, containerPath) {
+			return fmt.Errorf("mount path %q is not allowed: it would hide reserved path %q", containerPath, f)
+		}
+	}
+	return nil
+}
+
+// ContainerPath returns the directory a binding is mounted at, mirroring
+// the volume broker's choice.
+func ContainerPath(opts map[string]interface{}, instanceID string) string {
+	if mount, ok := opts[MountKey].(string); ok && mount != "" {
+		return mount
+	}
+	return path.Join(existingvolumebroker.DEFAULT_CONTAINER_PATH, instanceID)
+}
+
+// mountParameter validates the mount option if it is present in opts.
+func mountParameter(opts map[string]interface{}, forbidden []string) error {
+	value, ok := opts[MountKey]
+	if !ok {
+		return nil
+	}
+
+	mount, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("mount path must be a string")
+	}
+	return ValidateContainerPath(mount, forbidden)
+}
+
+func isPathWithin(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
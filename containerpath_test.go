@@ -0,0 +1,45 @@
+package main_test
+
+import (
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ContainerPath", func() {
+	table.DescribeTable("accepted mount paths",
+		func(mount string) {
+			Expect(ValidateContainerPath(mount, DefaultForbiddenMountPaths)).To(Succeed())
+		},
+		table.Entry("data directory", "/var/vcap/data/share"),
+		table.Entry("home data directory", "/home/vcap/data"),
+		table.Entry("sibling with reserved prefix", "/etcetera"),
+		table.Entry("spaces and UTF-8", "/mnt/my shäre"),
+	)
+
+	table.DescribeTable("rejected mount paths",
+		func(mount, message string) {
+			Expect(ValidateContainerPath(mount, DefaultForbiddenMountPaths)).To(MatchError(message))
+		},
+		table.Entry("root", "/", `mount path "/" is not allowed`),
+		table.Entry("relative", "data", `mount path "data" must be absolute`),
+		table.Entry("trailing slash", "/data/", `mount path "/data/" is not normalized, use "/data"`),
+		table.Entry("parent reference", "/data/../etc", `mount path "/data/../etc" is not normalized, use "/etc"`),
+		table.Entry("reserved", "/etc", `mount path "/etc" is not allowed: "/etc" is reserved`),
+		table.Entry("below reserved", "/proc/self", `mount path "/proc/self" is not allowed: "/proc" is reserved`),
+		table.Entry("app directory", "/home/vcap/app", `mount path "/home/vcap/app" is not allowed: "/home/vcap/app" is reserved`),
+		table.Entry("above reserved", "/home/vcap", `mount path "/home/vcap" is not allowed: it would hide reserved path "/home/vcap/app"`),
+		table.Entry("empty", "", "mount path must not be empty"),
+	)
+
+	It("uses the operator's list", func() {
+		Expect(ValidateContainerPath("/etc", []string{"/srv"})).To(Succeed())
+		Expect(ValidateContainerPath("/srv/data", []string{"/srv"})).To(HaveOccurred())
+	})
+
+	It("defaults to a per instance directory", func() {
+		Expect(ContainerPath(map[string]interface{}{}, "instance-id")).To(Equal("/var/vcap/data/instance-id"))
+		Expect(ContainerPath(map[string]interface{}{"mount": "/data"}, "instance-id")).To(Equal("/data"))
+	})
+})
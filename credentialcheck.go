@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/smbbroker/smbclient"
+)
+
+const (
+	UsernameKey = "username"
+	PasswordKey = "password"
+	DomainKey   = "domain"
+)
+
+// CredentialError is returned when the share host rejects the credentials
+// of an instance or the share they are for. It never carries the
+// credentials themselves.
+type CredentialError struct {
+	Host   string
+	Share  string
+	Status uint32
+}
+
+func (e *CredentialError) Error() string {
+	switch e.Status {
+	case smbclient.StatusBadNetworkName:
+		return fmt.Sprintf("share %q does not exist on host %q", e.Share, e.Host)
+	case smbclient.StatusAccessDenied:
+		return fmt.Sprintf("access to share %q on host %q is denied for the given user", e.Share, e.Host)
+	}
+	return fmt.Sprintf("logon to share host %q failed: check username, password and domain", e.Host)
+}
+
+// key returns the error key of the failure response.
+func (e *CredentialError) key() string {
+	switch e.Status {
+	case smbclient.StatusBadNetworkName:
+		return "bad-share-name"
+	case smbclient.StatusAccessDenied:
+		return "access-denied"
+	}
+	return "logon-failure"
+}
+
+// CredentialCheck logs on to the share host with the credentials of an
+// instance and connects to the share, so that wrong credentials are
+// reported when the instance is created rather than when an app mounts it.
+type CredentialCheck struct {
+	Port      int
+	Timeout   time.Duration
+	SkipPlans []string
+
+	Client *smbclient.Client
+}
+
+func NewCredentialCheck(port int, timeout time.Duration) *CredentialCheck {
+	return &CredentialCheck{
+		Port:    port,
+		Timeout: timeout,
+		Client:  smbclient.New(),
+	}
+}
+
+// Check verifies the username, password and domain in configuration against
+// share. Instances without a username are not checked. SMB 1.0 shares
+// cannot be checked and yield smbclient.ErrSMB1.
+func (c *CredentialCheck) Check(ctx context.Context, share Share, planID string, configuration map[string]interface{}) error {
+	if c == nil || contains(c.SkipPlans, planID) {
+		return nil
+	}
+
+	username, _ := configuration[UsernameKey].(string)
+	if username == "" {
+		return nil
+	}
+	password, _ := configuration[PasswordKey].(string)
+	domain, _ := configuration[DomainKey].(string)
+
+	versions := smbclient.Versions
+	if version, ok := configuration[VersionKey].(string); ok && contains(smbclient.Versions, version) {
+		versions = []string{version}
+	}
+	if len(versions) == 1 && versions[0] == "1.0" {
+		return smbclient.ErrSMB1
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	address := net.JoinHostPort(share.Host, strconv.Itoa(c.Port))
+	credentials := smbclient.Credentials{Username: username, Password: password, Domain: domain}
+	err := c.Client.CheckShare(ctx, address, share.Host, share.Name, versions, credentials)
+	if err == nil {
+		return nil
+	}
+
+	var statusErr *smbclient.StatusError
+	var dialectErr *smbclient.DialectError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &statusErr) && (statusErr.Status == smbclient.StatusLogonFailure ||
+		statusErr.Status == smbclient.StatusBadNetworkName || statusErr.Status == smbclient.StatusAccessDenied):
+		return &CredentialError{Host: share.Host, Share: share.Name, Status: statusErr.Status}
+	case err == smbclient.ErrGuestSession:
+		return &CredentialError{Host: share.Host, Share: share.Name, Status: smbclient.StatusLogonFailure}
+	case err == smbclient.ErrSMB1:
+		return err
+	case errors.As(err, &dialectErr):
+		return &VersionError{Host: share.Host, Versions: dialectErr.Offered}
+	case errors.As(err, &dnsErr):
+		return &ShareProbeError{Host: share.Host, Unresolved: true, Reason: lookupReason(dnsErr)}
+	}
+	return &ShareProbeError{Host: share.Host, Address: address, Reason: dialReason(ctx, err)}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	DefaultOTLPEndpoint      = "http://localhost:4318/v1/traces"
+	DefaultOTLPFlushInterval = 5 * time.Second
+	DefaultOTLPBatchSize     = 512
+	DefaultOTLPQueueSize     = 4096
+
+	tracingServiceName = "smbbroker"
+)
+
+// FileExporter writes every span as a line of JSON, to a file of its own so
+// that the spans do not end up between the log lines on stdout.
+type FileExporter struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+func NewFileExporter(out io.Writer) *FileExporter {
+	return &FileExporter{out: out}
+}
+
+// spanRecord is how the file exporter writes a span.
+type spanRecord struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_span_id,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       int                    `json:"kind"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+func (e *FileExporter) ExportSpan(span *Span) {
+	record := spanRecord{
+		TraceID:    span.TraceID.String(),
+		SpanID:     span.SpanID.String(),
+		Name:       span.Name,
+		Kind:       span.Kind,
+		Start:      span.Start,
+		End:        span.End,
+		Attributes: span.Attributes,
+		Error:      span.Error,
+	}
+	if span.ParentID != (SpanID{}) {
+		record.ParentID = span.ParentID.String()
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_ = json.NewEncoder(e.out).Encode(record)
+}
+
+// OTLPExporter sends spans in batches to an OpenTelemetry collector using
+// OTLP over HTTP with JSON encoding. It runs as an ifrit process that flushes
+// the queued spans periodically and once more when it is stopped.
+type OTLPExporter struct {
+	Endpoint      string
+	Client        *http.Client
+	FlushInterval time.Duration
+	BatchSize     int
+	QueueSize     int
+
+	logger lager.Logger
+
+	mutex   sync.Mutex
+	queue   []*Span
+	dropped int
+}
+
+func NewOTLPExporter(logger lager.Logger, endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		Endpoint:      endpoint,
+		Client:        &http.Client{Timeout: 10 * time.Second},
+		FlushInterval: DefaultOTLPFlushInterval,
+		BatchSize:     DefaultOTLPBatchSize,
+		QueueSize:     DefaultOTLPQueueSize,
+		logger:        logger.Session("otlp-exporter"),
+	}
+}
+
+// ExportSpan queues span. Spans are dropped while the queue is full.
+func (e *OTLPExporter) ExportSpan(span *Span) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if len(e.queue) >= e.QueueSize {
+		e.dropped++
+		return
+	}
+	e.queue = append(e.queue, span)
+}
+
+func (e *OTLPExporter) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	ticker := time.NewTicker(e.FlushInterval)
+	defer ticker.Stop()
+
+	close(ready)
+	for {
+		select {
+		case <-signals:
+			e.Flush()
+			return nil
+		case <-ticker.C:
+			e.Flush()
+		}
+	}
+}
+
+// Flush sends all queued spans.
+func (e *OTLPExporter) Flush() {
+	e.mutex.Lock()
+	queue, dropped := e.queue, e.dropped
+	e.queue, e.dropped = nil, 0
+	e.mutex.Unlock()
+
+	if dropped > 0 {
+		e.logger.Info("spans-dropped", lager.Data{"count": dropped})
+	}
+
+	for len(queue) > 0 {
+		n := len(queue)
+		if e.BatchSize > 0 && n > e.BatchSize {
+			n = e.BatchSize
+		}
+		if err := e.send(queue[:n]); err != nil {
+			e.logger.Error("failed-to-export-spans", err, lager.Data{"count": n})
+		}
+		queue = queue[n:]
+	}
+}
+
+func (e *OTLPExporter) send(spans []*Span) error {
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	response, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("collector responded with %s", response.Status)
+	}
+	return nil
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpRequest builds an ExportTraceServiceRequest in the OTLP JSON mapping.
+func otlpRequest(spans []*Span) map[string]interface{} {
+	converted := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			TraceState:        span.TraceState,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if span.ParentID != (SpanID{}) {
+			s.ParentSpanID = span.ParentID.String()
+		}
+		if span.Error != "" {
+			s.Status = &otlpStatus{Code: 2, Message: span.Error}
+		}
+		converted = append(converted, s)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": tracingServiceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": tracingServiceName},
+						"spans": converted,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	converted := make([]otlpAttribute, 0, len(attributes))
+	for _, k := range sortedKeys(attributes) {
+		var value map[string]interface{}
+		switch typed := attributes[k].(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(typed)}
+		case bool:
+			value = map[string]interface{}{"boolValue": typed}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprintf("%v", typed)}
+		}
+		converted = append(converted, otlpAttribute{Key: k, Value: value})
+	}
+	return converted
+}
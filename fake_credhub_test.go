@@ -0,0 +1,126 @@
+package main_test
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/credhub-cli/credhub/credentials"
+	"code.cloudfoundry.org/credhub-cli/credhub/credentials/values"
+)
+
+// fakeCredhub is an in-memory credhub_shims.Credhub used to drive the
+// broker store in unit tests.
+type fakeCredhub struct {
+	mutex   sync.Mutex
+	records map[string]values.JSON
+	values  map[string]values.Value
+	finds   int
+	reads   int
+
+	// versions are the creation times CredHub reports for the current
+	// version of each credential; a counter stands in for the time.
+	versions map[string]int
+	version  int
+}
+
+func newFakeCredhub() *fakeCredhub {
+	return &fakeCredhub{
+		records:  map[string]values.JSON{},
+		values:   map[string]values.Value{},
+		versions: map[string]int{},
+	}
+}
+
+func (c *fakeCredhub) SetJSON(name string, value values.JSON) (credentials.JSON, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.records[name] = value
+	c.version++
+	c.versions[name] = c.version
+	return credentials.JSON{Value: value}, nil
+}
+
+func (c *fakeCredhub) GetLatestJSON(name string) (credentials.JSON, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.reads++
+	value, ok := c.records[name]
+	if !ok {
+		return credentials.JSON{}, errors.New("The request could not be completed because the credential does not exist or you do not have sufficient authorization.")
+	}
+	return credentials.JSON{Value: value}, nil
+}
+
+func (c *fakeCredhub) SetValue(name string, value values.Value) (credentials.Value, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[name] = value
+	c.version++
+	c.versions[name] = c.version
+	return credentials.Value{Value: value}, nil
+}
+
+func (c *fakeCredhub) GetLatestValue(name string) (credentials.Value, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	value, ok := c.values[name]
+	if !ok {
+		return credentials.Value{}, errors.New("credential does not exist")
+	}
+	return credentials.Value{Value: value}, nil
+}
+
+func (c *fakeCredhub) FindByPath(path string) (credentials.FindResults, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.finds++
+
+	var names []string
+	for name := range c.records {
+		if strings.HasPrefix(name, path) {
+			names = append(names, name)
+		}
+	}
+	for name := range c.values {
+		if strings.HasPrefix(name, path) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var results credentials.FindResults
+	for _, name := range names {
+		results.Credentials = append(results.Credentials, credentials.Base{Name: name, VersionCreatedAt: strconv.Itoa(c.versions[name])})
+	}
+	return results, nil
+}
+
+func (c *fakeCredhub) Delete(name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.records[name]; !ok {
+		if _, ok := c.values[name]; !ok {
+			return errors.New("credential does not exist")
+		}
+	}
+	delete(c.records, name)
+	delete(c.values, name)
+	delete(c.versions, name)
+	return nil
+}
+
+func (c *fakeCredhub) has(name string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.records[name]
+	return ok
+}
+
+func (c *fakeCredhub) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.records)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"code.cloudfoundry.org/existingvolumebroker"
+	vmo "code.cloudfoundry.org/volume-mount-options"
+)
+
+// DefaultNFSProbePort is the port NFS servers listen on.
+const DefaultNFSProbePort = 2049
+
+// Flavor is what differs between the SMB and the NFS broker: the type of
+// the volume broker, the mount options bindings may set and how their
+// values are checked, how shares are written, the port the share probe
+// connects to and the catalog the broker ships. The store, auth and
+// observability are the same for both.
+type Flavor struct {
+	Name           string
+	BrokerType     existingvolumebroker.BrokerType
+	AllowedOptions string
+	Validators     []vmo.UserOptsValidation
+	ParseShare     func(raw string) (Share, error)
+	ProbePort      int
+	ServicesConfig string
+}
+
+var SMBFlavor = &Flavor{
+	Name:           "smb",
+	BrokerType:     existingvolumebroker.BrokerTypeSMB,
+	AllowedOptions: "source,mount,ro,username,password,domain,version,mfsymlinks",
+	Validators: []vmo.UserOptsValidation{
+		vmo.UserOptsValidationFunc(validateVersion),
+		vmo.UserOptsValidationFunc(validateMfsymlinks),
+	},
+	ParseShare:     ParseShare,
+	ProbePort:      DefaultShareProbePort,
+	ServicesConfig: "default_services.json",
+}
+
+var NFSFlavor = &Flavor{
+	Name:           "nfs",
+	BrokerType:     existingvolumebroker.BrokerTypeNFS,
+	AllowedOptions: "source,mount,ro,uid,gid,auto_cache,version",
+	Validators: []vmo.UserOptsValidation{
+		vmo.UserOptsValidationFunc(validateNFSID),
+		vmo.UserOptsValidationFunc(validateAutoCache),
+		vmo.UserOptsValidationFunc(validateNFSVersion),
+	},
+	ParseShare:     ParseNFSShare,
+	ProbePort:      DefaultNFSProbePort,
+	ServicesConfig: "default_nfs_services.json",
+}
+
+func FlavorByName(name string) (*Flavor, error) {
+	switch name {
+	case SMBFlavor.Name:
+		return SMBFlavor, nil
+	case NFSFlavor.Name:
+		return NFSFlavor, nil
+	}
+	return nil, fmt.Errorf("brokerType must be smb or nfs, not %q", name)
+}
+
+// Mask returns the mount option mask of allowed, a comma separated list of
+// options.
+func (f *Flavor) Mask(allowed string) (vmo.MountOptsMask, error) {
+	if !contains(splitList(allowed), existingvolumebroker.SOURCE_KEY) {
+		return vmo.MountOptsMask{}, fmt.Errorf("allowed options %q must include source", allowed)
+	}
+
+	return vmo.NewMountOptsMask(
+		splitList(allowed),
+		map[string]interface{}{},
+		map[string]string{
+			"readonly": "ro",
+			"share":    "source",
+		},
+		[]string{},
+		[]string{existingvolumebroker.SOURCE_KEY},
+		f.Validators...,
+	)
+}
+
+func validateNFSID(key string, val string) error {
+	if key != "uid" && key != "gid" {
+		return nil
+	}
+
+	if _, err := strconv.ParseUint(val, 10, 32); err != nil {
+		return fmt.Errorf("%s is not a valid value for %s", val, key)
+	}
+	return nil
+}
+
+func validateAutoCache(key string, val string) error {
+	if key != "auto_cache" {
+		return nil
+	}
+
+	if _, err := strconv.ParseBool(val); err != nil {
+		return fmt.Errorf("%s is not a valid value for auto_cache", val)
+	}
+	return nil
+}
+
+func validateNFSVersion(key string, val string) error {
+	if key != "version" {
+		return nil
+	}
+
+	for _, validVersion := range []string{"3", "4.0", "4.1", "4.2"} {
+		if val == validVersion {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a valid version", val)
+}
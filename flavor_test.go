@@ -0,0 +1,49 @@
+package main_test
+
+import (
+	vmo "code.cloudfoundry.org/volume-mount-options"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Flavor", func() {
+	It("looks up the flavours by name", func() {
+		Expect(FlavorByName("smb")).To(Equal(SMBFlavor))
+		Expect(FlavorByName("nfs")).To(Equal(NFSFlavor))
+
+		_, err := FlavorByName("cifs")
+		Expect(err).To(MatchError(`brokerType must be smb or nfs, not "cifs"`))
+	})
+
+	mountOpts := func(flavor *Flavor, opts map[string]interface{}) error {
+		mask, err := flavor.Mask(flavor.AllowedOptions)
+		Expect(err).NotTo(HaveOccurred())
+		opts["source"] = "server/export"
+		_, err = vmo.NewMountOpts(opts, mask)
+		return err
+	}
+
+	It("checks the options of NFS bindings", func() {
+		Expect(mountOpts(NFSFlavor, map[string]interface{}{"uid": "1000", "gid": "1000", "auto_cache": "true", "version": "4.1"})).To(Succeed())
+
+		Expect(mountOpts(NFSFlavor, map[string]interface{}{"uid": "-1"})).To(MatchError(ContainSubstring("-1 is not a valid value for uid")))
+		Expect(mountOpts(NFSFlavor, map[string]interface{}{"gid": "staff"})).To(MatchError(ContainSubstring("staff is not a valid value for gid")))
+		Expect(mountOpts(NFSFlavor, map[string]interface{}{"auto_cache": "sometimes"})).To(MatchError(ContainSubstring("sometimes is not a valid value for auto_cache")))
+		Expect(mountOpts(NFSFlavor, map[string]interface{}{"version": "3.0"})).To(MatchError(ContainSubstring("3.0 is not a valid version")))
+		Expect(mountOpts(NFSFlavor, map[string]interface{}{"username": "alice"})).To(HaveOccurred())
+	})
+
+	It("checks the options of SMB bindings", func() {
+		Expect(mountOpts(SMBFlavor, map[string]interface{}{"username": "alice", "version": "3.0", "mfsymlinks": "true"})).To(Succeed())
+
+		Expect(mountOpts(SMBFlavor, map[string]interface{}{"version": "4.1"})).To(MatchError(ContainSubstring("4.1 is not a valid version")))
+		Expect(mountOpts(SMBFlavor, map[string]interface{}{"uid": "1000"})).To(HaveOccurred())
+	})
+
+	It("requires source", func() {
+		_, err := NFSFlavor.Mask("uid,gid")
+		Expect(err).To(MatchError(`allowed options "uid,gid" must include source`))
+	})
+})
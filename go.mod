@@ -2,18 +2,24 @@ module code.cloudfoundry.org/smbbroker
 
 require (
 	code.cloudfoundry.org/clock v1.0.0
+	code.cloudfoundry.org/credhub-cli v0.0.0-20200227190202-0fffecb4557e
 	code.cloudfoundry.org/debugserver v0.0.0-20200131002057-141d5fa0e064
 	code.cloudfoundry.org/existingvolumebroker v0.55.0
 	code.cloudfoundry.org/goshims v0.5.0
 	code.cloudfoundry.org/lager v2.0.0+incompatible
 	code.cloudfoundry.org/service-broker-store v0.23.0
 	code.cloudfoundry.org/volume-mount-options v1.1.0
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/google/gofuzz v1.2.0
+	github.com/google/uuid v1.1.1
+	github.com/gorilla/mux v1.7.4
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d // indirect
 	github.com/onsi/ginkgo v1.16.4
 	github.com/onsi/gomega v1.14.0
 	github.com/pivotal-cf/brokerapi v6.4.2+incompatible
 	github.com/tedsuo/ifrit v0.0.0-20191009134036-9a97d0632f00
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 go 1.13
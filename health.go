@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"code.cloudfoundry.org/smbbroker/smbclient"
+)
+
+const (
+	DefaultHealthCheckInterval    = 5 * time.Minute
+	DefaultHealthCheckConcurrency = 4
+
+	HealthStatusHealthy = "healthy"
+)
+
+// InstanceHealth is the outcome of the latest health check of a service
+// instance's share, together with the bindings that depend on it.
+type InstanceHealth struct {
+	InstanceID    string     `json:"instance_id"`
+	OrgGUID       string     `json:"organization_guid"`
+	SpaceGUID     string     `json:"space_guid"`
+	Host          string     `json:"host"`
+	Share         string     `json:"share"`
+	Status        string     `json:"status"`
+	Error         string     `json:"error,omitempty"`
+	CheckedAt     time.Time  `json:"checked_at"`
+	Since         time.Time  `json:"since"`
+	LastHealthyAt *time.Time `json:"last_healthy_at,omitempty"`
+	Bindings      []string   `json:"bindings"`
+	Apps          []string   `json:"apps"`
+}
+
+func (h InstanceHealth) Healthy() bool {
+	return h.Status == HealthStatusHealthy
+}
+
+// HealthMonitor periodically probes the share of every provisioned service
+// instance and keeps the latest result per instance. It runs as an ifrit
+// process next to the broker API.
+type HealthMonitor struct {
+	Interval    time.Duration
+	Concurrency int
+	Probe       *ShareProbe
+	Credentials *CredentialCheck
+	Clock       clock.Clock
+
+	logger lager.Logger
+	store  *IndexedStore
+
+	mutex   sync.RWMutex
+	health  map[string]InstanceHealth
+	lastRun time.Time
+}
+
+func NewHealthMonitor(logger lager.Logger, store *IndexedStore, probe *ShareProbe) *HealthMonitor {
+	return &HealthMonitor{
+		Interval:    DefaultHealthCheckInterval,
+		Concurrency: DefaultHealthCheckConcurrency,
+		Probe:       probe,
+		Clock:       clock.NewClock(),
+		logger:      logger.Session("health-monitor"),
+		store:       store,
+		health:      map[string]InstanceHealth{},
+	}
+}
+
+func (m *HealthMonitor) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ticker := m.Clock.NewTicker(m.Interval)
+	defer ticker.Stop()
+
+	start := func() chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			m.CheckAll(ctx)
+			close(done)
+		}()
+		return done
+	}
+
+	done := start()
+	close(ready)
+
+	for {
+		select {
+		case <-signals:
+			cancel()
+			<-done
+			return nil
+		case <-ticker.C():
+			select {
+			case <-done:
+				done = start()
+			default:
+				m.logger.Info("skipping-run", lager.Data{"reason": "previous run still in progress"})
+			}
+		}
+	}
+}
+
+// CheckAll probes all service instances once.
+func (m *HealthMonitor) CheckAll(ctx context.Context) {
+	logger := m.logger.Session("check-all")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	instances, err := m.store.RetrieveAllInstanceDetails()
+	if err != nil {
+		logger.Error("failed-to-list-instances", err)
+		return
+	}
+
+	ids := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < m.concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				m.check(ctx, logger, id, instances[id])
+			}
+		}()
+	}
+	for id := range instances {
+		ids <- id
+	}
+	close(ids)
+	wg.Wait()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id := range m.health {
+		if _, ok := instances[id]; !ok {
+			delete(m.health, id)
+		}
+	}
+	m.lastRun = m.Clock.Now()
+
+	unhealthy := 0
+	for _, h := range m.health {
+		if !h.Healthy() {
+			unhealthy++
+		}
+	}
+	logger.Info("checked", lager.Data{"instances": len(m.health), "unhealthy": unhealthy})
+}
+
+func (m *HealthMonitor) check(ctx context.Context, logger lager.Logger, instanceID string, instance brokerstore.ServiceInstance) {
+	result := InstanceHealth{
+		InstanceID: instanceID,
+		OrgGUID:    instance.OrganizationGUID,
+		SpaceGUID:  instance.SpaceGUID,
+		Status:     HealthStatusHealthy,
+		Bindings:   []string{},
+		Apps:       []string{},
+	}
+
+	share, err := instanceShare(instance)
+	if err == nil {
+		result.Host, result.Share = share.Host, share.Name
+		err = m.Probe.Check(ctx, share.Host, "")
+	}
+	if err == nil {
+		err = m.Credentials.Check(ctx, share, "", instanceOptions(instance))
+		if err == smbclient.ErrSMB1 {
+			err = nil
+		}
+	}
+	if err != nil {
+		result.Status = healthStatus(err)
+		result.Error = err.Error()
+	}
+
+	bindings, err := m.store.BindingsByInstance(instanceID)
+	if err != nil {
+		logger.Error("failed-to-list-bindings", err, lager.Data{"instanceID": instanceID})
+	}
+	apps := map[string]bool{}
+	for id, binding := range bindings {
+		result.Bindings = append(result.Bindings, id)
+		if binding.AppGUID != "" && !apps[binding.AppGUID] {
+			apps[binding.AppGUID] = true
+			result.Apps = append(result.Apps, binding.AppGUID)
+		}
+	}
+	sort.Strings(result.Bindings)
+	sort.Strings(result.Apps)
+
+	now := m.Clock.Now()
+	result.CheckedAt = now
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	previous, known := m.health[instanceID]
+	result.Since = now
+	if known && previous.Status == result.Status {
+		result.Since = previous.Since
+	}
+	result.LastHealthyAt = previous.LastHealthyAt
+	if result.Healthy() {
+		result.LastHealthyAt = &now
+	}
+	if known && previous.Status != result.Status {
+		logger.Info("health-changed", lager.Data{"instanceID": instanceID, "from": previous.Status, "to": result.Status, "bindings": len(result.Bindings)})
+	}
+
+	m.health[instanceID] = result
+}
+
+// Health returns the latest results, ordered by instance ID.
+func (m *HealthMonitor) Health() []InstanceHealth {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	results := make([]InstanceHealth, 0, len(m.health))
+	for _, h := range m.health {
+		results = append(results, h)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].InstanceID < results[j].InstanceID })
+	return results
+}
+
+// ServeHTTP lists the health of all instances. With ?unhealthy=true only
+// failing instances are listed.
+func (m *HealthMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	onlyUnhealthy := r.URL.Query().Get("unhealthy") == "true"
+	instances := []InstanceHealth{}
+	for _, h := range m.Health() {
+		if !onlyUnhealthy || !h.Healthy() {
+			instances = append(instances, h)
+		}
+	}
+
+	m.mutex.RLock()
+	lastRun := m.lastRun
+	m.mutex.RUnlock()
+
+	response := struct {
+		LastRun   *time.Time       `json:"last_run,omitempty"`
+		Instances []InstanceHealth `json:"instances"`
+	}{Instances: instances}
+	if !lastRun.IsZero() {
+		response.LastRun = &lastRun
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// WriteMetrics writes the health of all instances in the Prometheus text
+// format.
+func (m *HealthMonitor) WriteMetrics(w io.Writer) {
+	health := m.Health()
+
+	fmt.Fprintln(w, "# HELP smbbroker_share_healthy Whether the share of a service instance passed its last health check.")
+	fmt.Fprintln(w, "# TYPE smbbroker_share_healthy gauge")
+	for _, h := range health {
+		value := 0
+		if h.Healthy() {
+			value = 1
+		}
+		fmt.Fprintf(w, "smbbroker_share_healthy{%s} %d\n", healthLabels(h), value)
+	}
+
+	fmt.Fprintln(w, "# HELP smbbroker_share_health_checked_timestamp_seconds When the share of a service instance was last checked.")
+	fmt.Fprintln(w, "# TYPE smbbroker_share_health_checked_timestamp_seconds gauge")
+	for _, h := range health {
+		fmt.Fprintf(w, "smbbroker_share_health_checked_timestamp_seconds{%s} %d\n", healthLabels(h), h.CheckedAt.Unix())
+	}
+
+	counts := map[string]int{}
+	for _, h := range health {
+		counts[h.Status]++
+	}
+	statuses := make([]string, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	fmt.Fprintln(w, "# HELP smbbroker_share_health_instances Number of service instances per health status.")
+	fmt.Fprintln(w, "# TYPE smbbroker_share_health_instances gauge")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "smbbroker_share_health_instances{status=%s} %d\n", labelValue(status), counts[status])
+	}
+}
+
+func (m *HealthMonitor) concurrency() int {
+	if m.Concurrency < 1 {
+		return 1
+	}
+	return m.Concurrency
+}
+
+// healthStatus names the reason a health check failed.
+func healthStatus(err error) string {
+	switch typed := err.(type) {
+	case *ShareError:
+		return "invalid-share"
+	case *ShareProbeError:
+		if typed.Unresolved {
+			return "unresolved"
+		}
+		return "unreachable"
+	case *VersionError:
+		return "unsupported-version"
+	case *CredentialError:
+		return typed.key()
+	}
+	return "error"
+}
+
+func healthLabels(h InstanceHealth) string {
+	return fmt.Sprintf("instance_id=%s,host=%s,share=%s,status=%s",
+		labelValue(h.InstanceID), labelValue(h.Host), labelValue(h.Share), labelValue(h.Status))
+}
+
+func labelValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,159 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/tedsuo/ifrit"
+
+	. "code.cloudfoundry.org/smbbroker"
+	"code.cloudfoundry.org/smbbroker/smbclient/smbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HealthMonitor", func() {
+	var (
+		credhub *fakeCredhub
+		store   *IndexedStore
+		server  *smbtest.Server
+		monitor *HealthMonitor
+	)
+
+	BeforeEach(func() {
+		var err error
+		server, err = smbtest.NewServer("3.0")
+		Expect(err).NotTo(HaveOccurred())
+		server.Users["alice"] = "secret"
+		server.Shares["share"] = nil
+
+		credhub = newFakeCredhub()
+		credhub.SetJSON("/smbbroker/instance-1", map[string]interface{}{
+			"organization_guid": "org-1", "space_guid": "space-1",
+			"ServiceFingerPrint": map[string]interface{}{"share": "//server/share", "username": "alice", "password": "secret"},
+		})
+		credhub.SetJSON("/smbbroker/instance-2", map[string]interface{}{
+			"organization_guid": "org-1", "space_guid": "space-2",
+			"ServiceFingerPrint": "//decommissioned/share",
+		})
+		credhub.SetJSON("/smbbroker/binding-1", map[string]interface{}{"app_guid": "app-1"})
+		credhub.SetJSON("/smbbroker/binding-2", map[string]interface{}{"app_guid": "app-2"})
+		credhub.SetJSON("/smbbroker/index/binding-1", map[string]interface{}{"instance_id": "instance-2"})
+		credhub.SetJSON("/smbbroker/index/binding-2", map[string]interface{}{"instance_id": "instance-2"})
+
+		logger := lager.NewLogger("health")
+		store = NewIndexedStore(logger, credhub, "smbbroker")
+
+		probe := NewShareProbe(server.Port(), time.Second)
+		probe.LookupHost = func(_ context.Context, host string) ([]string, error) {
+			if host == "server" {
+				return []string{"127.0.0.1"}, nil
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		monitor = NewHealthMonitor(logger, store, probe)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("records the health of every instance with the affected bindings", func() {
+		monitor.CheckAll(context.Background())
+
+		health := monitor.Health()
+		Expect(health).To(HaveLen(2))
+
+		Expect(health[0].InstanceID).To(Equal("instance-1"))
+		Expect(health[0].Status).To(Equal("healthy"))
+		Expect(health[0].CheckedAt).To(BeTemporally("~", time.Now(), time.Second))
+		Expect(health[0].LastHealthyAt).NotTo(BeNil())
+
+		Expect(health[1].InstanceID).To(Equal("instance-2"))
+		Expect(health[1].Status).To(Equal("unresolved"))
+		Expect(health[1].Error).To(Equal(`share host "decommissioned" cannot be resolved: no such host`))
+		Expect(health[1].LastHealthyAt).To(BeNil())
+		Expect(health[1].Bindings).To(Equal([]string{"binding-1", "binding-2"}))
+		Expect(health[1].Apps).To(Equal([]string{"app-1", "app-2"}))
+	})
+
+	It("keeps the time a status was first seen", func() {
+		monitor.CheckAll(context.Background())
+		since := monitor.Health()[0].Since
+
+		server.Close()
+		monitor.CheckAll(context.Background())
+		failed := monitor.Health()[0]
+		Expect(failed.Status).To(Equal("unreachable"))
+		Expect(failed.Since).To(BeTemporally(">", since))
+		Expect(*failed.LastHealthyAt).To(Equal(since))
+
+		monitor.CheckAll(context.Background())
+		Expect(monitor.Health()[0].Since).To(Equal(failed.Since))
+	})
+
+	It("optionally checks the credentials", func() {
+		monitor.Credentials = NewCredentialCheck(server.Port(), time.Second)
+		monitor.Credentials.Client.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Addr())
+		}
+		server.Users["alice"] = "expired"
+
+		monitor.CheckAll(context.Background())
+		Expect(monitor.Health()[0].Status).To(Equal("logon-failure"))
+	})
+
+	It("forgets deleted instances", func() {
+		monitor.CheckAll(context.Background())
+		Expect(store.DeleteInstanceDetails("instance-2")).To(Succeed())
+
+		monitor.CheckAll(context.Background())
+		Expect(monitor.Health()).To(HaveLen(1))
+	})
+
+	It("serves the results", func() {
+		monitor.CheckAll(context.Background())
+
+		recorder := httptest.NewRecorder()
+		monitor.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/health?unhealthy=true", nil))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+
+		var response struct {
+			LastRun   *time.Time       `json:"last_run"`
+			Instances []InstanceHealth `json:"instances"`
+		}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+		Expect(response.LastRun).NotTo(BeNil())
+		Expect(response.Instances).To(HaveLen(1))
+		Expect(response.Instances[0].InstanceID).To(Equal("instance-2"))
+	})
+
+	It("writes metrics", func() {
+		monitor.CheckAll(context.Background())
+
+		recorder := httptest.NewRecorder()
+		monitor.WriteMetrics(recorder)
+		Expect(recorder.Body.String()).To(ContainSubstring(`smbbroker_share_healthy{instance_id="instance-1",host="server",share="share",status="healthy"} 1`))
+		Expect(recorder.Body.String()).To(ContainSubstring(`smbbroker_share_healthy{instance_id="instance-2",host="decommissioned",share="share",status="unresolved"} 0`))
+		Expect(recorder.Body.String()).To(ContainSubstring(`smbbroker_share_health_instances{status="unresolved"} 1`))
+	})
+
+	It("runs periodically until signalled", func() {
+		monitor.Interval = 50 * time.Millisecond
+
+		process := ifrit.Invoke(monitor)
+		Eventually(monitor.Health).Should(HaveLen(2))
+
+		server.Close()
+		Eventually(func() string { return monitor.Health()[0].Status }).Should(Equal("unreachable"))
+
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+	})
+})
@@ -2,31 +2,39 @@ package main
 
 import (
 	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/credhub-cli/credhub"
+	credhubauth "code.cloudfoundry.org/credhub-cli/credhub/auth"
 	"code.cloudfoundry.org/debugserver"
 	"code.cloudfoundry.org/existingvolumebroker"
 	"code.cloudfoundry.org/existingvolumebroker/utils"
 	"code.cloudfoundry.org/goshims/osshim"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagerflags"
-	"code.cloudfoundry.org/service-broker-store/brokerstore"
 	vmo "code.cloudfoundry.org/volume-mount-options"
-	vmou "code.cloudfoundry.org/volume-mount-options/utils"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
-	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
+	"github.com/pivotal-cf/brokerapi/domain"
 	"github.com/tedsuo/ifrit"
 	"github.com/tedsuo/ifrit/grouper"
 	"github.com/tedsuo/ifrit/http_server"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"reflect"
 	"strings"
 	"time"
 )
 
+var configFile = flag.String(
+	"config",
+	"",
+	"(optional) YAML or JSON file with settings named like these flags; command line flags win over environment variables, which win over the file. allowedOptions is reloaded when the file changes",
+)
+
 var atAddress = flag.String(
 	"listenAddr",
 	"0.0.0.0:8999",
@@ -36,7 +44,43 @@ var atAddress = flag.String(
 var servicesConfig = flag.String(
 	"servicesConfig",
 	"",
-	"[REQUIRED] - Path to services config to register with cloud controller",
+	"[REQUIRED] - Path to services config to register with cloud controller; reloaded when it changes. Not needed with servicesURL or servicesCredential",
+)
+
+var servicesURL = flag.String(
+	"servicesURL",
+	"",
+	"(optional) HTTP(S) URL to fetch the services config from instead of servicesConfig; fetched again every servicesRefreshInterval",
+)
+
+var servicesCredential = flag.String(
+	"servicesCredential",
+	"",
+	"(optional) CredHub JSON credential holding the services config under \"services\", instead of servicesConfig; fetched again every servicesRefreshInterval",
+)
+
+var servicesRefreshInterval = flag.Duration(
+	"servicesRefreshInterval",
+	DefaultCatalogRefreshInterval,
+	"(optional) How often servicesURL or servicesCredential is fetched",
+)
+
+var serviceName = flag.String(
+	"serviceName",
+	"",
+	"(optional) Name to publish the service of servicesConfig under in the marketplace; defaults to SERVICENAME",
+)
+
+var brokerType = flag.String(
+	"brokerType",
+	SMBFlavor.Name,
+	"(optional) Kind of volume service to broker, smb or nfs; picks the allowed options, the shareProbePort and, when brokerType is given but no catalog is, the default catalog; defaults to BROKER_TYPE",
+)
+
+var allowedOptions = flag.String(
+	"allowedOptions",
+	AllowedOptions(),
+	"(optional) Comma separated mount options bindings may set; defaults to ALLOWED_OPTIONS or the options of brokerType",
 )
 
 var credhubURL = flag.String(
@@ -69,22 +113,256 @@ var uaaCACertPath = flag.String(
 	"(optional) Path to CA Cert for UAA used for CredHub authorization",
 )
 
+var uaaTokenKeysURL = flag.String(
+	"uaaTokenKeysURL",
+	"",
+	"(optional) UAA token_keys endpoint, e.g. https://uaa.example.com/token_keys; the broker API accepts UAA bearer tokens signed with these keys",
+)
+
+var uaaJWKSPath = flag.String(
+	"uaaJWKSPath",
+	"",
+	"(optional) Local JWKS file with the keys that sign UAA tokens, instead of uaaTokenKeysURL; reloaded when it changes",
+)
+
+var uaaIssuer = flag.String(
+	"uaaIssuer",
+	"",
+	"(optional) Issuer UAA bearer tokens must carry, e.g. https://uaa.example.com/oauth/token; required with uaaTokenKeysURL or uaaJWKSPath",
+)
+
+var uaaAudience = flag.String(
+	"uaaAudience",
+	"smbbroker",
+	"(optional) Audience UAA bearer tokens must include",
+)
+
+var uaaRequiredScopes = flag.String(
+	"uaaRequiredScopes",
+	"smbbroker.admin",
+	"(optional) Comma separated scopes UAA bearer tokens must all carry",
+)
+
 var storeID = flag.String(
 	"storeID",
 	"smbbroker",
 	"(optional) Store ID used to namespace instance details and bindings (credhub only)",
 )
 
+var indexMaxAge = flag.Duration(
+	"indexMaxAge",
+	DefaultIndexMaxAge,
+	"(optional) How long the in-memory index of instances and bindings is used before it is refreshed from CredHub; it is always refreshed before quotas are checked and bindings are created",
+)
+
+var serverPolicyConfig = flag.String(
+	"serverPolicyConfig",
+	"",
+	"(optional) Path to a policy file listing the SMB servers service instances may be created for",
+)
+
+var quotaConfig = flag.String(
+	"quotaConfig",
+	"",
+	"(optional) Path to a file with per org and per space instance and binding quotas",
+)
+
+var mountPolicyConfig = flag.String(
+	"mountPolicyConfig",
+	"",
+	"(optional) Path to a mount policy file with per org, space and plan mount option rules; reloaded on change",
+)
+
+var forbiddenMountPaths = flag.String(
+	"forbiddenMountPaths",
+	strings.Join(DefaultForbiddenMountPaths, ","),
+	"(optional) Comma separated container paths that bindings may neither mount at, below, nor above",
+)
+
+var shareProbe = flag.Bool(
+	"shareProbe",
+	false,
+	"(optional) Check that the share host accepts connections before provisioning or updating an instance",
+)
+
+var shareProbePort = flag.Int(
+	"shareProbePort",
+	DefaultShareProbePort,
+	"(optional) TCP port the share probe connects to",
+)
+
+var shareProbeTimeout = flag.Duration(
+	"shareProbeTimeout",
+	DefaultShareProbeTimeout,
+	"(optional) Deadline for resolving and connecting to the share host",
+)
+
+var shareProbeSkipPlans = flag.String(
+	"shareProbeSkipPlans",
+	"",
+	"(optional) Comma separated plan IDs the share probe, SMB version negotiation and credential verification are turned off for",
+)
+
+var negotiateVersion = flag.Bool(
+	"negotiateVersion",
+	false,
+	"(optional) Check the requested SMB version against the share host on provision, and record the highest common version when none is requested",
+)
+
+var verifyCredentials = flag.Bool(
+	"verifyCredentials",
+	false,
+	"(optional) Log on to the share host with the instance's username, password and domain on provision and connect to the share",
+)
+
+var healthCheckInterval = flag.Duration(
+	"healthCheckInterval",
+	0,
+	"(optional) How often the shares of all service instances are probed; their health is served at /health of the broker and admin APIs, 0 turns the health monitor off",
+)
+
+var healthCheckCredentials = flag.Bool(
+	"healthCheckCredentials",
+	false,
+	"(optional) Also log on to the share with the instance's credentials during health checks",
+)
+
+var adminAddress = flag.String(
+	"adminAddress",
+	"",
+	"(optional) host:port to serve the admin API on; requires ADMIN_USERNAME and ADMIN_PASSWORD, and tlsCertPath unless the address is a loopback address",
+)
+
+var tracingExporter = flag.String(
+	"tracingExporter",
+	"",
+	"(optional) Where to send request traces, otlp or file; tracing is off when empty",
+)
+
+var tracingFile = flag.String(
+	"tracingFile",
+	"",
+	"(optional) File the file exporter appends a JSON line per span to; required with tracingExporter file",
+)
+
+var otlpEndpoint = flag.String(
+	"otlpEndpoint",
+	DefaultOTLPEndpoint,
+	"(optional) OTLP/HTTP JSON traces endpoint, e.g. of an OpenTelemetry collector",
+)
+
+var auditLogPath = flag.String(
+	"auditLog",
+	"",
+	"(optional) File to append a hash chained record of every provision, update, deprovision, bind and unbind to, keyed with AUDIT_LOG_KEY; auditing is off when empty",
+)
+
+var webhookConfig = flag.String(
+	"webhookConfig",
+	"",
+	"(optional) JSON file listing the webhook endpoints to notify about provisioned, updated and deprovisioned instances and created and deleted bindings",
+)
+
+var webhookOutbox = flag.String(
+	"webhookOutbox",
+	"",
+	"(optional) Directory that keeps webhook events until they are delivered; required with webhookConfig",
+)
+
+var tlsCertPath = flag.String(
+	"tlsCertPath",
+	"",
+	"(optional) PEM certificate to serve the broker API over TLS with; reloaded when the file changes",
+)
+
+var tlsKeyPath = flag.String(
+	"tlsKeyPath",
+	"",
+	"(optional) PEM private key of tlsCertPath",
+)
+
+var tlsClientCAPath = flag.String(
+	"tlsClientCAPath",
+	"",
+	"(optional) PEM CA certificates that sign the client certificates the broker API requires; enables mutual TLS",
+)
+
+var tlsMinVersion = flag.String(
+	"tlsMinVersion",
+	DefaultTLSMinVersion,
+	"(optional) Minimum TLS version of the broker API, 1.0, 1.1, 1.2 or 1.3",
+)
+
+var tlsCipherSuites = flag.String(
+	"tlsCipherSuites",
+	"",
+	"(optional) Comma separated TLS 1.2 cipher suites the broker API accepts, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256; Go's defaults when empty",
+)
+
+var credentialsFile = flag.String(
+	"credentialsFile",
+	"",
+	"(optional) JSON file of further usernames and bcrypt password hashes the broker API accepts next to USERNAME and PASSWORD; reloaded when it changes",
+)
+
+var keepLegacyVolumeIDs = flag.Bool(
+	"keepLegacyVolumeIDs",
+	false,
+	"(optional) Give new bindings of service instances that still have bindings with legacy volume IDs a legacy volume ID too; requires VOLUME_ID_KEY",
+)
+
 var (
 	username string
 	password string
+
+	adminUsername string
+	adminPassword string
+
+	volumeIDKey      string
+	bindingParamsKey string
+	auditLogKey      string
+
+	// fixedSettings are the settings the command line or the environment
+	// gave, which the config file does not override.
+	fixedSettings map[string]bool
 )
 
+// credentialSettings are the config file settings that stand for the
+// credentials of the environment rather than for flags.
+var credentialSettings = map[string]*string{
+	"username":         &username,
+	"password":         &password,
+	"adminUsername":    &adminUsername,
+	"adminPassword":    &adminPassword,
+	"volumeIDKey":      &volumeIDKey,
+	"bindingParamsKey": &bindingParamsKey,
+	"auditLogKey":      &auditLogKey,
+}
+
+// environmentFlags are the environment variables that set flags which are
+// not given on the command line.
+var environmentFlags = map[string]string{
+	"serviceName":    "SERVICENAME",
+	"allowedOptions": "ALLOWED_OPTIONS",
+	"brokerType":     "BROKER_TYPE",
+}
+
 func main() {
-	parseCommandLine()
-	parseEnvironment()
+	args := runCommand(os.Args[1:])
+
+	parseCommandLine(args)
+	err := loadSettings(flag.CommandLine)
+	if err == nil {
+		err = applyBrokerType(flag.CommandLine)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nERROR: %s\n\n", err.Error())
+		flag.Usage()
+		os.Exit(1)
+	}
 
 	checkParams()
+	checkCatalog()
 
 	logger, logSink := newLogger()
 	logger.Info("starting")
@@ -92,16 +370,15 @@ func main() {
 
 	verifyCredhubIsReachable(logger)
 
-	server := createServer(logger)
+	members := createServer(logger)
 
 	if dbgAddr := debugserver.DebugAddress(flag.CommandLine); dbgAddr != "" {
-		server = utils.ProcessRunnerFor(grouper.Members{
+		members = append(grouper.Members{
 			{Name: "debug-server", Runner: debugserver.Runner(dbgAddr, logSink)},
-			{Name: "broker-api", Runner: server},
-		})
+		}, members...)
 	}
 
-	process := ifrit.Invoke(server)
+	process := ifrit.Invoke(utils.ProcessRunnerFor(members))
 	logger.Info("started")
 	utils.UntilTerminated(logger, process)
 }
@@ -149,15 +426,158 @@ func configureCACert(logger lager.Logger, client *http.Client) {
 }
 
 
-func parseCommandLine() {
+func parseCommandLine(args []string) {
 	lagerflags.AddFlags(flag.CommandLine)
 	debugserver.AddFlags(flag.CommandLine)
-	flag.Parse()
+	_ = flag.CommandLine.Parse(args)
 }
 
 func parseEnvironment() {
 	username, _ = os.LookupEnv("USERNAME")
 	password, _ = os.LookupEnv("PASSWORD")
+	adminUsername, _ = os.LookupEnv("ADMIN_USERNAME")
+	adminPassword, _ = os.LookupEnv("ADMIN_PASSWORD")
+	volumeIDKey, _ = os.LookupEnv("VOLUME_ID_KEY")
+	bindingParamsKey, _ = os.LookupEnv("BINDING_PARAMS_KEY")
+	auditLogKey, _ = os.LookupEnv("AUDIT_LOG_KEY")
+}
+
+// loadSettings fills in the settings the command line parsed by flags left
+// out, first from the environment and then from the config file. Command
+// line flags thus win over environment variables, which win over the config
+// file, which wins over the defaults.
+func loadSettings(flags *flag.FlagSet) error {
+	parseEnvironment()
+
+	fixedSettings = map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { fixedSettings[f.Name] = true })
+	for name, variable := range environmentFlags {
+		value := os.Getenv(variable)
+		if value == "" || fixedSettings[name] {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %s", value, variable, err.Error())
+		}
+		fixedSettings[name] = true
+	}
+	for name, value := range credentialSettings {
+		if *value != "" {
+			fixedSettings[name] = true
+		}
+	}
+
+	if *configFile == "" {
+		return nil
+	}
+	config, err := LoadConfigFile(*configFile)
+	if err != nil {
+		return fmt.Errorf("cannot load config file: %s", err.Error())
+	}
+
+	for _, name := range config.Names() {
+		value := config[name]
+		if credential, ok := credentialSettings[name]; ok {
+			if !fixedSettings[name] {
+				*credential = value
+			}
+			continue
+		}
+		if flags.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("config file: unknown setting %q", name)
+		}
+		if fixedSettings[name] {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("config file: invalid value %q for %s: %s", value, name, err.Error())
+		}
+	}
+	return nil
+}
+
+// applyBrokerType checks brokerType and gives the settings whose defaults
+// depend on it, and that flags did not set, the defaults of its flavour.
+func applyBrokerType(flags *flag.FlagSet) error {
+	flavor, err := FlavorByName(*brokerType)
+	if err != nil {
+		return err
+	}
+
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["allowedOptions"] {
+		*allowedOptions = flavor.AllowedOptions
+	}
+	if !set["shareProbePort"] {
+		*shareProbePort = flavor.ProbePort
+	}
+	if set["brokerType"] && countSet(*servicesConfig, *servicesURL, *servicesCredential) == 0 {
+		*servicesConfig = flavor.ServicesConfig
+	}
+	return nil
+}
+
+// currentFlavor returns the flavour brokerType names.
+func currentFlavor() *Flavor {
+	if flavor, err := FlavorByName(*brokerType); err == nil {
+		return flavor
+	}
+	return SMBFlavor
+}
+
+// reloadAllowedOptions reads allowedOptions from the config file again,
+// unless the command line or ALLOWED_OPTIONS gave it.
+func reloadAllowedOptions() (string, error) {
+	if fixedSettings["allowedOptions"] {
+		return *allowedOptions, nil
+	}
+	config, err := LoadConfigFile(*configFile)
+	if err != nil {
+		return "", err
+	}
+	if allowed, ok := config["allowedOptions"]; ok {
+		return allowed, nil
+	}
+	return currentFlavor().AllowedOptions, nil
+}
+
+// watchConfigFile calls onMask with the new mount option mask whenever a
+// change of the config file changes the allowed options, until stop is
+// closed. The other settings of the file need a restart.
+func watchConfigFile(logger lager.Logger, stop <-chan struct{}, onMask func(vmo.MountOptsMask)) error {
+	logger = logger.Session("config-file")
+	current := splitList(*allowedOptions)
+	return WatchFile(logger, *configFile, stop, func() {
+		allowed, err := reloadAllowedOptions()
+		if err != nil {
+			logger.Error("reload-failed", err)
+			return
+		}
+		if reflect.DeepEqual(splitList(allowed), current) {
+			logger.Debug("allowed-options-unchanged")
+			return
+		}
+		mask, err := newConfigMask(allowed)
+		if err != nil {
+			logger.Error("reload-failed", err)
+			return
+		}
+		current = splitList(allowed)
+		onMask(mask)
+		logger.Info("reloaded", lager.Data{"allowed-options": mask.Allowed})
+	})
+}
+
+// closeOnSignal returns a grouper member that closes stop when the group is
+// signalled, which stops the file watchers started with it.
+func closeOnSignal(stop chan struct{}) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		close(ready)
+		<-signals
+		close(stop)
+		return nil
+	})
 }
 
 func checkParams() {
@@ -167,11 +587,108 @@ func checkParams() {
 		os.Exit(1)
 	}
 
-	if *servicesConfig == "" {
+	if *servicesConfig == "" && *servicesURL == "" && *servicesCredential == "" {
 		fmt.Fprint(os.Stderr, "\nERROR: servicesConfig parameter must be provided.\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
+
+	if countSet(*servicesConfig, *servicesURL, *servicesCredential) > 1 {
+		fmt.Fprint(os.Stderr, "\nERROR: only one of servicesConfig, servicesURL and servicesCredential may be provided.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *tracingExporter != "" && *tracingExporter != "otlp" && *tracingExporter != "file" {
+		fmt.Fprint(os.Stderr, "\nERROR: tracingExporter must be otlp or file.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *tracingExporter == "file" && *tracingFile == "" {
+		fmt.Fprint(os.Stderr, "\nERROR: tracingFile must be provided when tracingExporter is file.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if (*tlsCertPath == "") != (*tlsKeyPath == "") || (*tlsClientCAPath != "" && *tlsCertPath == "") {
+		fmt.Fprint(os.Stderr, "\nERROR: tlsCertPath and tlsKeyPath must be provided together, and tlsClientCAPath requires them.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *uaaTokenKeysURL != "" && *uaaJWKSPath != "" {
+		fmt.Fprint(os.Stderr, "\nERROR: only one of uaaTokenKeysURL and uaaJWKSPath may be provided.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if (*uaaTokenKeysURL != "" || *uaaJWKSPath != "") && *uaaIssuer == "" {
+		fmt.Fprint(os.Stderr, "\nERROR: uaaIssuer must be provided when uaaTokenKeysURL or uaaJWKSPath is provided.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *webhookConfig != "" && *webhookOutbox == "" {
+		fmt.Fprint(os.Stderr, "\nERROR: webhookOutbox must be provided when webhookConfig is provided.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if currentFlavor() != SMBFlavor && (*negotiateVersion || *verifyCredentials || *healthCheckCredentials) {
+		fmt.Fprint(os.Stderr, "\nERROR: negotiateVersion, verifyCredentials and healthCheckCredentials need brokerType smb.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *adminAddress != "" && (adminUsername == "" || adminPassword == "") {
+		fmt.Fprint(os.Stderr, "\nERROR: ADMIN_USERNAME and ADMIN_PASSWORD must be set when adminAddress is provided.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *adminAddress != "" && *tlsCertPath == "" && !IsLoopbackAddress(*adminAddress) {
+		fmt.Fprint(os.Stderr, "\nERROR: tlsCertPath must be provided when adminAddress is not a loopback address.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *keepLegacyVolumeIDs && volumeIDKey == "" {
+		fmt.Fprint(os.Stderr, "\nERROR: VOLUME_ID_KEY must be set when keepLegacyVolumeIDs is provided.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *auditLogPath != "" && auditLogKey == "" {
+		fmt.Fprint(os.Stderr, "\nERROR: AUDIT_LOG_KEY must be set when auditLog is provided.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+// checkCatalog exits listing every problem of the services config, which
+// would otherwise only surface when the platform fetches the catalog.
+// Remote catalogs are checked when they are first fetched.
+func checkCatalog() {
+	if *servicesConfig == "" {
+		return
+	}
+
+	_, err := NewCatalogFromConfig(*servicesConfig, *serviceName)
+	if err == nil {
+		return
+	}
+
+	if catalogErr, ok := err.(*CatalogError); ok {
+		fmt.Fprintf(os.Stderr, "\nERROR: servicesConfig %s is invalid:\n", *servicesConfig)
+		for _, problem := range catalogErr.Problems {
+			fmt.Fprintf(os.Stderr, "  - %s\n", problem)
+		}
+		fmt.Fprintln(os.Stderr)
+	} else {
+		fmt.Fprintf(os.Stderr, "\nERROR: cannot load servicesConfig %s: %s\n\n", *servicesConfig, err.Error())
+	}
+	os.Exit(1)
 }
 
 func newLogger() (lager.Logger, *lager.ReconfigurableSink) {
@@ -181,74 +698,369 @@ func newLogger() (lager.Logger, *lager.ReconfigurableSink) {
 	return lagerflags.NewFromConfig("smbbroker", lagerConfig)
 }
 
-func createServer(logger lager.Logger) ifrit.Runner {
-	var credhubCACert string
-	if *credhubCACertPath != "" {
-		b, err := ioutil.ReadFile(*credhubCACertPath)
+func createServer(logger lager.Logger) grouper.Members {
+	stopWatching := make(chan struct{})
+	members := grouper.Members{{Name: "file-watchers", Runner: closeOnSignal(stopWatching)}}
+
+	var tracer *Tracer
+	switch *tracingExporter {
+	case "file":
+		file, err := os.OpenFile(*tracingFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 		if err != nil {
-			logger.Fatal("cannot-read-credhub-ca-cert", err, lager.Data{"path": *credhubCACertPath})
+			logger.Fatal("opening-tracing-file-error", err)
 		}
-		credhubCACert = string(b)
+		tracer = NewTracer(NewFileExporter(file))
+	case "otlp":
+		exporter := NewOTLPExporter(logger, *otlpEndpoint)
+		tracer = NewTracer(exporter)
+		members = append(members, grouper.Member{Name: "otlp-exporter", Runner: exporter})
+	}
+
+	credhubClient, err := newCredhub()
+	if err != nil {
+		logger.Fatal("failed-creating-credhub-store", err)
 	}
+	credhubHTTP := credhubClient.Client()
+	credhubHTTP.Transport = tracer.Transport("credhub", credhubHTTP.Transport)
 
-	var uaaCACert string
-	if *uaaCACertPath != "" {
-		b, err := ioutil.ReadFile(*uaaCACertPath)
+	store := NewIndexedStore(logger, credhubClient, *storeID)
+	store.MaxAge = *indexMaxAge
+	if bindingParamsKey != "" {
+		store.Redaction, err = NewBindingRedaction(bindingParamsKey)
 		if err != nil {
-			logger.Fatal("cannot-read-credhub-ca-cert", err, lager.Data{"path": *uaaCACertPath})
-		}
-		uaaCACert = string(b)
-	}
-
-	store := brokerstore.NewStore(
-		logger,
-		*credhubURL,
-		credhubCACert,
-		*uaaClientID,
-		*uaaClientSecret,
-		uaaCACert,
-		*storeID,
-	)
-
-	versionValidator := vmo.UserOptsValidationFunc(validateVersion)
-	symlinksValidator := vmo.UserOptsValidationFunc(validateMfsymlinks)
-
-	configMask, err := vmo.NewMountOptsMask(
-		strings.Split(AllowedOptions(), ","),
-		vmou.ParseOptionStringToMap("", ":"),
-		map[string]string{
-			"readonly": "ro",
-			"share":    "source",
-		},
-		[]string{},
-		[]string{"source"},
-		versionValidator, symlinksValidator,
-	)
+			logger.Fatal("loading-binding-parameters-key-error", err)
+		}
+	} else {
+		logger.Info("binding-parameters-not-redacted", lager.Data{"reason": "BINDING_PARAMS_KEY is not set"})
+	}
+	metrics := NewMetrics(store)
+	store.Metrics = metrics
+	store.Store = metrics.Store(store.Store)
+
+	configMask, err := newConfigMask(*allowedOptions)
 	if err != nil {
 		logger.Fatal("creating-config-mask-error", err)
 	}
 
 	logger.Debug("smbbroker-startup-config", lager.Data{"config-mask": configMask})
 
-	services, err := NewServicesFromConfig(*servicesConfig)
+	var broker *Broker
+	loadDelegates := func() {
+		if err := broker.LoadDelegates(); err != nil {
+			logger.Error("loading-volume-brokers-error", err)
+		}
+	}
+
+	var catalog Services
+	var catalogFile *Catalog
+	if *servicesURL != "" || *servicesCredential != "" {
+		remote, err := fetchRemoteCatalog(logger, credhubClient)
+		if err != nil {
+			logger.Fatal("fetching-services-config-error", err)
+		}
+		remote.Interval = *servicesRefreshInterval
+		remote.OnChange = loadDelegates
+		catalog = remote
+		metrics.Register(remote)
+		members = append(members, grouper.Member{Name: "catalog-refresher", Runner: remote})
+	} else {
+		catalogFile, err = NewCatalogFromConfig(*servicesConfig, *serviceName)
+		if err != nil {
+			logger.Fatal("loading-services-config-error", err)
+		}
+		catalogFile.OnChange = loadDelegates
+		catalog = catalogFile
+		metrics.Register(catalogFile)
+	}
+
+	scope := &Scope{}
+	newDelegate := func(mask vmo.MountOptsMask) domain.ServiceBroker {
+		return existingvolumebroker.New(
+			currentFlavor().BrokerType,
+			scope.Logger(logger),
+			catalog,
+			&osshim.OsShim{},
+			clock.NewClock(),
+			tracer.Store(scope, store),
+			mask,
+		)
+	}
+
+	broker = NewBroker(logger, newDelegate(configMask), store)
+	broker.Catalog = catalog
+	broker.Flavor = currentFlavor()
+	broker.NewDelegate = newDelegate
+	broker.Tracer = tracer
+	broker.Scope = scope
+	if err := broker.LoadDelegates(); err != nil {
+		logger.Fatal("loading-volume-brokers-error", err)
+	}
+	if catalogFile != nil {
+		if err := catalogFile.Watch(logger, stopWatching); err != nil {
+			logger.Fatal("watching-services-config-error", err)
+		}
+	}
+	broker.ForbiddenMountPaths = splitList(*forbiddenMountPaths)
+	broker.Metrics = metrics
+
+	if volumeIDKey != "" {
+		broker.VolumeIDs, err = NewVolumeIDs(volumeIDKey)
+		if err != nil {
+			logger.Fatal("loading-volume-id-key-error", err)
+		}
+		broker.VolumeIDs.KeepLegacy = *keepLegacyVolumeIDs
+	} else {
+		logger.Info("volume-ids-not-keyed", lager.Data{"reason": "VOLUME_ID_KEY is not set"})
+	}
+
+	if *auditLogPath != "" {
+		broker.Audit, err = OpenAuditLog(logger, *auditLogPath, auditLogKey)
+		if err != nil {
+			logger.Fatal("opening-audit-log-error", err)
+		}
+	}
+
+	if *serverPolicyConfig != "" {
+		broker.ServerPolicy, err = NewServerPolicyFromConfig(*serverPolicyConfig)
+		if err != nil {
+			logger.Fatal("loading-server-policy-error", err)
+		}
+	}
+
+	if *quotaConfig != "" {
+		broker.Quotas, err = NewQuotasFromConfig(*quotaConfig)
+		if err != nil {
+			logger.Fatal("loading-quota-config-error", err)
+		}
+	}
+
+	if *mountPolicyConfig != "" {
+		broker.MountPolicy, err = NewMountPolicyFromConfig(*mountPolicyConfig)
+		if err != nil {
+			logger.Fatal("loading-mount-policy-error", err)
+		}
+		if err := broker.MountPolicy.Watch(logger, stopWatching); err != nil {
+			logger.Fatal("watching-mount-policy-error", err)
+		}
+	}
+
+	if *shareProbe {
+		broker.ShareProbe = NewShareProbe(*shareProbePort, *shareProbeTimeout)
+		broker.ShareProbe.SkipPlans = splitList(*shareProbeSkipPlans)
+	}
+
+	if *negotiateVersion {
+		broker.Negotiator = NewVersionNegotiator(*shareProbePort, *shareProbeTimeout)
+		broker.Negotiator.SkipPlans = splitList(*shareProbeSkipPlans)
+	}
+
+	if *verifyCredentials {
+		broker.Credentials = NewCredentialCheck(*shareProbePort, *shareProbeTimeout)
+		broker.Credentials.SkipPlans = splitList(*shareProbeSkipPlans)
+	}
+
+	authenticator := NewAuthenticator(logger, username, password)
+	if *credentialsFile != "" {
+		authenticator, err = NewAuthenticatorFromFile(logger, *credentialsFile, username, password)
+		if err != nil {
+			logger.Fatal("loading-credentials-file-error", err)
+		}
+		if err := authenticator.Watch(logger, stopWatching); err != nil {
+			logger.Fatal("watching-credentials-file-error", err)
+		}
+		logger.Info("loaded-credentials-file", lager.Data{"principals": authenticator.Principals()})
+	}
+	if *uaaTokenKeysURL != "" || *uaaJWKSPath != "" {
+		authenticator.Tokens, err = newTokenVerifier(tracer)
+		if err != nil {
+			logger.Fatal("loading-uaa-token-keys-error", err)
+		}
+		if err := authenticator.Tokens.Keys.Watch(logger, stopWatching); err != nil {
+			logger.Fatal("watching-uaa-token-keys-error", err)
+		}
+	}
+	metrics.Register(authenticator)
+
+	var monitor *HealthMonitor
+	if *healthCheckInterval > 0 {
+		monitor = NewHealthMonitor(logger, store, NewShareProbe(*shareProbePort, *shareProbeTimeout))
+		monitor.Interval = *healthCheckInterval
+		if *healthCheckCredentials {
+			monitor.Credentials = NewCredentialCheck(*shareProbePort, *shareProbeTimeout)
+		}
+
+		metrics.Register(monitor)
+		members = append(members, grouper.Member{Name: "health-monitor", Runner: monitor})
+	}
+
+	handler := NewBrokerHandler(broker, logger.Session("broker-api"), authenticator)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", tracer.Handler(metrics.Handler(handler)))
+	mux.Handle("/metrics", authenticator.Wrap(metrics))
+	if monitor != nil {
+		mux.Handle("/health", authenticator.Wrap(monitor))
+	}
+
+	var serverTLS *ServerTLS
+	if *tlsCertPath != "" {
+		var err error
+		serverTLS, err = newServerTLS()
+		if err != nil {
+			logger.Fatal("loading-tls-config-error", err)
+		}
+		if err := serverTLS.Watch(logger, stopWatching); err != nil {
+			logger.Fatal("watching-tls-certificate-error", err)
+		}
+	}
+	members = append(members, grouper.Member{Name: "broker-api", Runner: newHTTPServer(*atAddress, mux, serverTLS)})
+
+	if *webhookConfig != "" {
+		webhooks, err := NewWebhooksFromConfig(logger, *webhookConfig, *webhookOutbox)
+		if err != nil {
+			logger.Fatal("loading-webhook-config-error", err)
+		}
+		webhooks.Source = "/smbbroker/" + *storeID
+		broker.Webhooks = webhooks
+
+		metrics.Register(webhooks)
+		members = append(members, grouper.Member{Name: "webhooks", Runner: webhooks})
+	}
+
+	var admin *AdminAPI
+	if *adminAddress != "" {
+		admin = NewAdminAPI(logger, store, broker, configMask)
+		admin.Health = monitor
+		adminHandler := auth.NewWrapper(adminUsername, adminPassword).Wrap(admin)
+		members = append(members, grouper.Member{Name: "admin-api", Runner: newHTTPServer(*adminAddress, adminHandler, serverTLS)})
+	}
+
+	if *configFile != "" {
+		err := watchConfigFile(logger, stopWatching, func(mask vmo.MountOptsMask) {
+			broker.SetDelegate(newDelegate(mask))
+			admin.SetMask(mask)
+		})
+		if err != nil {
+			logger.Fatal("watching-config-file-error", err)
+		}
+	}
+
+	return members
+}
+
+// fetchRemoteCatalog fetches the catalog from servicesURL or from the
+// servicesCredential in CredHub.
+func fetchRemoteCatalog(logger lager.Logger, credhubClient *credhub.CredHub) (*RemoteCatalog, error) {
+	if *servicesURL != "" {
+		return NewRemoteCatalogFromURL(logger, &http.Client{Timeout: 30 * time.Second}, *servicesURL, *serviceName)
+	}
+	return NewRemoteCatalogFromCredhub(logger, credhubClient, *servicesCredential, *serviceName)
+}
+
+// newHTTPServer serves handler on address, over TLS when serverTLS is set.
+func newHTTPServer(address string, handler http.Handler, serverTLS *ServerTLS) ifrit.Runner {
+	if serverTLS == nil {
+		return http_server.New(address, handler)
+	}
+	return http_server.NewTLSServer(address, handler, serverTLS.Config())
+}
+
+// newServerTLS loads the TLS settings of the broker API from the tls flags.
+func newServerTLS() (*ServerTLS, error) {
+	minVersion, err := ParseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := ParseCipherSuites(*tlsCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	serverTLS, err := NewServerTLS(*tlsCertPath, *tlsKeyPath, *tlsClientCAPath)
+	if err != nil {
+		return nil, err
+	}
+	serverTLS.MinVersion, serverTLS.CipherSuites = minVersion, cipherSuites
+	return serverTLS, nil
+}
+
+// newTokenVerifier loads the keys that sign UAA tokens from the uaa flags.
+// Keys fetched from UAA are traced with tracer.
+func newTokenVerifier(tracer *Tracer) (*TokenVerifier, error) {
+	var keys *TokenKeys
+	var err error
+	if *uaaJWKSPath != "" {
+		keys, err = NewTokenKeysFromFile(*uaaJWKSPath)
+	} else {
+		var client *http.Client
+		client, err = newUAAClient()
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = tracer.Transport("uaa", client.Transport)
+		keys, err = NewTokenKeysFromURL(client, *uaaTokenKeysURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewTokenVerifier(keys, *uaaIssuer, *uaaAudience, splitList(*uaaRequiredScopes)), nil
+}
+
+// newUAAClient creates an HTTP client that trusts the uaaCACertPath CA in
+// addition to the system CAs.
+func newUAAClient() (*http.Client, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if *uaaCACertPath == "" {
+		return client, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	b, err := ioutil.ReadFile(*uaaCACertPath)
 	if err != nil {
-		logger.Fatal("loading-services-config-error", err)
+		return nil, fmt.Errorf("cannot read ca cert %q: %s", *uaaCACertPath, err.Error())
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("ca cert %q contains no certificates", *uaaCACertPath)
 	}
+	client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return client, nil
+}
 
-	serviceBroker := existingvolumebroker.New(
-		existingvolumebroker.BrokerTypeSMB,
-		logger,
-		services,
-		&osshim.OsShim{},
-		clock.NewClock(),
-		store,
-		configMask,
-	)
+// newStore creates the CredHub backed store from the store flags.
+func newStore(logger lager.Logger) (*IndexedStore, error) {
+	credhubClient, err := newCredhub()
+	if err != nil {
+		return nil, err
+	}
+	return NewIndexedStore(logger, credhubClient, *storeID), nil
+}
+
+// newCredhub creates the CredHub client from the store flags.
+func newCredhub() (*credhub.CredHub, error) {
+	var caCerts []string
+	for _, path := range []string{*credhubCACertPath, *uaaCACertPath} {
+		if path == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read ca cert %q: %s", path, err.Error())
+		}
+		caCerts = append(caCerts, string(b))
+	}
 
-	credentials := brokerapi.BrokerCredentials{Username: username, Password: password}
-	handler := brokerapi.New(serviceBroker, logger.Session("broker-api"), credentials)
+	options := []credhub.Option{credhub.Auth(credhubauth.UaaClientCredentials(*uaaClientID, *uaaClientSecret))}
+	if len(caCerts) > 0 {
+		options = append(options, credhub.CaCerts(caCerts...))
+	}
+	return credhub.New(*credhubURL, options...)
+}
 
-	return http_server.New(*atAddress, handler)
+func newConfigMask(allowed string) (vmo.MountOptsMask, error) {
+	return currentFlavor().Mask(allowed)
 }
 
 func validateMfsymlinks(key string, val string) error {
@@ -278,4 +1090,25 @@ func validateVersion(key string, val string) error {
 	}
 
 	return errors.New(fmt.Sprintf("%s is not a valid version", val))
-}
\ No newline at end of file
+}
+
+// countSet returns how many of values are not empty.
+func countSet(values ...string) int {
+	count := 0
+	for _, value := range values {
+		if value != "" {
+			count++
+		}
+	}
+	return count
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -16,6 +16,7 @@ import (
 	"fmt"
 
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/onsi/gomega/gbytes"
@@ -57,11 +58,61 @@ var _ = Describe("smbbroker Main", func() {
 			process = ifrit.Invoke(volmanRunner)
 		})
 
+		It("rejects SMB checks for the NFS broker", func() {
+			args := []string{"-credhubURL", "credhub-url", "-brokerType", "nfs", "-verifyCredentials"}
+
+			volmanRunner := failRunner{
+				Name:       "smbbroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "negotiateVersion, verifyCredentials and healthCheckCredentials need brokerType smb.",
+			}
+
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		It("runs the server for the serve command", func() {
+			args := []string{"serve", "-credhubURL", "credhub-url"}
+
+			volmanRunner := failRunner{
+				Name:       "smbbroker",
+				Command:    exec.Command(binaryPath, args...),
+				StartCheck: "servicesConfig parameter must be provided.",
+			}
+
+			process = ifrit.Invoke(volmanRunner)
+		})
+
 		AfterEach(func() {
 			ginkgomon.Kill(process) // this is only if incorrect implementation leaves process running
 		})
 	})
 
+	Context("Invalid catalog", func() {
+		It("lists every problem of the services config", func() {
+			dir, err := ioutil.TempDir("", "catalog")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "services.yml")
+			Expect(ioutil.WriteFile(path, []byte(`
+- id: smb
+  name: smb
+  description: Existing SMB shares
+  bindable: true
+  plans:
+  - id: 0da18102-48dc-46d0-98b3-7a4ff6dc9c54
+    name: existing
+    description: A preexisting share
+`), 0600)).To(Succeed())
+
+			session, err := gexec.Start(exec.Command(binaryPath, "-credhubURL", "credhub-url", "-servicesConfig", path), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say(`servicesConfig .*services.yml is invalid:\n`))
+			Expect(session.Err).To(gbytes.Say(`  - service id "smb" is not a UUID\n`))
+			Expect(session.Err).To(gbytes.Say(`  - service smb does not require volume_mount\n`))
+		})
+	})
+
 	Context("credhub /info returns error", func() {
 		var volmanRunner *ginkgomon.Runner
 		var credhubServer *ghttp.Server
@@ -267,7 +318,7 @@ var _ = Describe("smbbroker Main", func() {
 				provisionDetailsJsons, err := json.Marshal(brokerapi.ProvisionDetails{
 					ServiceID:     serviceOfferingID,
 					PlanID:        planID,
-					RawParameters: json.RawMessage(`{"share": "sharevalue", "version": "1.0"}`),
+					RawParameters: json.RawMessage(`{"share": "//server/sharevalue", "version": "1.0"}`),
 				})
 
 				Expect(err).NotTo(HaveOccurred())
@@ -303,6 +354,11 @@ var _ = Describe("smbbroker Main", func() {
 				credhubServer.RouteToHandler("GET", "/api/v1/data", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 					if strings.Contains(r.URL.RawQuery, bindingID) {
 						w.WriteHeader(404)
+					} else if strings.Contains(r.URL.RawQuery, "path=") {
+						_, err := w.Write([]byte(`{ "credentials" : [] }`))
+						if err != nil {
+							w.WriteHeader(500)
+						}
 					} else if strings.Contains(r.URL.RawQuery, fmt.Sprintf("current=true&name=%%2Fsmbbroker%%2F%s", serviceInstanceID)) {
 						_, err := w.Write([]byte(`{ "data" : [ { "type": "value", "version_created_at": "2019", "id": "1", "name": "/some-name", "value": { "ServiceFingerPrint": "foobar" } } ] }`))
 						if err != nil {
@@ -327,7 +383,7 @@ var _ = Describe("smbbroker Main", func() {
 					rawParametersMap := map[string]string{
 						"username":   "user",
 						"password":   "foo",
-						"mount":      "somemount",
+						"mount":      "/var/vcap/data/somemount",
 						"readonly":   "true",
 						"domain":     "foo",
 						"mfsymlinks": "true",
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the latency
+// histograms.
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// MetricsWriter is implemented by the parts of the broker that export
+// their own metrics, like the health monitor.
+type MetricsWriter interface {
+	WriteMetrics(w io.Writer)
+}
+
+// Metrics collects request, store and lock metrics and serves them, with
+// those of the registered MetricsWriters, in the Prometheus text format.
+type Metrics struct {
+	Buckets []float64
+
+	store   *IndexedStore
+	writers []MetricsWriter
+
+	mutex     sync.Mutex
+	requests  map[string]*histogram
+	storeCall map[string]*histogram
+	storeErrs map[string]uint64
+	mutexWait *histogram
+}
+
+func NewMetrics(store *IndexedStore) *Metrics {
+	return &Metrics{
+		Buckets:   DefaultLatencyBuckets,
+		store:     store,
+		requests:  map[string]*histogram{},
+		storeCall: map[string]*histogram{},
+		storeErrs: map[string]uint64{},
+	}
+}
+
+// Register adds writers whose metrics are served after the broker's own.
+func (m *Metrics) Register(writers ...MetricsWriter) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.writers = append(m.writers, writers...)
+}
+
+// Handler wraps the broker API handler and records the duration of every
+// request by OSBAPI operation, outcome and HTTP status.
+func (m *Metrics) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		labels := fmt.Sprintf("operation=%s,outcome=%s,status=%s",
+			labelValue(operation(r)), labelValue(outcome(recorder.status)), labelValue(strconv.Itoa(recorder.status)))
+		m.observe(m.requests, labels, time.Since(start))
+	})
+}
+
+// Store wraps store and records the duration and failures of its calls by
+// method.
+func (m *Metrics) Store(store brokerstore.Store) brokerstore.Store {
+	return &instrumentedStore{store: store, metrics: m}
+}
+
+// ObserveMutexWait records how long a request waited for the broker mutex.
+func (m *Metrics) ObserveMutexWait(d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.mutexWait == nil {
+		m.mutexWait = newHistogram(m.Buckets)
+	}
+	m.mutexWait.observe(d.Seconds())
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteMetrics(w)
+}
+
+// WriteMetrics writes all metrics in the Prometheus text format.
+func (m *Metrics) WriteMetrics(w io.Writer) {
+	m.mutex.Lock()
+	requests := copyHistograms(m.requests)
+	storeCalls := copyHistograms(m.storeCall)
+	storeErrs := map[string]uint64{}
+	for k, v := range m.storeErrs {
+		storeErrs[k] = v
+	}
+	var mutexWait *histogram
+	if m.mutexWait != nil {
+		mutexWait = m.mutexWait.copy()
+	}
+	writers := append([]MetricsWriter{}, m.writers...)
+	m.mutex.Unlock()
+
+	fmt.Fprintln(w, "# HELP smbbroker_requests_total Number of broker API requests by operation, outcome and status.")
+	fmt.Fprintln(w, "# TYPE smbbroker_requests_total counter")
+	for _, labels := range sortedLabels(requests) {
+		fmt.Fprintf(w, "smbbroker_requests_total{%s} %d\n", labels, requests[labels].count)
+	}
+	writeHistogram(w, "smbbroker_request_duration_seconds", "Duration of broker API requests by operation, outcome and status.", requests)
+
+	writeHistogram(w, "smbbroker_store_duration_seconds", "Duration of broker store calls by method.", storeCalls)
+	fmt.Fprintln(w, "# HELP smbbroker_store_errors_total Number of failed broker store calls by method.")
+	fmt.Fprintln(w, "# TYPE smbbroker_store_errors_total counter")
+	for _, labels := range sortedLabels(storeCalls) {
+		fmt.Fprintf(w, "smbbroker_store_errors_total{%s} %d\n", labels, storeErrs[labels])
+	}
+
+	if mutexWait != nil {
+		writeHistogram(w, "smbbroker_broker_mutex_wait_seconds", "Time requests waited for the broker mutex.", map[string]*histogram{"": mutexWait})
+	}
+
+	if m.store != nil {
+		instances, err := m.store.RetrieveAllInstanceDetails()
+		if err == nil {
+			fmt.Fprintln(w, "# HELP smbbroker_instances Number of service instances.")
+			fmt.Fprintln(w, "# TYPE smbbroker_instances gauge")
+			fmt.Fprintf(w, "smbbroker_instances %d\n", len(instances))
+		}
+		bindings, err := m.store.RetrieveAllBindingDetails()
+		if err == nil {
+			fmt.Fprintln(w, "# HELP smbbroker_bindings Number of service bindings.")
+			fmt.Fprintln(w, "# TYPE smbbroker_bindings gauge")
+			fmt.Fprintf(w, "smbbroker_bindings %d\n", len(bindings))
+		}
+	}
+
+	for _, writer := range writers {
+		writer.WriteMetrics(w)
+	}
+}
+
+func (m *Metrics) observe(histograms map[string]*histogram, labels string, d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h, ok := histograms[labels]
+	if !ok {
+		h = newHistogram(m.Buckets)
+		histograms[labels] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *Metrics) observeStore(method string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+
+	labels := "method=" + labelValue(method)
+	m.observe(m.storeCall, labels, time.Since(start))
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err != nil {
+		m.storeErrs[labels]++
+	}
+}
+
+// operation names the OSBAPI operation of a broker API request.
+func operation(r *http.Request) string {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[1] == "catalog":
+		return "catalog"
+	case len(parts) == 3 && parts[1] == "service_instances":
+		switch r.Method {
+		case http.MethodPut:
+			return "provision"
+		case http.MethodPatch:
+			return "update"
+		case http.MethodDelete:
+			return "deprovision"
+		}
+		return "get_instance"
+	case len(parts) == 4 && parts[3] == "last_operation":
+		return "last_operation"
+	case len(parts) == 5 && parts[3] == "service_bindings":
+		switch r.Method {
+		case http.MethodPut:
+			return "bind"
+		case http.MethodDelete:
+			return "unbind"
+		}
+		return "get_binding"
+	case len(parts) == 6 && parts[5] == "last_operation":
+		return "last_binding_operation"
+	}
+	return "unknown"
+}
+
+func outcome(status int) string {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return "server_error"
+	case status >= http.StatusBadRequest:
+		return "client_error"
+	}
+	return "success"
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) copy() *histogram {
+	c := *h
+	c.counts = append([]uint64{}, h.counts...)
+	return &c
+}
+
+func copyHistograms(histograms map[string]*histogram) map[string]*histogram {
+	copied := map[string]*histogram{}
+	for k, h := range histograms {
+		copied[k] = h.copy()
+	}
+	return copied
+}
+
+// sortedLabels returns the label sets of histograms in order.
+func sortedLabels(histograms map[string]*histogram) []string {
+	labels := make([]string, 0, len(histograms))
+	for k := range histograms {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+func writeHistogram(w io.Writer, name, help string, histograms map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for _, labels := range sortedLabels(histograms) {
+		h := histograms[labels]
+		prefix := labels
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, bound := range h.bounds {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, prefix, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), h.count)
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// instrumentedStore records the duration and failures of the calls to a
+// brokerstore.Store.
+type instrumentedStore struct {
+	store   brokerstore.Store
+	metrics *Metrics
+}
+
+func (s *instrumentedStore) RetrieveInstanceDetails(id string) (brokerstore.ServiceInstance, error) {
+	start := time.Now()
+	details, err := s.store.RetrieveInstanceDetails(id)
+	s.metrics.observeStore("RetrieveInstanceDetails", start, err)
+	return details, err
+}
+
+func (s *instrumentedStore) RetrieveBindingDetails(id string) (brokerapi.BindDetails, error) {
+	start := time.Now()
+	details, err := s.store.RetrieveBindingDetails(id)
+	s.metrics.observeStore("RetrieveBindingDetails", start, err)
+	return details, err
+}
+
+func (s *instrumentedStore) RetrieveAllInstanceDetails() (map[string]brokerstore.ServiceInstance, error) {
+	start := time.Now()
+	instances, err := s.store.RetrieveAllInstanceDetails()
+	s.metrics.observeStore("RetrieveAllInstanceDetails", start, err)
+	return instances, err
+}
+
+func (s *instrumentedStore) RetrieveAllBindingDetails() (map[string]brokerapi.BindDetails, error) {
+	start := time.Now()
+	bindings, err := s.store.RetrieveAllBindingDetails()
+	s.metrics.observeStore("RetrieveAllBindingDetails", start, err)
+	return bindings, err
+}
+
+func (s *instrumentedStore) CreateInstanceDetails(id string, details brokerstore.ServiceInstance) error {
+	start := time.Now()
+	err := s.store.CreateInstanceDetails(id, details)
+	s.metrics.observeStore("CreateInstanceDetails", start, err)
+	return err
+}
+
+func (s *instrumentedStore) CreateBindingDetails(id string, details brokerapi.BindDetails) error {
+	start := time.Now()
+	err := s.store.CreateBindingDetails(id, details)
+	s.metrics.observeStore("CreateBindingDetails", start, err)
+	return err
+}
+
+func (s *instrumentedStore) DeleteInstanceDetails(id string) error {
+	start := time.Now()
+	err := s.store.DeleteInstanceDetails(id)
+	s.metrics.observeStore("DeleteInstanceDetails", start, err)
+	return err
+}
+
+func (s *instrumentedStore) DeleteBindingDetails(id string) error {
+	start := time.Now()
+	err := s.store.DeleteBindingDetails(id)
+	s.metrics.observeStore("DeleteBindingDetails", start, err)
+	return err
+}
+
+func (s *instrumentedStore) IsInstanceConflict(id string, details brokerstore.ServiceInstance) bool {
+	start := time.Now()
+	conflict := s.store.IsInstanceConflict(id, details)
+	s.metrics.observeStore("IsInstanceConflict", start, nil)
+	return conflict
+}
+
+func (s *instrumentedStore) IsBindingConflict(id string, details brokerapi.BindDetails) bool {
+	start := time.Now()
+	conflict := s.store.IsBindingConflict(id, details)
+	s.metrics.observeStore("IsBindingConflict", start, nil)
+	return conflict
+}
+
+func (s *instrumentedStore) Restore(logger lager.Logger) error {
+	start := time.Now()
+	err := s.store.Restore(logger)
+	s.metrics.observeStore("Restore", start, err)
+	return err
+}
+
+func (s *instrumentedStore) Save(logger lager.Logger) error {
+	start := time.Now()
+	err := s.store.Save(logger)
+	s.metrics.observeStore("Save", start, err)
+	return err
+}
+
+func (s *instrumentedStore) Cleanup() error {
+	start := time.Now()
+	err := s.store.Cleanup()
+	s.metrics.observeStore("Cleanup", start, err)
+	return err
+}
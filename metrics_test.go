@@ -0,0 +1,142 @@
+package main_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type staticMetrics string
+
+func (s staticMetrics) WriteMetrics(w io.Writer) {
+	fmt.Fprintln(w, string(s))
+}
+
+var _ = Describe("Metrics", func() {
+	var (
+		credhub *fakeCredhub
+		store   *IndexedStore
+		metrics *Metrics
+	)
+
+	BeforeEach(func() {
+		credhub = newFakeCredhub()
+		credhub.SetJSON("/smbbroker/instance-1", map[string]interface{}{
+			"ServiceFingerPrint": map[string]interface{}{"share": "//server/share"},
+		})
+		credhub.SetJSON("/smbbroker/binding-1", map[string]interface{}{"app_guid": "app-1"})
+		credhub.SetJSON("/smbbroker/binding-2", map[string]interface{}{"app_guid": "app-2"})
+
+		store = NewIndexedStore(lager.NewLogger("metrics"), credhub, "smbbroker")
+		metrics = NewMetrics(store)
+		metrics.Buckets = []float64{0.5, 1}
+	})
+
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		metrics.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		Expect(recorder.Header().Get("Content-Type")).To(Equal("text/plain; version=0.0.4"))
+		return recorder.Body.String()
+	}
+
+	It("counts broker API requests by operation, outcome and status", func() {
+		handler := metrics.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodPut:
+				w.WriteHeader(http.StatusCreated)
+			case http.MethodDelete:
+				w.WriteHeader(http.StatusInternalServerError)
+			default:
+				w.Write([]byte("{}"))
+			}
+		}))
+
+		for _, request := range []struct{ method, path string }{
+			{http.MethodGet, "/v2/catalog"},
+			{http.MethodPut, "/v2/service_instances/instance-1"},
+			{http.MethodPut, "/v2/service_instances/instance-2"},
+			{http.MethodPut, "/v2/service_instances/instance-1/service_bindings/binding-1"},
+			{http.MethodDelete, "/v2/service_instances/instance-1/service_bindings/binding-1"},
+			{http.MethodGet, "/v2/service_instances/instance-1/last_operation"},
+		} {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(request.method, request.path, nil))
+		}
+
+		output := scrape()
+		Expect(output).To(ContainSubstring("# TYPE smbbroker_requests_total counter\n" +
+			`smbbroker_requests_total{operation="bind",outcome="success",status="201"} 1` + "\n" +
+			`smbbroker_requests_total{operation="catalog",outcome="success",status="200"} 1` + "\n" +
+			`smbbroker_requests_total{operation="last_operation",outcome="success",status="200"} 1` + "\n" +
+			`smbbroker_requests_total{operation="provision",outcome="success",status="201"} 2` + "\n" +
+			`smbbroker_requests_total{operation="unbind",outcome="server_error",status="500"} 1` + "\n"))
+		Expect(output).To(ContainSubstring(`smbbroker_request_duration_seconds_bucket{operation="provision",outcome="success",status="201",le="+Inf"} 2`))
+		Expect(output).To(ContainSubstring(`smbbroker_request_duration_seconds_count{operation="provision",outcome="success",status="201"} 2`))
+	})
+
+	It("records store calls and failures by method", func() {
+		instrumented := metrics.Store(store.Store)
+
+		_, err := instrumented.RetrieveInstanceDetails("instance-1")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = instrumented.RetrieveInstanceDetails("missing")
+		Expect(err).To(HaveOccurred())
+		Expect(instrumented.DeleteBindingDetails("binding-2")).To(Succeed())
+
+		output := scrape()
+		Expect(output).To(ContainSubstring(`smbbroker_store_duration_seconds_count{method="RetrieveInstanceDetails"} 2`))
+		Expect(output).To(ContainSubstring(`smbbroker_store_errors_total{method="RetrieveInstanceDetails"} 1`))
+		Expect(output).To(ContainSubstring(`smbbroker_store_errors_total{method="DeleteBindingDetails"} 0`))
+	})
+
+	It("records the calls the index answers or makes itself", func() {
+		store.Metrics = metrics
+
+		Expect(store.Refresh()).To(Succeed())
+		Expect(store.IndexBinding("binding-1", BindingIndex{InstanceID: "instance-1"})).To(Succeed())
+		_, err := store.RetrieveAllBindingDetails()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = store.RetrieveAllInstanceDetails()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.DeleteBindingDetails("binding-1")).To(Succeed())
+
+		output := scrape()
+		for _, method := range []string{"Refresh", "IndexBinding", "RetrieveAllBindingDetails", "RetrieveAllInstanceDetails", "DeleteBindingIndex"} {
+			Expect(output).To(ContainSubstring(`smbbroker_store_duration_seconds_count{method="` + method + `"} 1`))
+			Expect(output).To(ContainSubstring(`smbbroker_store_errors_total{method="` + method + `"} 0`))
+		}
+	})
+
+	It("records the time spent waiting for the broker mutex", func() {
+		metrics.ObserveMutexWait(100 * time.Millisecond)
+		metrics.ObserveMutexWait(2 * time.Second)
+
+		Expect(scrape()).To(ContainSubstring("# TYPE smbbroker_broker_mutex_wait_seconds histogram\n" +
+			`smbbroker_broker_mutex_wait_seconds_bucket{le="0.5"} 1` + "\n" +
+			`smbbroker_broker_mutex_wait_seconds_bucket{le="1"} 1` + "\n" +
+			`smbbroker_broker_mutex_wait_seconds_bucket{le="+Inf"} 2` + "\n" +
+			"smbbroker_broker_mutex_wait_seconds_sum 2.1\n" +
+			"smbbroker_broker_mutex_wait_seconds_count 2\n"))
+
+		var none *Metrics
+		Expect(func() { none.ObserveMutexWait(time.Second) }).NotTo(Panic())
+	})
+
+	It("exports instance and binding counts and registered metrics", func() {
+		metrics.Register(staticMetrics("smbbroker_share_healthy 1"))
+
+		buffer := &bytes.Buffer{}
+		metrics.WriteMetrics(buffer)
+		Expect(buffer.String()).To(ContainSubstring("smbbroker_instances 1\n"))
+		Expect(buffer.String()).To(ContainSubstring("smbbroker_bindings 2\n"))
+		Expect(buffer.String()).To(HaveSuffix("smbbroker_share_healthy 1\n"))
+	})
+})
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"code.cloudfoundry.org/existingvolumebroker"
+	"code.cloudfoundry.org/lager"
+)
+
+// MountPolicyMatch selects the requests a rule applies to. Empty lists match
+// everything.
+type MountPolicyMatch struct {
+	Orgs          []string `json:"orgs,omitempty"`
+	Spaces        []string `json:"spaces,omitempty"`
+	Plans         []string `json:"plans,omitempty"`
+	Services      []string `json:"services,omitempty"`
+	ExcludeOrgs   []string `json:"exclude_orgs,omitempty"`
+	ExcludeSpaces []string `json:"exclude_spaces,omitempty"`
+}
+
+// MountPolicyRule constrains the mount options of matching requests. The
+// readonly mode is treated like any other option.
+//
+// Require lists options that have to be set. Forbid lists options that must
+// not be set, or only the forbidden values when a value list is given.
+// Defaults are applied when the option is missing and Force always wins over
+// user supplied values.
+type MountPolicyRule struct {
+	Name     string                 `json:"name"`
+	Match    MountPolicyMatch       `json:"match"`
+	Require  []string               `json:"require,omitempty"`
+	Forbid   map[string][]string    `json:"forbid,omitempty"`
+	Defaults map[string]interface{} `json:"defaults,omitempty"`
+	Force    map[string]interface{} `json:"force,omitempty"`
+}
+
+type MountPolicyRequest struct {
+	OrgGUID   string `json:"org"`
+	SpaceGUID string `json:"space"`
+	PlanID    string `json:"plan"`
+	ServiceID string `json:"service"`
+}
+
+type MountPolicyError struct {
+	Rule   string
+	Reason string
+}
+
+func (e *MountPolicyError) Error() string {
+	return fmt.Sprintf("%s by mount policy rule %q", e.Reason, e.Rule)
+}
+
+// MountPolicy evaluates the rules of a policy file. Reload swaps in a new
+// set of rules without interrupting requests that are being evaluated.
+type MountPolicy struct {
+	path  string
+	mutex sync.RWMutex
+	rules []MountPolicyRule
+}
+
+func NewMountPolicyFromConfig(pathToMountPolicy string) (*MountPolicy, error) {
+	policy := &MountPolicy{path: pathToMountPolicy}
+	if err := policy.Reload(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Reload re-reads the policy file. The current rules are kept when the file
+// cannot be loaded.
+func (p *MountPolicy) Reload() error {
+	/* #nosec */
+	contents, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+
+	var config struct {
+		Rules []MountPolicyRule `json:"rules"`
+	}
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return err
+	}
+
+	for i, rule := range config.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("mount policy rule %d has no name", i)
+		}
+		for _, options := range []map[string]interface{}{rule.Defaults, rule.Force} {
+			for k := range options {
+				if k == existingvolumebroker.SHARE_KEY || k == existingvolumebroker.SOURCE_KEY {
+					return fmt.Errorf("mount policy rule %q must not set %q", rule.Name, k)
+				}
+			}
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.rules = config.Rules
+	return nil
+}
+
+// Watch reloads the policy whenever its file changes.
+func (p *MountPolicy) Watch(logger lager.Logger, stop <-chan struct{}) error {
+	logger = logger.Session("mount-policy")
+	return WatchFile(logger, p.path, stop, func() {
+		if err := p.Reload(); err != nil {
+			logger.Error("reload-failed", err)
+			return
+		}
+		logger.Info("reloaded", lager.Data{"rules": len(p.Rules())})
+	})
+}
+
+func (p *MountPolicy) Rules() []MountPolicyRule {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.rules
+}
+
+// Matching returns the rules that apply to request, in file order.
+func (p *MountPolicy) Matching(request MountPolicyRequest) []MountPolicyRule {
+	if p == nil {
+		return nil
+	}
+
+	var matching []MountPolicyRule
+	for _, rule := range p.Rules() {
+		if rule.Match.matches(request) {
+			matching = append(matching, rule)
+		}
+	}
+	return matching
+}
+
+// CheckForbidden reports options that matching rules forbid outright. It is
+// used at provision time, before bind parameters are known.
+func (p *MountPolicy) CheckForbidden(request MountPolicyRequest, opts map[string]interface{}) error {
+	for _, rule := range p.Matching(request) {
+		if err := rule.checkForbidden(opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply evaluates all matching rules against the merged instance and bind
+// options. It returns the options the policy sets through Force and
+// Defaults, or an error when an option is forbidden or missing.
+func (p *MountPolicy) Apply(request MountPolicyRequest, opts map[string]interface{}) (map[string]interface{}, error) {
+	rules := p.Matching(request)
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	merged := map[string]interface{}{}
+	for k, v := range opts {
+		merged[k] = v
+	}
+	changes := map[string]interface{}{}
+
+	for _, rule := range rules {
+		for _, k := range sortedKeys(rule.Force) {
+			merged[k] = rule.Force[k]
+			changes[k] = rule.Force[k]
+		}
+	}
+	for _, rule := range rules {
+		for _, k := range sortedKeys(rule.Defaults) {
+			if _, ok := merged[k]; !ok {
+				merged[k] = rule.Defaults[k]
+				changes[k] = rule.Defaults[k]
+			}
+		}
+	}
+
+	for _, rule := range rules {
+		if err := rule.checkForbidden(merged); err != nil {
+			return nil, err
+		}
+		for _, k := range rule.Require {
+			if _, ok := merged[k]; !ok {
+				return nil, &MountPolicyError{Rule: rule.Name, Reason: fmt.Sprintf("mount option %q is required", k)}
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+func (r MountPolicyRule) checkForbidden(opts map[string]interface{}) error {
+	forbidden := make([]string, 0, len(r.Forbid))
+	for k := range r.Forbid {
+		forbidden = append(forbidden, k)
+	}
+	sort.Strings(forbidden)
+
+	for _, k := range forbidden {
+		v, ok := opts[k]
+		if !ok {
+			continue
+		}
+
+		value := fmt.Sprintf("%v", v)
+		if len(r.Forbid[k]) == 0 {
+			return &MountPolicyError{Rule: r.Name, Reason: fmt.Sprintf("mount option %q is forbidden", k)}
+		}
+		if contains(r.Forbid[k], value) {
+			return &MountPolicyError{Rule: r.Name, Reason: fmt.Sprintf("mount option \"%s=%s\" is forbidden", k, value)}
+		}
+	}
+	return nil
+}
+
+func (m MountPolicyMatch) matches(request MountPolicyRequest) bool {
+	matchesList := func(list []string, value string) bool {
+		return len(list) == 0 || contains(list, value)
+	}
+
+	return matchesList(m.Orgs, request.OrgGUID) &&
+		matchesList(m.Spaces, request.SpaceGUID) &&
+		matchesList(m.Plans, request.PlanID) &&
+		matchesList(m.Services, request.ServiceID) &&
+		!contains(m.ExcludeOrgs, request.OrgGUID) &&
+		!contains(m.ExcludeSpaces, request.SpaceGUID)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
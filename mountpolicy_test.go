@@ -0,0 +1,137 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const testMountPolicy = `{
+	"rules": [
+		{
+			"name": "read-only-outside-finance",
+			"match": {"exclude_orgs": ["finance-org"]},
+			"force": {"readonly": true}
+		},
+		{
+			"name": "no-smb1-in-sandbox",
+			"match": {"spaces": ["sandbox-space"]},
+			"forbid": {"version": ["1.0"], "mfsymlinks": []},
+			"defaults": {"version": "3.0"}
+		},
+		{
+			"name": "finance-needs-domain",
+			"match": {"orgs": ["finance-org"], "plans": ["plan-id"]},
+			"require": ["domain"]
+		}
+	]
+}`
+
+var _ = Describe("MountPolicy", func() {
+	var (
+		dir    string
+		path   string
+		policy *MountPolicy
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "mount-policy")
+		Expect(err).NotTo(HaveOccurred())
+
+		path = filepath.Join(dir, "mount-policy.json")
+		Expect(ioutil.WriteFile(path, []byte(testMountPolicy), 0600)).To(Succeed())
+
+		policy, err = NewMountPolicyFromConfig(path)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("matches rules on org, space and plan", func() {
+		names := func(rules []MountPolicyRule) []string {
+			var names []string
+			for _, rule := range rules {
+				names = append(names, rule.Name)
+			}
+			return names
+		}
+
+		Expect(names(policy.Matching(MountPolicyRequest{OrgGUID: "other-org", SpaceGUID: "sandbox-space"}))).To(Equal([]string{"read-only-outside-finance", "no-smb1-in-sandbox"}))
+		Expect(names(policy.Matching(MountPolicyRequest{OrgGUID: "finance-org", PlanID: "plan-id"}))).To(Equal([]string{"finance-needs-domain"}))
+		Expect(policy.Matching(MountPolicyRequest{OrgGUID: "finance-org", PlanID: "other-plan"})).To(BeEmpty())
+	})
+
+	It("forces and defaults options", func() {
+		changes, err := policy.Apply(MountPolicyRequest{OrgGUID: "other-org", SpaceGUID: "sandbox-space"}, map[string]interface{}{"username": "user"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changes).To(Equal(map[string]interface{}{"readonly": true, "version": "3.0"}))
+	})
+
+	It("keeps user values over defaults", func() {
+		changes, err := policy.Apply(MountPolicyRequest{OrgGUID: "other-org", SpaceGUID: "sandbox-space"}, map[string]interface{}{"version": "2.1"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changes).NotTo(HaveKey("version"))
+	})
+
+	It("rejects forbidden values", func() {
+		_, err := policy.Apply(MountPolicyRequest{OrgGUID: "other-org", SpaceGUID: "sandbox-space"}, map[string]interface{}{"version": "1.0"})
+		Expect(err).To(MatchError(`mount option "version=1.0" is forbidden by mount policy rule "no-smb1-in-sandbox"`))
+
+		err = policy.CheckForbidden(MountPolicyRequest{SpaceGUID: "sandbox-space"}, map[string]interface{}{"mfsymlinks": "true"})
+		Expect(err).To(MatchError(`mount option "mfsymlinks" is forbidden by mount policy rule "no-smb1-in-sandbox"`))
+	})
+
+	It("rejects missing required options", func() {
+		_, err := policy.Apply(MountPolicyRequest{OrgGUID: "finance-org", PlanID: "plan-id"}, map[string]interface{}{})
+		Expect(err).To(MatchError(`mount option "domain" is required by mount policy rule "finance-needs-domain"`))
+	})
+
+	It("refuses rules that set the share", func() {
+		Expect(ioutil.WriteFile(path, []byte(`{"rules": [{"name": "bad", "force": {"share": "//x/y"}}]}`), 0600)).To(Succeed())
+		Expect(policy.Reload()).To(MatchError(`mount policy rule "bad" must not set "share"`))
+		Expect(policy.Rules()).To(HaveLen(3))
+	})
+
+	It("reloads the policy when the file changes", func() {
+		stop := make(chan struct{})
+		defer close(stop)
+		Expect(policy.Watch(lager.NewLogger("test"), stop)).To(Succeed())
+
+		Expect(ioutil.WriteFile(path, []byte(`{"rules": [{"name": "only-rule"}]}`), 0600)).To(Succeed())
+		Eventually(func() int { return len(policy.Rules()) }, "5s").Should(Equal(1))
+	})
+
+	Describe("policy test command", func() {
+		It("shows matching rules and the resulting options", func() {
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			code := PolicyCommand([]string{"test", "-mountPolicyConfig", path, "-org", "other-org", "-space", "sandbox-space"}, stdout, stderr)
+
+			Expect(code).To(Equal(0))
+			Expect(stdout.String()).To(Equal("matches rule \"read-only-outside-finance\"\nmatches rule \"no-smb1-in-sandbox\"\nsets readonly=true\nsets version=3.0\nallowed\n"))
+		})
+
+		It("reports denied requests", func() {
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			code := PolicyCommand([]string{"test", "-mountPolicyConfig", path, "-space", "sandbox-space", "-params", `{"version": "1.0"}`}, stdout, stderr)
+
+			Expect(code).To(Equal(1))
+			Expect(stdout.String()).To(ContainSubstring(`denied: mount option "version=1.0" is forbidden`))
+		})
+
+		It("requires a policy file", func() {
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			Expect(PolicyCommand([]string{"test"}, stdout, stderr)).To(Equal(2))
+			Expect(stderr.String()).To(ContainSubstring("mountPolicyConfig parameter must be provided"))
+		})
+	})
+})
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/smbbroker/smbclient"
+)
+
+const VersionKey = "version"
+
+// VersionError is returned when the share host does not support the SMB
+// version requested for an instance, or none of the versions the broker
+// knows about.
+type VersionError struct {
+	Host     string
+	Versions []string
+}
+
+func (e *VersionError) Error() string {
+	if len(e.Versions) == 1 {
+		return fmt.Sprintf("share host %q does not support SMB version %s", e.Host, e.Versions[0])
+	}
+	return fmt.Sprintf("share host %q supports none of the SMB versions %s", e.Host, strings.Join(e.Versions, ", "))
+}
+
+// VersionNegotiator asks the share host which SMB dialects it supports. It
+// rejects requested versions the host does not offer and picks the highest
+// common version when none is requested.
+type VersionNegotiator struct {
+	Port      int
+	Timeout   time.Duration
+	SkipPlans []string
+
+	Client *smbclient.Client
+}
+
+func NewVersionNegotiator(port int, timeout time.Duration) *VersionNegotiator {
+	return &VersionNegotiator{
+		Port:    port,
+		Timeout: timeout,
+		Client:  smbclient.New(),
+	}
+}
+
+// Negotiate checks the version option in configuration against host and
+// sets it to the negotiated version when it is missing. Connection failures
+// are returned as a *ShareProbeError.
+func (n *VersionNegotiator) Negotiate(ctx context.Context, host, planID string, configuration map[string]interface{}) error {
+	if n == nil || contains(n.SkipPlans, planID) {
+		return nil
+	}
+
+	versions := smbclient.Versions
+	requested, ok := configuration[VersionKey]
+	if ok {
+		version, isString := requested.(string)
+		if !isString || !contains(smbclient.Versions, version) {
+			// left to the mount option validation
+			return nil
+		}
+		versions = []string{version}
+	}
+
+	if n.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.Timeout)
+		defer cancel()
+	}
+
+	address := net.JoinHostPort(host, strconv.Itoa(n.Port))
+	version, err := n.Client.Negotiate(ctx, address, versions)
+	if err != nil {
+		var dialectErr *smbclient.DialectError
+		if errors.As(err, &dialectErr) {
+			return &VersionError{Host: host, Versions: dialectErr.Offered}
+		}
+
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return &ShareProbeError{Host: host, Unresolved: true, Reason: lookupReason(dnsErr)}
+		}
+		return &ShareProbeError{Host: host, Address: address, Reason: dialReason(ctx, err)}
+	}
+
+	if !ok {
+		configuration[VersionKey] = version
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultShareProbePort    = 445
+	DefaultShareProbeTimeout = 5 * time.Second
+)
+
+// ShareProbeError is returned when a share host cannot be resolved or does
+// not accept connections on the SMB port.
+type ShareProbeError struct {
+	Host       string
+	Address    string
+	Unresolved bool
+	Reason     string
+}
+
+func (e *ShareProbeError) Error() string {
+	if e.Unresolved {
+		return fmt.Sprintf("share host %q cannot be resolved: %s", e.Host, e.Reason)
+	}
+	return fmt.Sprintf("share host %q is not reachable at %s: %s", e.Host, e.Address, e.Reason)
+}
+
+// ShareProbe checks that a share host accepts TCP connections before an
+// instance is created for it, so that typos do not surface only when an app
+// fails to mount the share on a cell.
+type ShareProbe struct {
+	Port      int
+	Timeout   time.Duration
+	SkipPlans []string
+
+	LookupHost  func(ctx context.Context, host string) ([]string, error)
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func NewShareProbe(port int, timeout time.Duration) *ShareProbe {
+	resolver := &net.Resolver{}
+	dialer := &net.Dialer{}
+	return &ShareProbe{
+		Port:        port,
+		Timeout:     timeout,
+		LookupHost:  resolver.LookupHost,
+		DialContext: dialer.DialContext,
+	}
+}
+
+// Check resolves host and connects to each of its addresses in turn until
+// one accepts the connection. It is a no-op for plans the probe is turned
+// off for.
+func (p *ShareProbe) Check(ctx context.Context, host, planID string) error {
+	if p == nil || contains(p.SkipPlans, planID) {
+		return nil
+	}
+
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	addresses := []string{host}
+	if net.ParseIP(host) == nil {
+		var err error
+		addresses, err = p.LookupHost(ctx, host)
+		if err != nil {
+			return &ShareProbeError{Host: host, Unresolved: true, Reason: lookupReason(err)}
+		}
+		if len(addresses) == 0 {
+			return &ShareProbeError{Host: host, Unresolved: true, Reason: "no addresses found"}
+		}
+	}
+
+	var probeErr error
+	for _, address := range addresses {
+		target := net.JoinHostPort(address, strconv.Itoa(p.Port))
+		conn, err := p.DialContext(ctx, "tcp", target)
+		if err == nil {
+			_ = conn.Close()
+			return nil
+		}
+		probeErr = &ShareProbeError{Host: host, Address: target, Reason: dialReason(ctx, err)}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return probeErr
+}
+
+func lookupReason(err error) string {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		if dnsErr.IsNotFound {
+			return "no such host"
+		}
+		if dnsErr.IsTimeout {
+			return "lookup timed out"
+		}
+		return dnsErr.Err
+	}
+	return err.Error()
+}
+
+func dialReason(ctx context.Context, err error) string {
+	if ctx.Err() == context.DeadlineExceeded {
+		return "connection timed out"
+	}
+	if opErr, ok := err.(*net.OpError); ok && opErr.Err != nil {
+		return opErr.Err.Error()
+	}
+	return err.Error()
+}
@@ -0,0 +1,99 @@
+package main_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ShareProbe", func() {
+	var (
+		listener net.Listener
+		port     int
+		probe    *ShareProbe
+	)
+
+	BeforeEach(func() {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		port = listener.Addr().(*net.TCPAddr).Port
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+
+		probe = NewShareProbe(port, time.Second)
+		probe.LookupHost = func(_ context.Context, host string) ([]string, error) {
+			switch host {
+			case "server":
+				return []string{"127.0.0.1"}, nil
+			case "multi":
+				return []string{"127.0.0.2", "127.0.0.1"}, nil
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	It("succeeds when the host accepts connections", func() {
+		Expect(probe.Check(context.Background(), "server", "plan")).To(Succeed())
+		Expect(probe.Check(context.Background(), "127.0.0.1", "plan")).To(Succeed())
+	})
+
+	It("tries every address of the host", func() {
+		Expect(probe.Check(context.Background(), "multi", "plan")).To(Succeed())
+	})
+
+	It("reports hosts that cannot be resolved", func() {
+		err := probe.Check(context.Background(), "unknown", "plan")
+		Expect(err).To(MatchError(`share host "unknown" cannot be resolved: no such host`))
+		Expect(err.(*ShareProbeError).Unresolved).To(BeTrue())
+	})
+
+	It("reports hosts that refuse connections", func() {
+		listener.Close()
+
+		err := probe.Check(context.Background(), "server", "plan")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix(`share host "server" is not reachable at 127.0.0.1:` + strconv.Itoa(port) + ": "))
+		Expect(err.(*ShareProbeError).Unresolved).To(BeFalse())
+	})
+
+	It("gives up at the deadline", func() {
+		probe.Timeout = 50 * time.Millisecond
+		probe.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, errors.New("i/o timeout")
+		}
+
+		err := probe.Check(context.Background(), "server", "plan")
+		Expect(err).To(MatchError(`share host "server" is not reachable at 127.0.0.1:` + strconv.Itoa(port) + ": connection timed out"))
+	})
+
+	It("is turned off for skipped plans", func() {
+		probe.SkipPlans = []string{"plan"}
+		Expect(probe.Check(context.Background(), "unknown", "plan")).To(Succeed())
+		Expect(probe.Check(context.Background(), "unknown", "other-plan")).To(HaveOccurred())
+	})
+
+	It("does nothing when not configured", func() {
+		var probe *ShareProbe
+		Expect(probe.Check(context.Background(), "unknown", "plan")).To(Succeed())
+	})
+})
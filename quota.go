@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// QuotaLimits caps the number of records the broker creates. Zero means no
+// limit; in org and space overrides a negative value lifts a default limit.
+type QuotaLimits struct {
+	MaxInstancesPerOrg     int `json:"max_instances_per_org,omitempty"`
+	MaxInstancesPerSpace   int `json:"max_instances_per_space,omitempty"`
+	MaxBindingsPerInstance int `json:"max_bindings_per_instance,omitempty"`
+	MaxServersPerOrg       int `json:"max_servers_per_org,omitempty"`
+}
+
+// Quotas holds the default limits together with per org and per space
+// overrides keyed by GUID. Space overrides win over org overrides.
+type Quotas struct {
+	QuotaLimits
+	Orgs   map[string]QuotaLimits `json:"orgs,omitempty"`
+	Spaces map[string]QuotaLimits `json:"spaces,omitempty"`
+}
+
+type QuotaError struct {
+	Scope string
+	GUID  string
+	Limit int
+	What  string
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s %q has reached its limit of %d %s", e.Scope, e.GUID, e.Limit, e.What)
+}
+
+func NewQuotasFromConfig(pathToQuotaConfig string) (*Quotas, error) {
+	/* #nosec */
+	contents, err := ioutil.ReadFile(pathToQuotaConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var quotas Quotas
+	if err := json.Unmarshal(contents, &quotas); err != nil {
+		return nil, err
+	}
+	return &quotas, nil
+}
+
+// LimitsFor returns the effective limits for an org and space.
+func (q *Quotas) LimitsFor(orgGUID, spaceGUID string) QuotaLimits {
+	if q == nil {
+		return QuotaLimits{}
+	}
+
+	limits := q.QuotaLimits
+	limits = limits.override(q.Orgs[orgGUID])
+	limits = limits.override(q.Spaces[spaceGUID])
+	return limits
+}
+
+func (l QuotaLimits) override(o QuotaLimits) QuotaLimits {
+	pick := func(current, override int) int {
+		switch {
+		case override < 0:
+			return 0
+		case override > 0:
+			return override
+		}
+		return current
+	}
+
+	return QuotaLimits{
+		MaxInstancesPerOrg:     pick(l.MaxInstancesPerOrg, o.MaxInstancesPerOrg),
+		MaxInstancesPerSpace:   pick(l.MaxInstancesPerSpace, o.MaxInstancesPerSpace),
+		MaxBindingsPerInstance: pick(l.MaxBindingsPerInstance, o.MaxBindingsPerInstance),
+		MaxServersPerOrg:       pick(l.MaxServersPerOrg, o.MaxServersPerOrg),
+	}
+}
+
+// CheckProvision verifies that creating instanceID on host keeps the org and
+// space within their limits.
+func (q *Quotas) CheckProvision(store *IndexedStore, instanceID, orgGUID, spaceGUID, host string) error {
+	limits := q.LimitsFor(orgGUID, spaceGUID)
+	if limits == (QuotaLimits{}) {
+		return nil
+	}
+
+	if limits.MaxInstancesPerOrg > 0 || limits.MaxServersPerOrg > 0 {
+		orgInstances, err := store.InstancesByOrg(orgGUID)
+		if err != nil {
+			return err
+		}
+		delete(orgInstances, instanceID)
+
+		if limits.MaxInstancesPerOrg > 0 && len(orgInstances) >= limits.MaxInstancesPerOrg {
+			return &QuotaError{Scope: "org", GUID: orgGUID, Limit: limits.MaxInstancesPerOrg, What: "service instances"}
+		}
+
+		if limits.MaxServersPerOrg > 0 {
+			servers := map[string]bool{}
+			for _, instance := range orgInstances {
+				if share, err := instanceShare(instance); err == nil {
+					servers[share.Host] = true
+				}
+			}
+			if !servers[host] && len(servers) >= limits.MaxServersPerOrg {
+				return &QuotaError{Scope: "org", GUID: orgGUID, Limit: limits.MaxServersPerOrg, What: "distinct servers"}
+			}
+		}
+	}
+
+	if limits.MaxInstancesPerSpace > 0 {
+		spaceInstances, err := store.InstancesBySpace(spaceGUID)
+		if err != nil {
+			return err
+		}
+		delete(spaceInstances, instanceID)
+
+		if len(spaceInstances) >= limits.MaxInstancesPerSpace {
+			return &QuotaError{Scope: "space", GUID: spaceGUID, Limit: limits.MaxInstancesPerSpace, What: "service instances"}
+		}
+	}
+
+	return nil
+}
+
+// CheckBind verifies that adding bindingID keeps instanceID within its limit.
+func (q *Quotas) CheckBind(store *IndexedStore, instanceID, bindingID, orgGUID, spaceGUID string) error {
+	limits := q.LimitsFor(orgGUID, spaceGUID)
+	if limits.MaxBindingsPerInstance <= 0 {
+		return nil
+	}
+
+	bindings, err := store.BindingsByInstance(instanceID)
+	if err != nil {
+		return err
+	}
+	delete(bindings, bindingID)
+
+	if len(bindings) >= limits.MaxBindingsPerInstance {
+		return &QuotaError{Scope: "service instance", GUID: instanceID, Limit: limits.MaxBindingsPerInstance, What: "bindings"}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/existingvolumebroker"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	vmo "code.cloudfoundry.org/volume-mount-options"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Quotas", func() {
+	It("loads defaults and overrides from a file", func() {
+		dir, err := ioutil.TempDir("", "quotas")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "quotas.json")
+		Expect(ioutil.WriteFile(path, []byte(`{
+			"max_instances_per_org": 10,
+			"max_bindings_per_instance": 5,
+			"orgs": {"big-org": {"max_instances_per_org": 100, "max_servers_per_org": 3}},
+			"spaces": {"free-space": {"max_bindings_per_instance": -1}}
+		}`), 0600)).To(Succeed())
+
+		quotas, err := NewQuotasFromConfig(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(quotas.LimitsFor("org", "space")).To(Equal(QuotaLimits{MaxInstancesPerOrg: 10, MaxBindingsPerInstance: 5}))
+		Expect(quotas.LimitsFor("big-org", "space")).To(Equal(QuotaLimits{MaxInstancesPerOrg: 100, MaxBindingsPerInstance: 5, MaxServersPerOrg: 3}))
+		Expect(quotas.LimitsFor("big-org", "free-space")).To(Equal(QuotaLimits{MaxInstancesPerOrg: 100, MaxServersPerOrg: 3}))
+	})
+
+	It("has no limits when not configured", func() {
+		var quotas *Quotas
+		Expect(quotas.LimitsFor("org", "space")).To(Equal(QuotaLimits{}))
+	})
+
+	Describe("enforcement", func() {
+		var store *IndexedStore
+
+		BeforeEach(func() {
+			store = NewIndexedStore(lager.NewLogger("quotas"), newFakeCredhub(), "smbbroker")
+		})
+
+		createInstance := func(id, org, space, share string) {
+			Expect(store.CreateInstanceDetails(id, brokerstore.ServiceInstance{
+				ServiceID: "service", PlanID: "plan", OrganizationGUID: org, SpaceGUID: space,
+				ServiceFingerPrint: map[string]interface{}{"share": share},
+			})).To(Succeed())
+		}
+
+		createBinding := func(id, instanceID string) {
+			Expect(store.CreateBindingDetails(id, brokerapi.BindDetails{AppGUID: "app-guid"})).To(Succeed())
+			Expect(store.IndexBinding(id, BindingIndex{InstanceID: instanceID})).To(Succeed())
+		}
+
+		It("stops provisioning once an org or space reaches its limit", func() {
+			quotas := &Quotas{QuotaLimits: QuotaLimits{MaxInstancesPerOrg: 2, MaxInstancesPerSpace: 1}}
+			createInstance("instance-1", "org", "space-1", "//server/share")
+
+			Expect(quotas.CheckProvision(store, "instance-2", "org", "space-2", "server")).To(Succeed())
+			Expect(quotas.CheckProvision(store, "instance-2", "org", "space-1", "server")).To(MatchError(`space "space-1" has reached its limit of 1 service instances`))
+
+			createInstance("instance-2", "org", "space-2", "//server/share")
+			Expect(quotas.CheckProvision(store, "instance-3", "org", "space-3", "server")).To(MatchError(`org "org" has reached its limit of 2 service instances`))
+			Expect(quotas.CheckProvision(store, "instance-2", "org", "space-2", "server")).To(Succeed())
+		})
+
+		It("limits the distinct servers of an org", func() {
+			quotas := &Quotas{QuotaLimits: QuotaLimits{MaxServersPerOrg: 1}}
+			createInstance("instance-1", "org", "space", "//server/share")
+
+			Expect(quotas.CheckProvision(store, "instance-2", "org", "space", "server")).To(Succeed())
+			Expect(quotas.CheckProvision(store, "instance-2", "org", "space", "other-server")).To(MatchError(`org "org" has reached its limit of 1 distinct servers`))
+		})
+
+		It("stops binding once an instance reaches its limit", func() {
+			quotas := &Quotas{QuotaLimits: QuotaLimits{MaxBindingsPerInstance: 1}}
+			createInstance("instance-1", "org", "space", "//server/share")
+			createBinding("binding-1", "instance-1")
+
+			Expect(quotas.CheckBind(store, "instance-1", "binding-2", "org", "space")).To(MatchError(`service instance "instance-1" has reached its limit of 1 bindings`))
+			Expect(quotas.CheckBind(store, "instance-1", "binding-1", "org", "space")).To(Succeed())
+		})
+
+		It("lifts a default limit with a negative override", func() {
+			quotas := &Quotas{
+				QuotaLimits: QuotaLimits{MaxInstancesPerOrg: 1, MaxBindingsPerInstance: 1},
+				Orgs:        map[string]QuotaLimits{"big-org": {MaxInstancesPerOrg: -1}},
+				Spaces:      map[string]QuotaLimits{"free-space": {MaxBindingsPerInstance: -1}},
+			}
+			createInstance("instance-1", "big-org", "free-space", "//server/share")
+			createBinding("binding-1", "instance-1")
+
+			Expect(quotas.CheckProvision(store, "instance-2", "big-org", "space", "server")).To(Succeed())
+			Expect(quotas.CheckBind(store, "instance-1", "binding-2", "big-org", "free-space")).To(Succeed())
+			Expect(quotas.CheckBind(store, "instance-1", "binding-2", "big-org", "space")).To(HaveOccurred())
+		})
+
+		It("fails provisions over the limit with a 403", func() {
+			logger := lager.NewLogger("quotas")
+			services, err := NewServicesFromConfig("./default_services.json")
+			Expect(err).NotTo(HaveOccurred())
+			mask, err := vmo.NewMountOptsMask([]string{"source"}, map[string]interface{}{}, map[string]string{"share": "source"}, []string{}, []string{"source"})
+			Expect(err).NotTo(HaveOccurred())
+			broker := NewBroker(logger, existingvolumebroker.New(existingvolumebroker.BrokerTypeSMB, logger, services, &osshim.OsShim{}, clock.NewClock(), store, mask), store)
+			broker.Quotas = &Quotas{QuotaLimits: QuotaLimits{MaxInstancesPerOrg: 1}}
+			createInstance("instance-1", "org", "space", "//server/share")
+
+			_, err = broker.Provision(context.Background(), "instance-2", domain.ProvisionDetails{
+				ServiceID:        "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+				PlanID:           "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+				OrganizationGUID: "org",
+				SpaceGUID:        "space",
+				RawParameters:    json.RawMessage(`{"share": "//server/share"}`),
+			}, false)
+			Expect(err).To(BeAssignableToTypeOf(&apiresponses.FailureResponse{}))
+			Expect(err.(*apiresponses.FailureResponse).ValidatedStatusCode(nil)).To(Equal(403))
+			Expect(err).To(MatchError(`org "org" has reached its limit of 1 service instances`))
+		})
+	})
+})
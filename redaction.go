@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ParamsHMACKey is the parameter under which redacted binding records keep
+// the HMAC of the parameters the binding was created with.
+const ParamsHMACKey = "paramsHmac"
+
+// BindingRedaction keeps the secret bind parameters out of the store while
+// still recognizing a repeated bind with the same parameters. Records keep
+// their other parameters next to a keyed HMAC of the canonical JSON of all
+// of them, which unlike the bcrypt hash of the volume broker's stores is
+// cheap to check while the broker mutex is held and does not depend on the
+// order of the keys.
+type BindingRedaction struct {
+	key []byte
+}
+
+func NewBindingRedaction(key string) (*BindingRedaction, error) {
+	if len(key) < MinKeyLength {
+		return nil, fmt.Errorf("binding parameters key must be at least %d bytes long", MinKeyLength)
+	}
+	return &BindingRedaction{key: []byte(key)}, nil
+}
+
+// Redact returns the parameters to store for a binding created with raw.
+// Without a key they are stored as they are.
+func (r *BindingRedaction) Redact(raw json.RawMessage) (json.RawMessage, error) {
+	if r == nil || len(raw) == 0 {
+		return raw, nil
+	}
+
+	sum, err := r.sum(raw)
+	if err != nil {
+		return nil, err
+	}
+	params, err := decodeParameters(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	redacted := map[string]interface{}{ParamsHMACKey: sum}
+	for k, v := range params {
+		if !contains(SecretOptions, k) {
+			redacted[k] = v
+		}
+	}
+	return json.Marshal(redacted)
+}
+
+// Matches reports whether stored are the parameters recorded for a binding
+// created with raw. Records of the volume broker's stores carry a bcrypt
+// hash instead of the HMAC, and records written without a key the
+// parameters themselves; both still match and are redacted when they are
+// stored again.
+func (r *BindingRedaction) Matches(stored, raw json.RawMessage) (bool, error) {
+	if len(stored) == 0 || len(raw) == 0 {
+		return len(stored) == len(raw), nil
+	}
+
+	params, err := decodeParameters(stored)
+	if err != nil {
+		return false, err
+	}
+
+	if sum, ok := params[ParamsHMACKey].(string); ok {
+		if r == nil {
+			return false, fmt.Errorf("binding parameters are redacted but no binding parameters key is configured")
+		}
+		expected, err := r.sum(raw)
+		if err != nil {
+			return false, err
+		}
+		return hmac.Equal([]byte(sum), []byte(expected)), nil
+	}
+
+	if hash, ok := params[brokerstore.HashKey].(string); ok {
+		legacy, err := legacyParamsJSON(raw)
+		if err != nil {
+			return false, err
+		}
+		return bcrypt.CompareHashAndPassword([]byte(hash), legacy) == nil, nil
+	}
+
+	storedJSON, err := canonicalJSON(stored)
+	if err != nil {
+		return false, err
+	}
+	rawJSON, err := canonicalJSON(raw)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(storedJSON, rawJSON), nil
+}
+
+func (r *BindingRedaction) sum(raw json.RawMessage) (string, error) {
+	canonical, err := canonicalJSON(raw)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write(canonical)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// bindingParameters returns the parameters of a stored binding without the
+// HMAC or bcrypt hash that stands for the redacted ones.
+func bindingParameters(stored json.RawMessage) (map[string]interface{}, error) {
+	params, err := decodeParameters(stored)
+	if err != nil {
+		return nil, err
+	}
+	delete(params, ParamsHMACKey)
+	delete(params, brokerstore.HashKey)
+	return params, nil
+}
+
+// canonicalJSON re-encodes a JSON document with the keys of its objects
+// sorted and no insignificant white space. Numbers are kept as written.
+func canonicalJSON(raw json.RawMessage) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// legacyParamsJSON encodes parameters the way the volume broker's stores
+// did before hashing them with bcrypt.
+func legacyParamsJSON(raw json.RawMessage) ([]byte, error) {
+	var opts map[string]interface{}
+	if err := json.Unmarshal(raw, &opts); err != nil {
+		return nil, err
+	}
+	return json.Marshal(opts)
+}
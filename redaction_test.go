@@ -0,0 +1,208 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/existingvolumebroker"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	vmo "code.cloudfoundry.org/volume-mount-options"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"golang.org/x/crypto/bcrypt"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const bindingParamsKey = "0123456789abcdef0123456789abcdef"
+
+var _ = Describe("BindingRedaction", func() {
+	var redaction *BindingRedaction
+
+	BeforeEach(func() {
+		var err error
+		redaction, err = NewBindingRedaction(bindingParamsKey)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	decode := func(raw json.RawMessage) map[string]interface{} {
+		var params map[string]interface{}
+		Expect(json.Unmarshal(raw, &params)).To(Succeed())
+		return params
+	}
+
+	It("keeps the other parameters next to an HMAC of all of them", func() {
+		stored, err := redaction.Redact(json.RawMessage(`{"username": "alice", "password": "secret"}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		params := decode(stored)
+		Expect(params).To(HaveKeyWithValue("username", "alice"))
+		Expect(params).NotTo(HaveKey("password"))
+		Expect(params[ParamsHMACKey]).To(MatchRegexp(`^[0-9a-f]{64}$`))
+	})
+
+	It("stores the parameters as they are without a key", func() {
+		var none *BindingRedaction
+		stored, err := none.Redact(json.RawMessage(`{"password": "secret"}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(stored)).To(Equal(`{"password": "secret"}`))
+	})
+
+	It("matches the same parameters in any key order", func() {
+		stored, err := redaction.Redact(json.RawMessage(`{"username": "alice", "password": "secret", "uid": 1000}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(redaction.Matches(stored, json.RawMessage(`{"uid":1000,"password":"secret","username":"alice"}`))).To(BeTrue())
+		Expect(redaction.Matches(stored, json.RawMessage(`{"username": "alice", "password": "other", "uid": 1000}`))).To(BeFalse())
+		Expect(redaction.Matches(stored, json.RawMessage(`{"username": "alice", "password": "secret"}`))).To(BeFalse())
+		Expect(redaction.Matches(stored, nil)).To(BeFalse())
+	})
+
+	It("does not match with another key", func() {
+		stored, err := redaction.Redact(json.RawMessage(`{"password": "secret"}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		other, err := NewBindingRedaction("fedcba9876543210fedcba9876543210")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other.Matches(stored, json.RawMessage(`{"password": "secret"}`))).To(BeFalse())
+
+		var none *BindingRedaction
+		_, err = none.Matches(stored, json.RawMessage(`{"password": "secret"}`))
+		Expect(err).To(MatchError("binding parameters are redacted but no binding parameters key is configured"))
+	})
+
+	It("matches the bcrypt hashes of the volume broker's stores", func() {
+		hash, err := bcrypt.GenerateFromPassword([]byte(`{"password":"secret","username":"alice"}`), bcrypt.MinCost)
+		Expect(err).NotTo(HaveOccurred())
+		stored, err := json.Marshal(map[string]string{"paramsHash": string(hash)})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(redaction.Matches(stored, json.RawMessage(`{"username": "alice", "password": "secret"}`))).To(BeTrue())
+		Expect(redaction.Matches(stored, json.RawMessage(`{"username": "alice", "password": "other"}`))).To(BeFalse())
+	})
+
+	It("matches parameters that were stored as they are", func() {
+		stored := json.RawMessage(`{"username": "alice", "password": "secret"}`)
+		Expect(redaction.Matches(stored, json.RawMessage(`{"password":"secret","username":"alice"}`))).To(BeTrue())
+		Expect(redaction.Matches(stored, json.RawMessage(`{"password":"other","username":"alice"}`))).To(BeFalse())
+	})
+
+	It("matches bindings without parameters", func() {
+		Expect(redaction.Matches(nil, nil)).To(BeTrue())
+		Expect(redaction.Matches(nil, json.RawMessage(`{}`))).To(BeFalse())
+	})
+
+	It("rejects short keys", func() {
+		_, err := NewBindingRedaction("secret")
+		Expect(err).To(MatchError("binding parameters key must be at least 32 bytes long"))
+	})
+})
+
+const benchmarkBindParams = `{"username": "alice", "password": "secret", "domain": "example", "version": "3.0"}`
+
+// newBenchmarkBroker returns a broker with a provisioned instance and a
+// binding with benchmarkBindParams, binding-1, that a repeated bind with
+// the same parameters does not conflict with.
+func newBenchmarkBroker(b *testing.B, redaction *BindingRedaction) (*Broker, *IndexedStore) {
+	logger := lager.NewLogger("benchmark")
+	store := NewIndexedStore(logger, newFakeCredhub(), "smbbroker")
+	store.Redaction = redaction
+
+	services, err := NewServicesFromConfig("./default_services.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	mask, err := vmo.NewMountOptsMask([]string{"source", "mount", "ro", "username", "password", "domain", "version", "mfsymlinks"},
+		map[string]interface{}{}, map[string]string{"readonly": "ro", "share": "source"}, []string{}, []string{"source"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	delegate := existingvolumebroker.New(existingvolumebroker.BrokerTypeSMB, logger, services, &osshim.OsShim{}, clock.NewClock(), store, mask)
+	broker := NewBroker(logger, delegate, store)
+
+	_, err = broker.Provision(context.Background(), "instance-id", domain.ProvisionDetails{
+		ServiceID:        "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+		PlanID:           "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+		OrganizationGUID: "org-guid",
+		SpaceGUID:        "space-guid",
+		RawParameters:    json.RawMessage(`{"share": "//server/share"}`),
+	}, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := repeatBind(broker); err != nil {
+		b.Fatal(err)
+	}
+	return broker, store
+}
+
+func repeatBind(broker *Broker) error {
+	_, err := broker.Bind(context.Background(), "instance-id", "binding-1", domain.BindDetails{
+		ServiceID:     "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+		PlanID:        "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+		AppGUID:       "app-guid",
+		RawParameters: json.RawMessage(benchmarkBindParams),
+	}, false)
+	return err
+}
+
+func BenchmarkRepeatBind(b *testing.B) {
+	redaction, err := NewBindingRedaction(bindingParamsKey)
+	if err != nil {
+		b.Fatal(err)
+	}
+	broker, _ := newBenchmarkBroker(b, redaction)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := repeatBind(broker); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRepeatBindBcrypt repeats binds whose record still has the bcrypt
+// hash of the volume broker's stores, as every repeated bind did before.
+func BenchmarkRepeatBindBcrypt(b *testing.B) {
+	redaction, err := NewBindingRedaction(bindingParamsKey)
+	if err != nil {
+		b.Fatal(err)
+	}
+	broker, store := newBenchmarkBroker(b, redaction)
+
+	var params map[string]interface{}
+	if err := json.Unmarshal([]byte(benchmarkBindParams), &params); err != nil {
+		b.Fatal(err)
+	}
+	legacy, _ := json.Marshal(params)
+	hash, err := bcrypt.GenerateFromPassword(legacy, bcrypt.DefaultCost)
+	if err != nil {
+		b.Fatal(err)
+	}
+	record := brokerapi.BindDetails{
+		ServiceID:     "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+		PlanID:        "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+		AppGUID:       "app-guid",
+		RawParameters: json.RawMessage(`{"paramsHash": "` + string(hash) + `"}`),
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		store.Redaction = nil
+		if err := store.CreateBindingDetails("binding-1", record); err != nil {
+			b.Fatal(err)
+		}
+		store.Redaction = redaction
+		b.StartTimer()
+
+		if err := repeatBind(broker); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore/credhub_shims"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	DefaultCatalogRefreshInterval = 5 * time.Minute
+
+	catalogCredentialKey = "services"
+	maxCatalogSize       = 4 << 20
+)
+
+// RemoteCatalog is a catalog fetched from an HTTP(S) URL or from a CredHub
+// JSON credential, which holds the services under "services", so that one
+// catalog can be shared by many foundations. It is fetched again every
+// Interval; URLs are asked with the ETag of the last response so that an
+// unchanged catalog is not transferred again. A catalog that cannot be
+// fetched or is invalid is logged and counted, and the last good one stays
+// in use.
+type RemoteCatalog struct {
+	Interval time.Duration
+	Clock    clock.Clock
+
+	// OnChange is called after a refresh swapped in a new catalog.
+	OnChange func()
+
+	logger     lager.Logger
+	name       string
+	source     string
+	url        string
+	client     *http.Client
+	credhub    credhub_shims.Credhub
+	credential string
+
+	mutex       sync.RWMutex
+	services    []brokerapi.Service
+	settings    CatalogSettings
+	version     string
+	etag        string
+	refreshedAt time.Time
+	refreshes   map[string]uint64
+}
+
+func NewRemoteCatalogFromURL(logger lager.Logger, client *http.Client, catalogURL, name string) (*RemoteCatalog, error) {
+	u, err := url.Parse(catalogURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("catalog URL %q is not an http or https URL", catalogURL)
+	}
+
+	source := u.String()
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+		source = u.String()
+	}
+
+	c := newRemoteCatalog(logger, name, source)
+	c.client = client
+	c.url = catalogURL
+	if err := c.Refresh(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func NewRemoteCatalogFromCredhub(logger lager.Logger, credhub credhub_shims.Credhub, credential, name string) (*RemoteCatalog, error) {
+	c := newRemoteCatalog(logger, name, "credhub:"+credential)
+	c.credhub = credhub
+	c.credential = credential
+	if err := c.Refresh(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newRemoteCatalog(logger lager.Logger, name, source string) *RemoteCatalog {
+	return &RemoteCatalog{
+		Interval:  DefaultCatalogRefreshInterval,
+		Clock:     clock.NewClock(),
+		logger:    logger.Session("remote-catalog", lager.Data{"source": source}),
+		name:      name,
+		source:    source,
+		refreshes: map[string]uint64{},
+	}
+}
+
+func (c *RemoteCatalog) List() []brokerapi.Service {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.services
+}
+
+func (c *RemoteCatalog) VolumeSettings(serviceID, planID string) VolumeSettings {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.settings.Resolve(serviceID, planID)
+}
+
+func (c *RemoteCatalog) Version() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.version
+}
+
+// Refresh fetches the catalog and swaps it in if it changed and is valid.
+func (c *RemoteCatalog) Refresh() error {
+	services, settings, etag, err := c.fetch()
+	if err == nil && services != nil {
+		err = prepareCatalog(services, settings, c.name)
+	}
+	if err != nil {
+		c.logger.Error("refresh-failed", err, lager.Data{"version": c.Version()})
+		c.count("failed")
+		return err
+	}
+
+	if c.swap(services, settings, etag) && c.OnChange != nil {
+		c.OnChange()
+	}
+	return nil
+}
+
+// swap replaces the catalog with a fetched one and reports whether it
+// changed. Fetches that were answered with 304 Not Modified have no
+// services.
+func (c *RemoteCatalog) swap(services []brokerapi.Service, settings CatalogSettings, etag string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.refreshedAt = c.Clock.Now()
+	if services == nil {
+		c.refreshes["unchanged"]++
+		return false
+	}
+
+	version := CatalogVersion(services, settings)
+	c.etag = etag
+	if version == c.version {
+		c.refreshes["unchanged"]++
+		return false
+	}
+
+	c.logger.Info("catalog-updated", lager.Data{"version": version, "previous-version": c.version, "services": len(services)})
+	c.services, c.settings, c.version = services, settings, version
+	c.refreshes["updated"]++
+	return true
+}
+
+func (c *RemoteCatalog) count(result string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.refreshes[result]++
+}
+
+// fetch returns the services and volume settings of the catalog and the
+// ETag of the response, or no services when the URL reports that the
+// catalog did not change.
+func (c *RemoteCatalog) fetch() ([]brokerapi.Service, CatalogSettings, string, error) {
+	if c.credhub != nil {
+		credential, err := c.credhub.GetLatestJSON(c.credential)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		value, ok := credential.Value[catalogCredentialKey]
+		if !ok {
+			return nil, nil, "", fmt.Errorf("credential %q has no %q key", c.credential, catalogCredentialKey)
+		}
+		contents, err := json.Marshal(value)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		services, settings, err := parseCatalog(contents, false)
+		return services, settings, "", err
+	}
+
+	request, err := http.NewRequest(http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	request.Header.Set("Accept", "application/json, application/yaml")
+	c.mutex.RLock()
+	if c.etag != "" {
+		request.Header.Set("If-None-Match", c.etag)
+	}
+	c.mutex.RUnlock()
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		return nil, nil, "", nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxCatalogSize))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, nil, "", fmt.Errorf("%s responded with %s", c.source, response.Status)
+	}
+
+	yamlFormat := strings.Contains(response.Header.Get("Content-Type"), "yaml") || isYAML(request.URL.Path)
+	services, settings, err := parseCatalog(body, yamlFormat)
+	return services, settings, response.Header.Get("ETag"), err
+}
+
+// Run refreshes the catalog every Interval until it is signalled.
+func (c *RemoteCatalog) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	ticker := c.Clock.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	close(ready)
+
+	for {
+		select {
+		case <-signals:
+			return nil
+		case <-ticker.C():
+			_ = c.Refresh()
+		}
+	}
+}
+
+func (c *RemoteCatalog) WriteMetrics(out io.Writer) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	writeCatalogInfo(out, c.source, c.version)
+
+	fmt.Fprintln(out, "# HELP smbbroker_catalog_refreshes_total Fetches of the remote catalog by result, updated, unchanged or failed.")
+	fmt.Fprintln(out, "# TYPE smbbroker_catalog_refreshes_total counter")
+	for _, result := range []string{"updated", "unchanged", "failed"} {
+		fmt.Fprintf(out, "smbbroker_catalog_refreshes_total{result=%q} %d\n", result, c.refreshes[result])
+	}
+
+	fmt.Fprintln(out, "# HELP smbbroker_catalog_refreshed_timestamp_seconds When the remote catalog was last fetched successfully.")
+	fmt.Fprintln(out, "# TYPE smbbroker_catalog_refreshed_timestamp_seconds gauge")
+	fmt.Fprintf(out, "smbbroker_catalog_refreshed_timestamp_seconds %d\n", c.refreshedAt.Unix())
+}
@@ -0,0 +1,206 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/onsi/gomega/ghttp"
+	"github.com/tedsuo/ifrit"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RemoteCatalog", func() {
+	const (
+		serviceID = "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad"
+		planID    = "0da18102-48dc-46d0-98b3-7a4ff6dc9c54"
+	)
+
+	var logger lager.Logger
+
+	catalog := func(description string) []interface{} {
+		return []interface{}{map[string]interface{}{
+			"id":          serviceID,
+			"name":        "smb",
+			"description": description,
+			"bindable":    true,
+			"requires":    []string{"volume_mount"},
+			"plans": []interface{}{map[string]interface{}{
+				"id":          planID,
+				"name":        "existing",
+				"description": "A preexisting share",
+			}},
+		}}
+	}
+
+	catalogJSON := func(description string) string {
+		contents, err := json.Marshal(catalog(description))
+		Expect(err).NotTo(HaveOccurred())
+		return string(contents)
+	}
+
+	metrics := func(c *RemoteCatalog) string {
+		out := &bytes.Buffer{}
+		c.WriteMetrics(out)
+		return out.String()
+	}
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("remote-catalog")
+	})
+
+	Describe("from a URL", func() {
+		var server *ghttp.Server
+
+		BeforeEach(func() {
+			server = ghttp.NewServer()
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("fetches the catalog again only when its ETag changed", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest(http.MethodGet, "/catalog"),
+					ghttp.RespondWith(http.StatusOK, catalogJSON("Shares"), http.Header{"ETag": {`"v1"`}}),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyHeaderKV("If-None-Match", `"v1"`),
+					ghttp.RespondWith(http.StatusNotModified, nil),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyHeaderKV("If-None-Match", `"v1"`),
+					ghttp.RespondWith(http.StatusOK, catalogJSON("Shared shares"), http.Header{"ETag": {`"v2"`}}),
+				),
+			)
+
+			c, err := NewRemoteCatalogFromURL(logger, http.DefaultClient, server.URL()+"/catalog", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.List()[0].Description).To(Equal("Shares"))
+			first := c.Version()
+			Expect(first).NotTo(BeEmpty())
+			changes := 0
+			c.OnChange = func() { changes++ }
+
+			Expect(c.Refresh()).To(Succeed())
+			Expect(c.Version()).To(Equal(first))
+			Expect(changes).To(Equal(0))
+
+			Expect(c.Refresh()).To(Succeed())
+			Expect(c.List()[0].Description).To(Equal("Shared shares"))
+			Expect(c.Version()).NotTo(Equal(first))
+			Expect(changes).To(Equal(1))
+
+			Expect(metrics(c)).To(ContainSubstring(`smbbroker_catalog_info{source="` + server.URL() + `/catalog",version="` + c.Version() + `"} 1`))
+			Expect(metrics(c)).To(ContainSubstring(`smbbroker_catalog_refreshes_total{result="updated"} 2`))
+			Expect(metrics(c)).To(ContainSubstring(`smbbroker_catalog_refreshes_total{result="unchanged"} 1`))
+		})
+
+		It("keeps the last good catalog when a fetch fails or the catalog is invalid", func() {
+			invalid := catalog("")
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusOK, catalogJSON("Shares")),
+				ghttp.RespondWith(http.StatusBadGateway, "down"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, invalid),
+			)
+
+			c, err := NewRemoteCatalogFromURL(logger, http.DefaultClient, server.URL()+"/catalog", "")
+			Expect(err).NotTo(HaveOccurred())
+			version := c.Version()
+
+			Expect(c.Refresh()).To(MatchError(ContainSubstring("responded with 502 Bad Gateway")))
+			Expect(c.Refresh()).To(MatchError("invalid catalog: service smb has no description"))
+
+			Expect(c.List()[0].Description).To(Equal("Shares"))
+			Expect(c.Version()).To(Equal(version))
+			Expect(metrics(c)).To(ContainSubstring(`smbbroker_catalog_refreshes_total{result="failed"} 2`))
+		})
+
+		It("reads YAML catalogs", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, `
+- id: `+serviceID+`
+  name: smb
+  description: Shares
+  bindable: true
+  requires: [volume_mount]
+  plans:
+  - id: `+planID+`
+    name: existing
+    description: A preexisting share
+`, http.Header{"Content-Type": {"application/yaml"}}))
+
+			c, err := NewRemoteCatalogFromURL(logger, http.DefaultClient, server.URL()+"/catalog", "smb-shares")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.List()[0].Name).To(Equal("smb-shares"))
+		})
+
+		It("fails when the first fetch fails", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusNotFound, ""))
+
+			_, err := NewRemoteCatalogFromURL(logger, http.DefaultClient, server.URL()+"/catalog", "")
+			Expect(err).To(MatchError(ContainSubstring("responded with 404 Not Found")))
+
+			_, err = NewRemoteCatalogFromURL(logger, http.DefaultClient, "ftp://example.com/catalog", "")
+			Expect(err).To(MatchError(`catalog URL "ftp://example.com/catalog" is not an http or https URL`))
+		})
+
+		It("does not show the password of the URL", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, catalogJSON("Shares")))
+
+			c, err := NewRemoteCatalogFromURL(logger, http.DefaultClient, "http://broker:secret@"+server.Addr()+"/catalog", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metrics(c)).To(ContainSubstring(`source="http://broker@` + server.Addr() + `/catalog"`))
+			Expect(metrics(c)).NotTo(ContainSubstring("secret"))
+		})
+
+		It("refreshes the catalog every interval", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, catalogJSON("Shares")))
+			server.SetAllowUnhandledRequests(true)
+
+			c, err := NewRemoteCatalogFromURL(logger, http.DefaultClient, server.URL()+"/catalog", "")
+			Expect(err).NotTo(HaveOccurred())
+			c.Interval = 10 * time.Millisecond
+
+			server.SetUnhandledRequestStatusCode(http.StatusOK)
+			server.RouteToHandler(http.MethodGet, "/catalog", ghttp.RespondWith(http.StatusOK, catalogJSON("Shared shares")))
+
+			process := ifrit.Invoke(c)
+			defer func() {
+				process.Signal(os.Interrupt)
+				Eventually(process.Wait()).Should(Receive())
+			}()
+
+			Eventually(func() string { return c.List()[0].Description }).Should(Equal("Shared shares"))
+		})
+	})
+
+	Describe("from CredHub", func() {
+		It("reads the services of the credential", func() {
+			credhub := newFakeCredhub()
+			credhub.SetJSON("/smbbroker/catalog", map[string]interface{}{"services": catalog("Shares")})
+
+			c, err := NewRemoteCatalogFromCredhub(logger, credhub, "/smbbroker/catalog", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.List()[0].Description).To(Equal("Shares"))
+			version := c.Version()
+
+			credhub.SetJSON("/smbbroker/catalog", map[string]interface{}{"services": catalog("Shared shares")})
+			Expect(c.Refresh()).To(Succeed())
+			Expect(c.List()[0].Description).To(Equal("Shared shares"))
+			Expect(c.Version()).NotTo(Equal(version))
+			Expect(metrics(c)).To(ContainSubstring(`smbbroker_catalog_info{source="credhub:/smbbroker/catalog",version="` + c.Version() + `"} 1`))
+
+			credhub.SetJSON("/smbbroker/catalog", map[string]interface{}{"catalog": catalog("Shares")})
+			Expect(c.Refresh()).To(MatchError(`credential "/smbbroker/catalog" has no "services" key`))
+			Expect(c.List()[0].Description).To(Equal("Shared shares"))
+		})
+	})
+})
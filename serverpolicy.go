@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// ServerRule matches SMB servers by exact name or address, by wildcard
+// domain (*.example.com) or by CIDR range. Orgs and Spaces optionally
+// restrict the rule to the given org or space GUIDs.
+//
+// Servers given by name are resolved to check them against address and
+// CIDR rules, and servers given by address are checked against name rules
+// with the addresses the name resolves to, or for wildcard domains the
+// names the address reverse resolves to.
+type ServerRule struct {
+	Server string   `json:"server"`
+	Orgs   []string `json:"orgs,omitempty"`
+	Spaces []string `json:"spaces,omitempty"`
+
+	network *net.IPNet
+}
+
+// ServerPolicy decides which SMB servers service instances may point at.
+// Deny rules win over allow rules; when allow rules are configured a server
+// has to match one of them. Names and addresses that do not resolve match
+// no rule. A server whose lookup for a deny rule fails otherwise, e.g. times
+// out, is denied, and does not match an allow rule that needs the lookup.
+type ServerPolicy struct {
+	Allow []ServerRule `json:"allow"`
+	Deny  []ServerRule `json:"deny"`
+
+	LookupHost func(host string) ([]string, error) `json:"-"`
+	LookupAddr func(addr string) ([]string, error) `json:"-"`
+}
+
+type ServerPolicyError struct {
+	Server string
+	Reason string
+}
+
+func (e *ServerPolicyError) Error() string {
+	return fmt.Sprintf("server %q %s", e.Server, e.Reason)
+}
+
+func NewServerPolicyFromConfig(pathToServerPolicy string) (*ServerPolicy, error) {
+	/* #nosec */
+	contents, err := ioutil.ReadFile(pathToServerPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy ServerPolicy
+	if err := json.Unmarshal(contents, &policy); err != nil {
+		return nil, err
+	}
+
+	if err := policy.compile(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (p *ServerPolicy) compile() error {
+	for _, rules := range [][]ServerRule{p.Allow, p.Deny} {
+		for i := range rules {
+			rule := &rules[i]
+			rule.Server = strings.ToLower(strings.TrimSpace(rule.Server))
+			if rule.Server == "" {
+				return fmt.Errorf("server policy rule %d has no server", i)
+			}
+			if strings.Contains(rule.Server, "/") {
+				_, network, err := net.ParseCIDR(rule.Server)
+				if err != nil {
+					return fmt.Errorf("server policy rule %q: %s", rule.Server, err.Error())
+				}
+				rule.network = network
+			}
+		}
+	}
+
+	return nil
+}
+
+// Check returns a *ServerPolicyError when host may not be used from the
+// given org and space.
+func (p *ServerPolicy) Check(host, orgGUID, spaceGUID string) error {
+	if p == nil {
+		return nil
+	}
+
+	server := p.server(host)
+
+	for _, rule := range p.Deny {
+		if !rule.appliesTo(orgGUID, spaceGUID) {
+			continue
+		}
+		matched, err := rule.matches(server)
+		if err != nil && !isNotFound(err) {
+			return &ServerPolicyError{Server: server.host, Reason: fmt.Sprintf("cannot be checked against broker policy (rule %q): %s", rule.Server, err.Error())}
+		}
+		if matched {
+			return &ServerPolicyError{Server: server.host, Reason: fmt.Sprintf("is denied by broker policy (rule %q)", rule.Server)}
+		}
+	}
+
+	if len(p.Allow) == 0 {
+		return nil
+	}
+
+	for _, rule := range p.Allow {
+		if !rule.appliesTo(orgGUID, spaceGUID) {
+			continue
+		}
+		if matched, err := rule.matches(server); err == nil && matched {
+			return nil
+		}
+	}
+	return &ServerPolicyError{Server: server.host, Reason: "is not in the list of servers allowed by broker policy"}
+}
+
+// policyServer is a server being checked against the rules of a policy.
+// Its addresses and names are looked up at most once, when a rule first
+// needs them.
+type policyServer struct {
+	host   string
+	ip     net.IP
+	policy *ServerPolicy
+
+	resolved  bool
+	addresses []net.IP
+	lookupErr error
+
+	reversed   bool
+	names      []string
+	reverseErr error
+}
+
+func (p *ServerPolicy) server(host string) *policyServer {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return &policyServer{host: host, ip: net.ParseIP(host), policy: p}
+}
+
+func (p *ServerPolicy) lookupHost(host string) ([]net.IP, error) {
+	lookup := p.LookupHost
+	if lookup == nil {
+		lookup = net.LookupHost
+	}
+	resolved, err := lookup(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []net.IP
+	for _, address := range resolved {
+		if ip := net.ParseIP(address); ip != nil {
+			addresses = append(addresses, ip)
+		}
+	}
+	return addresses, nil
+}
+
+// resolve returns the addresses of the server.
+func (s *policyServer) resolve() ([]net.IP, error) {
+	if s.ip != nil {
+		return []net.IP{s.ip}, nil
+	}
+	if !s.resolved {
+		s.addresses, s.lookupErr = s.policy.lookupHost(s.host)
+		s.resolved = true
+	}
+	return s.addresses, s.lookupErr
+}
+
+// reverse returns the names of the server.
+func (s *policyServer) reverse() ([]string, error) {
+	if s.ip == nil {
+		return []string{s.host}, nil
+	}
+	if !s.reversed {
+		lookup := s.policy.LookupAddr
+		if lookup == nil {
+			lookup = net.LookupAddr
+		}
+		var names []string
+		names, s.reverseErr = lookup(s.host)
+		for _, name := range names {
+			s.names = append(s.names, strings.TrimSuffix(strings.ToLower(name), "."))
+		}
+		s.reversed = true
+	}
+	return s.names, s.reverseErr
+}
+
+func (r ServerRule) appliesTo(orgGUID, spaceGUID string) bool {
+	if len(r.Orgs) > 0 && !contains(r.Orgs, orgGUID) {
+		return false
+	}
+	if len(r.Spaces) > 0 && !contains(r.Spaces, spaceGUID) {
+		return false
+	}
+	return true
+}
+
+func (r ServerRule) matches(server *policyServer) (bool, error) {
+	if r.network != nil {
+		addresses, err := server.resolve()
+		if err != nil {
+			return false, err
+		}
+		for _, ip := range addresses {
+			if r.network.Contains(ip) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	if strings.HasPrefix(r.Server, "*.") {
+		names, err := server.reverse()
+		if err != nil {
+			return false, err
+		}
+		for _, name := range names {
+			if strings.HasSuffix(name, r.Server[1:]) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	if ip := net.ParseIP(r.Server); ip != nil {
+		addresses, err := server.resolve()
+		if err != nil {
+			return false, err
+		}
+		return containsIP(addresses, ip), nil
+	}
+
+	name := strings.TrimSuffix(r.Server, ".")
+	if server.ip == nil {
+		return server.host == name, nil
+	}
+	addresses, err := server.policy.lookupHost(name)
+	if err != nil {
+		return false, err
+	}
+	return containsIP(addresses, server.ip), nil
+}
+
+// isNotFound reports whether err is a lookup of a name or address that does
+// not exist, as opposed to one that could not be answered.
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func containsIP(addresses []net.IP, ip net.IP) bool {
+	for _, address := range addresses {
+		if address.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func writeServerPolicy(dir, contents string) string {
+	path := filepath.Join(dir, "server-policy.json")
+	Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+	return path
+}
+
+var _ = Describe("ServerPolicy", func() {
+	var (
+		dir    string
+		policy *ServerPolicy
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "server-policy")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Context("with allow and deny rules", func() {
+		BeforeEach(func() {
+			var err error
+			policy, err = NewServerPolicyFromConfig(writeServerPolicy(dir, `{
+				"allow": [
+					{"server": "*.corp.example.com"},
+					{"server": "10.0.0.0/8"},
+					{"server": "finance.example.com", "orgs": ["finance-org"]},
+					{"server": "sandbox.example.com", "spaces": ["sandbox-space"]}
+				],
+				"deny": [
+					{"server": "legacy.corp.example.com"},
+					{"server": "10.1.0.0/16", "orgs": ["untrusted-org"]}
+				]
+			}`))
+			Expect(err).NotTo(HaveOccurred())
+
+			policy.LookupHost = func(host string) ([]string, error) {
+				switch host {
+				case "legacy.corp.example.com":
+					return []string{"10.3.0.1"}, nil
+				case "sneaky.example.org":
+					return []string{"10.1.0.5"}, nil
+				case "slow.corp.example.com":
+					return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+				}
+				return nil, notFound(host)
+			}
+			policy.LookupAddr = func(addr string) ([]string, error) {
+				return nil, notFound(addr)
+			}
+		})
+
+		table.DescribeTable("allowed servers",
+			func(host, org, space string) {
+				Expect(policy.Check(host, org, space)).To(Succeed())
+			},
+			table.Entry("wildcard domain", "files.corp.example.com", "org", "space"),
+			table.Entry("nested wildcard domain", "a.b.corp.example.com", "org", "space"),
+			table.Entry("CIDR range", "10.2.3.4", "org", "space"),
+			table.Entry("denied range in another org", "10.1.2.3", "org", "space"),
+			table.Entry("org scoped rule", "finance.example.com", "finance-org", "space"),
+			table.Entry("space scoped rule", "sandbox.example.com", "org", "sandbox-space"),
+		)
+
+		table.DescribeTable("rejected servers",
+			func(host, org, space, reason string) {
+				err := policy.Check(host, org, space)
+				Expect(err).To(BeAssignableToTypeOf(&ServerPolicyError{}))
+				Expect(err).To(MatchError(ContainSubstring(reason)))
+			},
+			table.Entry("explicitly denied", "legacy.corp.example.com", "org", "space", `server "legacy.corp.example.com" is denied by broker policy (rule "legacy.corp.example.com")`),
+			table.Entry("denied range in scoped org", "10.1.2.3", "untrusted-org", "space", `rule "10.1.0.0/16"`),
+			table.Entry("wildcard does not match apex", "corp.example.com", "org", "space", "is not in the list of servers allowed"),
+			table.Entry("outside CIDR", "192.168.0.1", "org", "space", "is not in the list of servers allowed"),
+			table.Entry("org scoped rule in another org", "finance.example.com", "other-org", "space", "is not in the list of servers allowed"),
+		)
+
+		It("checks the addresses of hostnames against CIDR rules", func() {
+			Expect(policy.Check("sneaky.example.org", "untrusted-org", "space")).To(MatchError(ContainSubstring("is denied")))
+			Expect(policy.Check("sneaky.example.org", "org", "space")).To(Succeed())
+		})
+
+		It("denies the address of a denied hostname", func() {
+			Expect(policy.Check("10.3.0.1", "org", "space")).To(MatchError(ContainSubstring(`is denied by broker policy (rule "legacy.corp.example.com")`)))
+		})
+
+		It("denies servers whose lookup for a deny rule fails", func() {
+			err := policy.Check("slow.corp.example.com", "untrusted-org", "space")
+			Expect(err).To(BeAssignableToTypeOf(&ServerPolicyError{}))
+			Expect(err).To(MatchError(`server "slow.corp.example.com" cannot be checked against broker policy (rule "10.1.0.0/16"): lookup slow.corp.example.com: i/o timeout`))
+		})
+
+		It("does not match deny rules with names that do not resolve", func() {
+			Expect(policy.Check("unknown.corp.example.com", "untrusted-org", "space")).To(Succeed())
+		})
+	})
+
+	It("checks addresses against wildcard rules by their reverse names", func() {
+		policy, err := NewServerPolicyFromConfig(writeServerPolicy(dir, `{"deny": [{"server": "*.legacy.example.com"}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		policy.LookupAddr = func(addr string) ([]string, error) {
+			switch addr {
+			case "192.168.0.9":
+				return []string{"Files.Legacy.Example.Com."}, nil
+			case "192.168.0.11":
+				return nil, &net.DNSError{Err: "server misbehaving", Name: addr, IsTemporary: true}
+			}
+			return nil, notFound(addr)
+		}
+
+		Expect(policy.Check("192.168.0.9", "org", "space")).To(MatchError(ContainSubstring("is denied by broker policy")))
+		Expect(policy.Check("192.168.0.10", "org", "space")).To(Succeed())
+		Expect(policy.Check("192.168.0.11", "org", "space")).To(MatchError(ContainSubstring("cannot be checked against broker policy")))
+		Expect(policy.Check("files.example.com", "org", "space")).To(Succeed())
+	})
+
+	It("does not deny addresses for a hostname rule whose name no longer resolves", func() {
+		policy, err := NewServerPolicyFromConfig(writeServerPolicy(dir, `{"deny": [{"server": "retired.example.com"}]}`))
+		Expect(err).NotTo(HaveOccurred())
+		policy.LookupHost = func(host string) ([]string, error) {
+			return nil, notFound(host)
+		}
+
+		Expect(policy.Check("10.0.0.1", "org", "space")).To(Succeed())
+	})
+
+	It("allows everything not denied when there are no allow rules", func() {
+		policy, err := NewServerPolicyFromConfig(writeServerPolicy(dir, `{"deny": [{"server": "bad.example.com"}]}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(policy.Check("good.example.com", "org", "space")).To(Succeed())
+		Expect(policy.Check("bad.example.com", "org", "space")).To(HaveOccurred())
+	})
+
+	It("allows everything when there is no policy", func() {
+		var policy *ServerPolicy
+		Expect(policy.Check("any.example.com", "org", "space")).To(Succeed())
+	})
+
+	It("rejects invalid CIDR rules", func() {
+		_, err := NewServerPolicyFromConfig(writeServerPolicy(dir, `{"allow": [{"server": "10.0.0.0/99"}]}`))
+		Expect(err).To(MatchError(ContainSubstring(`server policy rule "10.0.0.0/99"`)))
+	})
+})
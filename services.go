@@ -1,36 +1,372 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 
+	"code.cloudfoundry.org/lager"
 	"github.com/pivotal-cf/brokerapi"
+	"gopkg.in/yaml.v2"
 )
 
 type Services interface {
 	List() []brokerapi.Service
+	VolumeSettings(serviceID, planID string) VolumeSettings
 }
 
 type services struct {
 	services []brokerapi.Service
+	settings CatalogSettings
 }
 
+// NewServicesFromConfig reads a JSON or, by its .yml or .yaml extension,
+// YAML catalog. ${NAME} and ${NAME:-default} in its strings are replaced by
+// environment variables, so that e.g. the SERVICENAME of manifest.yml can
+// name the service.
 func NewServicesFromConfig(pathToServicesConfig string) (Services, error) {
-	/* #nosec */
-	contents, err := ioutil.ReadFile(pathToServicesConfig)
+	s, settings, err := readCatalog(pathToServicesConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	var s []brokerapi.Service
-	err = json.Unmarshal(contents, &s)
+	return &services{s, settings}, nil
+}
+
+func readCatalog(path string) ([]brokerapi.Service, CatalogSettings, error) {
+	/* #nosec */
+	contents, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	return parseCatalog(contents, isYAML(path))
+}
+
+func isYAML(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		return true
+	}
+	return false
+}
+
+// parseCatalog decodes a JSON or YAML catalog, replaces the environment
+// variable references in its strings and takes out the volume settings of
+// its services and plans.
+func parseCatalog(contents []byte, yamlFormat bool) ([]brokerapi.Service, CatalogSettings, error) {
+	var catalog interface{}
+	var err error
+	if yamlFormat {
+		err = yaml.Unmarshal(contents, &catalog)
+	} else {
+		err = json.Unmarshal(contents, &catalog)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unset []string
+	catalog = interpolate(catalog, &unset)
+	if len(unset) > 0 {
+		return nil, nil, fmt.Errorf("services config uses unset environment variables %s", strings.Join(unset, ", "))
+	}
+
+	settings, err := extractVolumeSettings(catalog)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	contents, err = json.Marshal(catalog)
+	if err != nil {
+		return nil, nil, err
 	}
+	var s []brokerapi.Service
+	if err := json.Unmarshal(contents, &s); err != nil {
+		return nil, nil, err
+	}
+	return s, settings, nil
+}
+
+// prepareCatalog names the only service of a catalog name, if it is set,
+// and validates the catalog.
+func prepareCatalog(services []brokerapi.Service, settings CatalogSettings, name string) error {
+	if name != "" {
+		if len(services) != 1 {
+			return fmt.Errorf("service name %q can only be applied to a catalog with one service, not %d", name, len(services))
+		}
+		services[0].Name = name
+	}
+	if problems := validateCatalog(services, settings); len(problems) > 0 {
+		return &CatalogError{Problems: problems}
+	}
+	return nil
+}
+
+// validateCatalog returns the problems of a catalog and of the volume
+// settings of its services and plans.
+func validateCatalog(services []brokerapi.Service, settings CatalogSettings) []string {
+	return append(ValidateCatalog(services), settings.validate(services)...)
+}
+
+// CatalogVersion identifies the content of a catalog, including its volume
+// settings, in logs and metrics.
+func CatalogVersion(services []brokerapi.Service, settings CatalogSettings) string {
+	hash := sha256.New()
+	contents, _ := json.Marshal(services)
+	hash.Write(contents)
+	if len(settings) > 0 {
+		contents, _ = json.Marshal(settings)
+		hash.Write(contents)
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:6])
+}
+
+// writeCatalogInfo writes the catalog info metric, which is 1 for the
+// version of the catalog the broker serves.
+func writeCatalogInfo(out io.Writer, source, version string) {
+	fmt.Fprintln(out, "# HELP smbbroker_catalog_info The catalog the broker serves, by source and version.")
+	fmt.Fprintln(out, "# TYPE smbbroker_catalog_info gauge")
+	fmt.Fprintf(out, "smbbroker_catalog_info{source=%q,version=%q} 1\n", source, version)
+}
 
-	return &services{s}, nil
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolate replaces the environment variable references in the strings
+// of a decoded JSON or YAML document, and turns YAML maps into ones JSON can
+// encode. It appends the variables that are unset and have no default to
+// unset.
+func interpolate(value interface{}, unset *[]string) interface{} {
+	switch typed := value.(type) {
+	case string:
+		return envReference.ReplaceAllStringFunc(typed, func(reference string) string {
+			match := envReference.FindStringSubmatch(reference)
+			if value, ok := os.LookupEnv(match[1]); ok && value != "" {
+				return value
+			}
+			if match[2] == "" && !contains(*unset, match[1]) {
+				*unset = append(*unset, match[1])
+			}
+			return match[3]
+		})
+	case []interface{}:
+		for i := range typed {
+			typed[i] = interpolate(typed[i], unset)
+		}
+		return typed
+	case map[string]interface{}:
+		for k, v := range typed {
+			typed[k] = interpolate(v, unset)
+		}
+		return typed
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, v := range typed {
+			m[fmt.Sprint(k)] = interpolate(v, unset)
+		}
+		return m
+	}
+	return value
 }
 
 func (s *services) List() []brokerapi.Service {
 	return s.services
 }
+
+func (s *services) VolumeSettings(serviceID, planID string) VolumeSettings {
+	return s.settings.Resolve(serviceID, planID)
+}
+
+// Catalog is the services config the broker serves. Reload swaps in a new
+// catalog without interrupting requests that are listing the current one.
+// When name is set it replaces the name of the catalog's only service, which
+// is how SERVICENAME publishes the service under another name.
+type Catalog struct {
+	// OnChange is called after a reload swapped in a new catalog.
+	OnChange func()
+
+	path string
+	name string
+
+	mutex    sync.RWMutex
+	services []brokerapi.Service
+	settings CatalogSettings
+	version  string
+}
+
+func NewCatalogFromConfig(pathToServicesConfig, name string) (*Catalog, error) {
+	catalog := &Catalog{path: pathToServicesConfig, name: name}
+	if err := catalog.Reload(); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// Reload re-reads the services config. The current catalog is kept when the
+// new one cannot be loaded or is invalid.
+func (c *Catalog) Reload() error {
+	services, settings, err := readCatalog(c.path)
+	if err != nil {
+		return err
+	}
+
+	if err := prepareCatalog(services, settings, c.name); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.services = services
+	c.settings = settings
+	c.version = CatalogVersion(services, settings)
+	c.mutex.Unlock()
+
+	if c.OnChange != nil {
+		c.OnChange()
+	}
+	return nil
+}
+
+// Watch reloads the catalog whenever its file changes.
+func (c *Catalog) Watch(logger lager.Logger, stop <-chan struct{}) error {
+	logger = logger.Session("services-config")
+	return WatchFile(logger, c.path, stop, func() {
+		if err := c.Reload(); err != nil {
+			logger.Error("reload-failed", err)
+			return
+		}
+		logger.Info("reloaded", lager.Data{"services": len(c.List()), "version": c.Version()})
+	})
+}
+
+func (c *Catalog) List() []brokerapi.Service {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.services
+}
+
+func (c *Catalog) VolumeSettings(serviceID, planID string) VolumeSettings {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.settings.Resolve(serviceID, planID)
+}
+
+func (c *Catalog) Version() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.version
+}
+
+func (c *Catalog) WriteMetrics(out io.Writer) {
+	writeCatalogInfo(out, c.path, c.Version())
+}
+
+// CatalogError lists the problems of an invalid catalog.
+type CatalogError struct {
+	Problems []string
+}
+
+func (e *CatalogError) Error() string {
+	return "invalid catalog: " + strings.Join(e.Problems, "; ")
+}
+
+var (
+	catalogUUID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	catalogName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]*$`)
+)
+
+// ValidateCatalog returns the problems of a catalog that the platform would
+// otherwise only report when it fetches the catalog, or when apps bind to
+// the service. Names have to be CLI friendly as the OSBAPI spec asks, IDs
+// have to be UUIDs, and every service has to be bindable and require
+// volume_mount, since that is what the broker's bindings are for.
+func ValidateCatalog(services []brokerapi.Service) []string {
+	var problems []string
+	if len(services) == 0 {
+		problems = append(problems, "catalog has no services")
+	}
+
+	serviceIDs := map[string]bool{}
+	serviceNames := map[string]bool{}
+	planIDs := map[string]bool{}
+	for i, service := range services {
+		name := service.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+			problems = append(problems, fmt.Sprintf("service %s has no name", name))
+		} else if serviceNames[name] {
+			problems = append(problems, fmt.Sprintf("service name %q is used more than once", name))
+		} else if !catalogName.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("service name %q may only contain letters, digits, periods and hyphens", name))
+		}
+		serviceNames[service.Name] = true
+
+		if service.ID == "" {
+			problems = append(problems, fmt.Sprintf("service %s has no id", name))
+		} else if serviceIDs[service.ID] {
+			problems = append(problems, fmt.Sprintf("service id %q is used more than once", service.ID))
+		} else if !catalogUUID.MatchString(service.ID) {
+			problems = append(problems, fmt.Sprintf("service id %q is not a UUID", service.ID))
+		}
+		serviceIDs[service.ID] = true
+
+		if service.Description == "" {
+			problems = append(problems, fmt.Sprintf("service %s has no description", name))
+		}
+		if !service.Bindable {
+			problems = append(problems, fmt.Sprintf("service %s is not bindable", name))
+		}
+		if !requiresVolumeMount(service) {
+			problems = append(problems, fmt.Sprintf("service %s does not require %s", name, brokerapi.PermissionVolumeMount))
+		}
+
+		if len(service.Plans) == 0 {
+			problems = append(problems, fmt.Sprintf("service %s has no plans", name))
+		}
+		planNames := map[string]bool{}
+		for j, plan := range service.Plans {
+			planName := plan.Name
+			if planName == "" {
+				planName = fmt.Sprintf("#%d", j+1)
+				problems = append(problems, fmt.Sprintf("plan %s of service %s has no name", planName, name))
+			} else if planNames[planName] {
+				problems = append(problems, fmt.Sprintf("plan name %q is used more than once in service %s", planName, name))
+			} else if !catalogName.MatchString(planName) {
+				problems = append(problems, fmt.Sprintf("plan name %q of service %s may only contain letters, digits, periods and hyphens", planName, name))
+			}
+			planNames[plan.Name] = true
+
+			if plan.ID == "" {
+				problems = append(problems, fmt.Sprintf("plan %s of service %s has no id", planName, name))
+			} else if planIDs[plan.ID] {
+				problems = append(problems, fmt.Sprintf("plan id %q is used more than once", plan.ID))
+			} else if !catalogUUID.MatchString(plan.ID) {
+				problems = append(problems, fmt.Sprintf("plan id %q is not a UUID", plan.ID))
+			}
+			planIDs[plan.ID] = true
+
+			if plan.Description == "" {
+				problems = append(problems, fmt.Sprintf("plan %s of service %s has no description", planName, name))
+			}
+			if plan.Bindable != nil && !*plan.Bindable {
+				problems = append(problems, fmt.Sprintf("plan %s of service %s is not bindable", planName, name))
+			}
+		}
+	}
+	return problems
+}
+
+func requiresVolumeMount(service brokerapi.Service) bool {
+	for _, permission := range service.Requires {
+		if permission == brokerapi.PermissionVolumeMount {
+			return true
+		}
+	}
+	return false
+}
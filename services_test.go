@@ -1,6 +1,12 @@
 package main_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/pivotal-cf/brokerapi"
@@ -42,4 +48,121 @@ var _ = Describe("Services", func() {
 			}))
 		})
 	})
+
+	Describe("Catalog", func() {
+		const (
+			serviceID = "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad"
+			planID    = "0da18102-48dc-46d0-98b3-7a4ff6dc9c54"
+		)
+
+		var (
+			dir  string
+			path string
+		)
+
+		catalogJSON := func(plans ...string) string {
+			return `[{"id": "` + serviceID + `", "name": "smb", "description": "Existing SMB shares", "bindable": true, "requires": ["volume_mount"], "plans": [` + strings.Join(plans, ",") + `]}]`
+		}
+
+		writeCatalog := func(contents string) {
+			Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "catalog")
+			Expect(err).NotTo(HaveOccurred())
+			path = filepath.Join(dir, "services.json")
+			writeCatalog(catalogJSON(`{"id": "` + planID + `", "name": "existing", "description": "A preexisting share"}`))
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("publishes the service under the given name", func() {
+			catalog, err := NewCatalogFromConfig(path, "smb-shares")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(catalog.List()).To(HaveLen(1))
+			Expect(catalog.List()[0].Name).To(Equal("smb-shares"))
+			Expect(catalog.List()[0].ID).To(Equal(serviceID))
+		})
+
+		It("cannot rename catalogs with more than one service", func() {
+			writeCatalog(`[{"id": "a", "name": "smb", "plans": []}, {"id": "b", "name": "smb2", "plans": []}]`)
+			_, err := NewCatalogFromConfig(path, "smb-shares")
+			Expect(err).To(MatchError(`service name "smb-shares" can only be applied to a catalog with one service, not 2`))
+		})
+
+		It("reloads the catalog when the file changes", func() {
+			catalog, err := NewCatalogFromConfig(path, "")
+			Expect(err).NotTo(HaveOccurred())
+			stop := make(chan struct{})
+			defer close(stop)
+			Expect(catalog.Watch(lager.NewLogger("catalog"), stop)).To(Succeed())
+
+			writeCatalog(catalogJSON(
+				`{"id": "`+planID+`", "name": "existing", "description": "A preexisting share"}`,
+				`{"id": "4c4b2c1e-0d0b-4b1c-9a43-2a0c5e7ab1f2", "name": "readonly", "description": "A preexisting share, mounted read only"}`,
+			))
+
+			Eventually(func() int {
+				return len(catalog.List()[0].Plans)
+			}).Should(Equal(2))
+		})
+
+		It("reads YAML catalogs and environment variables", func() {
+			path = filepath.Join(dir, "services.yml")
+			Expect(ioutil.WriteFile(path, []byte(`
+- id: ${SMB_SERVICE_ID}
+  name: ${SMB_TEST_SERVICENAME:-smb}
+  description: Existing SMB shares of ${SMB_TEST_ORG:-the org}
+  bindable: true
+  requires: [volume_mount]
+  plans:
+  - id: `+planID+`
+    name: existing
+    description: A preexisting share
+`), 0600)).To(Succeed())
+
+			_, err := NewCatalogFromConfig(path, "")
+			Expect(err).To(MatchError("services config uses unset environment variables SMB_SERVICE_ID"))
+
+			os.Setenv("SMB_SERVICE_ID", serviceID)
+			defer os.Unsetenv("SMB_SERVICE_ID")
+			os.Setenv("SMB_TEST_SERVICENAME", "smb-shares")
+			defer os.Unsetenv("SMB_TEST_SERVICENAME")
+
+			catalog, err := NewCatalogFromConfig(path, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(catalog.List()[0].ID).To(Equal(serviceID))
+			Expect(catalog.List()[0].Name).To(Equal("smb-shares"))
+			Expect(catalog.List()[0].Description).To(Equal("Existing SMB shares of the org"))
+			Expect(catalog.List()[0].Plans[0].Name).To(Equal("existing"))
+		})
+
+		It("lists every problem of an invalid catalog", func() {
+			writeCatalog(catalogJSON(
+				`{"id": "`+planID+`", "name": "existing", "description": "A preexisting share", "bindable": false}`,
+				`{"id": "4c4b2c1e-0d0b-4b1c-9a43-2a0c5e7ab1f2", "name": "existing"}`,
+			))
+
+			_, err := NewCatalogFromConfig(path, "")
+			Expect(err).To(BeAssignableToTypeOf(&CatalogError{}))
+			Expect(err.(*CatalogError).Problems).To(Equal([]string{
+				"plan existing of service smb is not bindable",
+				`plan name "existing" is used more than once in service smb`,
+				"plan existing of service smb has no description",
+			}))
+		})
+
+		It("keeps the catalog when the new one is invalid", func() {
+			catalog, err := NewCatalogFromConfig(path, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			writeCatalog(catalogJSON())
+			Expect(catalog.Reload()).To(MatchError("invalid catalog: service smb has no plans"))
+			Expect(catalog.List()[0].Plans).To(HaveLen(1))
+		})
+	})
 })
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxShareNameLength = 80
+
+// shareQueryOptions maps the query parameters accepted in smb:// URLs to the
+// broker parameter they set.
+var shareQueryOptions = map[string]string{
+	"vers":       "version",
+	"version":    "version",
+	"domain":     "domain",
+	"mfsymlinks": "mfsymlinks",
+}
+
+type ShareError struct {
+	Share  string
+	Reason string
+}
+
+func (e *ShareError) Error() string {
+	return fmt.Sprintf("invalid share %q: %s", e.Share, e.Reason)
+}
+
+// Share is an SMB share or NFS export address broken into its components.
+// The Name of an NFS export is the first component of its path.
+type Share struct {
+	Host    string
+	Name    string
+	Path    string
+	Options map[string]string
+	NFS     bool
+}
+
+// ParseShare accepts UNC (\\server\share), smb:// URL and //server/share
+// addresses and returns the validated share they point at.
+func ParseShare(raw string) (Share, error) {
+	if !utf8.ValidString(raw) {
+		return Share{}, &ShareError{Share: raw, Reason: "share is not valid UTF-8"}
+	}
+
+	trimmed := strings.TrimSpace(raw)
+	switch {
+	case trimmed == "":
+		return Share{}, &ShareError{Share: raw, Reason: "share is empty"}
+	case hasPrefixFold(trimmed, "smb://"):
+		return parseShareURL(raw, trimmed)
+	case strings.HasPrefix(trimmed, `\\`):
+		return parseSharePath(raw, strings.Replace(trimmed[2:], `\`, "/", -1))
+	case strings.HasPrefix(trimmed, "//"):
+		return parseSharePath(raw, trimmed[2:])
+	}
+
+	return Share{}, &ShareError{Share: raw, Reason: `expected \\server\share, //server/share or smb://server/share`}
+}
+
+// ParseNFSShare accepts server/export, server:/export and nfs:// URL
+// addresses of NFS exports and returns the validated export they point at.
+func ParseNFSShare(raw string) (Share, error) {
+	if !utf8.ValidString(raw) {
+		return Share{}, &ShareError{Share: raw, Reason: "share is not valid UTF-8"}
+	}
+
+	rest := strings.TrimSpace(raw)
+	switch {
+	case rest == "":
+		return Share{}, &ShareError{Share: raw, Reason: "share is empty"}
+	case hasPrefixFold(rest, "nfs://"):
+		rest = rest[len("nfs://"):]
+		if strings.ContainsAny(rest, "?#") {
+			return Share{}, &ShareError{Share: raw, Reason: "options must be passed as parameters, not in the share URL"}
+		}
+	case strings.HasPrefix(rest, "/") || strings.HasPrefix(rest, `\`):
+		return Share{}, &ShareError{Share: raw, Reason: "expected server/export, server:/export or nfs://server/export"}
+	default:
+		if i := strings.Index(rest, ":/"); i > 0 && !strings.HasPrefix(rest, "[") {
+			rest = rest[:i] + rest[i+1:]
+		}
+	}
+
+	share, err := parseSharePath(raw, rest)
+	if err != nil {
+		return Share{}, err
+	}
+	share.NFS = true
+	return share, nil
+}
+
+// parseInstanceShare parses the share recorded for an instance of either
+// broker type; SMB shares are recorded with leading slashes.
+func parseInstanceShare(raw string) (Share, error) {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" || hasPrefixFold(trimmed, "smb://") || strings.HasPrefix(trimmed, "//") || strings.HasPrefix(trimmed, `\`) {
+		return ParseShare(raw)
+	}
+	return ParseNFSShare(raw)
+}
+
+// Source returns the canonical //server/share[/path] form handed to the
+// driver, or server/export[/path] for NFS exports.
+func (s Share) Source() string {
+	host := s.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	source := host + "/" + s.Name
+	if s.Path != "" {
+		source += "/" + s.Path
+	}
+	if s.NFS {
+		return source
+	}
+	return "//" + source
+}
+
+func parseShareURL(raw, trimmed string) (Share, error) {
+	u, err := url.Parse(trimmed)
+	if err != nil {
+		return Share{}, &ShareError{Share: raw, Reason: fmt.Sprintf("malformed smb URL: %s", err.Error())}
+	}
+	if u.User != nil {
+		return Share{}, &ShareError{Share: raw, Reason: "credentials must be passed as username and password parameters, not in the share URL"}
+	}
+	if u.Port() != "" {
+		return Share{}, &ShareError{Share: raw, Reason: "ports are not supported in the share address"}
+	}
+	if u.Fragment != "" {
+		return Share{}, &ShareError{Share: raw, Reason: "fragments are not supported in the share address"}
+	}
+
+	host, err := normalizeShareHost(u.Hostname())
+	if err != nil {
+		return Share{}, &ShareError{Share: raw, Reason: err.Error()}
+	}
+
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, segment := range segments {
+		segments[i], err = url.PathUnescape(segment)
+		if err != nil {
+			return Share{}, &ShareError{Share: raw, Reason: fmt.Sprintf("malformed escape in path: %s", err.Error())}
+		}
+	}
+
+	share, err := shareFromSegments(host, segments)
+	if err != nil {
+		return Share{}, &ShareError{Share: raw, Reason: err.Error()}
+	}
+
+	share.Options, err = parseShareQuery(u.RawQuery)
+	if err != nil {
+		return Share{}, &ShareError{Share: raw, Reason: err.Error()}
+	}
+
+	return share, nil
+}
+
+func parseSharePath(raw, rest string) (Share, error) {
+	var hostPart, pathPart string
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]")
+		if end < 0 {
+			return Share{}, &ShareError{Share: raw, Reason: "unterminated IPv6 address"}
+		}
+		hostPart, pathPart = rest[:end+1], rest[end+1:]
+	} else if i := strings.Index(rest, "/"); i >= 0 {
+		hostPart, pathPart = rest[:i], rest[i:]
+	} else {
+		hostPart = rest
+	}
+
+	host, err := normalizeShareHost(strings.TrimSuffix(strings.TrimPrefix(hostPart, "["), "]"))
+	if err != nil {
+		return Share{}, &ShareError{Share: raw, Reason: err.Error()}
+	}
+
+	share, err := shareFromSegments(host, strings.Split(pathPart, "/"))
+	if err != nil {
+		return Share{}, &ShareError{Share: raw, Reason: err.Error()}
+	}
+	return share, nil
+}
+
+func shareFromSegments(host string, segments []string) (Share, error) {
+	var parts []string
+	for _, segment := range segments {
+		if segment != "" {
+			parts = append(parts, segment)
+		}
+	}
+	if len(parts) == 0 {
+		return Share{}, fmt.Errorf("missing share name after server %q", host)
+	}
+
+	if err := validateShareName(parts[0]); err != nil {
+		return Share{}, err
+	}
+	for _, part := range parts[1:] {
+		if err := validateSharePathComponent(part); err != nil {
+			return Share{}, err
+		}
+	}
+
+	return Share{
+		Host: host,
+		Name: parts[0],
+		Path: strings.Join(parts[1:], "/"),
+	}, nil
+}
+
+func normalizeShareHost(host string) (string, error) {
+	if host == "" {
+		return "", fmt.Errorf("missing server")
+	}
+
+	if strings.HasSuffix(strings.ToLower(host), ".ipv6-literal.net") {
+		literal := host[:len(host)-len(".ipv6-literal.net")]
+		host = strings.NewReplacer("-", ":", "s", "%", "S", "%").Replace(literal)
+	}
+
+	if strings.Contains(host, ":") {
+		if strings.Contains(host, "%") {
+			return "", fmt.Errorf("IPv6 zone identifiers are not supported in server %q", host)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return "", fmt.Errorf("invalid IPv6 address %q", host)
+		}
+		return ip.String(), nil
+	}
+
+	if strings.Trim(host, "0123456789.") == "" {
+		ip := net.ParseIP(host)
+		if ip == nil || ip.To4() == nil {
+			return "", fmt.Errorf("invalid IPv4 address %q", host)
+		}
+		return ip.String(), nil
+	}
+
+	return normalizeHostname(host)
+}
+
+// normalizeHostname lower-cases a DNS or NetBIOS server name. Labels may
+// contain underscores, which Active Directory and NetBIOS names often do
+// even though DNS host names may not.
+func normalizeHostname(host string) (string, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if len(name) > 253 {
+		return "", fmt.Errorf("server name %q is longer than 253 characters", host)
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return "", fmt.Errorf("server name %q contains an empty label", host)
+		}
+		if len(label) > 63 {
+			return "", fmt.Errorf("label %q in server name %q is longer than 63 characters", label, host)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return "", fmt.Errorf("label %q in server name %q must not start or end with a hyphen", label, host)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", fmt.Errorf("server name %q contains invalid character %q; only letters, digits, hyphens and underscores are allowed", host, c)
+			}
+		}
+	}
+
+	return name, nil
+}
+
+func validateShareName(name string) error {
+	if utf8.RuneCountInString(name) > maxShareNameLength {
+		return fmt.Errorf("share name %q is longer than %d characters", name, maxShareNameLength)
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) || strings.ContainsRune(`"\/[]:|<>+=;,*?`, c) {
+			return fmt.Errorf("share name %q contains invalid character %q", name, c)
+		}
+	}
+	return nil
+}
+
+func validateSharePathComponent(component string) error {
+	if component == "." || component == ".." {
+		return fmt.Errorf("relative path component %q is not allowed", component)
+	}
+	for _, c := range component {
+		if unicode.IsControl(c) || strings.ContainsRune(`"\:|<>*?`, c) {
+			return fmt.Errorf("path component %q contains invalid character %q", component, c)
+		}
+	}
+	return nil
+}
+
+func parseShareQuery(rawQuery string) (map[string]string, error) {
+	if rawQuery == "" {
+		return nil, nil
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("malformed query: %s", err.Error())
+	}
+
+	options := map[string]string{}
+	for key, values := range query {
+		option, ok := shareQueryOptions[strings.ToLower(key)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported option %q in share URL", key)
+		}
+		if len(values) != 1 {
+			return nil, fmt.Errorf("option %q is given more than once in share URL", key)
+		}
+		if existing, ok := options[option]; ok && existing != values[0] {
+			return nil, fmt.Errorf("option %q is given more than once in share URL", option)
+		}
+		options[option] = values[0]
+	}
+	return options, nil
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
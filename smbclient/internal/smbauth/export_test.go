@@ -0,0 +1,3 @@
+package smbauth
+
+var MD4 = md4
@@ -0,0 +1,356 @@
+// Package smbauth implements NTLMv2 authentication wrapped in SPNEGO and the
+// SMB2 message signing that depends on its session key.
+package smbauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	negotiateUnicode                 uint32 = 0x00000001
+	requestTarget                    uint32 = 0x00000004
+	negotiateSign                    uint32 = 0x00000010
+	negotiateNTLM                    uint32 = 0x00000200
+	negotiateAlwaysSign              uint32 = 0x00008000
+	negotiateExtendedSessionSecurity uint32 = 0x00080000
+	negotiateTargetInfo              uint32 = 0x00800000
+	negotiateVersion                 uint32 = 0x02000000
+	negotiate128                     uint32 = 0x20000000
+	negotiateKeyExch                 uint32 = 0x40000000
+	negotiate56                      uint32 = 0x80000000
+
+	clientFlags = negotiateUnicode | requestTarget | negotiateSign | negotiateNTLM | negotiateAlwaysSign |
+		negotiateExtendedSessionSecurity | negotiateTargetInfo | negotiateVersion | negotiate128 | negotiateKeyExch | negotiate56
+
+	avEOL          = 0x0000
+	avNbDomainName = 0x0002
+	avFlags        = 0x0006
+	avTimestamp    = 0x0007
+
+	avFlagMICPresent = 0x00000002
+
+	negotiateMessageType    = 1
+	challengeMessageType    = 2
+	authenticateMessageType = 3
+
+	authenticateHeaderSize = 88
+	micOffset              = 72
+)
+
+var (
+	signature = []byte("NTLMSSP\x00")
+
+	// windows 10.0 build 17763, NTLM revision 15
+	version = []byte{10, 0, 0x63, 0x45, 0, 0, 0, 15}
+
+	ErrMalformed = errors.New("malformed NTLM message")
+)
+
+// Client holds the state of one NTLMv2 authentication.
+type Client struct {
+	User     string
+	Password string
+	Domain   string
+
+	negotiate  []byte
+	sessionKey []byte
+}
+
+// Negotiate returns the first NTLM message.
+func (c *Client) Negotiate() []byte {
+	message := make([]byte, 40)
+	copy(message, signature)
+	binary.LittleEndian.PutUint32(message[8:], negotiateMessageType)
+	binary.LittleEndian.PutUint32(message[12:], clientFlags)
+	copy(message[32:], version)
+	c.negotiate = message
+	return message
+}
+
+// Authenticate answers the server's challenge message.
+func (c *Client) Authenticate(challenge []byte) ([]byte, error) {
+	if len(challenge) < 48 || !bytes.Equal(challenge[:8], signature) || binary.LittleEndian.Uint32(challenge[8:]) != challengeMessageType {
+		return nil, ErrMalformed
+	}
+	flags := binary.LittleEndian.Uint32(challenge[20:]) & clientFlags
+	serverChallenge := challenge[24:32]
+	targetInfo, ok := field(challenge, 40)
+	if !ok {
+		return nil, ErrMalformed
+	}
+
+	timestamp, hasTimestamp := findAv(targetInfo, avTimestamp)
+	if !hasTimestamp {
+		timestamp = make([]byte, 8)
+		binary.LittleEndian.PutUint64(timestamp, fileTime(time.Now()))
+	}
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, withMICFlag(targetInfo)...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	responseKey := NTOWFv2(c.User, c.Password, c.Domain)
+	proof := hmacMD5(responseKey, serverChallenge, temp)
+	ntResponse := append(proof, temp...)
+	sessionBaseKey := hmacMD5(responseKey, proof)
+
+	exportedKey := sessionBaseKey
+	var encryptedKey []byte
+	if flags&negotiateKeyExch != 0 {
+		exportedKey = make([]byte, 16)
+		if _, err := rand.Read(exportedKey); err != nil {
+			return nil, err
+		}
+		encryptedKey = rc4Crypt(sessionBaseKey, exportedKey)
+	}
+
+	payload := [][]byte{
+		make([]byte, 24),
+		ntResponse,
+		utf16le(c.Domain),
+		utf16le(c.User),
+		nil,
+		encryptedKey,
+	}
+
+	message := make([]byte, authenticateHeaderSize)
+	copy(message, signature)
+	binary.LittleEndian.PutUint32(message[8:], authenticateMessageType)
+	offset := authenticateHeaderSize
+	for i, value := range payload {
+		putField(message[12+8*i:], len(value), offset)
+		message = append(message, value...)
+		offset += len(value)
+	}
+	binary.LittleEndian.PutUint32(message[60:], flags|negotiateVersion)
+	copy(message[64:], version)
+
+	mic := hmacMD5(exportedKey, c.negotiate, challenge, message)
+	copy(message[micOffset:], mic)
+
+	c.sessionKey = exportedKey
+	return message, nil
+}
+
+// SessionKey returns the exported session key once Authenticate succeeded.
+func (c *Client) SessionKey() []byte {
+	return c.sessionKey
+}
+
+// Server verifies NTLMv2 authentications against known passwords.
+type Server struct {
+	TargetName string
+	// Password returns the password of a user, or false if the user is not
+	// known.
+	Password func(user, domain string) (string, bool)
+
+	negotiate []byte
+	challenge []byte
+}
+
+// Challenge answers the client's negotiate message.
+func (s *Server) Challenge(negotiate []byte) ([]byte, error) {
+	if len(negotiate) < 16 || !bytes.Equal(negotiate[:8], signature) || binary.LittleEndian.Uint32(negotiate[8:]) != negotiateMessageType {
+		return nil, ErrMalformed
+	}
+	flags := binary.LittleEndian.Uint32(negotiate[12:]) & clientFlags
+
+	serverChallenge := make([]byte, 8)
+	if _, err := rand.Read(serverChallenge); err != nil {
+		return nil, err
+	}
+
+	var targetInfo []byte
+	targetInfo = appendAv(targetInfo, avNbDomainName, utf16le(s.TargetName))
+	timestamp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestamp, fileTime(time.Now()))
+	targetInfo = appendAv(targetInfo, avTimestamp, timestamp)
+	targetInfo = appendAv(targetInfo, avEOL, nil)
+
+	targetName := utf16le(s.TargetName)
+	message := make([]byte, 56)
+	copy(message, signature)
+	binary.LittleEndian.PutUint32(message[8:], challengeMessageType)
+	putField(message[12:], len(targetName), 56)
+	binary.LittleEndian.PutUint32(message[20:], flags|negotiateTargetInfo)
+	copy(message[24:], serverChallenge)
+	putField(message[40:], len(targetInfo), 56+len(targetName))
+	copy(message[48:], version)
+	message = append(message, targetName...)
+	message = append(message, targetInfo...)
+
+	s.negotiate = negotiate
+	s.challenge = message
+	return message, nil
+}
+
+// Verify checks the client's authenticate message and returns the user and
+// the exported session key.
+func (s *Server) Verify(authenticate []byte) (string, []byte, error) {
+	if len(authenticate) < authenticateHeaderSize || !bytes.Equal(authenticate[:8], signature) ||
+		binary.LittleEndian.Uint32(authenticate[8:]) != authenticateMessageType || s.challenge == nil {
+		return "", nil, ErrMalformed
+	}
+
+	ntResponse, ok1 := field(authenticate, 20)
+	domain, ok2 := field(authenticate, 28)
+	user, ok3 := field(authenticate, 36)
+	encryptedKey, ok4 := field(authenticate, 52)
+	if !ok1 || !ok2 || !ok3 || !ok4 || len(ntResponse) < 16 {
+		return "", nil, ErrMalformed
+	}
+
+	userName, domainName := fromUTF16le(user), fromUTF16le(domain)
+	password, known := s.Password(userName, domainName)
+	if !known {
+		return "", nil, errors.New("unknown user")
+	}
+
+	responseKey := NTOWFv2(userName, password, domainName)
+	proof := hmacMD5(responseKey, s.challenge[24:32], ntResponse[16:])
+	if !hmac.Equal(proof, ntResponse[:16]) {
+		return "", nil, errors.New("wrong password")
+	}
+
+	sessionKey := hmacMD5(responseKey, proof)
+	if binary.LittleEndian.Uint32(authenticate[60:])&negotiateKeyExch != 0 {
+		if len(encryptedKey) != 16 {
+			return "", nil, ErrMalformed
+		}
+		sessionKey = rc4Crypt(sessionKey, encryptedKey)
+	}
+
+	withoutMIC := append([]byte{}, authenticate...)
+	copy(withoutMIC[micOffset:micOffset+16], make([]byte, 16))
+	mic := hmacMD5(sessionKey, s.negotiate, s.challenge, withoutMIC)
+	if !hmac.Equal(mic, authenticate[micOffset:micOffset+16]) {
+		return "", nil, errors.New("MIC mismatch")
+	}
+
+	return userName, sessionKey, nil
+}
+
+// NTOWFv2 derives the NTLMv2 response key from the user's password.
+func NTOWFv2(user, password, domain string) []byte {
+	hash := md4(utf16le(password))
+	return hmacMD5(hash[:], utf16le(strings.ToUpper(user)+domain))
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func rc4Crypt(key, data []byte) []byte {
+	cipher, _ := rc4.NewCipher(key)
+	out := make([]byte, len(data))
+	cipher.XORKeyStream(out, data)
+	return out
+}
+
+func utf16le(s string) []byte {
+	codes := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(codes))
+	for i, code := range codes {
+		binary.LittleEndian.PutUint16(b[2*i:], code)
+	}
+	return b
+}
+
+func fromUTF16le(b []byte) string {
+	codes := make([]uint16, len(b)/2)
+	for i := range codes {
+		codes[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(codes))
+}
+
+// fileTime converts t to 100ns intervals since 1601-01-01.
+func fileTime(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100) + 116444736000000000
+}
+
+func putField(b []byte, length, offset int) {
+	binary.LittleEndian.PutUint16(b[0:], uint16(length))
+	binary.LittleEndian.PutUint16(b[2:], uint16(length))
+	binary.LittleEndian.PutUint32(b[4:], uint32(offset))
+}
+
+func field(message []byte, at int) ([]byte, bool) {
+	if len(message) < at+8 {
+		return nil, false
+	}
+	length := int(binary.LittleEndian.Uint16(message[at:]))
+	offset := int(binary.LittleEndian.Uint32(message[at+4:]))
+	if offset+length > len(message) {
+		return nil, false
+	}
+	return message[offset : offset+length], true
+}
+
+func appendAv(b []byte, id uint16, value []byte) []byte {
+	var header [4]byte
+	binary.LittleEndian.PutUint16(header[0:], id)
+	binary.LittleEndian.PutUint16(header[2:], uint16(len(value)))
+	return append(append(b, header[:]...), value...)
+}
+
+func findAv(info []byte, id uint16) ([]byte, bool) {
+	for len(info) >= 4 {
+		avID := binary.LittleEndian.Uint16(info[0:])
+		length := int(binary.LittleEndian.Uint16(info[2:]))
+		if avID == avEOL || len(info) < 4+length {
+			break
+		}
+		if avID == id {
+			return info[4 : 4+length], true
+		}
+		info = info[4+length:]
+	}
+	return nil, false
+}
+
+// withMICFlag returns a copy of the server's target info that announces the
+// MIC in the authenticate message.
+func withMICFlag(info []byte) []byte {
+	var out []byte
+	flags := uint32(avFlagMICPresent)
+	for len(info) >= 4 {
+		avID := binary.LittleEndian.Uint16(info[0:])
+		length := int(binary.LittleEndian.Uint16(info[2:]))
+		if avID == avEOL || len(info) < 4+length {
+			break
+		}
+		if avID == avFlags && length == 4 {
+			flags |= binary.LittleEndian.Uint32(info[4:])
+		} else {
+			out = appendAv(out, avID, info[4:4+length])
+		}
+		info = info[4+length:]
+	}
+
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, flags)
+	out = appendAv(out, avFlags, value)
+	return appendAv(out, avEOL, nil)
+}
@@ -0,0 +1,128 @@
+package smbauth
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+const (
+	signatureOffset = 48
+	signatureSize   = 16
+)
+
+// Signer signs SMB2 messages with the key of an authenticated session.
+// SMB 2.x uses HMAC-SHA256 over the session key, SMB 3.0 AES-CMAC over a
+// key derived from it.
+type Signer struct {
+	key  []byte
+	cmac bool
+}
+
+// NewSigner returns a signer for the session key and dialect.
+func NewSigner(sessionKey []byte, dialect uint16) *Signer {
+	if dialect >= 0x0300 {
+		return &Signer{key: kdf(sessionKey, []byte("SMB2AESCMAC\x00"), []byte("SmbSign\x00")), cmac: true}
+	}
+	return &Signer{key: sessionKey}
+}
+
+// Sign writes the signature of message into its header.
+func (s *Signer) Sign(message []byte) {
+	copy(message[signatureOffset:signatureOffset+signatureSize], s.signature(message))
+}
+
+// Verify reports whether message carries a valid signature.
+func (s *Signer) Verify(message []byte) bool {
+	if len(message) < signatureOffset+signatureSize {
+		return false
+	}
+	return hmac.Equal(message[signatureOffset:signatureOffset+signatureSize], s.signature(message))
+}
+
+func (s *Signer) signature(message []byte) []byte {
+	unsigned := append([]byte{}, message...)
+	copy(unsigned[signatureOffset:signatureOffset+signatureSize], make([]byte, signatureSize))
+
+	if s.cmac {
+		return AESCMAC(s.key, unsigned)
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(unsigned)
+	return mac.Sum(nil)[:signatureSize]
+}
+
+// kdf is the SP800-108 counter mode KDF with HMAC-SHA256 and a 128 bit
+// output used by SMB 3.
+func kdf(key, label, context []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	var counter, length [4]byte
+	binary.BigEndian.PutUint32(counter[:], 1)
+	binary.BigEndian.PutUint32(length[:], 128)
+	mac.Write(counter[:])
+	mac.Write(label)
+	mac.Write([]byte{0})
+	mac.Write(context)
+	mac.Write(length[:])
+	return mac.Sum(nil)[:16]
+}
+
+// AESCMAC computes the AES-CMAC of message (RFC 4493).
+func AESCMAC(key, message []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+
+	subkey := func(b []byte) []byte {
+		out := make([]byte, aes.BlockSize)
+		carry := byte(0)
+		for i := aes.BlockSize - 1; i >= 0; i-- {
+			out[i] = b[i]<<1 | carry
+			carry = b[i] >> 7
+		}
+		if b[0]&0x80 != 0 {
+			out[aes.BlockSize-1] ^= 0x87
+		}
+		return out
+	}
+
+	l := make([]byte, aes.BlockSize)
+	block.Encrypt(l, l)
+	k1 := subkey(l)
+	k2 := subkey(k1)
+
+	n := (len(message) + aes.BlockSize - 1) / aes.BlockSize
+	complete := n > 0 && len(message)%aes.BlockSize == 0
+	if n == 0 {
+		n = 1
+	}
+
+	last := make([]byte, aes.BlockSize)
+	tail := message[(n-1)*aes.BlockSize:]
+	if complete {
+		for i := range last {
+			last[i] = tail[i] ^ k1[i]
+		}
+	} else {
+		copy(last, tail)
+		last[len(tail)] = 0x80
+		for i := range last {
+			last[i] ^= k2[i]
+		}
+	}
+
+	x := make([]byte, aes.BlockSize)
+	for i := 0; i < n-1; i++ {
+		for j := range x {
+			x[j] ^= message[i*aes.BlockSize+j]
+		}
+		block.Encrypt(x, x)
+	}
+	for j := range x {
+		x[j] ^= last[j]
+	}
+	block.Encrypt(x, x)
+	return x
+}
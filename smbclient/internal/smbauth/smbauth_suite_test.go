@@ -0,0 +1,13 @@
+package smbauth_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSmbauth(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SMB Auth Suite")
+}
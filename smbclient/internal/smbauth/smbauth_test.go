@@ -0,0 +1,140 @@
+package smbauth_test
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"code.cloudfoundry.org/smbbroker/smbclient/internal/smbauth"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	Expect(err).NotTo(HaveOccurred())
+	return b
+}
+
+var _ = Describe("smbauth", func() {
+	table.DescribeTable("MD4 (RFC 1320)",
+		func(input, digest string) {
+			sum := smbauth.MD4([]byte(input))
+			Expect(hex.EncodeToString(sum[:])).To(Equal(digest))
+		},
+		table.Entry("empty", "", "31d6cfe0d16ae931b73c59d7e0c089c0"),
+		table.Entry("a", "a", "bde52cb31de33e46245e05fbdbd6fb24"),
+		table.Entry("abc", "abc", "a448017aaf21d8525fc10ae87aa6729d"),
+		table.Entry("alphabet", "abcdefghijklmnopqrstuvwxyz", "d79e1c308aa5bbcdeea8ed63df412da9"),
+		table.Entry("two blocks", "12345678901234567890123456789012345678901234567890123456789012345678901234567890", "e33b4ddc9c38f2199c3e7b164fcc0536"),
+	)
+
+	It("derives the NTLMv2 response key (MS-NLMP 4.2.4.1.1)", func() {
+		Expect(smbauth.NTOWFv2("User", "Password", "Domain")).To(Equal(unhex("0c868a403bfd7a93a3001ef22ef02e3f")))
+	})
+
+	table.DescribeTable("AES-CMAC (RFC 4493)",
+		func(message, mac string) {
+			key := unhex("2b7e1516 28aed2a6 abf71588 09cf4f3c")
+			Expect(smbauth.AESCMAC(key, unhex(message))).To(Equal(unhex(mac)))
+		},
+		table.Entry("empty", "", "bb1d6929 e9593728 7fa37d12 9b756746"),
+		table.Entry("one block", "6bc1bee2 2e409f96 e93d7e11 7393172a", "070a16b4 6b4d4144 f79bdd9d d04a287c"),
+		table.Entry("partial block", "6bc1bee2 2e409f96 e93d7e11 7393172a ae2d8a57 1e03ac9c 9eb76fac 45af8e51 30c81c46 a35ce411", "dfa66747 de9ae630 30ca3261 1497c827"),
+		table.Entry("four blocks", "6bc1bee2 2e409f96 e93d7e11 7393172a ae2d8a57 1e03ac9c 9eb76fac 45af8e51 30c81c46 a35ce411 e5fbc119 1a0a52ef f69f2445 df4f9b17 ad2b417b e66c3710", "51f0bebf 7e3b9d92 fc497417 79363cfe"),
+	)
+
+	Describe("NTLM", func() {
+		var (
+			client *smbauth.Client
+			server *smbauth.Server
+		)
+
+		BeforeEach(func() {
+			client = &smbauth.Client{User: "alice", Password: "secret", Domain: "CORP"}
+			server = &smbauth.Server{
+				TargetName: "SERVER",
+				Password: func(user, domain string) (string, bool) {
+					return "secret", strings.EqualFold(user, "alice")
+				},
+			}
+		})
+
+		authenticate := func() (string, []byte, error) {
+			challenge, err := server.Challenge(client.Negotiate())
+			Expect(err).NotTo(HaveOccurred())
+			message, err := client.Authenticate(challenge)
+			Expect(err).NotTo(HaveOccurred())
+			return server.Verify(message)
+		}
+
+		It("agrees on the session key", func() {
+			user, key, err := authenticate()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user).To(Equal("alice"))
+			Expect(key).To(HaveLen(16))
+			Expect(key).To(Equal(client.SessionKey()))
+		})
+
+		It("rejects a wrong password", func() {
+			client.Password = "wrong"
+			_, _, err := authenticate()
+			Expect(err).To(MatchError("wrong password"))
+		})
+
+		It("rejects unknown users", func() {
+			client.User = "mallory"
+			_, _, err := authenticate()
+			Expect(err).To(MatchError("unknown user"))
+		})
+	})
+
+	Describe("SPNEGO", func() {
+		It("round trips the NTLM messages", func() {
+			ntlm := (&smbauth.Client{}).Negotiate()
+
+			message, state, err := smbauth.ParseToken(smbauth.InitToken(ntlm))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message).To(Equal(ntlm))
+			Expect(state).To(Equal(-1))
+
+			message, state, err = smbauth.ParseToken(smbauth.ResponseToken(smbauth.NegStateAcceptIncomplete, ntlm))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message).To(Equal(ntlm))
+			Expect(state).To(Equal(smbauth.NegStateAcceptIncomplete))
+
+			message, state, err = smbauth.ParseToken(smbauth.ResponseToken(smbauth.NegStateAcceptCompleted, nil))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message).To(BeNil())
+			Expect(state).To(Equal(smbauth.NegStateAcceptCompleted))
+		})
+
+		It("encodes long messages", func() {
+			ntlm := append([]byte("NTLMSSP\x00"), make([]byte, 300)...)
+			message, _, err := smbauth.ParseToken(smbauth.ResponseToken(-1, ntlm))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message).To(Equal(ntlm))
+		})
+
+		It("accepts raw NTLM messages", func() {
+			ntlm := (&smbauth.Client{}).Negotiate()
+			message, _, err := smbauth.ParseToken(ntlm)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message).To(Equal(ntlm))
+		})
+	})
+
+	It("signs SMB2 messages", func() {
+		message := make([]byte, 80)
+		message[0] = 0xfe
+
+		for _, dialect := range []uint16{0x0202, 0x0300} {
+			signer := smbauth.NewSigner(make([]byte, 16), dialect)
+			signer.Sign(message)
+			Expect(signer.Verify(message)).To(BeTrue())
+
+			message[70] ^= 1
+			Expect(signer.Verify(message)).To(BeFalse())
+		}
+	})
+})
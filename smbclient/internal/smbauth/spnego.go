@@ -0,0 +1,132 @@
+package smbauth
+
+import (
+	"bytes"
+	"errors"
+)
+
+var (
+	spnegoOID  = []byte{0x2b, 0x06, 0x01, 0x05, 0x05, 0x02}
+	ntlmsspOID = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0x82, 0x37, 0x02, 0x02, 0x0a}
+
+	ErrNotNTLM = errors.New("security token does not carry NTLM")
+)
+
+const (
+	NegStateAcceptCompleted  = 0
+	NegStateAcceptIncomplete = 1
+	NegStateReject           = 2
+)
+
+// InitToken wraps the NTLM negotiate message in a SPNEGO NegTokenInit.
+func InitToken(ntlm []byte) []byte {
+	mechTypes := der(0xa0, der(0x30, der(0x06, ntlmsspOID)))
+	mechToken := der(0xa2, der(0x04, ntlm))
+	return der(0x60, append(der(0x06, spnegoOID), der(0xa0, der(0x30, append(mechTypes, mechToken...)))...))
+}
+
+// ResponseToken wraps an NTLM message in a SPNEGO NegTokenResp. A state
+// below zero is left out, as clients do not send one.
+func ResponseToken(state int, ntlm []byte) []byte {
+	var fields []byte
+	if state >= 0 {
+		fields = append(fields, der(0xa0, der(0x0a, []byte{byte(state)}))...)
+		fields = append(fields, der(0xa1, der(0x06, ntlmsspOID))...)
+	}
+	if ntlm != nil {
+		fields = append(fields, der(0xa2, der(0x04, ntlm))...)
+	}
+	return der(0xa1, der(0x30, fields))
+}
+
+// ParseToken returns the NTLM message and the negotiation state carried by
+// a SPNEGO token. Raw NTLM messages are returned as they are.
+func ParseToken(token []byte) ([]byte, int, error) {
+	if bytes.HasPrefix(token, signature) {
+		return token, -1, nil
+	}
+
+	tag, content, _, err := parseDER(token)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch tag {
+	case 0x60:
+		tag, oid, rest, err := parseDER(content)
+		if err != nil || tag != 0x06 || !bytes.Equal(oid, spnegoOID) {
+			return nil, 0, ErrNotNTLM
+		}
+		if tag, content, _, err = parseDER(rest); err != nil || tag != 0xa0 {
+			return nil, 0, ErrNotNTLM
+		}
+	case 0xa1:
+	default:
+		return nil, 0, ErrNotNTLM
+	}
+
+	tag, fields, _, err := parseDER(content)
+	if err != nil || tag != 0x30 {
+		return nil, 0, ErrNotNTLM
+	}
+
+	state := -1
+	var ntlm []byte
+	for len(fields) > 0 {
+		var value []byte
+		tag, value, fields, err = parseDER(fields)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		_, inner, _, err := parseDER(value)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch tag {
+		case 0xa0:
+			if len(inner) == 1 {
+				state = int(inner[0])
+			}
+		case 0xa2:
+			ntlm = inner
+		}
+	}
+	return ntlm, state, nil
+}
+
+func der(tag byte, content []byte) []byte {
+	out := []byte{tag}
+	switch n := len(content); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	default:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	}
+	return append(out, content...)
+}
+
+func parseDER(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errors.New("truncated security token")
+	}
+
+	tag, length, b := b[0], int(b[1]), b[2:]
+	if length >= 0x80 {
+		size := length & 0x7f
+		if size == 0 || size > 2 || len(b) < size {
+			return 0, nil, nil, errors.New("invalid security token length")
+		}
+		length = 0
+		for _, c := range b[:size] {
+			length = length<<8 | int(c)
+		}
+		b = b[size:]
+	}
+	if len(b) < length {
+		return 0, nil, nil, errors.New("truncated security token")
+	}
+	return tag, b[:length], b[length:], nil
+}
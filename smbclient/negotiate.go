@@ -0,0 +1,296 @@
+package smbclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"code.cloudfoundry.org/smbbroker/smbclient/internal/smbauth"
+)
+
+// Versions are the SMB protocol versions understood by the mount helper, in
+// ascending order.
+var Versions = []string{"1.0", "2.0", "2.1", "3.0"}
+
+const (
+	DialectSMB202 uint16 = 0x0202
+	DialectSMB210 uint16 = 0x0210
+	DialectSMB300 uint16 = 0x0300
+
+	securityModeSigningEnabled = 0x0001
+
+	smb1CommandNegotiate = 0x72
+	smb1Dialect          = "NT LM 0.12"
+)
+
+var dialectVersions = map[uint16]string{
+	DialectSMB202: "2.0",
+	DialectSMB210: "2.1",
+	DialectSMB300: "3.0",
+}
+
+// DialectError is returned when the server does not support any of the
+// offered versions.
+type DialectError struct {
+	Offered []string
+}
+
+func (e *DialectError) Error() string {
+	if len(e.Offered) == 1 {
+		return fmt.Sprintf("server does not support SMB version %s", e.Offered[0])
+	}
+	return fmt.Sprintf("server supports none of the SMB versions %s", strings.Join(e.Offered, ", "))
+}
+
+// Client opens SMB connections.
+type Client struct {
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func New() *Client {
+	dialer := &net.Dialer{}
+	return &Client{DialContext: dialer.DialContext}
+}
+
+// Conn is a connection on which a dialect has been negotiated.
+type Conn struct {
+	conn      net.Conn
+	version   string
+	dialect   uint16
+	messageID uint64
+	sessionID uint64
+	signer    *smbauth.Signer
+}
+
+// Version returns the negotiated SMB version, e.g. "3.0".
+func (c *Conn) Version() string {
+	return c.version
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Negotiate returns the highest of versions that the server at address
+// supports.
+func (c *Client) Negotiate(ctx context.Context, address string, versions []string) (string, error) {
+	conn, err := c.Dial(ctx, address, versions)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.Version(), nil
+}
+
+// Dial connects to address and negotiates the highest of versions that the
+// server supports. SMB 1.0 is only tried when none of the SMB2 versions is
+// accepted.
+func (c *Client) Dial(ctx context.Context, address string, versions []string) (*Conn, error) {
+	var dialects []uint16
+	for _, version := range versions {
+		dialect, ok := dialectFor(version)
+		if !ok && version != "1.0" {
+			return nil, fmt.Errorf("unknown SMB version %q", version)
+		}
+		if ok {
+			dialects = append(dialects, dialect)
+		}
+	}
+
+	if len(dialects) > 0 {
+		conn, err := c.dial(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		err = conn.negotiate(dialects)
+		if err == nil {
+			return conn, nil
+		}
+		conn.Close()
+		if !isNotSupported(err) {
+			return nil, err
+		}
+	}
+
+	if contains(versions, "1.0") {
+		conn, err := c.dial(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		err = conn.negotiateSMB1()
+		if err == nil {
+			return conn, nil
+		}
+		conn.Close()
+		if !isNotSupported(err) {
+			return nil, err
+		}
+	}
+
+	return nil, &DialectError{Offered: versions}
+}
+
+func (c *Client) dial(ctx context.Context, address string) (*Conn, error) {
+	conn, err := c.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &Conn{conn: conn}, nil
+}
+
+func (c *Conn) negotiate(dialects []uint16) error {
+	body := make([]byte, 36, 36+2*len(dialects))
+	binary.LittleEndian.PutUint16(body[0:], 36)
+	binary.LittleEndian.PutUint16(body[2:], uint16(len(dialects)))
+	binary.LittleEndian.PutUint16(body[4:], securityModeSigningEnabled)
+	if _, err := rand.Read(body[12:28]); err != nil {
+		return err
+	}
+	for _, dialect := range dialects {
+		body = appendUint16(body, dialect)
+	}
+
+	_, response, err := c.roundTrip(Header{Command: CommandNegotiate}, body)
+	if err != nil {
+		return err
+	}
+	if len(response) < 6 {
+		return errors.New("NEGOTIATE response is too short")
+	}
+
+	dialect := binary.LittleEndian.Uint16(response[4:])
+	version, ok := dialectVersions[dialect]
+	if !ok || !containsDialect(dialects, dialect) {
+		return fmt.Errorf("server selected dialect 0x%04x that was not offered", dialect)
+	}
+
+	c.dialect = dialect
+	c.version = version
+	return nil
+}
+
+func (c *Conn) negotiateSMB1() error {
+	request := make([]byte, 32, 64)
+	copy(request[0:4], smb1ProtocolID)
+	request[4] = smb1CommandNegotiate
+	request[9] = 0x18
+	binary.LittleEndian.PutUint16(request[10:], 0xC801)
+	request = append(request, 0)
+	request = appendUint16(request, uint16(len(smb1Dialect)+2))
+	request = append(request, 0x02)
+	request = append(request, smb1Dialect...)
+	request = append(request, 0)
+
+	if err := WriteMessage(c.conn, request); err != nil {
+		return err
+	}
+	response, err := ReadMessage(c.conn)
+	if err != nil {
+		return err
+	}
+
+	if !IsSMB1(response) || len(response) < 35 || response[4] != smb1CommandNegotiate {
+		return &StatusError{Command: CommandNegotiate, Status: StatusNotSupported}
+	}
+	if status := binary.LittleEndian.Uint32(response[5:]); status != StatusSuccess {
+		return &StatusError{Command: CommandNegotiate, Status: status}
+	}
+	if binary.LittleEndian.Uint16(response[33:]) != 0 {
+		return &StatusError{Command: CommandNegotiate, Status: StatusNotSupported}
+	}
+
+	c.version = "1.0"
+	return nil
+}
+
+// roundTrip sends a request and returns the matching response. Requests
+// are signed once a session is set up. Error statuses other than
+// STATUS_MORE_PROCESSING_REQUIRED become a *StatusError.
+func (c *Conn) roundTrip(header Header, body []byte) (Header, []byte, error) {
+	header.MessageID = c.messageID
+	header.SessionID = c.sessionID
+	header.Credits = 1
+	c.messageID++
+
+	if c.signer != nil {
+		header.Flags |= FlagSigned
+	}
+	request := header.Marshal(body)
+	if c.signer != nil {
+		c.signer.Sign(request)
+	}
+
+	if err := WriteMessage(c.conn, request); err != nil {
+		return Header{}, nil, err
+	}
+
+	message, err := ReadMessage(c.conn)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	response, responseBody, err := ParseHeader(message)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	if response.Command != header.Command || response.MessageID != header.MessageID || response.Flags&FlagResponse == 0 {
+		return Header{}, nil, fmt.Errorf("unexpected response to %s", commandNames[header.Command])
+	}
+	if response.Status != StatusSuccess && response.Status != StatusMoreProcessingRequired {
+		return response, nil, &StatusError{Command: header.Command, Status: response.Status}
+	}
+	return response, responseBody, nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func dialectFor(version string) (uint16, bool) {
+	for dialect, v := range dialectVersions {
+		if v == version {
+			return dialect, true
+		}
+	}
+	return 0, false
+}
+
+// isNotSupported reports whether err means that the server rejected the
+// offered dialects. Servers either answer STATUS_NOT_SUPPORTED or, like
+// Samba, drop the connection.
+func isNotSupported(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Status == StatusNotSupported
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, syscall.ECONNRESET)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsDialect(list []uint16, d uint16) bool {
+	for _, item := range list {
+		if item == d {
+			return true
+		}
+	}
+	return false
+}
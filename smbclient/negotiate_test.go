@@ -0,0 +1,87 @@
+package smbclient_test
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"code.cloudfoundry.org/smbbroker/smbclient"
+	"code.cloudfoundry.org/smbbroker/smbclient/smbtest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Negotiate", func() {
+	var (
+		server *smbtest.Server
+		client *smbclient.Client
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		var err error
+		server, err = smbtest.NewServer("2.0", "2.1")
+		Expect(err).NotTo(HaveOccurred())
+
+		client = smbclient.New()
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	})
+
+	AfterEach(func() {
+		cancel()
+		server.Close()
+	})
+
+	It("selects the highest common version", func() {
+		version, err := client.Negotiate(ctx, server.Addr(), smbclient.Versions)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(version).To(Equal("2.1"))
+		Expect(server.Requests()).To(Equal([]string{"NEGOTIATE 2.0,2.1"}))
+	})
+
+	It("accepts a single supported version", func() {
+		version, err := client.Negotiate(ctx, server.Addr(), []string{"2.0"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(version).To(Equal("2.0"))
+	})
+
+	It("rejects versions the server does not offer", func() {
+		_, err := client.Negotiate(ctx, server.Addr(), []string{"3.0"})
+		Expect(err).To(MatchError("server does not support SMB version 3.0"))
+		Expect(err).To(BeAssignableToTypeOf(&smbclient.DialectError{}))
+	})
+
+	It("treats a dropped connection as an unsupported version", func() {
+		server.DropUnsupported = true
+
+		_, err := client.Negotiate(ctx, server.Addr(), []string{"3.0"})
+		Expect(err).To(MatchError("server does not support SMB version 3.0"))
+	})
+
+	It("falls back to SMB 1.0", func() {
+		server.Versions = []string{"1.0"}
+
+		version, err := client.Negotiate(ctx, server.Addr(), smbclient.Versions)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(version).To(Equal("1.0"))
+	})
+
+	It("only tries SMB 1.0 when it is offered", func() {
+		_, err := client.Negotiate(ctx, server.Addr(), []string{"1.0"})
+		Expect(err).To(MatchError("server does not support SMB version 1.0"))
+		Expect(server.Requests()).To(Equal([]string{"NEGOTIATE 1.0"}))
+	})
+
+	It("rejects unknown versions", func() {
+		_, err := client.Negotiate(ctx, server.Addr(), []string{"4.0"})
+		Expect(err).To(MatchError(`unknown SMB version "4.0"`))
+	})
+
+	It("returns connection errors", func() {
+		server.Close()
+
+		_, err := client.Negotiate(ctx, server.Addr(), smbclient.Versions)
+		Expect(err).To(BeAssignableToTypeOf(&net.OpError{}))
+	})
+})
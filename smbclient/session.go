@@ -0,0 +1,173 @@
+package smbclient
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"code.cloudfoundry.org/smbbroker/smbclient/internal/smbauth"
+)
+
+const (
+	FlagSigned uint32 = 0x00000008
+
+	SessionFlagIsGuest uint16 = 0x0001
+	SessionFlagIsNull  uint16 = 0x0002
+)
+
+var (
+	// ErrSMB1 is returned when a session is requested on an SMB 1.0
+	// connection, which this client cannot authenticate.
+	ErrSMB1 = errors.New("SMB 1.0 connections cannot be authenticated")
+
+	// ErrGuestSession is returned when the server accepted the credentials
+	// only by mapping them to the guest account.
+	ErrGuestSession = errors.New("server mapped the user to the guest account")
+)
+
+// Credentials are the user a session is set up for. A domain may also be
+// given as part of the username, as in DOMAIN\user.
+type Credentials struct {
+	Username string
+	Password string
+	Domain   string
+}
+
+// CheckShare authenticates against the server at address and connects to
+// \\host\share, disconnecting again when done. It returns a *StatusError
+// with StatusLogonFailure, StatusBadNetworkName or StatusAccessDenied when
+// the server rejects the credentials or the share.
+func (c *Client) CheckShare(ctx context.Context, address, host, share string, versions []string, credentials Credentials) error {
+	conn, err := c.Dial(ctx, address, versions)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SessionSetup(credentials); err != nil {
+		return err
+	}
+	defer conn.Logoff()
+
+	treeID, err := conn.TreeConnect(host, share)
+	if err != nil {
+		return err
+	}
+	return conn.TreeDisconnect(treeID)
+}
+
+// SessionSetup authenticates the connection with NTLMv2.
+func (c *Conn) SessionSetup(credentials Credentials) error {
+	if c.dialect == 0 {
+		return ErrSMB1
+	}
+
+	user, domain := credentials.Username, credentials.Domain
+	if i := strings.Index(user, `\`); i >= 0 && domain == "" {
+		domain, user = user[:i], user[i+1:]
+	}
+	ntlm := &smbauth.Client{User: user, Password: credentials.Password, Domain: domain}
+
+	_, token, err := c.sessionSetup(smbauth.InitToken(ntlm.Negotiate()))
+	if err != nil {
+		return err
+	}
+
+	challenge, state, err := smbauth.ParseToken(token)
+	if err != nil {
+		return err
+	}
+	if state == smbauth.NegStateReject || challenge == nil {
+		return &StatusError{Command: CommandSessionSetup, Status: StatusLogonFailure}
+	}
+
+	authenticate, err := ntlm.Authenticate(challenge)
+	if err != nil {
+		return err
+	}
+
+	flags, _, err := c.sessionSetup(smbauth.ResponseToken(-1, authenticate))
+	if err != nil {
+		return err
+	}
+	if flags&(SessionFlagIsGuest|SessionFlagIsNull) != 0 {
+		return ErrGuestSession
+	}
+
+	c.signer = smbauth.NewSigner(ntlm.SessionKey(), c.dialect)
+	return nil
+}
+
+func (c *Conn) sessionSetup(token []byte) (uint16, []byte, error) {
+	body := make([]byte, 24, 24+len(token))
+	binary.LittleEndian.PutUint16(body[0:], 25)
+	body[3] = securityModeSigningEnabled
+	binary.LittleEndian.PutUint16(body[12:], HeaderSize+24)
+	binary.LittleEndian.PutUint16(body[14:], uint16(len(token)))
+	body = append(body, token...)
+
+	header, response, err := c.roundTrip(Header{Command: CommandSessionSetup}, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	c.sessionID = header.SessionID
+
+	if len(response) < 8 {
+		return 0, nil, errors.New("SESSION_SETUP response is too short")
+	}
+	flags := binary.LittleEndian.Uint16(response[2:])
+	offset := int(binary.LittleEndian.Uint16(response[4:])) - HeaderSize
+	length := int(binary.LittleEndian.Uint16(response[6:]))
+	if length == 0 {
+		return flags, nil, nil
+	}
+	if offset < 8 || offset+length > len(response) {
+		return 0, nil, errors.New("SESSION_SETUP response has an invalid security buffer")
+	}
+	return flags, response[offset : offset+length], nil
+}
+
+// TreeConnect connects to \\host\share and returns the tree ID.
+func (c *Conn) TreeConnect(host, share string) (uint32, error) {
+	path := utf16le(fmt.Sprintf(`\\%s\%s`, host, share))
+
+	body := make([]byte, 8, 8+len(path))
+	binary.LittleEndian.PutUint16(body[0:], 9)
+	binary.LittleEndian.PutUint16(body[4:], HeaderSize+8)
+	binary.LittleEndian.PutUint16(body[6:], uint16(len(path)))
+	body = append(body, path...)
+
+	header, _, err := c.roundTrip(Header{Command: CommandTreeConnect}, body)
+	if err != nil {
+		return 0, err
+	}
+	return header.TreeID, nil
+}
+
+func (c *Conn) TreeDisconnect(treeID uint32) error {
+	_, _, err := c.roundTrip(Header{Command: CommandTreeDisconn, TreeID: treeID}, shortBody())
+	return err
+}
+
+func (c *Conn) Logoff() error {
+	_, _, err := c.roundTrip(Header{Command: CommandLogoff}, shortBody())
+	return err
+}
+
+func shortBody() []byte {
+	body := make([]byte, 4)
+	binary.LittleEndian.PutUint16(body[0:], 4)
+	return body
+}
+
+func utf16le(s string) []byte {
+	codes := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(codes))
+	for i, code := range codes {
+		binary.LittleEndian.PutUint16(b[2*i:], code)
+	}
+	return b
+}
@@ -0,0 +1,113 @@
+package smbclient_test
+
+import (
+	"context"
+	"time"
+
+	"code.cloudfoundry.org/smbbroker/smbclient"
+	"code.cloudfoundry.org/smbbroker/smbclient/smbtest"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CheckShare", func() {
+	var (
+		server      *smbtest.Server
+		client      *smbclient.Client
+		ctx         context.Context
+		cancel      context.CancelFunc
+		credentials smbclient.Credentials
+	)
+
+	BeforeEach(func() {
+		var err error
+		server, err = smbtest.NewServer("2.0", "2.1", "3.0")
+		Expect(err).NotTo(HaveOccurred())
+		server.Users["alice"] = "secret"
+		server.Users["bob"] = "hunter2"
+		server.Shares["public"] = nil
+		server.Shares["private"] = []string{"alice"}
+
+		client = smbclient.New()
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		credentials = smbclient.Credentials{Username: "alice", Password: "secret", Domain: "CORP"}
+	})
+
+	AfterEach(func() {
+		cancel()
+		server.Close()
+	})
+
+	check := func(share string, versions ...string) error {
+		if len(versions) == 0 {
+			versions = smbclient.Versions
+		}
+		return client.CheckShare(ctx, server.Addr(), "server", share, versions, credentials)
+	}
+
+	statusOf := func(err error) uint32 {
+		Expect(err).To(BeAssignableToTypeOf(&smbclient.StatusError{}))
+		return err.(*smbclient.StatusError).Status
+	}
+
+	It("connects to the share with valid credentials", func() {
+		Expect(check("private")).To(Succeed())
+		Expect(server.Requests()).To(Equal([]string{
+			"NEGOTIATE 2.0,2.1,3.0",
+			"SESSION_SETUP",
+			`TREE_CONNECT \\server\private`,
+			"TREE_DISCONNECT",
+			"LOGOFF",
+		}))
+	})
+
+	It("takes the domain from the username", func() {
+		credentials = smbclient.Credentials{Username: `CORP\alice`, Password: "secret"}
+		Expect(check("private")).To(Succeed())
+	})
+
+	It("reports a logon failure for a wrong password", func() {
+		credentials.Password = "wrong"
+		err := check("public")
+		Expect(statusOf(err)).To(Equal(smbclient.StatusLogonFailure))
+		Expect(err).To(MatchError("SESSION_SETUP failed: logon failure"))
+	})
+
+	It("reports a logon failure for an unknown user", func() {
+		credentials.Username = "mallory"
+		Expect(statusOf(check("public"))).To(Equal(smbclient.StatusLogonFailure))
+	})
+
+	It("reports unknown shares", func() {
+		err := check("missing")
+		Expect(statusOf(err)).To(Equal(smbclient.StatusBadNetworkName))
+		Expect(err).To(MatchError("TREE_CONNECT failed: bad network name"))
+	})
+
+	It("reports shares the user may not access", func() {
+		credentials = smbclient.Credentials{Username: "bob", Password: "hunter2"}
+		Expect(statusOf(check("private"))).To(Equal(smbclient.StatusAccessDenied))
+	})
+
+	It("refuses guest sessions", func() {
+		server.Guest = true
+		credentials.Password = "wrong"
+		Expect(check("public")).To(MatchError(smbclient.ErrGuestSession))
+	})
+
+	table.DescribeTable("signs requests when the server requires it",
+		func(version string) {
+			server.RequireSigning = true
+			Expect(check("private", version)).To(Succeed())
+		},
+		table.Entry("SMB 2.0", "2.0"),
+		table.Entry("SMB 2.1", "2.1"),
+		table.Entry("SMB 3.0", "3.0"),
+	)
+
+	It("cannot authenticate SMB 1.0 connections", func() {
+		server.Versions = []string{"1.0"}
+		Expect(check("public")).To(MatchError(smbclient.ErrSMB1))
+	})
+})
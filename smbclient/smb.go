@@ -0,0 +1,159 @@
+// Package smbclient implements the small part of the SMB protocol the broker
+// needs to check shares before handing them to apps: dialect negotiation,
+// NTLM authentication and tree connects. It does not read or write files.
+package smbclient
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	maxMessageSize = 1 << 20
+
+	HeaderSize = 64
+
+	CommandNegotiate    uint16 = 0x0000
+	CommandSessionSetup uint16 = 0x0001
+	CommandLogoff       uint16 = 0x0002
+	CommandTreeConnect  uint16 = 0x0003
+	CommandTreeDisconn  uint16 = 0x0004
+
+	FlagResponse uint32 = 0x00000001
+
+	StatusSuccess                uint32 = 0x00000000
+	StatusMoreProcessingRequired uint32 = 0xC0000016
+	StatusLogonFailure           uint32 = 0xC000006D
+	StatusAccessDenied           uint32 = 0xC0000022
+	StatusBadNetworkName         uint32 = 0xC00000CC
+	StatusNotSupported           uint32 = 0xC00000BB
+)
+
+var (
+	smb1ProtocolID = []byte{0xFF, 'S', 'M', 'B'}
+	smb2ProtocolID = []byte{0xFE, 'S', 'M', 'B'}
+)
+
+// Header is the fixed SMB2 packet header. Only the fields the broker uses
+// are kept; the rest are written as zero.
+type Header struct {
+	CreditCharge uint16
+	Status       uint32
+	Command      uint16
+	Credits      uint16
+	Flags        uint32
+	MessageID    uint64
+	TreeID       uint32
+	SessionID    uint64
+}
+
+// Marshal returns the header followed by body.
+func (h Header) Marshal(body []byte) []byte {
+	b := make([]byte, HeaderSize, HeaderSize+len(body))
+	copy(b[0:4], smb2ProtocolID)
+	binary.LittleEndian.PutUint16(b[4:], HeaderSize)
+	binary.LittleEndian.PutUint16(b[6:], h.CreditCharge)
+	binary.LittleEndian.PutUint32(b[8:], h.Status)
+	binary.LittleEndian.PutUint16(b[12:], h.Command)
+	binary.LittleEndian.PutUint16(b[14:], h.Credits)
+	binary.LittleEndian.PutUint32(b[16:], h.Flags)
+	binary.LittleEndian.PutUint64(b[24:], h.MessageID)
+	binary.LittleEndian.PutUint32(b[36:], h.TreeID)
+	binary.LittleEndian.PutUint64(b[40:], h.SessionID)
+	return append(b, body...)
+}
+
+// ParseHeader splits an SMB2 message into its header and body.
+func ParseHeader(message []byte) (Header, []byte, error) {
+	if len(message) < HeaderSize || string(message[0:4]) != string(smb2ProtocolID) {
+		return Header{}, nil, errors.New("not an SMB2 message")
+	}
+
+	h := Header{
+		CreditCharge: binary.LittleEndian.Uint16(message[6:]),
+		Status:       binary.LittleEndian.Uint32(message[8:]),
+		Command:      binary.LittleEndian.Uint16(message[12:]),
+		Credits:      binary.LittleEndian.Uint16(message[14:]),
+		Flags:        binary.LittleEndian.Uint32(message[16:]),
+		MessageID:    binary.LittleEndian.Uint64(message[24:]),
+		TreeID:       binary.LittleEndian.Uint32(message[36:]),
+		SessionID:    binary.LittleEndian.Uint64(message[40:]),
+	}
+	return h, message[HeaderSize:], nil
+}
+
+// IsSMB1 reports whether message is an SMB1 message.
+func IsSMB1(message []byte) bool {
+	return len(message) >= 4 && string(message[0:4]) == string(smb1ProtocolID)
+}
+
+// WriteMessage writes message with the direct TCP transport framing.
+func WriteMessage(w io.Writer, message []byte) error {
+	if len(message) > maxMessageSize {
+		return fmt.Errorf("message of %d bytes is too large", len(message))
+	}
+
+	frame := make([]byte, 4, 4+len(message))
+	frame[1] = byte(len(message) >> 16)
+	frame[2] = byte(len(message) >> 8)
+	frame[3] = byte(len(message))
+	_, err := w.Write(append(frame, message...))
+	return err
+}
+
+// ReadMessage reads one message framed with the direct TCP transport.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	var frame [4]byte
+	if _, err := io.ReadFull(r, frame[:]); err != nil {
+		return nil, err
+	}
+	if frame[0] != 0 {
+		return nil, fmt.Errorf("unexpected transport frame type 0x%02x", frame[0])
+	}
+
+	size := int(frame[1])<<16 | int(frame[2])<<8 | int(frame[3])
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes is too large", size)
+	}
+
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// StatusError is returned when the server answers a request with an error
+// status.
+type StatusError struct {
+	Command uint16
+	Status  uint32
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s failed: %s", commandNames[e.Command], statusText(e.Status))
+}
+
+var commandNames = map[uint16]string{
+	CommandNegotiate:    "NEGOTIATE",
+	CommandSessionSetup: "SESSION_SETUP",
+	CommandLogoff:       "LOGOFF",
+	CommandTreeConnect:  "TREE_CONNECT",
+	CommandTreeDisconn:  "TREE_DISCONNECT",
+}
+
+func statusText(status uint32) string {
+	switch status {
+	case StatusLogonFailure:
+		return "logon failure"
+	case StatusAccessDenied:
+		return "access denied"
+	case StatusBadNetworkName:
+		return "bad network name"
+	case StatusNotSupported:
+		return "not supported"
+	}
+	return fmt.Sprintf("status 0x%08x", status)
+}
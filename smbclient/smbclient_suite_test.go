@@ -0,0 +1,13 @@
+package smbclient_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSmbclient(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SMB Client Suite")
+}
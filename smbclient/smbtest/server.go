@@ -0,0 +1,366 @@
+// Package smbtest provides an in-process SMB server for tests. It speaks
+// just enough of the protocol to answer the requests smbclient sends.
+package smbtest
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"unicode/utf16"
+
+	"code.cloudfoundry.org/smbbroker/smbclient"
+	"code.cloudfoundry.org/smbbroker/smbclient/internal/smbauth"
+)
+
+const (
+	sessionID = 0x0000100000000041
+	treeID    = 0x00000001
+
+	securityModeSigningRequired = 0x0002
+
+	StatusUserSessionDeleted uint32 = 0xC0000203
+)
+
+var dialects = map[string]uint16{
+	"2.0": smbclient.DialectSMB202,
+	"2.1": smbclient.DialectSMB210,
+	"3.0": smbclient.DialectSMB300,
+}
+
+// Server is a fake SMB server listening on a local port.
+type Server struct {
+	// Versions are the SMB versions the server accepts.
+	Versions []string
+	// DropUnsupported makes the server close the connection instead of
+	// answering STATUS_NOT_SUPPORTED when no offered dialect is accepted.
+	DropUnsupported bool
+
+	// Users maps user names to passwords. User names are compared case
+	// insensitively, the domain is ignored.
+	Users map[string]string
+	// Shares maps share names to the users that may connect to them. An
+	// empty list allows every user.
+	Shares map[string][]string
+	// Guest maps unknown users to the guest account instead of failing the
+	// logon.
+	Guest bool
+	// RequireSigning rejects unsigned or wrongly signed requests after the
+	// session is set up.
+	RequireSigning bool
+
+	listener net.Listener
+	mutex    sync.Mutex
+	requests []string
+}
+
+// NewServer starts a server that accepts the given SMB versions.
+func NewServer(versions ...string) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Versions: versions,
+		Users:    map[string]string{},
+		Shares:   map[string][]string{},
+		listener: listener,
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// Requests returns the commands received so far, e.g. "NEGOTIATE 2.0,2.1"
+// or `TREE_CONNECT \\host\share`.
+func (s *Server) Requests() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) record(request string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests = append(s.requests, request)
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// connection is the state of one client connection.
+type connection struct {
+	server  *Server
+	dialect uint16
+	ntlm    *smbauth.Server
+	user    string
+	signer  *smbauth.Signer
+	guest   bool
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	c := &connection{server: s}
+	for {
+		message, err := smbclient.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+
+		var response []byte
+		if smbclient.IsSMB1(message) {
+			response = s.negotiateSMB1(message)
+		} else {
+			header, body, err := smbclient.ParseHeader(message)
+			if err != nil {
+				return
+			}
+			response = c.dispatch(header, body, message)
+		}
+
+		if response == nil {
+			return
+		}
+		if err := smbclient.WriteMessage(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+func (c *connection) dispatch(header smbclient.Header, body, message []byte) []byte {
+	if header.Command != smbclient.CommandNegotiate && header.Command != smbclient.CommandSessionSetup {
+		if c.user == "" && !c.guest {
+			return reply(header, StatusUserSessionDeleted, errorBody())
+		}
+		if c.server.RequireSigning && (header.Flags&smbclient.FlagSigned == 0 || c.signer == nil || !c.signer.Verify(message)) {
+			return reply(header, smbclient.StatusAccessDenied, errorBody())
+		}
+	}
+
+	switch header.Command {
+	case smbclient.CommandNegotiate:
+		return c.negotiate(header, body)
+	case smbclient.CommandSessionSetup:
+		return c.sessionSetup(header, body)
+	case smbclient.CommandTreeConnect:
+		return c.treeConnect(header, body)
+	case smbclient.CommandTreeDisconn, smbclient.CommandLogoff:
+		c.server.record(commandName(header.Command))
+		return reply(header, smbclient.StatusSuccess, errorBody()[:4])
+	}
+	return reply(header, smbclient.StatusNotSupported, errorBody())
+}
+
+func (c *connection) negotiate(header smbclient.Header, body []byte) []byte {
+	if len(body) < 36 {
+		return nil
+	}
+
+	count := int(binary.LittleEndian.Uint16(body[2:]))
+	if len(body) < 36+2*count {
+		return nil
+	}
+
+	var offered []string
+	var selected uint16
+	for i := 0; i < count; i++ {
+		dialect := binary.LittleEndian.Uint16(body[36+2*i:])
+		for _, version := range c.server.Versions {
+			if dialects[version] == dialect {
+				offered = append(offered, version)
+				if dialect > selected {
+					selected = dialect
+				}
+			}
+		}
+	}
+	c.server.record("NEGOTIATE " + strings.Join(offered, ","))
+
+	if selected == 0 {
+		if c.server.DropUnsupported {
+			return nil
+		}
+		return reply(header, smbclient.StatusNotSupported, errorBody())
+	}
+	c.dialect = selected
+
+	securityMode := uint16(0x0001)
+	if c.server.RequireSigning {
+		securityMode |= securityModeSigningRequired
+	}
+
+	response := make([]byte, 64)
+	binary.LittleEndian.PutUint16(response[0:], 65)
+	binary.LittleEndian.PutUint16(response[2:], securityMode)
+	binary.LittleEndian.PutUint16(response[4:], selected)
+	return reply(header, smbclient.StatusSuccess, response)
+}
+
+func (c *connection) sessionSetup(header smbclient.Header, body []byte) []byte {
+	if len(body) < 24 {
+		return nil
+	}
+	offset := int(binary.LittleEndian.Uint16(body[12:])) - smbclient.HeaderSize
+	length := int(binary.LittleEndian.Uint16(body[14:]))
+	if offset < 24 || offset+length > len(body) {
+		return nil
+	}
+
+	message, _, err := smbauth.ParseToken(body[offset : offset+length])
+	if err != nil || message == nil {
+		return reply(header, smbclient.StatusLogonFailure, errorBody())
+	}
+	header.SessionID = sessionID
+
+	if c.ntlm == nil {
+		c.server.record("SESSION_SETUP")
+		c.ntlm = &smbauth.Server{TargetName: "SMBTEST", Password: c.server.password}
+		challenge, err := c.ntlm.Challenge(message)
+		if err != nil {
+			return reply(header, smbclient.StatusLogonFailure, errorBody())
+		}
+		return reply(header, smbclient.StatusMoreProcessingRequired, sessionSetupBody(0, smbauth.ResponseToken(smbauth.NegStateAcceptIncomplete, challenge)))
+	}
+
+	user, sessionKey, err := c.ntlm.Verify(message)
+	c.ntlm = nil
+	if err != nil {
+		if c.server.Guest {
+			c.guest = true
+			return reply(header, smbclient.StatusSuccess, sessionSetupBody(smbclient.SessionFlagIsGuest, smbauth.ResponseToken(smbauth.NegStateAcceptCompleted, nil)))
+		}
+		return reply(header, smbclient.StatusLogonFailure, errorBody())
+	}
+
+	c.user = user
+	c.signer = smbauth.NewSigner(sessionKey, c.dialect)
+	return reply(header, smbclient.StatusSuccess, sessionSetupBody(0, smbauth.ResponseToken(smbauth.NegStateAcceptCompleted, nil)))
+}
+
+func (c *connection) treeConnect(header smbclient.Header, body []byte) []byte {
+	if len(body) < 8 {
+		return nil
+	}
+	offset := int(binary.LittleEndian.Uint16(body[4:])) - smbclient.HeaderSize
+	length := int(binary.LittleEndian.Uint16(body[6:]))
+	if offset < 8 || offset+length > len(body) {
+		return nil
+	}
+
+	path := fromUTF16le(body[offset : offset+length])
+	c.server.record("TREE_CONNECT " + path)
+
+	share := path[strings.LastIndex(path, `\`)+1:]
+	users, ok := c.server.Shares[share]
+	if !ok {
+		return reply(header, smbclient.StatusBadNetworkName, errorBody())
+	}
+	if len(users) > 0 && !containsFold(users, c.user) {
+		return reply(header, smbclient.StatusAccessDenied, errorBody())
+	}
+
+	header.TreeID = treeID
+	response := make([]byte, 16)
+	binary.LittleEndian.PutUint16(response[0:], 16)
+	response[2] = 0x01
+	return reply(header, smbclient.StatusSuccess, response)
+}
+
+func (s *Server) password(user, domain string) (string, bool) {
+	for name, password := range s.Users {
+		if strings.EqualFold(name, user) {
+			return password, true
+		}
+	}
+	return "", false
+}
+
+func (s *Server) negotiateSMB1(message []byte) []byte {
+	s.record("NEGOTIATE 1.0")
+
+	supported := false
+	for _, version := range s.Versions {
+		supported = supported || version == "1.0"
+	}
+	if !supported {
+		return nil
+	}
+
+	response := make([]byte, 35)
+	copy(response, message[:32])
+	response[9] |= 0x80
+	response[32] = 1
+	return response
+}
+
+func reply(request smbclient.Header, status uint32, body []byte) []byte {
+	header := smbclient.Header{
+		Status:    status,
+		Command:   request.Command,
+		Credits:   1,
+		Flags:     smbclient.FlagResponse,
+		MessageID: request.MessageID,
+		TreeID:    request.TreeID,
+		SessionID: request.SessionID,
+	}
+	return header.Marshal(body)
+}
+
+func sessionSetupBody(flags uint16, token []byte) []byte {
+	body := make([]byte, 8, 8+len(token))
+	binary.LittleEndian.PutUint16(body[0:], 9)
+	binary.LittleEndian.PutUint16(body[2:], flags)
+	binary.LittleEndian.PutUint16(body[4:], smbclient.HeaderSize+8)
+	binary.LittleEndian.PutUint16(body[6:], uint16(len(token)))
+	return append(body, token...)
+}
+
+func errorBody() []byte {
+	body := make([]byte, 9)
+	binary.LittleEndian.PutUint16(body[0:], 9)
+	return body
+}
+
+func commandName(command uint16) string {
+	if command == smbclient.CommandLogoff {
+		return "LOGOFF"
+	}
+	return "TREE_DISCONNECT"
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func fromUTF16le(b []byte) string {
+	codes := make([]uint16, len(b)/2)
+	for i := range codes {
+		codes[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(codes))
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"code.cloudfoundry.org/service-broker-store/brokerstore/credhub_shims"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const bindingIndexPath = "index"
+
+// BindingIndex is what the store records about a binding next to the
+// binding details themselves.
+type BindingIndex struct {
+	InstanceID     string `json:"instance_id"`
+	ContainerDir   string `json:"container_dir,omitempty"`
+	VolumeIDScheme string `json:"volume_id_scheme,omitempty"`
+}
+
+// DefaultIndexMaxAge is how long the index of an IndexedStore is used before
+// it is refreshed.
+const DefaultIndexMaxAge = 30 * time.Second
+
+// IndexedStore is a CredHub backed brokerstore.Store that keeps an in-memory
+// index of all instances and bindings so that they can be listed and counted
+// without a CredHub round trip per record. The index is loaded on first use
+// and refreshed once it is older than MaxAge, or when Refresh is called, so
+// that it sees what other broker instances, the store commands and CredHub
+// operators changed. A refresh lists the records and only reads those whose
+// version changed.
+//
+// Bindings are not stored with their service instance, so the instance a
+// binding belongs to, and where it is mounted, is recorded separately under
+// /<storeID>/index/<bindingID>.
+type IndexedStore struct {
+	brokerstore.Store
+
+	// Redaction keeps the secret bind parameters out of binding records;
+	// they are stored as given when nil.
+	Redaction *BindingRedaction
+
+	MaxAge time.Duration
+
+	// Metrics records the duration and failures of the calls the index
+	// answers or makes to CredHub itself: refreshes, the listings and the
+	// writes and deletes of binding index records. The instance and binding
+	// records are read and written by Store, which Metrics.Store wraps.
+	Metrics *Metrics
+
+	logger  lager.Logger
+	credhub credhub_shims.Credhub
+	storeID string
+
+	mutex        sync.RWMutex
+	loaded       bool
+	loadedAt     time.Time
+	versions     map[string]string
+	instances    map[string]brokerstore.ServiceInstance
+	bindings     map[string]brokerapi.BindDetails
+	bindingIndex map[string]BindingIndex
+}
+
+func NewIndexedStore(logger lager.Logger, credhub credhub_shims.Credhub, storeID string) *IndexedStore {
+	return &IndexedStore{
+		Store:   brokerstore.NewCredhubStore(logger, credhub, storeID),
+		logger:  logger.Session("indexed-store"),
+		credhub: credhub,
+		storeID: storeID,
+
+		MaxAge: DefaultIndexMaxAge,
+	}
+}
+
+func (s *IndexedStore) CreateInstanceDetails(id string, details brokerstore.ServiceInstance) error {
+	if err := s.Store.CreateInstanceDetails(id, details); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.loaded {
+		s.instances[id] = details
+	}
+	return nil
+}
+
+func (s *IndexedStore) CreateBindingDetails(id string, details brokerapi.BindDetails) error {
+	var err error
+	details.RawParameters, err = s.Redaction.Redact(details.RawParameters)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Store.CreateBindingDetails(id, details); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.loaded {
+		s.bindings[id] = details
+	}
+	return nil
+}
+
+func (s *IndexedStore) DeleteInstanceDetails(id string) error {
+	if err := s.Store.DeleteInstanceDetails(id); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.instances, id)
+	return nil
+}
+
+func (s *IndexedStore) DeleteBindingDetails(id string) error {
+	if err := s.Store.DeleteBindingDetails(id); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err := s.credhub.Delete(s.bindingIndexName(id))
+	s.Metrics.observeStore("DeleteBindingIndex", start, err)
+	if err != nil {
+		s.logger.Info("binding-index-not-deleted", lager.Data{"bindingID": id, "error": err.Error()})
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.bindings, id)
+	delete(s.bindingIndex, id)
+	return nil
+}
+
+// IsBindingConflict reports whether a binding with id exists that was not
+// created with details. The volume broker stores the binding again when it
+// is not, which redacts records that still have a bcrypt hash or their
+// parameters.
+func (s *IndexedStore) IsBindingConflict(id string, details brokerapi.BindDetails) bool {
+	if err := s.load(); err != nil {
+		s.logger.Error("failed-to-check-binding-conflict", err)
+		return true
+	}
+
+	s.mutex.RLock()
+	existing, ok := s.bindings[id]
+	s.mutex.RUnlock()
+	if !ok {
+		return false
+	}
+
+	if existing.AppGUID != details.AppGUID || existing.PlanID != details.PlanID || existing.ServiceID != details.ServiceID ||
+		!reflect.DeepEqual(existing.BindResource, details.BindResource) {
+		return true
+	}
+
+	matches, err := s.Redaction.Matches(existing.RawParameters, details.RawParameters)
+	if err != nil {
+		s.logger.Error("failed-to-compare-binding-parameters", err, lager.Data{"bindingID": id})
+		return true
+	}
+	return !matches
+}
+
+// IndexBinding records the service instance a binding was created for and
+// the container directory it is mounted at.
+func (s *IndexedStore) IndexBinding(bindingID string, index BindingIndex) error {
+	value := map[string]interface{}{}
+	if err := decodeRecord(index, &value); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	_, err := s.credhub.SetJSON(s.bindingIndexName(bindingID), value)
+	s.Metrics.observeStore("IndexBinding", start, err)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.loaded {
+		s.bindingIndex[bindingID] = index
+	}
+	return nil
+}
+
+func (s *IndexedStore) RetrieveAllInstanceDetails() (map[string]brokerstore.ServiceInstance, error) {
+	start := time.Now()
+	instances, err := s.Instances(func(string, brokerstore.ServiceInstance) bool { return true })
+	s.Metrics.observeStore("RetrieveAllInstanceDetails", start, err)
+	return instances, err
+}
+
+func (s *IndexedStore) RetrieveAllBindingDetails() (map[string]brokerapi.BindDetails, error) {
+	start := time.Now()
+	err := s.load()
+	s.Metrics.observeStore("RetrieveAllBindingDetails", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	all := map[string]brokerapi.BindDetails{}
+	for id, details := range s.bindings {
+		all[id] = details
+	}
+	return all, nil
+}
+
+// Instances returns the service instances accepted by filter.
+func (s *IndexedStore) Instances(filter func(id string, details brokerstore.ServiceInstance) bool) (map[string]brokerstore.ServiceInstance, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	matches := map[string]brokerstore.ServiceInstance{}
+	for id, details := range s.instances {
+		if filter(id, details) {
+			matches[id] = details
+		}
+	}
+	return matches, nil
+}
+
+func (s *IndexedStore) InstancesByOrg(orgGUID string) (map[string]brokerstore.ServiceInstance, error) {
+	return s.Instances(func(_ string, details brokerstore.ServiceInstance) bool {
+		return details.OrganizationGUID == orgGUID
+	})
+}
+
+func (s *IndexedStore) InstancesBySpace(spaceGUID string) (map[string]brokerstore.ServiceInstance, error) {
+	return s.Instances(func(_ string, details brokerstore.ServiceInstance) bool {
+		return details.SpaceGUID == spaceGUID
+	})
+}
+
+// BindingsByInstance returns the bindings known to belong to instanceID.
+// Bindings created before the index existed are not attributed to any
+// instance.
+func (s *IndexedStore) BindingsByInstance(instanceID string) (map[string]brokerapi.BindDetails, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	matches := map[string]brokerapi.BindDetails{}
+	for id, details := range s.bindings {
+		if s.bindingIndex[id].InstanceID == instanceID {
+			matches[id] = details
+		}
+	}
+	return matches, nil
+}
+
+// BindingsByApp returns the index entries of the bindings for appGUID.
+func (s *IndexedStore) BindingsByApp(appGUID string) (map[string]BindingIndex, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	matches := map[string]BindingIndex{}
+	for id, details := range s.bindings {
+		if details.AppGUID == appGUID {
+			matches[id] = s.bindingIndex[id]
+		}
+	}
+	return matches, nil
+}
+
+// LegacyVolumeIDs reports whether any binding of instanceID has a legacy
+// volume ID.
+func (s *IndexedStore) LegacyVolumeIDs(instanceID string) (bool, error) {
+	if err := s.load(); err != nil {
+		return false, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for id := range s.bindings {
+		index := s.bindingIndex[id]
+		if index.InstanceID == instanceID && index.VolumeIDScheme == "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// InstanceForBinding returns the instance a binding belongs to, or "" when
+// it is not known.
+func (s *IndexedStore) InstanceForBinding(bindingID string) (string, error) {
+	if err := s.load(); err != nil {
+		return "", err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.bindingIndex[bindingID].InstanceID, nil
+}
+
+func (s *IndexedStore) load() error {
+	s.mutex.RLock()
+	fresh := s.loaded && time.Since(s.loadedAt) < s.MaxAge
+	s.mutex.RUnlock()
+	if fresh {
+		return nil
+	}
+	return s.Refresh()
+}
+
+// Refresh brings the index up to date with CredHub. The broker refreshes it
+// before it counts against quotas or checks a binding with an explicit mount
+// path against the other bindings of its app, and otherwise relies on
+// MaxAge.
+func (s *IndexedStore) Refresh() error {
+	start := time.Now()
+	err := s.refresh()
+	s.Metrics.observeStore("Refresh", start, err)
+	return err
+}
+
+func (s *IndexedStore) refresh() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	logger := s.logger.Session("refresh")
+	logger.Debug("start")
+	defer logger.Debug("end")
+
+	results, err := s.credhub.FindByPath(s.namespaced(""))
+	if err != nil {
+		return fmt.Errorf("failed to list store records: %s", err.Error())
+	}
+
+	versions := map[string]string{}
+	instances := map[string]brokerstore.ServiceInstance{}
+	bindings := map[string]brokerapi.BindDetails{}
+	bindingIndex := map[string]BindingIndex{}
+	read := 0
+
+	for _, credential := range results.Credentials {
+		id := strings.TrimPrefix(credential.Name, s.namespaced(""))
+		if id == credential.Name || id == "migrated-from-sql" {
+			continue
+		}
+		bindingID := strings.TrimPrefix(id, bindingIndexPath+"/")
+
+		if s.loaded && credential.VersionCreatedAt != "" && s.versions[credential.Name] == credential.VersionCreatedAt {
+			versions[credential.Name] = credential.VersionCreatedAt
+			if index, ok := s.bindingIndex[bindingID]; ok && bindingID != id {
+				bindingIndex[bindingID] = index
+			} else if instance, ok := s.instances[id]; ok {
+				instances[id] = instance
+			} else if binding, ok := s.bindings[id]; ok {
+				bindings[id] = binding
+			}
+			continue
+		}
+
+		record, err := s.credhub.GetLatestJSON(credential.Name)
+		if err != nil {
+			logger.Info("skipping-record", lager.Data{"name": credential.Name, "error": err.Error()})
+			continue
+		}
+		read++
+		versions[credential.Name] = credential.VersionCreatedAt
+
+		if bindingID != id {
+			var index BindingIndex
+			if err := decodeRecord(record.Value, &index); err != nil {
+				logger.Info("skipping-record", lager.Data{"name": credential.Name, "error": err.Error()})
+				continue
+			}
+			bindingIndex[bindingID] = index
+			continue
+		}
+
+		if _, ok := record.Value["ServiceFingerPrint"]; ok {
+			var instance brokerstore.ServiceInstance
+			if err := decodeRecord(record.Value, &instance); err != nil {
+				logger.Info("skipping-record", lager.Data{"name": credential.Name, "error": err.Error()})
+				continue
+			}
+			instances[id] = instance
+		} else if _, ok := record.Value["app_guid"]; ok {
+			var binding brokerapi.BindDetails
+			if err := decodeRecord(record.Value, &binding); err != nil {
+				logger.Info("skipping-record", lager.Data{"name": credential.Name, "error": err.Error()})
+				continue
+			}
+			bindings[id] = binding
+		}
+	}
+
+	s.versions = versions
+	s.instances = instances
+	s.bindings = bindings
+	s.bindingIndex = bindingIndex
+	s.loaded = true
+	s.loadedAt = time.Now()
+
+	logger.Info("refreshed", lager.Data{"instances": len(instances), "bindings": len(bindings), "read": read})
+	return nil
+}
+
+func (s *IndexedStore) namespaced(id string) string {
+	return fmt.Sprintf("/%s/%s", s.storeID, id)
+}
+
+func (s *IndexedStore) bindingIndexName(bindingID string) string {
+	return s.namespaced(bindingIndexPath + "/" + bindingID)
+}
+
+func decodeRecord(value interface{}, target interface{}) error {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, target)
+}
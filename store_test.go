@@ -0,0 +1,184 @@
+package main_test
+
+import (
+	"encoding/json"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"github.com/pivotal-cf/brokerapi"
+	"golang.org/x/crypto/bcrypt"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IndexedStore", func() {
+	var (
+		credhub *fakeCredhub
+		store   *IndexedStore
+	)
+
+	BeforeEach(func() {
+		credhub = newFakeCredhub()
+		store = NewIndexedStore(lager.NewLogger("store"), credhub, "smbbroker")
+	})
+
+	Context("with existing records", func() {
+		BeforeEach(func() {
+			credhub.SetValue("/smbbroker/migrated-from-sql", "true")
+			credhub.SetJSON("/smbbroker/instance-1", map[string]interface{}{
+				"service_id": "service", "plan_id": "plan", "organization_guid": "org-1", "space_guid": "space-1",
+				"ServiceFingerPrint": map[string]interface{}{"share": "//server/share"},
+			})
+			credhub.SetJSON("/smbbroker/instance-2", map[string]interface{}{
+				"service_id": "service", "plan_id": "plan", "organization_guid": "org-1", "space_guid": "space-2",
+				"ServiceFingerPrint": "//server/legacy",
+			})
+			credhub.SetJSON("/smbbroker/binding-1", map[string]interface{}{"app_guid": "app-1", "plan_id": "plan", "service_id": "service"})
+			credhub.SetJSON("/smbbroker/binding-2", map[string]interface{}{"app_guid": "app-2", "plan_id": "plan", "service_id": "service"})
+			credhub.SetJSON("/smbbroker/index/binding-1", map[string]interface{}{"instance_id": "instance-1"})
+			credhub.SetJSON("/other/instance-3", map[string]interface{}{"ServiceFingerPrint": "//server/other"})
+		})
+
+		It("lists all instances and bindings", func() {
+			instances, err := store.RetrieveAllInstanceDetails()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instances).To(HaveLen(2))
+			Expect(instances["instance-1"].SpaceGUID).To(Equal("space-1"))
+			Expect(instances["instance-2"].ServiceFingerPrint).To(Equal("//server/legacy"))
+
+			bindings, err := store.RetrieveAllBindingDetails()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bindings).To(HaveLen(2))
+			Expect(bindings["binding-2"].AppGUID).To(Equal("app-2"))
+		})
+
+		It("answers index queries", func() {
+			byOrg, err := store.InstancesByOrg("org-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(byOrg).To(HaveLen(2))
+
+			bySpace, err := store.InstancesBySpace("space-2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bySpace).To(HaveKey("instance-2"))
+
+			byInstance, err := store.BindingsByInstance("instance-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(byInstance).To(HaveLen(1))
+			Expect(byInstance).To(HaveKey("binding-1"))
+
+			Expect(store.InstanceForBinding("binding-2")).To(Equal(""))
+		})
+
+		It("loads CredHub only once and keeps the index current", func() {
+			_, err := store.RetrieveAllInstanceDetails()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(store.CreateInstanceDetails("instance-4", brokerstore.ServiceInstance{OrganizationGUID: "org-1", ServiceFingerPrint: "//server/new"})).To(Succeed())
+			Expect(store.CreateBindingDetails("binding-3", brokerapi.BindDetails{AppGUID: "app-3"})).To(Succeed())
+			Expect(store.IndexBinding("binding-3", BindingIndex{InstanceID: "instance-4", ContainerDir: "/data"})).To(Succeed())
+			Expect(store.DeleteInstanceDetails("instance-2")).To(Succeed())
+
+			byOrg, err := store.InstancesByOrg("org-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(byOrg).To(HaveLen(2))
+			Expect(byOrg).To(HaveKey("instance-4"))
+
+			Expect(store.InstanceForBinding("binding-3")).To(Equal("instance-4"))
+			Expect(store.BindingsByApp("app-3")).To(Equal(map[string]BindingIndex{"binding-3": {InstanceID: "instance-4", ContainerDir: "/data"}}))
+			Expect(credhub.finds).To(Equal(1))
+		})
+
+		It("refreshes the index with the records that changed in CredHub", func() {
+			_, err := store.RetrieveAllInstanceDetails()
+			Expect(err).NotTo(HaveOccurred())
+			reads := credhub.reads
+
+			credhub.Delete("/smbbroker/instance-2")
+			credhub.SetJSON("/smbbroker/binding-2", map[string]interface{}{"app_guid": "app-3", "plan_id": "plan", "service_id": "service"})
+			credhub.SetJSON("/smbbroker/index/binding-2", map[string]interface{}{"instance_id": "instance-1"})
+
+			instances, err := store.RetrieveAllInstanceDetails()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instances).To(HaveLen(2))
+
+			Expect(store.Refresh()).To(Succeed())
+			Expect(credhub.reads - reads).To(Equal(2))
+
+			instances, err = store.RetrieveAllInstanceDetails()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instances).To(HaveLen(1))
+			Expect(store.BindingsByApp("app-3")).To(Equal(map[string]BindingIndex{"binding-2": {InstanceID: "instance-1"}}))
+			Expect(store.BindingsByInstance("instance-1")).To(HaveLen(2))
+		})
+
+		It("refreshes the index once it is older than MaxAge", func() {
+			store.MaxAge = 0
+			_, err := store.RetrieveAllInstanceDetails()
+			Expect(err).NotTo(HaveOccurred())
+
+			credhub.Delete("/smbbroker/instance-2")
+			instances, err := store.RetrieveAllInstanceDetails()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instances).To(HaveLen(1))
+			Expect(credhub.finds).To(Equal(2))
+		})
+
+		It("removes the binding index record with the binding", func() {
+			Expect(store.DeleteBindingDetails("binding-1")).To(Succeed())
+			Expect(credhub.has("/smbbroker/index/binding-1")).To(BeFalse())
+
+			byInstance, err := store.BindingsByInstance("instance-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(byInstance).To(BeEmpty())
+		})
+	})
+
+	Context("with binding redaction", func() {
+		BeforeEach(func() {
+			var err error
+			store.Redaction, err = NewBindingRedaction(bindingParamsKey)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		bindDetails := func(appGUID, params string) brokerapi.BindDetails {
+			return brokerapi.BindDetails{AppGUID: appGUID, PlanID: "plan", ServiceID: "service", RawParameters: json.RawMessage(params)}
+		}
+
+		It("keeps the secret parameters out of CredHub", func() {
+			Expect(store.CreateBindingDetails("binding-1", bindDetails("app-1", `{"username": "alice", "password": "secret"}`))).To(Succeed())
+
+			params := credhub.records["/smbbroker/binding-1"]["parameters"]
+			Expect(params).To(HaveKeyWithValue("username", "alice"))
+			Expect(params).To(HaveKey(ParamsHMACKey))
+			Expect(params).NotTo(HaveKey("password"))
+		})
+
+		It("detects conflicting bindings", func() {
+			Expect(store.CreateBindingDetails("binding-1", bindDetails("app-1", `{"username": "alice", "password": "secret"}`))).To(Succeed())
+
+			Expect(store.IsBindingConflict("binding-1", bindDetails("app-1", `{"password": "secret", "username": "alice"}`))).To(BeFalse())
+			Expect(store.IsBindingConflict("binding-1", bindDetails("app-1", `{"password": "other", "username": "alice"}`))).To(BeTrue())
+			Expect(store.IsBindingConflict("binding-1", bindDetails("app-2", `{"password": "secret", "username": "alice"}`))).To(BeTrue())
+			Expect(store.IsBindingConflict("binding-2", bindDetails("app-2", `{}`))).To(BeFalse())
+		})
+
+		It("does not conflict with records of the volume broker's stores", func() {
+			hash, err := bcrypt.GenerateFromPassword([]byte(`{"password":"secret"}`), bcrypt.MinCost)
+			Expect(err).NotTo(HaveOccurred())
+			credhub.SetJSON("/smbbroker/binding-1", map[string]interface{}{
+				"app_guid": "app-1", "plan_id": "plan", "service_id": "service",
+				"parameters": map[string]interface{}{"paramsHash": string(hash)},
+			})
+			credhub.SetJSON("/smbbroker/binding-2", map[string]interface{}{
+				"app_guid": "app-2", "plan_id": "plan", "service_id": "service",
+				"parameters": map[string]interface{}{"password": "secret"},
+			})
+
+			Expect(store.IsBindingConflict("binding-1", bindDetails("app-1", `{"password": "secret"}`))).To(BeFalse())
+			Expect(store.IsBindingConflict("binding-1", bindDetails("app-1", `{"password": "other"}`))).To(BeTrue())
+			Expect(store.IsBindingConflict("binding-2", bindDetails("app-2", `{"password": "secret"}`))).To(BeFalse())
+		})
+	})
+})
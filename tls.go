@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const DefaultTLSMinVersion = "1.2"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuiteNames are the cipher suites that can be configured, by their
+// IANA names. TLS 1.3 suites are not configurable.
+var cipherSuiteNames = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// ParseTLSVersion maps a version such as "1.2" to its crypto/tls constant.
+func ParseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimSpace(version)]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, use one of 1.0, 1.1, 1.2 or 1.3", version)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites maps a comma separated list of cipher suite names to
+// their crypto/tls constants. An empty list selects the Go defaults.
+func ParseCipherSuites(list string) ([]uint16, error) {
+	var suites []uint16
+	for _, name := range splitList(list) {
+		suite, ok := cipherSuiteNames[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
+
+// ServerTLS holds the certificate of the broker API and, for mutual TLS,
+// the CAs that sign client certificates. Both are read again when their
+// files change, and new connections use them without a restart.
+type ServerTLS struct {
+	MinVersion   uint16
+	CipherSuites []uint16
+
+	certPath     string
+	keyPath      string
+	clientCAPath string
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+func NewServerTLS(certPath, keyPath, clientCAPath string) (*ServerTLS, error) {
+	t := &ServerTLS{
+		MinVersion:   tls.VersionTLS12,
+		certPath:     certPath,
+		keyPath:      keyPath,
+		clientCAPath: clientCAPath,
+	}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload reads the certificate, key and client CAs. The previous ones stay
+// in use when that fails.
+func (t *ServerTLS) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(t.certPath, t.keyPath)
+	if err != nil {
+		return fmt.Errorf("cannot load certificate %q and key %q: %s", t.certPath, t.keyPath, err.Error())
+	}
+
+	var clientCAs *x509.CertPool
+	if t.clientCAPath != "" {
+		/* #nosec */
+		pem, err := ioutil.ReadFile(t.clientCAPath)
+		if err != nil {
+			return fmt.Errorf("cannot read client ca %q: %s", t.clientCAPath, err.Error())
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("client ca %q contains no certificates", t.clientCAPath)
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.certificate, t.clientCAs = &certificate, clientCAs
+	return nil
+}
+
+// Watch reloads the certificate, key and client CAs whenever one of their
+// files changes, until stop is closed.
+func (t *ServerTLS) Watch(logger lager.Logger, stop <-chan struct{}) error {
+	logger = logger.Session("server-tls")
+	for _, path := range []string{t.certPath, t.keyPath, t.clientCAPath} {
+		if path == "" {
+			continue
+		}
+		err := WatchFile(logger, path, stop, func() {
+			if err := t.Reload(); err != nil {
+				logger.Error("reload-failed", err)
+				return
+			}
+			logger.Info("reloaded")
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Config returns the TLS config of the broker API listener. Client
+// certificates are required when client CAs are configured.
+func (t *ServerTLS) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion:   t.MinVersion,
+		CipherSuites: t.CipherSuites,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mutex.RLock()
+			defer t.mutex.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   t.MinVersion,
+				CipherSuites: t.CipherSuites,
+				Certificates: []tls.Certificate{*t.certificate},
+			}
+			if t.clientCAs != nil {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = t.clientCAs
+			}
+			return config, nil
+		},
+	}
+}
@@ -0,0 +1,226 @@
+package main_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testCA signs certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for commonName.
+func (ca *testCA) issue(commonName string, serial int64) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).NotTo(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+var _ = Describe("ServerTLS", func() {
+	var (
+		dir      string
+		certPath string
+		keyPath  string
+		ca       *testCA
+		listener net.Listener
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "tls")
+		Expect(err).NotTo(HaveOccurred())
+		certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+		ca = newTestCA("server-ca")
+		cert, key := ca.issue("broker-1", 2)
+		Expect(ioutil.WriteFile(certPath, cert, 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(keyPath, key, 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if listener != nil {
+			listener.Close()
+			listener = nil
+		}
+		os.RemoveAll(dir)
+	})
+
+	serve := func(serverTLS *ServerTLS) string {
+		var err error
+		listener, err = tls.Listen("tcp", "127.0.0.1:0", serverTLS.Config())
+		Expect(err).NotTo(HaveOccurred())
+		go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		return listener.Addr().String()
+	}
+
+	dial := func(address string, config *tls.Config) (*x509.Certificate, error) {
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM(ca.pem)
+		config.RootCAs = roots
+
+		conn, err := tls.Dial("tcp", address, config)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		// TLS 1.3 servers report a rejected client certificate after the
+		// handshake, so a read is needed to see it.
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				return nil, err
+			}
+		}
+		return conn.ConnectionState().PeerCertificates[0], nil
+	}
+
+	It("serves the certificate", func() {
+		serverTLS, err := NewServerTLS(certPath, keyPath, "")
+		Expect(err).NotTo(HaveOccurred())
+
+		cert, err := dial(serve(serverTLS), &tls.Config{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cert.Subject.CommonName).To(Equal("broker-1"))
+	})
+
+	It("reloads the certificate when the files change", func() {
+		serverTLS, err := NewServerTLS(certPath, keyPath, "")
+		Expect(err).NotTo(HaveOccurred())
+		stop := make(chan struct{})
+		defer close(stop)
+		Expect(serverTLS.Watch(lager.NewLogger("tls"), stop)).To(Succeed())
+		address := serve(serverTLS)
+
+		cert, key := ca.issue("broker-2", 3)
+		Expect(ioutil.WriteFile(keyPath, key, 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(certPath, cert, 0600)).To(Succeed())
+
+		Eventually(func() string {
+			cert, err := dial(address, &tls.Config{})
+			if err != nil {
+				return err.Error()
+			}
+			return cert.Subject.CommonName
+		}).Should(Equal("broker-2"))
+	})
+
+	It("keeps the certificate when the new one cannot be loaded", func() {
+		serverTLS, err := NewServerTLS(certPath, keyPath, "")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ioutil.WriteFile(certPath, []byte("garbage"), 0600)).To(Succeed())
+		Expect(serverTLS.Reload()).To(MatchError(ContainSubstring("cannot load certificate")))
+
+		cert, err := dial(serve(serverTLS), &tls.Config{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cert.Subject.CommonName).To(Equal("broker-1"))
+	})
+
+	It("enforces the minimum TLS version", func() {
+		serverTLS, err := NewServerTLS(certPath, keyPath, "")
+		Expect(err).NotTo(HaveOccurred())
+		serverTLS.MinVersion = tls.VersionTLS13
+		address := serve(serverTLS)
+
+		_, err = dial(address, &tls.Config{MaxVersion: tls.VersionTLS12})
+		Expect(err).To(HaveOccurred())
+		_, err = dial(address, &tls.Config{})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("requires client certificates signed by the client CA", func() {
+		clientCA := newTestCA("client-ca")
+		clientCAPath := filepath.Join(dir, "client-ca.pem")
+		Expect(ioutil.WriteFile(clientCAPath, clientCA.pem, 0600)).To(Succeed())
+
+		serverTLS, err := NewServerTLS(certPath, keyPath, clientCAPath)
+		Expect(err).NotTo(HaveOccurred())
+		address := serve(serverTLS)
+
+		_, err = dial(address, &tls.Config{})
+		Expect(err).To(HaveOccurred())
+
+		certPEM, keyPEM := ca.issue("stranger", 4)
+		stranger, err := tls.X509KeyPair(certPEM, keyPEM)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = dial(address, &tls.Config{Certificates: []tls.Certificate{stranger}})
+		Expect(err).To(HaveOccurred())
+
+		certPEM, keyPEM = clientCA.issue("cloud-controller", 5)
+		client, err := tls.X509KeyPair(certPEM, keyPEM)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = dial(address, &tls.Config{Certificates: []tls.Certificate{client}})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("parses TLS versions and cipher suites", func() {
+		version, err := ParseTLSVersion("1.3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(version).To(Equal(uint16(tls.VersionTLS13)))
+		_, err = ParseTLSVersion("1.4")
+		Expect(err).To(MatchError(`unknown TLS version "1.4", use one of 1.0, 1.1, 1.2 or 1.3`))
+
+		suites, err := ParseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls_ecdhe_ecdsa_with_aes_256_gcm_sha384")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(suites).To(Equal([]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}))
+		_, err = ParseCipherSuites("TLS_RSA_WITH_RC4_128_SHA")
+		Expect(err).To(MatchError(`unknown cipher suite "TLS_RSA_WITH_RC4_128_SHA"`))
+	})
+})
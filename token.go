@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	DefaultTokenKeysRefreshInterval = time.Minute
+	DefaultTokenLeeway              = 30 * time.Second
+)
+
+var tokenAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+// TokenClaims are the claims of a UAA access token the broker looks at.
+type TokenClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  audience    `json:"aud"`
+	Scope     []string    `json:"scope"`
+	ClientID  string      `json:"client_id"`
+	UserName  string      `json:"user_name"`
+	ExpiresAt json.Number `json:"exp"`
+	NotBefore json.Number `json:"nbf"`
+}
+
+// Principal is the user the token was issued to or, for client credentials
+// tokens, the client.
+func (c TokenClaims) Principal() string {
+	if c.UserName != "" {
+		return c.UserName
+	}
+	if c.ClientID != "" {
+		return c.ClientID
+	}
+	return c.Subject
+}
+
+// audience is the aud claim, which is either a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// TokenKeys are the RSA keys that sign UAA tokens, read from UAA's
+// token_keys endpoint or from a local JWKS file. Keys fetched from the
+// endpoint are fetched again when a token names a key that is not known
+// yet, at most once per RefreshInterval, so that UAA key rotation needs no
+// restart. A file is read again when it changes.
+type TokenKeys struct {
+	RefreshInterval time.Duration
+	Client          *http.Client
+	Clock           clock.Clock
+
+	url  string
+	path string
+
+	mutex     sync.RWMutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+func NewTokenKeysFromURL(client *http.Client, url string) (*TokenKeys, error) {
+	k := &TokenKeys{
+		RefreshInterval: DefaultTokenKeysRefreshInterval,
+		Client:          client,
+		Clock:           clock.NewClock(),
+		url:             url,
+	}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func NewTokenKeysFromFile(path string) (*TokenKeys, error) {
+	k := &TokenKeys{Clock: clock.NewClock(), path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reads the keys again. The previous keys stay in use when that
+// fails.
+func (k *TokenKeys) Reload() error {
+	k.mutex.Lock()
+	k.fetchedAt = k.Clock.Now()
+	k.mutex.Unlock()
+
+	var contents []byte
+	var err error
+	if k.url != "" {
+		contents, err = k.fetch()
+	} else {
+		/* #nosec */
+		contents, err = ioutil.ReadFile(k.path)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read token keys: %s", err.Error())
+	}
+
+	keys, err := parseJWKS(contents)
+	if err != nil {
+		return fmt.Errorf("cannot read token keys: %s", err.Error())
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.keys = keys
+	return nil
+}
+
+// Watch reads a JWKS file again whenever it changes, until stop is closed.
+// Keys from the token_keys endpoint are refreshed on demand instead.
+func (k *TokenKeys) Watch(logger lager.Logger, stop <-chan struct{}) error {
+	if k.path == "" {
+		return nil
+	}
+
+	logger = logger.Session("token-keys")
+	return WatchFile(logger, k.path, stop, func() {
+		if err := k.Reload(); err != nil {
+			logger.Error("reload-failed", err)
+			return
+		}
+		logger.Info("reloaded")
+	})
+}
+
+// Key returns the key with ID kid, or the only key when kid is empty.
+func (k *TokenKeys) Key(kid string) (*rsa.PublicKey, error) {
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+
+	k.mutex.RLock()
+	refresh := k.url != "" && k.Clock.Since(k.fetchedAt) >= k.RefreshInterval
+	k.mutex.RUnlock()
+	if refresh {
+		if err := k.Reload(); err != nil {
+			return nil, err
+		}
+		if key, ok := k.lookup(kid); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (k *TokenKeys) lookup(kid string) (*rsa.PublicKey, bool) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+func (k *TokenKeys) fetch() ([]byte, error) {
+	response, err := k.Client.Get(k.url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with %s", k.url, response.Status)
+	}
+	return body, nil
+}
+
+// parseJWKS reads the RSA keys of a JSON Web Key Set, which is also the
+// format of UAA's token_keys endpoint.
+func parseJWKS(contents []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(contents, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.N, "="))
+		if err != nil {
+			return nil, fmt.Errorf("key %q: invalid modulus: %s", jwk.Kid, err.Error())
+		}
+		e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.E, "="))
+		if err != nil {
+			return nil, fmt.Errorf("key %q: invalid exponent: %s", jwk.Kid, err.Error())
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("key %q: invalid exponent", jwk.Kid)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RSA signing keys")
+	}
+	return keys, nil
+}
+
+// TokenVerifier accepts UAA access tokens signed with one of Keys, issued
+// by Issuer for Audience and carrying every scope of Scopes.
+type TokenVerifier struct {
+	Issuer   string
+	Audience string
+	Scopes   []string
+	Leeway   time.Duration
+	Keys     *TokenKeys
+	Clock    clock.Clock
+}
+
+func NewTokenVerifier(keys *TokenKeys, issuer, audience string, scopes []string) *TokenVerifier {
+	return &TokenVerifier{
+		Issuer:   issuer,
+		Audience: audience,
+		Scopes:   scopes,
+		Leeway:   DefaultTokenLeeway,
+		Keys:     keys,
+		Clock:    clock.NewClock(),
+	}
+}
+
+// Verify checks the signature and claims of token.
+func (v *TokenVerifier) Verify(token string) (TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return TokenClaims{}, fmt.Errorf("token is not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return TokenClaims{}, fmt.Errorf("invalid token header: %s", err.Error())
+	}
+
+	hash, ok := tokenAlgorithms[header.Alg]
+	if !ok {
+		return TokenClaims{}, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+	key, err := v.Keys.Key(header.Kid)
+	if err != nil {
+		return TokenClaims{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return TokenClaims{}, fmt.Errorf("invalid token signature: %s", err.Error())
+	}
+	digest := hash.New()
+	digest.Write([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, hash, digest.Sum(nil), signature); err != nil {
+		return TokenClaims{}, fmt.Errorf("invalid token signature")
+	}
+
+	var claims TokenClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return TokenClaims{}, fmt.Errorf("invalid token claims: %s", err.Error())
+	}
+	return claims, v.checkClaims(claims)
+}
+
+func (v *TokenVerifier) checkClaims(claims TokenClaims) error {
+	now := v.Clock.Now()
+
+	expiresAt, err := claims.ExpiresAt.Int64()
+	if err != nil {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now.After(time.Unix(expiresAt, 0).Add(v.Leeway)) {
+		return fmt.Errorf("token expired at %s", time.Unix(expiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	if notBefore, err := claims.NotBefore.Int64(); err == nil && now.Add(v.Leeway).Before(time.Unix(notBefore, 0)) {
+		return fmt.Errorf("token is not valid before %s", time.Unix(notBefore, 0).UTC().Format(time.RFC3339))
+	}
+
+	if claims.Issuer != v.Issuer {
+		return fmt.Errorf("token issuer %q is not %q", claims.Issuer, v.Issuer)
+	}
+	if v.Audience != "" && !contains(claims.Audience, v.Audience) {
+		return fmt.Errorf("token audience %v does not include %q", []string(claims.Audience), v.Audience)
+	}
+	for _, scope := range v.Scopes {
+		if !contains(claims.Scope, scope) {
+			return fmt.Errorf("token lacks scope %q", scope)
+		}
+	}
+	return nil
+}
+
+func decodeTokenPart(part string, target interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, target)
+}
@@ -0,0 +1,238 @@
+package main_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/onsi/gomega/ghttp"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testSigner signs tokens the way UAA does, with RS256.
+type testSigner struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+func newTestSigner(kid string) *testSigner {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+	return &testSigner{kid: kid, key: key}
+}
+
+func (s *testSigner) jwk() map[string]interface{} {
+	return map[string]interface{}{
+		"kty": "RSA",
+		"kid": s.kid,
+		"alg": "RS256",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+	}
+}
+
+func (s *testSigner) sign(claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": s.kid, "typ": "JWT"})
+	Expect(err).NotTo(HaveOccurred())
+	payload, err := json.Marshal(claims)
+	Expect(err).NotTo(HaveOccurred())
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	Expect(err).NotTo(HaveOccurred())
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func jwks(signers ...*testSigner) []byte {
+	var keys []interface{}
+	for _, signer := range signers {
+		keys = append(keys, signer.jwk())
+	}
+	contents, err := json.Marshal(map[string]interface{}{"keys": keys})
+	Expect(err).NotTo(HaveOccurred())
+	return contents
+}
+
+var _ = Describe("TokenVerifier", func() {
+	const issuer = "https://uaa.example.com/oauth/token"
+
+	var (
+		signer   *testSigner
+		dir      string
+		path     string
+		verifier *TokenVerifier
+	)
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":       issuer,
+			"sub":       "platform-tool",
+			"client_id": "platform-tool",
+			"aud":       []string{"smbbroker", "platform-tool"},
+			"scope":     []string{"smbbroker.admin", "uaa.none"},
+			"exp":       time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	BeforeEach(func() {
+		signer = newTestSigner("key-1")
+
+		var err error
+		dir, err = ioutil.TempDir("", "token")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "jwks.json")
+		Expect(ioutil.WriteFile(path, jwks(signer), 0600)).To(Succeed())
+
+		keys, err := NewTokenKeysFromFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		verifier = NewTokenVerifier(keys, issuer, "smbbroker", []string{"smbbroker.admin"})
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("accepts a valid token", func() {
+		verified, err := verifier.Verify(signer.sign(claims(nil)))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verified.Principal()).To(Equal("platform-tool"))
+
+		verified, err = verifier.Verify(signer.sign(claims(map[string]interface{}{"user_name": "alice", "aud": "smbbroker"})))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(verified.Principal()).To(Equal("alice"))
+	})
+
+	DescribeRejection := func(description string, overrides map[string]interface{}, message string) {
+		It("rejects "+description, func() {
+			_, err := verifier.Verify(signer.sign(claims(overrides)))
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		})
+	}
+
+	DescribeRejection("another issuer", map[string]interface{}{"iss": "https://other"}, `token issuer "https://other" is not "https://uaa.example.com/oauth/token"`)
+	DescribeRejection("another audience", map[string]interface{}{"aud": []string{"cloud_controller"}}, `token audience [cloud_controller] does not include "smbbroker"`)
+	DescribeRejection("a missing scope", map[string]interface{}{"scope": []string{"uaa.none"}}, `token lacks scope "smbbroker.admin"`)
+	DescribeRejection("an expired token", map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}, "token expired at")
+	DescribeRejection("a token without expiry", map[string]interface{}{"exp": nil}, "token has no expiry")
+	DescribeRejection("a token that is not valid yet", map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()}, "token is not valid before")
+
+	It("rejects tokens signed with another key", func() {
+		other := newTestSigner("key-1")
+		_, err := verifier.Verify(other.sign(claims(nil)))
+		Expect(err).To(MatchError("invalid token signature"))
+	})
+
+	It("rejects tokens signed with an unknown key", func() {
+		other := newTestSigner("key-2")
+		_, err := verifier.Verify(other.sign(claims(nil)))
+		Expect(err).To(MatchError(`unknown signing key "key-2"`))
+	})
+
+	It("rejects unsigned tokens", func() {
+		token := signer.sign(claims(nil))
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+		_, err := verifier.Verify(header + token[len(base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"key-1","typ":"JWT"}`))):])
+		Expect(err).To(MatchError(`unsupported signing algorithm "none"`))
+	})
+
+	Describe("the token_keys endpoint", func() {
+		var server *ghttp.Server
+
+		BeforeEach(func() {
+			server = ghttp.NewServer()
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("fetches the keys again when a token names a new key", func() {
+			rotated := newTestSigner("key-2")
+			server.AppendHandlers(
+				ghttp.CombineHandlers(ghttp.VerifyRequest(http.MethodGet, "/token_keys"), ghttp.RespondWith(http.StatusOK, jwks(signer))),
+				ghttp.CombineHandlers(ghttp.VerifyRequest(http.MethodGet, "/token_keys"), ghttp.RespondWith(http.StatusOK, jwks(signer, rotated))),
+			)
+
+			keys, err := NewTokenKeysFromURL(http.DefaultClient, server.URL()+"/token_keys")
+			Expect(err).NotTo(HaveOccurred())
+			keys.RefreshInterval = 0
+			verifier.Keys = keys
+
+			_, err = verifier.Verify(signer.sign(claims(nil)))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = verifier.Verify(rotated.sign(claims(nil)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		It("does not fetch the keys more often than the refresh interval", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, jwks(signer)))
+
+			keys, err := NewTokenKeysFromURL(http.DefaultClient, server.URL()+"/token_keys")
+			Expect(err).NotTo(HaveOccurred())
+			verifier.Keys = keys
+
+			_, err = verifier.Verify(newTestSigner("key-2").sign(claims(nil)))
+			Expect(err).To(MatchError(`unknown signing key "key-2"`))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+
+	Describe("bearer auth", func() {
+		var authenticator *Authenticator
+
+		BeforeEach(func() {
+			authenticator = NewAuthenticator(lager.NewLogger("auth"), "admin", "secret")
+			authenticator.Tokens = verifier
+		})
+
+		request := func(authorization string) int {
+			handler := authenticator.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			request := httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+			request.Header.Set("Authorization", authorization)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			return recorder.Code
+		}
+
+		It("accepts valid bearer tokens next to basic auth", func() {
+			Expect(request("Bearer " + signer.sign(claims(nil)))).To(Equal(http.StatusOK))
+			Expect(request("bearer " + signer.sign(claims(nil)))).To(Equal(http.StatusOK))
+			Expect(request("Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret")))).To(Equal(http.StatusOK))
+		})
+
+		It("rejects invalid bearer tokens", func() {
+			Expect(request("Bearer " + signer.sign(claims(map[string]interface{}{"scope": []string{}})))).To(Equal(http.StatusUnauthorized))
+			Expect(request("Bearer garbage")).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("rejects bearer tokens when token auth is off", func() {
+			authenticator.Tokens = nil
+			Expect(request("Bearer " + signer.sign(claims(nil)))).To(Equal(http.StatusUnauthorized))
+		})
+	})
+})
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// Span is one timed operation of a trace.
+type Span struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	ParentID   SpanID
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+
+	// Sampled spans are exported. Spans of traces the caller did not sample
+	// are only propagated.
+	Sampled bool
+	// TraceState is the vendor specific trace state received from the
+	// caller, passed on unchanged.
+	TraceState string
+
+	tracer *Tracer
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// Finish ends the span and hands it to the exporter.
+func (s *Span) Finish() {
+	s.End = time.Now()
+	if s.Sampled && s.tracer.Exporter != nil {
+		s.tracer.Exporter.ExportSpan(s)
+	}
+}
+
+// TraceParent formats the span as a W3C traceparent header value.
+func (s *Span) TraceParent() string {
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", s.TraceID, s.SpanID, flags)
+}
+
+// SpanExporter sends finished spans to a tracing backend.
+type SpanExporter interface {
+	ExportSpan(span *Span)
+}
+
+type spanContextKey struct{}
+
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// SpanFromContext returns the span of ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// traceData returns the trace and span ID of ctx for request log sessions.
+func traceData(ctx context.Context) lager.Data {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return lager.Data{}
+	}
+	return lager.Data{"trace-id": span.TraceID.String(), "span-id": span.SpanID.String()}
+}
+
+// Tracer creates a span for every broker API request, carried in the context
+// of the request, and child spans for the store calls made while serving it.
+// It propagates W3C trace context and exports spans itself, without the
+// OpenTelemetry SDK.
+//
+// The volume broker does not pass the context of a request on: it logs with
+// the logger it was created with and calls a store that does not take one.
+// It gets the context through a Scope instead. The HTTP requests of the
+// CredHub client and of the UAA token keys get client spans from Transport.
+type Tracer struct {
+	Exporter SpanExporter
+}
+
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{Exporter: exporter}
+}
+
+// Start begins a span that is a child of the span in ctx, or a new trace.
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	span := t.newSpan(SpanFromContext(ctx), name, kind)
+	return ContextWithSpan(ctx, span), span
+}
+
+// Handler wraps the broker API handler. It continues the trace of the W3C
+// traceparent header sent by the Cloud Controller, if there is one. Requests
+// without a correlation ID get the trace ID as X-Correlation-ID, so that the
+// brokerapi log lines of the request carry it as well.
+func (t *Tracer) Handler(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, ok := ParseTraceParent(r.Header.Get(TraceParentHeader))
+		if ok {
+			parent.TraceState = r.Header.Get(TraceStateHeader)
+		}
+
+		span := t.newSpan(parent, "osbapi "+operation(r), SpanKindServer)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		if correlationID := correlationID(r); correlationID != "" {
+			span.SetAttribute("correlation_id", correlationID)
+		} else {
+			r.Header.Set("X-Correlation-ID", span.TraceID.String())
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ContextWithSpan(r.Context(), span)))
+
+		span.SetAttribute("http.status_code", recorder.status)
+		if recorder.status >= http.StatusInternalServerError {
+			span.Error = http.StatusText(recorder.status)
+		}
+		span.Finish()
+	})
+}
+
+// Store wraps the store of the volume broker so that its calls become
+// children of the span of the request in scope.
+func (t *Tracer) Store(scope *Scope, store brokerstore.Store) brokerstore.Store {
+	if t == nil {
+		return store
+	}
+	return &tracedStore{store: store, tracer: t, scope: scope}
+}
+
+// traceStore calls fn, a call of method to the store, in a child span of the
+// span of ctx. Without a tracer or outside of requests it only calls fn.
+func (t *Tracer) traceStore(ctx context.Context, method string, fn func() error) error {
+	finish := t.startStore(ctx, method)
+	err := fn()
+	finish(err)
+	return err
+}
+
+func (t *Tracer) startStore(ctx context.Context, method string) func(error) {
+	parent := SpanFromContext(ctx)
+	if t == nil || parent == nil {
+		return func(error) {}
+	}
+
+	span := t.newSpan(parent, "store "+method, SpanKindInternal)
+	span.SetAttribute("store.method", method)
+	return func(err error) {
+		span.SetError(err)
+		span.Finish()
+	}
+}
+
+// Transport wraps the transport of an HTTP client so that every request it
+// sends gets a client span, named after the client peer and the method, e.g.
+// "credhub GET", and passes the trace on in a traceparent header. The span
+// is a child of the span of the request's context. The CredHub client and
+// the UAA token keys send their requests without a context, so their spans
+// start traces of their own; the store spans of a broker request tell which
+// of its calls reached CredHub.
+func (t *Tracer) Transport(peer string, next http.RoundTripper) http.RoundTripper {
+	if t == nil {
+		return next
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &tracedTransport{peer: peer, next: next, tracer: t}
+}
+
+type tracedTransport struct {
+	peer   string
+	next   http.RoundTripper
+	tracer *Tracer
+}
+
+func (t *tracedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	span := t.tracer.newSpan(SpanFromContext(r.Context()), t.peer+" "+r.Method, SpanKindClient)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.url", (&url.URL{Scheme: r.URL.Scheme, Host: r.URL.Host, Path: r.URL.Path}).String())
+
+	r = r.Clone(r.Context())
+	r.Header.Set(TraceParentHeader, span.TraceParent())
+	if span.TraceState != "" {
+		r.Header.Set(TraceStateHeader, span.TraceState)
+	}
+
+	response, err := t.next.RoundTrip(r)
+	if err != nil {
+		span.SetError(err)
+	} else {
+		span.SetAttribute("http.status_code", response.StatusCode)
+		if response.StatusCode >= http.StatusInternalServerError {
+			span.Error = http.StatusText(response.StatusCode)
+		}
+	}
+	span.Finish()
+	return response, err
+}
+
+func (t *Tracer) newSpan(parent *Span, name string, kind int) *Span {
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{},
+		Sampled:    true,
+		tracer:     t,
+	}
+	if parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+		span.Sampled = parent.Sampled
+		span.TraceState = parent.TraceState
+	} else {
+		_, _ = rand.Read(span.TraceID[:])
+	}
+	_, _ = rand.Read(span.SpanID[:])
+	return span
+}
+
+// Scope hands the context of the broker request being served to the volume
+// broker. The broker enters it while it holds its mutex, which it does for
+// every call to the volume broker, so there is at most one request in scope
+// and the volume broker only runs while it is.
+type Scope struct {
+	mutex sync.RWMutex
+	ctx   context.Context
+}
+
+// Context returns the context of the request in scope.
+func (s *Scope) Context() context.Context {
+	if s == nil {
+		return context.Background()
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// Logger returns logger with the trace data of the request in scope added
+// to every log line, for the volume broker.
+func (s *Scope) Logger(logger lager.Logger) lager.Logger {
+	return &scopedLogger{Logger: logger, scope: s}
+}
+
+func (s *Scope) enter(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ctx = ctx
+}
+
+func (s *Scope) leave() {
+	s.enter(nil)
+}
+
+type scopedLogger struct {
+	lager.Logger
+	scope *Scope
+}
+
+func (l *scopedLogger) Session(task string, data ...lager.Data) lager.Logger {
+	return &scopedLogger{Logger: l.Logger.Session(task, data...), scope: l.scope}
+}
+
+func (l *scopedLogger) WithData(data lager.Data) lager.Logger {
+	return &scopedLogger{Logger: l.Logger.WithData(data), scope: l.scope}
+}
+
+func (l *scopedLogger) Debug(action string, data ...lager.Data) {
+	l.Logger.Debug(action, l.traced(data)...)
+}
+
+func (l *scopedLogger) Info(action string, data ...lager.Data) {
+	l.Logger.Info(action, l.traced(data)...)
+}
+
+func (l *scopedLogger) Error(action string, err error, data ...lager.Data) {
+	l.Logger.Error(action, err, l.traced(data)...)
+}
+
+func (l *scopedLogger) Fatal(action string, err error, data ...lager.Data) {
+	l.Logger.Fatal(action, err, l.traced(data)...)
+}
+
+func (l *scopedLogger) traced(data []lager.Data) []lager.Data {
+	return append(data, traceData(l.scope.Context()))
+}
+
+// ParseTraceParent parses a W3C traceparent header value into a remote
+// parent span.
+func ParseTraceParent(value string) (*Span, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return nil, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 ||
+		strings.ToLower(value) != value {
+		return nil, false
+	}
+
+	span := &Span{}
+	if _, err := hex.Decode(span.TraceID[:], []byte(parts[1])); err != nil || span.TraceID == (TraceID{}) {
+		return nil, false
+	}
+	if _, err := hex.Decode(span.SpanID[:], []byte(parts[2])); err != nil || span.SpanID == (SpanID{}) {
+		return nil, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return nil, false
+	}
+	span.Sampled = flags&0x01 != 0
+	return span, true
+}
+
+var correlationIDHeaders = []string{"X-Correlation-ID", "X-CorrelationID", "X-ForRequest-ID", "X-Request-ID", "X-Vcap-Request-Id"}
+
+// correlationID returns the correlation ID the brokerapi middleware picks up
+// from the request.
+func correlationID(r *http.Request) string {
+	for _, header := range correlationIDHeaders {
+		if value := r.Header.Get(header); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// tracedStore records the calls to a brokerstore.Store as spans.
+type tracedStore struct {
+	store  brokerstore.Store
+	tracer *Tracer
+	scope  *Scope
+}
+
+func (s *tracedStore) start(method string) func(error) {
+	return s.tracer.startStore(s.scope.Context(), method)
+}
+
+func (s *tracedStore) RetrieveInstanceDetails(id string) (brokerstore.ServiceInstance, error) {
+	finish := s.start("RetrieveInstanceDetails")
+	details, err := s.store.RetrieveInstanceDetails(id)
+	finish(err)
+	return details, err
+}
+
+func (s *tracedStore) RetrieveBindingDetails(id string) (brokerapi.BindDetails, error) {
+	finish := s.start("RetrieveBindingDetails")
+	details, err := s.store.RetrieveBindingDetails(id)
+	finish(err)
+	return details, err
+}
+
+func (s *tracedStore) RetrieveAllInstanceDetails() (map[string]brokerstore.ServiceInstance, error) {
+	finish := s.start("RetrieveAllInstanceDetails")
+	instances, err := s.store.RetrieveAllInstanceDetails()
+	finish(err)
+	return instances, err
+}
+
+func (s *tracedStore) RetrieveAllBindingDetails() (map[string]brokerapi.BindDetails, error) {
+	finish := s.start("RetrieveAllBindingDetails")
+	bindings, err := s.store.RetrieveAllBindingDetails()
+	finish(err)
+	return bindings, err
+}
+
+func (s *tracedStore) CreateInstanceDetails(id string, details brokerstore.ServiceInstance) error {
+	finish := s.start("CreateInstanceDetails")
+	err := s.store.CreateInstanceDetails(id, details)
+	finish(err)
+	return err
+}
+
+func (s *tracedStore) CreateBindingDetails(id string, details brokerapi.BindDetails) error {
+	finish := s.start("CreateBindingDetails")
+	err := s.store.CreateBindingDetails(id, details)
+	finish(err)
+	return err
+}
+
+func (s *tracedStore) DeleteInstanceDetails(id string) error {
+	finish := s.start("DeleteInstanceDetails")
+	err := s.store.DeleteInstanceDetails(id)
+	finish(err)
+	return err
+}
+
+func (s *tracedStore) DeleteBindingDetails(id string) error {
+	finish := s.start("DeleteBindingDetails")
+	err := s.store.DeleteBindingDetails(id)
+	finish(err)
+	return err
+}
+
+func (s *tracedStore) IsInstanceConflict(id string, details brokerstore.ServiceInstance) bool {
+	finish := s.start("IsInstanceConflict")
+	conflict := s.store.IsInstanceConflict(id, details)
+	finish(nil)
+	return conflict
+}
+
+func (s *tracedStore) IsBindingConflict(id string, details brokerapi.BindDetails) bool {
+	finish := s.start("IsBindingConflict")
+	conflict := s.store.IsBindingConflict(id, details)
+	finish(nil)
+	return conflict
+}
+
+func (s *tracedStore) Restore(logger lager.Logger) error {
+	finish := s.start("Restore")
+	err := s.store.Restore(logger)
+	finish(err)
+	return err
+}
+
+func (s *tracedStore) Save(logger lager.Logger) error {
+	finish := s.start("Save")
+	err := s.store.Save(logger)
+	finish(err)
+	return err
+}
+
+func (s *tracedStore) Cleanup() error {
+	finish := s.start("Cleanup")
+	err := s.store.Cleanup()
+	finish(err)
+	return err
+}
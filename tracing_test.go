@@ -0,0 +1,327 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/existingvolumebroker"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/pivotal-cf/brokerapi/domain"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type recordingExporter struct {
+	mutex sync.Mutex
+	spans []*Span
+}
+
+func (e *recordingExporter) ExportSpan(span *Span) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func (e *recordingExporter) Spans() []*Span {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]*Span{}, e.spans...)
+}
+
+var _ = Describe("Tracer", func() {
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	var (
+		exporter *recordingExporter
+		tracer   *Tracer
+		store    *IndexedStore
+	)
+
+	BeforeEach(func() {
+		exporter = &recordingExporter{}
+		tracer = NewTracer(exporter)
+
+		credhub := newFakeCredhub()
+		credhub.SetJSON("/smbbroker/instance-1", map[string]interface{}{
+			"ServiceID":          "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+			"PlanID":             "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+			"ServiceFingerPrint": map[string]interface{}{"share": "//server/share"},
+		})
+		store = NewIndexedStore(lager.NewLogger("tracing"), credhub, "smbbroker")
+	})
+
+	serve := func(handler http.HandlerFunc, header http.Header) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPut, "/v2/service_instances/instance-1/service_bindings/binding-1", nil)
+		for k, v := range header {
+			request.Header[k] = v
+		}
+		recorder := httptest.NewRecorder()
+		tracer.Handler(handler).ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	It("creates a span per request and continues the caller's trace", func() {
+		var requestSpan *Span
+		var correlationID string
+		serve(func(w http.ResponseWriter, r *http.Request) {
+			requestSpan = SpanFromContext(r.Context())
+			correlationID = r.Header.Get("X-Correlation-ID")
+			w.WriteHeader(http.StatusCreated)
+		}, http.Header{"Traceparent": {traceParent}, "Tracestate": {"vendor=value"}})
+
+		spans := exporter.Spans()
+		Expect(spans).To(HaveLen(1))
+		Expect(spans[0]).To(BeIdenticalTo(requestSpan))
+		Expect(spans[0].Name).To(Equal("osbapi bind"))
+		Expect(spans[0].Kind).To(Equal(SpanKindServer))
+		Expect(spans[0].TraceID.String()).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+		Expect(spans[0].ParentID.String()).To(Equal("00f067aa0ba902b7"))
+		Expect(spans[0].TraceState).To(Equal("vendor=value"))
+		Expect(spans[0].Attributes).To(HaveKeyWithValue("http.status_code", http.StatusCreated))
+		Expect(correlationID).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+	})
+
+	It("keeps the correlation ID of the caller", func() {
+		serve(func(w http.ResponseWriter, r *http.Request) {}, http.Header{"X-Vcap-Request-Id": {"request-1"}})
+
+		spans := exporter.Spans()
+		Expect(spans).To(HaveLen(1))
+		Expect(spans[0].ParentID).To(Equal(SpanID{}))
+		Expect(spans[0].Attributes).To(HaveKeyWithValue("correlation_id", "request-1"))
+	})
+
+	Describe("the broker", func() {
+		var (
+			broker *Broker
+			logs   *gbytes.Buffer
+		)
+
+		BeforeEach(func() {
+			logs = gbytes.NewBuffer()
+			logger := lager.NewLogger("tracing")
+			logger.RegisterSink(lager.NewWriterSink(logs, lager.INFO))
+
+			services, err := NewServicesFromConfig("./default_services.json")
+			Expect(err).NotTo(HaveOccurred())
+			mask, err := SMBFlavor.Mask(SMBFlavor.AllowedOptions)
+			Expect(err).NotTo(HaveOccurred())
+
+			scope := &Scope{}
+			delegate := existingvolumebroker.New(existingvolumebroker.BrokerTypeSMB, scope.Logger(logger), services, &osshim.OsShim{}, clock.NewClock(), tracer.Store(scope, store), mask)
+			broker = NewBroker(logger, delegate, store)
+			broker.Tracer = tracer
+			broker.Scope = scope
+		})
+
+		bind := func(ctx context.Context) {
+			_, err := broker.Bind(ctx, "instance-1", "binding-1", domain.BindDetails{AppGUID: "app-guid"}, false)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		It("records the store calls of a request as its children", func() {
+			ctx, request := tracer.Start(context.Background(), "osbapi bind", SpanKindServer)
+			bind(ctx)
+
+			var names []string
+			for _, span := range exporter.Spans() {
+				Expect(span.TraceID).To(Equal(request.TraceID))
+				Expect(span.ParentID).To(Equal(request.SpanID))
+				Expect(span.Attributes).To(HaveKey("store.method"))
+				names = append(names, span.Name)
+			}
+			Expect(names).To(ContainElement("store RetrieveInstanceDetails"))
+			Expect(names).To(ContainElement("store IsBindingConflict"))
+			Expect(names).To(ContainElement("store CreateBindingDetails"))
+			Expect(names).To(ContainElement("store IndexBinding"))
+		})
+
+		It("logs the trace ID on the lines of the volume broker", func() {
+			ctx, request := tracer.Start(context.Background(), "osbapi bind", SpanKindServer)
+			bind(ctx)
+
+			Expect(logs).To(gbytes.Say(`"message":"tracing.bind.starting-broker-bind".*"trace-id":"` + request.TraceID.String() + `"`))
+		})
+
+		It("does not trace calls outside of requests", func() {
+			bind(context.Background())
+			Expect(exporter.Spans()).To(BeEmpty())
+
+			_, err := tracer.Store(&Scope{}, store).RetrieveInstanceDetails("instance-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exporter.Spans()).To(BeEmpty())
+		})
+	})
+
+	Describe("HTTP clients", func() {
+		var (
+			server  *httptest.Server
+			headers chan http.Header
+			client  *http.Client
+		)
+
+		BeforeEach(func() {
+			headers = make(chan http.Header, 1)
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				headers <- r.Header
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			client = &http.Client{Transport: tracer.Transport("credhub", nil)}
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("records every request as a client span and passes the trace on", func() {
+			response, err := client.Get(server.URL + "/api/v1/data?name=secret")
+			Expect(err).NotTo(HaveOccurred())
+			response.Body.Close()
+
+			Expect(exporter.Spans()).To(HaveLen(1))
+			span := exporter.Spans()[0]
+			Expect(span.Name).To(Equal("credhub GET"))
+			Expect(span.Kind).To(Equal(SpanKindClient))
+			Expect(span.ParentID).To(Equal(SpanID{}))
+			Expect(span.Attributes).To(HaveKeyWithValue("http.url", server.URL+"/api/v1/data"))
+			Expect(span.Attributes).To(HaveKeyWithValue("http.status_code", http.StatusServiceUnavailable))
+			Expect(span.Error).To(Equal("Service Unavailable"))
+			Expect((<-headers).Get("Traceparent")).To(Equal(span.TraceParent()))
+		})
+
+		It("makes requests with the span of a request in their context its children", func() {
+			serve(func(w http.ResponseWriter, r *http.Request) {
+				request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+				Expect(err).NotTo(HaveOccurred())
+				response, err := client.Do(request.WithContext(r.Context()))
+				Expect(err).NotTo(HaveOccurred())
+				response.Body.Close()
+			}, http.Header{"Traceparent": {traceParent}})
+
+			spans := exporter.Spans()
+			Expect(spans).To(HaveLen(2))
+			Expect(spans[0].Name).To(Equal("credhub GET"))
+			Expect(spans[0].ParentID).To(Equal(spans[1].SpanID))
+			Expect(spans[0].TraceID.String()).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+		})
+
+		It("leaves the transport alone when tracing is off", func() {
+			var none *Tracer
+			Expect(none.Transport("credhub", http.DefaultTransport)).To(BeIdenticalTo(http.DefaultTransport))
+		})
+	})
+
+	It("propagates but does not export unsampled traces", func() {
+		var requestSpan *Span
+		serve(func(w http.ResponseWriter, r *http.Request) {
+			requestSpan = SpanFromContext(r.Context())
+		}, http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"}})
+
+		Expect(requestSpan.TraceParent()).To(MatchRegexp("^00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-00$"))
+		Expect(exporter.Spans()).To(BeEmpty())
+	})
+
+	It("passes the store through when tracing is off", func() {
+		var none *Tracer
+		Expect(none.Store(&Scope{}, store)).To(BeIdenticalTo(store))
+	})
+
+	table.DescribeTable("parsing traceparent headers", func(value string, valid bool) {
+		_, ok := ParseTraceParent(value)
+		Expect(ok).To(Equal(valid))
+	},
+		table.Entry("valid", traceParent, true),
+		table.Entry("future version with more fields", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true),
+		table.Entry("empty", "", false),
+		table.Entry("upper case", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false),
+		table.Entry("zero trace ID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false),
+		table.Entry("zero parent ID", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false),
+		table.Entry("invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false),
+		table.Entry("extra fields in version 00", traceParent+"-extra", false),
+		table.Entry("short trace ID", "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false),
+	)
+
+	Describe("exporters", func() {
+		var span *Span
+
+		BeforeEach(func() {
+			serve(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			}, http.Header{"Traceparent": {traceParent}})
+			span = exporter.Spans()[0]
+		})
+
+		It("writes spans as JSON lines", func() {
+			out := &bytes.Buffer{}
+			NewFileExporter(out).ExportSpan(span)
+
+			var record map[string]interface{}
+			Expect(json.Unmarshal(out.Bytes(), &record)).To(Succeed())
+			Expect(record).To(HaveKeyWithValue("trace_id", "4bf92f3577b34da6a3ce929d0e0e4736"))
+			Expect(record).To(HaveKeyWithValue("parent_span_id", "00f067aa0ba902b7"))
+			Expect(record).To(HaveKeyWithValue("name", "osbapi bind"))
+			Expect(record).To(HaveKeyWithValue("error", "Internal Server Error"))
+		})
+
+		It("sends batches of spans to an OTLP collector", func() {
+			bodies := make(chan []byte, 10)
+			collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.URL.Path).To(Equal("/v1/traces"))
+				Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+				body, _ := ioutil.ReadAll(r.Body)
+				bodies <- body
+			}))
+			defer collector.Close()
+
+			otlp := NewOTLPExporter(lager.NewLogger("otlp"), collector.URL+"/v1/traces")
+			otlp.BatchSize = 1
+			otlp.ExportSpan(span)
+			otlp.ExportSpan(span)
+			otlp.Flush()
+
+			Expect(bodies).To(HaveLen(2))
+			var request struct {
+				ResourceSpans []struct {
+					ScopeSpans []struct {
+						Spans []struct {
+							TraceID      string `json:"traceId"`
+							ParentSpanID string `json:"parentSpanId"`
+							Name         string `json:"name"`
+							Kind         int    `json:"kind"`
+							Attributes   []struct {
+								Key   string                 `json:"key"`
+								Value map[string]interface{} `json:"value"`
+							} `json:"attributes"`
+							Status struct {
+								Code int `json:"code"`
+							} `json:"status"`
+						} `json:"spans"`
+					} `json:"scopeSpans"`
+				} `json:"resourceSpans"`
+			}
+			Expect(json.Unmarshal(<-bodies, &request)).To(Succeed())
+			sent := request.ResourceSpans[0].ScopeSpans[0].Spans
+			Expect(sent).To(HaveLen(1))
+			Expect(sent[0].TraceID).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+			Expect(sent[0].ParentSpanID).To(Equal("00f067aa0ba902b7"))
+			Expect(sent[0].Kind).To(Equal(SpanKindServer))
+			Expect(sent[0].Status.Code).To(Equal(2))
+			values := map[string]map[string]interface{}{}
+			for _, attribute := range sent[0].Attributes {
+				values[attribute.Key] = attribute.Value
+			}
+			Expect(values).To(HaveKeyWithValue("http.status_code", map[string]interface{}{"intValue": "500"}))
+			Expect(values).To(HaveKeyWithValue("http.method", map[string]interface{}{"stringValue": "PUT"}))
+		})
+	})
+})
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pivotal-cf/brokerapi/domain"
+)
+
+// VolumeIDSchemeHMAC is recorded in the binding index of bindings whose
+// volume ID VolumeIDs derived. Bindings without a scheme have the legacy
+// volume ID of the volume broker, the MD5 of their mount options.
+const VolumeIDSchemeHMAC = "hmac-sha256"
+
+// MinKeyLength is the shortest key VolumeIDs and BindingRedaction accept.
+const MinKeyLength = 32
+
+// VolumeIDs derives the volume IDs of new bindings from a secret key, so
+// that neither the cells nor the platform learn anything about the mount
+// options from them. Diego shares a mount between the containers of a cell
+// whose volume IDs are the same, so the ID covers every mount option but
+// the secret ones: bindings that only differ in their password share a
+// mount.
+type VolumeIDs struct {
+	key []byte
+
+	// KeepLegacy gives new bindings of an instance that still has bindings
+	// with legacy volume IDs the legacy volume ID as well, so that the apps
+	// of the instance keep sharing their mounts until those bindings are
+	// re-created.
+	KeepLegacy bool
+}
+
+func NewVolumeIDs(key string) (*VolumeIDs, error) {
+	if len(key) < MinKeyLength {
+		return nil, fmt.Errorf("volume ID key must be at least %d bytes long", MinKeyLength)
+	}
+	return &VolumeIDs{key: []byte(key)}, nil
+}
+
+// ID returns the volume ID of a binding of instanceID with the mount
+// options opts.
+func (v *VolumeIDs) ID(instanceID string, opts map[string]interface{}) (string, error) {
+	canonical, err := canonicalOptions(opts)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write(canonical)
+	return instanceID + "-" + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// apply replaces the volume IDs of the volume mounts of a binding the volume
+// broker created.
+func (v *VolumeIDs) apply(binding *domain.Binding, instanceID string) error {
+	for i := range binding.VolumeMounts {
+		device := &binding.VolumeMounts[i].Device
+		id, err := v.ID(instanceID, device.MountConfig)
+		if err != nil {
+			return err
+		}
+		device.VolumeId = id
+	}
+	return nil
+}
+
+// canonicalOptions returns the JSON object of the mount options without the
+// secret ones, with the keys sorted and every value written as a string, so
+// that options that mount the same way give the same bytes.
+func canonicalOptions(opts map[string]interface{}) ([]byte, error) {
+	canonical := map[string]string{}
+	for k, v := range opts {
+		if contains(SecretOptions, k) {
+			continue
+		}
+		canonical[k] = fmt.Sprintf("%v", v)
+	}
+	return json.Marshal(canonical)
+}
@@ -0,0 +1,59 @@
+package main_test
+
+import (
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("VolumeIDs", func() {
+	const key = "0123456789abcdef0123456789abcdef"
+
+	var volumeIDs *VolumeIDs
+
+	BeforeEach(func() {
+		var err error
+		volumeIDs, err = NewVolumeIDs(key)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	id := func(v *VolumeIDs, opts map[string]interface{}) string {
+		id, err := v.ID("instance-id", opts)
+		Expect(err).NotTo(HaveOccurred())
+		return id
+	}
+
+	It("prefixes a SHA-256 HMAC with the instance ID", func() {
+		Expect(id(volumeIDs, map[string]interface{}{"source": "//server/share"})).To(MatchRegexp(`^instance-id-[0-9a-f]{64}$`))
+	})
+
+	It("leaves the secret options out", func() {
+		opts := map[string]interface{}{"source": "//server/share", "username": "alice"}
+		withPassword := map[string]interface{}{"source": "//server/share", "username": "alice", "password": "secret"}
+		Expect(id(volumeIDs, withPassword)).To(Equal(id(volumeIDs, opts)))
+	})
+
+	It("covers every other option", func() {
+		opts := map[string]interface{}{"source": "//server/share", "username": "alice"}
+		Expect(id(volumeIDs, map[string]interface{}{"source": "//server/share", "username": "bob"})).NotTo(Equal(id(volumeIDs, opts)))
+		Expect(id(volumeIDs, map[string]interface{}{"source": "//server/share", "username": "alice", "ro": "true"})).NotTo(Equal(id(volumeIDs, opts)))
+	})
+
+	It("gives options that mount the same way the same ID", func() {
+		Expect(id(volumeIDs, map[string]interface{}{"source": "//server/share", "ro": true})).
+			To(Equal(id(volumeIDs, map[string]interface{}{"ro": "true", "source": "//server/share"})))
+	})
+
+	It("depends on the key", func() {
+		other, err := NewVolumeIDs("fedcba9876543210fedcba9876543210")
+		Expect(err).NotTo(HaveOccurred())
+
+		opts := map[string]interface{}{"source": "//server/share"}
+		Expect(id(other, opts)).NotTo(Equal(id(volumeIDs, opts)))
+	})
+
+	It("rejects short keys", func() {
+		_, err := NewVolumeIDs("secret")
+		Expect(err).To(MatchError("volume ID key must be at least 32 bytes long"))
+	})
+})
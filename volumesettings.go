@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"code.cloudfoundry.org/existingvolumebroker"
+	vmo "code.cloudfoundry.org/volume-mount-options"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/domain"
+)
+
+const volumeSettingsKey = "volume"
+
+// VolumeSettings configure the volume mounts of the bindings of a service
+// or plan. They are given under "volume" in a service or plan entry of the
+// catalog, where plans override the settings of their service, and are not
+// published to the platform. Unset settings fall back to the driver of the
+// broker type, shared devices, DEFAULT_CONTAINER_PATH and the allowedOptions
+// mask.
+type VolumeSettings struct {
+	Driver         string   `json:"driver,omitempty"`
+	DeviceType     string   `json:"device_type,omitempty"`
+	ContainerPath  string   `json:"container_path,omitempty"`
+	AllowedOptions []string `json:"allowed_options,omitempty"`
+}
+
+func (s VolumeSettings) override(other VolumeSettings) VolumeSettings {
+	if other.Driver != "" {
+		s.Driver = other.Driver
+	}
+	if other.DeviceType != "" {
+		s.DeviceType = other.DeviceType
+	}
+	if other.ContainerPath != "" {
+		s.ContainerPath = other.ContainerPath
+	}
+	if len(other.AllowedOptions) > 0 {
+		s.AllowedOptions = other.AllowedOptions
+	}
+	return s
+}
+
+// Mask returns the mount option mask of the allowed options for flavor,
+// SMB when nil. It must only be used when AllowedOptions is set.
+func (s VolumeSettings) Mask(flavor *Flavor) (vmo.MountOptsMask, error) {
+	if flavor == nil {
+		flavor = SMBFlavor
+	}
+	return flavor.Mask(strings.Join(s.AllowedOptions, ","))
+}
+
+// ContainerDir returns the directory a binding with opts is mounted at.
+func (s VolumeSettings) ContainerDir(opts map[string]interface{}, instanceID string) string {
+	if _, ok := opts[MountKey]; !ok && s.ContainerPath != "" {
+		return path.Join(s.ContainerPath, instanceID)
+	}
+	return ContainerPath(opts, instanceID)
+}
+
+// apply sets the driver, device type and container directory of the
+// volume mounts of a binding the volume broker created.
+func (s VolumeSettings) apply(binding *domain.Binding, containerDir string) {
+	for i := range binding.VolumeMounts {
+		mount := &binding.VolumeMounts[i]
+		if s.Driver != "" {
+			mount.Driver = s.Driver
+		}
+		if s.DeviceType != "" {
+			mount.DeviceType = s.DeviceType
+		}
+		if s.ContainerPath != "" && containerDir != "" {
+			mount.ContainerDir = containerDir
+		}
+	}
+}
+
+// CatalogSettings holds the volume settings of the services and plans of
+// a catalog by their IDs.
+type CatalogSettings map[string]VolumeSettings
+
+// Resolve returns the settings of a plan of a service.
+func (c CatalogSettings) Resolve(serviceID, planID string) VolumeSettings {
+	return c[serviceID].override(c[planID])
+}
+
+// extractVolumeSettings removes the volume settings from the service and
+// plan entries of a decoded catalog.
+func extractVolumeSettings(catalog interface{}) (CatalogSettings, error) {
+	settings := CatalogSettings{}
+	entries, _ := catalog.([]interface{})
+	for _, entry := range entries {
+		service, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if err := settings.extract(service, fmt.Sprintf("service %v", service["name"])); err != nil {
+			return nil, err
+		}
+
+		plans, _ := service["plans"].([]interface{})
+		for _, p := range plans {
+			plan, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if err := settings.extract(plan, fmt.Sprintf("plan %v of service %v", plan["name"], service["name"])); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return settings, nil
+}
+
+func (c CatalogSettings) extract(entry map[string]interface{}, name string) error {
+	value, ok := entry[volumeSettingsKey]
+	if !ok {
+		return nil
+	}
+	delete(entry, volumeSettingsKey)
+
+	contents, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	var settings VolumeSettings
+	if err := decoder.Decode(&settings); err != nil {
+		return fmt.Errorf("volume settings of %s: %s", name, err.Error())
+	}
+
+	id, _ := entry["id"].(string)
+	c[id] = settings
+	return nil
+}
+
+// validate returns the problems of the volume settings of a catalog.
+func (c CatalogSettings) validate(services []brokerapi.Service) []string {
+	var problems []string
+	check := func(name string, settings VolumeSettings) {
+		if settings.ContainerPath != "" {
+			if err := ValidateContainerPath(settings.ContainerPath, nil); err != nil {
+				problems = append(problems, fmt.Sprintf("container_path of %s: %s", name, err.Error()))
+			}
+		}
+		if len(settings.AllowedOptions) > 0 && !contains(settings.AllowedOptions, existingvolumebroker.SOURCE_KEY) {
+			problems = append(problems, fmt.Sprintf("allowed_options of %s must include %s", name, existingvolumebroker.SOURCE_KEY))
+		}
+	}
+
+	for _, service := range services {
+		if settings, ok := c[service.ID]; ok {
+			check("service "+service.Name, settings)
+		}
+		for _, plan := range service.Plans {
+			if settings, ok := c[plan.ID]; ok {
+				check(fmt.Sprintf("plan %s of service %s", plan.Name, service.Name), settings)
+			}
+		}
+	}
+	return problems
+}
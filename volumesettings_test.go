@@ -0,0 +1,177 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	vmo "code.cloudfoundry.org/volume-mount-options"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("VolumeSettings", func() {
+	const (
+		smbID      = "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad"
+		existingID = "0da18102-48dc-46d0-98b3-7a4ff6dc9c54"
+		readonlyID = "6b0b4a5e-8f7f-4d5e-9b36-1c2f3a4d5e6f"
+		customID   = "2f1e0d9c-8b7a-4c6d-9e5f-4a3b2c1d0e9f"
+		mountID    = "7c6b5a49-3827-4160-9f8e-7d6c5b4a3928"
+	)
+
+	var (
+		dir  string
+		path string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "volume-settings")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "services.yml")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	load := func(contents string) (*Catalog, error) {
+		Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+		return NewCatalogFromConfig(path, "")
+	}
+
+	catalogYAML := `
+- id: ` + smbID + `
+  name: smb
+  description: Existing SMB shares
+  bindable: true
+  requires: [volume_mount]
+  volume:
+    container_path: /var/vcap/data/smb
+  plans:
+  - id: ` + existingID + `
+    name: existing
+    description: A preexisting share
+  - id: ` + readonlyID + `
+    name: readonly
+    description: A preexisting share, read only
+    volume:
+      allowed_options: [source, ro, username, password, domain, version]
+- id: ` + customID + `
+  name: smb-custom
+  description: Existing SMB shares of a custom driver
+  bindable: true
+  requires: [volume_mount]
+  volume:
+    driver: customsmbdriver
+    device_type: shared
+  plans:
+  - id: ` + mountID + `
+    name: existing
+    description: A preexisting share
+`
+
+	It("resolves the settings of a plan over the ones of its service", func() {
+		catalog, err := load(catalogYAML)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(catalog.VolumeSettings(smbID, existingID)).To(Equal(VolumeSettings{ContainerPath: "/var/vcap/data/smb"}))
+		Expect(catalog.VolumeSettings(smbID, readonlyID)).To(Equal(VolumeSettings{
+			ContainerPath:  "/var/vcap/data/smb",
+			AllowedOptions: []string{"source", "ro", "username", "password", "domain", "version"},
+		}))
+		Expect(catalog.VolumeSettings(customID, mountID)).To(Equal(VolumeSettings{Driver: "customsmbdriver", DeviceType: "shared"}))
+		Expect(catalog.VolumeSettings("unknown", "unknown")).To(Equal(VolumeSettings{}))
+	})
+
+	It("does not publish the settings in the catalog", func() {
+		catalog, err := load(catalogYAML)
+		Expect(err).NotTo(HaveOccurred())
+
+		contents, err := json.Marshal(catalog.List())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).NotTo(ContainSubstring(`"volume"`))
+		Expect(string(contents)).NotTo(ContainSubstring("customsmbdriver"))
+	})
+
+	It("changes the catalog version when only the settings change", func() {
+		catalog, err := load(catalogYAML)
+		Expect(err).NotTo(HaveOccurred())
+		version := catalog.Version()
+
+		Expect(ioutil.WriteFile(path, []byte(`
+- id: `+smbID+`
+  name: smb
+  description: Existing SMB shares
+  bindable: true
+  requires: [volume_mount]
+  volume:
+    container_path: /var/vcap/data/shares
+  plans:
+  - id: `+existingID+`
+    name: existing
+    description: A preexisting share
+`), 0600)).To(Succeed())
+		Expect(catalog.Reload()).To(Succeed())
+		Expect(catalog.VolumeSettings(smbID, existingID).ContainerPath).To(Equal("/var/vcap/data/shares"))
+		Expect(catalog.Version()).NotTo(Equal(version))
+	})
+
+	It("reports invalid settings", func() {
+		_, err := load(`
+- id: ` + smbID + `
+  name: smb
+  description: Existing SMB shares
+  bindable: true
+  requires: [volume_mount]
+  volume:
+    container_path: data
+  plans:
+  - id: ` + existingID + `
+    name: existing
+    description: A preexisting share
+    volume:
+      allowed_options: [ro]
+`)
+		Expect(err).To(BeAssignableToTypeOf(&CatalogError{}))
+		Expect(err.(*CatalogError).Problems).To(Equal([]string{
+			`container_path of service smb: mount path "data" must be absolute`,
+			"allowed_options of plan existing of service smb must include source",
+		}))
+	})
+
+	It("rejects unknown settings", func() {
+		_, err := load(`
+- id: ` + smbID + `
+  name: smb
+  volume:
+    drivername: customsmbdriver
+`)
+		Expect(err).To(MatchError(ContainSubstring(`volume settings of service smb: json: unknown field "drivername"`)))
+	})
+
+	It("builds the mask with the validators of the given flavor", func() {
+		settings := VolumeSettings{AllowedOptions: []string{"source", "uid"}}
+
+		mask, err := settings.Mask(NFSFlavor)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mask.Allowed).To(ConsistOf("source", "uid"))
+		_, err = vmo.NewMountOpts(map[string]interface{}{"source": "nfs://server/export", "uid": "alice"}, mask)
+		Expect(err).To(HaveOccurred())
+
+		mask, err = settings.Mask(nil)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = vmo.NewMountOpts(map[string]interface{}{"source": "//server/share", "uid": "alice"}, mask)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("derives the container directory of a binding", func() {
+		settings := VolumeSettings{ContainerPath: "/var/vcap/data/smb"}
+		Expect(settings.ContainerDir(map[string]interface{}{}, "instance-id")).To(Equal("/var/vcap/data/smb/instance-id"))
+		Expect(settings.ContainerDir(map[string]interface{}{"mount": "/data"}, "instance-id")).To(Equal("/data"))
+		Expect(VolumeSettings{}.ContainerDir(map[string]interface{}{}, "instance-id")).To(Equal("/var/vcap/data/instance-id"))
+	})
+})
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/fsnotify/fsnotify"
+)
+
+const watchSettleDelay = 100 * time.Millisecond
+
+// WatchFile calls onChange whenever the file at path is written, created or
+// replaced until stop is closed. The parent directory is watched so that
+// files swapped in by rename or symlink updates are picked up as well.
+func WatchFile(logger lager.Logger, path string, stop <-chan struct{}, onChange func()) error {
+	logger = logger.Session("watch-file", lager.Data{"path": path})
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+
+	if err := watcher.Add(filepath.Dir(absPath)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var settle <-chan time.Time
+
+		for {
+			select {
+			case <-stop:
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == absPath || event.Op&fsnotify.Create != 0 {
+					settle = time.After(watchSettleDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("watch-error", err)
+			case <-settle:
+				settle = nil
+				if _, err := os.Stat(absPath); err != nil {
+					logger.Info("file-missing", lager.Data{"error": err.Error()})
+					continue
+				}
+				logger.Info("changed")
+				onChange()
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultWebhookRetryInterval = 10 * time.Second
+	DefaultWebhookMaxBackoff    = time.Hour
+	DefaultWebhookMaxAttempts   = 20
+	DefaultWebhookTimeout       = 10 * time.Second
+
+	// WebhookSignatureHeader carries "sha256=" and the hex encoded
+	// HMAC-SHA256 of the timestamp header, a dot and the request body,
+	// keyed with the endpoint's secret.
+	WebhookSignatureHeader = "X-Smbbroker-Signature"
+
+	// WebhookTimestampHeader carries the Unix time in seconds at which a
+	// delivery attempt was signed.
+	WebhookTimestampHeader = "X-Smbbroker-Timestamp"
+
+	// WebhookTolerance is how far the timestamp of a delivery may be off
+	// the receiver's clock. Receivers should reject older or later requests,
+	// so that a captured request cannot be replayed after the window, and
+	// ignore event IDs they have already seen within it.
+	WebhookTolerance = 5 * time.Minute
+
+	WebhookInstanceProvisioned   = "org.cloudfoundry.smbbroker.instance.provisioned"
+	WebhookInstanceUpdated       = "org.cloudfoundry.smbbroker.instance.updated"
+	WebhookInstanceDeprovisioned = "org.cloudfoundry.smbbroker.instance.deprovisioned"
+	WebhookBindingCreated        = "org.cloudfoundry.smbbroker.binding.created"
+	WebhookBindingDeleted        = "org.cloudfoundry.smbbroker.binding.deleted"
+
+	cloudEventsContentType = "application/cloudevents+json"
+	webhookFailedSuffix    = ".failed"
+)
+
+// webhookEventTypes maps the audited operations to the type of the event
+// they send.
+var webhookEventTypes = map[string]string{
+	"provision":             WebhookInstanceProvisioned,
+	"update":                WebhookInstanceUpdated,
+	"deprovision":           WebhookInstanceDeprovisioned,
+	"admin-delete-instance": WebhookInstanceDeprovisioned,
+	"bind":                  WebhookBindingCreated,
+	"unbind":                WebhookBindingDeleted,
+	"admin-delete-binding":  WebhookBindingDeleted,
+}
+
+// WebhookEndpoint is an HTTP endpoint that is notified about lifecycle
+// events. Events limits the notifications to the listed event types.
+type WebhookEndpoint struct {
+	Name   string   `json:"name"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+type WebhookConfig struct {
+	Endpoints []WebhookEndpoint `json:"endpoints"`
+}
+
+// CloudEvent is a CloudEvents 1.0 event in the structured JSON mode.
+type CloudEvent struct {
+	SpecVersion     string         `json:"specversion"`
+	ID              string         `json:"id"`
+	Source          string         `json:"source"`
+	Type            string         `json:"type"`
+	Subject         string         `json:"subject"`
+	Time            time.Time      `json:"time"`
+	DataContentType string         `json:"datacontenttype"`
+	Data            LifecycleEvent `json:"data"`
+}
+
+// LifecycleEvent is the data of the events. It never holds options, so
+// that no credentials leave the broker.
+type LifecycleEvent struct {
+	InstanceID string `json:"instance_id"`
+	BindingID  string `json:"binding_id,omitempty"`
+	ServiceID  string `json:"service_id,omitempty"`
+	PlanID     string `json:"plan_id,omitempty"`
+	OrgGUID    string `json:"organization_guid,omitempty"`
+	SpaceGUID  string `json:"space_guid,omitempty"`
+	AppGUID    string `json:"app_guid,omitempty"`
+	Host       string `json:"host,omitempty"`
+	Share      string `json:"share,omitempty"`
+}
+
+// webhookDelivery is an event waiting in the outbox to be sent to an
+// endpoint. Body is kept as first sent; every attempt signs it anew with the
+// timestamp of the attempt.
+type webhookDelivery struct {
+	Endpoint    string          `json:"endpoint"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+	Body        json.RawMessage `json:"body"`
+}
+
+// Webhooks sends lifecycle events to the configured endpoints. Events are
+// written to an outbox directory first and removed once the endpoint
+// accepted them, so they survive restarts. Failed deliveries are retried
+// with exponential backoff and, after MaxAttempts, renamed to end in
+// ".failed" for operators to inspect. Deliveries to an endpoint keep the
+// order of the events. It runs as an ifrit process next to the broker API.
+type Webhooks struct {
+	Source        string
+	RetryInterval time.Duration
+	MaxBackoff    time.Duration
+	MaxAttempts   int
+	Client        *http.Client
+	Clock         clock.Clock
+
+	logger    lager.Logger
+	endpoints []WebhookEndpoint
+	outbox    string
+	wake      chan struct{}
+
+	delivering sync.Mutex
+
+	mutex     sync.Mutex
+	delivered uint64
+	failed    uint64
+}
+
+func NewWebhooks(logger lager.Logger, endpoints []WebhookEndpoint, outbox string) (*Webhooks, error) {
+	if err := os.MkdirAll(outbox, 0700); err != nil {
+		return nil, err
+	}
+
+	return &Webhooks{
+		Source:        "smbbroker",
+		RetryInterval: DefaultWebhookRetryInterval,
+		MaxBackoff:    DefaultWebhookMaxBackoff,
+		MaxAttempts:   DefaultWebhookMaxAttempts,
+		Client:        &http.Client{Timeout: DefaultWebhookTimeout},
+		Clock:         clock.NewClock(),
+		logger:        logger.Session("webhooks"),
+		endpoints:     endpoints,
+		outbox:        outbox,
+		wake:          make(chan struct{}, 1),
+	}, nil
+}
+
+func NewWebhooksFromConfig(logger lager.Logger, pathToWebhookConfig, outbox string) (*Webhooks, error) {
+	config, err := LoadWebhookConfig(pathToWebhookConfig)
+	if err != nil {
+		return nil, err
+	}
+	return NewWebhooks(logger, config.Endpoints, outbox)
+}
+
+// LoadWebhookConfig reads and validates a webhook config.
+func LoadWebhookConfig(pathToWebhookConfig string) (WebhookConfig, error) {
+	/* #nosec */
+	contents, err := ioutil.ReadFile(pathToWebhookConfig)
+	if err != nil {
+		return WebhookConfig{}, err
+	}
+
+	var config WebhookConfig
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return WebhookConfig{}, err
+	}
+
+	names := map[string]bool{}
+	for i, endpoint := range config.Endpoints {
+		if endpoint.Name == "" {
+			return WebhookConfig{}, fmt.Errorf("webhook endpoint %d has no name", i)
+		}
+		if names[endpoint.Name] {
+			return WebhookConfig{}, fmt.Errorf("webhook endpoint %q is configured twice", endpoint.Name)
+		}
+		names[endpoint.Name] = true
+
+		u, err := url.Parse(endpoint.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return WebhookConfig{}, fmt.Errorf("webhook endpoint %q: url must be an absolute http or https URL", endpoint.Name)
+		}
+		if endpoint.Secret == "" {
+			return WebhookConfig{}, fmt.Errorf("webhook endpoint %q has no secret", endpoint.Name)
+		}
+		for _, eventType := range endpoint.Events {
+			if !contains(webhookTypes(), eventType) {
+				return WebhookConfig{}, fmt.Errorf("webhook endpoint %q: unknown event type %q", endpoint.Name, eventType)
+			}
+		}
+	}
+	return config, nil
+}
+
+// Publish queues the event for a successful operation for every endpoint
+// that subscribed to its type.
+func (w *Webhooks) Publish(record AuditRecord) {
+	if w == nil {
+		return
+	}
+
+	eventType, ok := webhookEventTypes[record.Operation]
+	if !ok {
+		return
+	}
+
+	event := CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              uuid.New().String(),
+		Source:          w.Source,
+		Type:            eventType,
+		Subject:         record.InstanceID,
+		Time:            w.Clock.Now().UTC(),
+		DataContentType: "application/json",
+		Data: LifecycleEvent{
+			InstanceID: record.InstanceID,
+			BindingID:  record.BindingID,
+			ServiceID:  record.ServiceID,
+			PlanID:     record.PlanID,
+			OrgGUID:    record.OrgGUID,
+			SpaceGUID:  record.SpaceGUID,
+			AppGUID:    record.AppGUID,
+			Share:      record.Share,
+		},
+	}
+	if record.BindingID != "" {
+		event.Subject = record.BindingID
+	}
+	if share, err := parseInstanceShare(record.Share); err == nil {
+		event.Data.Host = share.Host
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		w.logger.Error("failed-to-encode-event", err)
+		return
+	}
+
+	queued := false
+	for i, endpoint := range w.endpoints {
+		if len(endpoint.Events) > 0 && !contains(endpoint.Events, eventType) {
+			continue
+		}
+
+		delivery := webhookDelivery{Endpoint: endpoint.Name, NextAttempt: event.Time, Body: body}
+		name := fmt.Sprintf("%020d-%s-%d.json", event.Time.UnixNano(), event.ID, i)
+		if err := w.write(name, delivery); err != nil {
+			w.logger.Error("failed-to-queue-event", err, lager.Data{"endpoint": endpoint.Name, "event": event.ID})
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *Webhooks) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	ticker := w.Clock.NewTicker(w.RetryInterval)
+	defer ticker.Stop()
+
+	close(ready)
+	w.Deliver()
+
+	for {
+		select {
+		case <-signals:
+			return nil
+		case <-ticker.C():
+			w.Deliver()
+		case <-w.wake:
+			w.Deliver()
+		}
+	}
+}
+
+// Deliver sends the queued events that are due, oldest first. An endpoint
+// gets no further events in a run once one of its events was not sent.
+func (w *Webhooks) Deliver() {
+	w.delivering.Lock()
+	defer w.delivering.Unlock()
+
+	names, err := w.queued()
+	if err != nil {
+		w.logger.Error("failed-to-read-outbox", err)
+		return
+	}
+
+	endpoints := map[string]WebhookEndpoint{}
+	for _, endpoint := range w.endpoints {
+		endpoints[endpoint.Name] = endpoint
+	}
+
+	blocked := map[string]bool{}
+	now := w.Clock.Now()
+	for _, name := range names {
+		delivery, err := w.read(name)
+		if err != nil {
+			w.logger.Error("failed-to-read-delivery", err, lager.Data{"delivery": name})
+			continue
+		}
+		if blocked[delivery.Endpoint] {
+			continue
+		}
+		if delivery.NextAttempt.After(now) {
+			blocked[delivery.Endpoint] = true
+			continue
+		}
+
+		endpoint, ok := endpoints[delivery.Endpoint]
+		if !ok {
+			w.logger.Info("dropping-delivery", lager.Data{"delivery": name, "reason": fmt.Sprintf("endpoint %q is no longer configured", delivery.Endpoint)})
+			w.remove(name)
+			continue
+		}
+
+		if err := w.send(endpoint, delivery.Body); err != nil {
+			delivery.LastError = err.Error()
+		} else {
+			w.remove(name)
+			w.count(&w.delivered)
+			continue
+		}
+
+		blocked[delivery.Endpoint] = true
+		delivery.Attempts++
+		logger := w.logger.WithData(lager.Data{"endpoint": endpoint.Name, "delivery": name, "attempts": delivery.Attempts})
+		if delivery.Attempts >= w.MaxAttempts {
+			logger.Error("giving-up-delivery", fmt.Errorf("%s", delivery.LastError))
+			w.count(&w.failed)
+			if err := w.write(name, delivery); err == nil {
+				err = os.Rename(filepath.Join(w.outbox, name), filepath.Join(w.outbox, name+webhookFailedSuffix))
+				if err != nil {
+					logger.Error("failed-to-set-aside-delivery", err)
+				}
+			}
+			continue
+		}
+
+		delivery.NextAttempt = now.Add(w.backoff(delivery.Attempts))
+		logger.Info("delivery-failed", lager.Data{"error": delivery.LastError, "next-attempt": delivery.NextAttempt})
+		if err := w.write(name, delivery); err != nil {
+			logger.Error("failed-to-update-delivery", err)
+		}
+	}
+}
+
+// Pending returns the number of events in the outbox that are still to be
+// sent.
+func (w *Webhooks) Pending() int {
+	names, _ := w.queued()
+	return len(names)
+}
+
+func (w *Webhooks) WriteMetrics(out io.Writer) {
+	w.mutex.Lock()
+	delivered, failed := w.delivered, w.failed
+	w.mutex.Unlock()
+
+	fmt.Fprintln(out, "# HELP smbbroker_webhook_pending Lifecycle events waiting in the webhook outbox.")
+	fmt.Fprintln(out, "# TYPE smbbroker_webhook_pending gauge")
+	fmt.Fprintf(out, "smbbroker_webhook_pending %d\n", w.Pending())
+	fmt.Fprintln(out, "# HELP smbbroker_webhook_deliveries_total Lifecycle events sent to webhook endpoints.")
+	fmt.Fprintln(out, "# TYPE smbbroker_webhook_deliveries_total counter")
+	fmt.Fprintf(out, "smbbroker_webhook_deliveries_total{outcome=\"delivered\"} %d\n", delivered)
+	fmt.Fprintf(out, "smbbroker_webhook_deliveries_total{outcome=\"failed\"} %d\n", failed)
+}
+
+func (w *Webhooks) send(endpoint WebhookEndpoint, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", cloudEventsContentType)
+	timestamp := strconv.FormatInt(w.Clock.Now().Unix(), 10)
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	request.Header.Set(WebhookSignatureHeader, "sha256="+WebhookSignature(endpoint.Secret, timestamp, body))
+
+	response, err := w.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("endpoint responded with %s", response.Status)
+	}
+	return nil
+}
+
+func (w *Webhooks) backoff(attempts int) time.Duration {
+	backoff := w.RetryInterval
+	for i := 1; i < attempts && backoff < w.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > w.MaxBackoff {
+		backoff = w.MaxBackoff
+	}
+	return backoff
+}
+
+// queued lists the deliveries in the outbox in the order of their events.
+func (w *Webhooks) queued() ([]string, error) {
+	files, err := ioutil.ReadDir(w.outbox)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (w *Webhooks) read(name string) (webhookDelivery, error) {
+	var delivery webhookDelivery
+	contents, err := ioutil.ReadFile(filepath.Join(w.outbox, name))
+	if err != nil {
+		return delivery, err
+	}
+	err = json.Unmarshal(contents, &delivery)
+	return delivery, err
+}
+
+// write stores a delivery through a temporary file, so that a crash never
+// leaves a partial delivery behind.
+func (w *Webhooks) write(name string, delivery webhookDelivery) error {
+	contents, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(w.outbox, ".delivery-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(w.outbox, name))
+}
+
+func (w *Webhooks) remove(name string) {
+	if err := os.Remove(filepath.Join(w.outbox, name)); err != nil && !os.IsNotExist(err) {
+		w.logger.Error("failed-to-remove-delivery", err, lager.Data{"delivery": name})
+	}
+}
+
+func (w *Webhooks) count(counter *uint64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	*counter++
+}
+
+// WebhookSignature returns the hex encoded HMAC-SHA256 of timestamp, a dot
+// and body keyed with secret, which receivers compare with the signature
+// header after checking the timestamp against WebhookTolerance.
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookTypes() []string {
+	var types []string
+	for _, eventType := range webhookEventTypes {
+		if !contains(types, eventType) {
+			types = append(types, eventType)
+		}
+	}
+	return types
+}
@@ -0,0 +1,261 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/existingvolumebroker"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	vmo "code.cloudfoundry.org/volume-mount-options"
+	"github.com/onsi/ginkgo/extensions/table"
+	"github.com/onsi/gomega/ghttp"
+	"github.com/pivotal-cf/brokerapi/domain"
+
+	. "code.cloudfoundry.org/smbbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Webhooks", func() {
+	var (
+		dir        string
+		outbox     string
+		logger     lager.Logger
+		server     *ghttp.Server
+		webhooks   *Webhooks
+		bodies     chan []byte
+		timestamps chan string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "webhooks")
+		Expect(err).NotTo(HaveOccurred())
+		outbox = filepath.Join(dir, "outbox")
+
+		logger = lager.NewLogger("webhooks")
+		server = ghttp.NewServer()
+		server.SetAllowUnhandledRequests(true)
+		server.SetUnhandledRequestStatusCode(http.StatusServiceUnavailable)
+
+		bodies = make(chan []byte, 10)
+		timestamps = make(chan string, 10)
+		webhooks, err = NewWebhooks(logger, []WebhookEndpoint{{Name: "cmdb", URL: server.URL() + "/events", Secret: "hook-secret"}}, outbox)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	accept := func() http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/cloudevents+json"))
+			timestamp := r.Header.Get(WebhookTimestampHeader)
+			Expect(r.Header.Get(WebhookSignatureHeader)).To(Equal("sha256=" + WebhookSignature("hook-secret", timestamp, body)))
+			bodies <- body
+			timestamps <- timestamp
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}
+
+	bindRecord := AuditRecord{
+		Operation:  "bind",
+		InstanceID: "instance-id",
+		BindingID:  "binding-id",
+		PlanID:     "plan-id",
+		OrgGUID:    "org-guid",
+		SpaceGUID:  "space-guid",
+		AppGUID:    "app-guid",
+		Share:      "//server.example.com/share",
+		Parameters: map[string]interface{}{"password": "secret"},
+	}
+
+	outboxFiles := func() []string {
+		files, err := filepath.Glob(filepath.Join(outbox, "*"))
+		Expect(err).NotTo(HaveOccurred())
+		return files
+	}
+
+	It("sends signed CloudEvents without secrets", func() {
+		server.AppendHandlers(accept())
+
+		webhooks.Publish(bindRecord)
+		webhooks.Deliver()
+
+		var body []byte
+		Eventually(bodies).Should(Receive(&body))
+		Expect(string(body)).NotTo(ContainSubstring("secret"))
+
+		var event CloudEvent
+		Expect(json.Unmarshal(body, &event)).To(Succeed())
+		Expect(event.SpecVersion).To(Equal("1.0"))
+		Expect(event.ID).NotTo(BeEmpty())
+		Expect(event.Source).To(Equal("smbbroker"))
+		Expect(event.Type).To(Equal(WebhookBindingCreated))
+		Expect(event.Subject).To(Equal("binding-id"))
+		Expect(event.Data).To(Equal(LifecycleEvent{
+			InstanceID: "instance-id",
+			BindingID:  "binding-id",
+			PlanID:     "plan-id",
+			OrgGUID:    "org-guid",
+			SpaceGUID:  "space-guid",
+			AppGUID:    "app-guid",
+			Host:       "server.example.com",
+			Share:      "//server.example.com/share",
+		}))
+		Expect(outboxFiles()).To(BeEmpty())
+	})
+
+	It("signs the time of the delivery along with the body", func() {
+		server.AppendHandlers(accept())
+
+		webhooks.Publish(bindRecord)
+		webhooks.Deliver()
+
+		var timestamp string
+		Eventually(timestamps).Should(Receive(&timestamp))
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(time.Unix(seconds, 0)).To(BeTemporally("~", time.Now(), WebhookTolerance))
+
+		body := []byte(`{"id": "event-id"}`)
+		Expect(WebhookSignature("hook-secret", timestamp, body)).NotTo(Equal(WebhookSignature("hook-secret", "0", body)))
+	})
+
+	It("only sends the events an endpoint subscribed to", func() {
+		var err error
+		webhooks, err = NewWebhooks(logger, []WebhookEndpoint{{Name: "cmdb", URL: server.URL(), Secret: "hook-secret", Events: []string{WebhookInstanceProvisioned}}}, outbox)
+		Expect(err).NotTo(HaveOccurred())
+
+		webhooks.Publish(bindRecord)
+		Expect(outboxFiles()).To(BeEmpty())
+	})
+
+	It("keeps events in the outbox until they are delivered", func() {
+		webhooks.RetryInterval = 50 * time.Millisecond
+		server.AppendHandlers(ghttp.RespondWith(http.StatusInternalServerError, nil), accept())
+
+		webhooks.Publish(bindRecord)
+		webhooks.Deliver()
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+		Expect(outboxFiles()).To(HaveLen(1))
+
+		webhooks.Deliver()
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+
+		time.Sleep(60 * time.Millisecond)
+		webhooks.Deliver()
+		Expect(server.ReceivedRequests()).To(HaveLen(2))
+		Expect(outboxFiles()).To(BeEmpty())
+	})
+
+	It("keeps the order of the events of an endpoint", func() {
+		server.AppendHandlers(ghttp.RespondWith(http.StatusInternalServerError, nil))
+
+		webhooks.Publish(bindRecord)
+		unbind := bindRecord
+		unbind.Operation = "unbind"
+		webhooks.Publish(unbind)
+		webhooks.Deliver()
+
+		Expect(server.ReceivedRequests()).To(HaveLen(1))
+		Expect(outboxFiles()).To(HaveLen(2))
+	})
+
+	It("sets deliveries aside after the last attempt", func() {
+		webhooks.MaxAttempts = 1
+
+		webhooks.Publish(bindRecord)
+		webhooks.Deliver()
+
+		files := outboxFiles()
+		Expect(files).To(HaveLen(1))
+		Expect(files[0]).To(HaveSuffix(".json.failed"))
+		Expect(webhooks.Pending()).To(Equal(0))
+	})
+
+	It("delivers events queued before a restart", func() {
+		webhooks.Publish(bindRecord)
+
+		restarted, err := NewWebhooks(logger, []WebhookEndpoint{{Name: "cmdb", URL: server.URL() + "/events", Secret: "hook-secret"}}, outbox)
+		Expect(err).NotTo(HaveOccurred())
+		server.AppendHandlers(accept())
+		restarted.Deliver()
+
+		Eventually(bodies).Should(Receive())
+		Expect(outboxFiles()).To(BeEmpty())
+	})
+
+	It("sends events for the operations of the broker", func() {
+		server.AppendHandlers(accept(), accept())
+
+		store := NewIndexedStore(logger, newFakeCredhub(), "smbbroker")
+		services, err := NewServicesFromConfig("./default_services.json")
+		Expect(err).NotTo(HaveOccurred())
+		mask, err := vmo.NewMountOptsMask([]string{"source", "mount", "ro", "username", "password", "domain", "version"},
+			map[string]interface{}{}, map[string]string{"readonly": "ro", "share": "source"}, []string{}, []string{"source"})
+		Expect(err).NotTo(HaveOccurred())
+		delegate := existingvolumebroker.New(existingvolumebroker.BrokerTypeSMB, logger, services, &osshim.OsShim{}, clock.NewClock(), store, mask)
+		broker := NewBroker(logger, delegate, store)
+		broker.Webhooks = webhooks
+
+		_, err = broker.Provision(context.Background(), "instance-id", domain.ProvisionDetails{
+			ServiceID:        "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+			PlanID:           "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+			OrganizationGUID: "org-guid",
+			SpaceGUID:        "space-guid",
+			RawParameters:    json.RawMessage(`{"share": "smb://server/share", "password": "secret"}`),
+		}, false)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = broker.Bind(context.Background(), "instance-id", "binding-id", domain.BindDetails{
+			ServiceID: "9db9cca4-8fd5-4b96-a4c7-0a48f47c3bad",
+			PlanID:    "0da18102-48dc-46d0-98b3-7a4ff6dc9c54",
+			AppGUID:   "app-guid",
+		}, false)
+		Expect(err).NotTo(HaveOccurred())
+		webhooks.Deliver()
+
+		var provisioned, bound CloudEvent
+		var body []byte
+		Eventually(bodies).Should(Receive(&body))
+		Expect(json.Unmarshal(body, &provisioned)).To(Succeed())
+		Eventually(bodies).Should(Receive(&body))
+		Expect(json.Unmarshal(body, &bound)).To(Succeed())
+
+		Expect(provisioned.Type).To(Equal(WebhookInstanceProvisioned))
+		Expect(provisioned.Data.Host).To(Equal("server"))
+		Expect(provisioned.Data.OrgGUID).To(Equal("org-guid"))
+		Expect(provisioned.Data.Share).To(Equal("//server/share"))
+		Expect(bound.Type).To(Equal(WebhookBindingCreated))
+		Expect(bound.Data.AppGUID).To(Equal("app-guid"))
+		Expect(bound.Data.SpaceGUID).To(Equal("space-guid"))
+		Expect(bound.Data.Share).To(Equal("//server/share"))
+	})
+
+	table.DescribeTable("rejected configs",
+		func(config, message string) {
+			path := filepath.Join(dir, "webhooks.json")
+			Expect(ioutil.WriteFile(path, []byte(config), 0600)).To(Succeed())
+
+			_, err := LoadWebhookConfig(path)
+			Expect(err).To(MatchError(message))
+		},
+		table.Entry("no name", `{"endpoints": [{"url": "https://cmdb", "secret": "s"}]}`, "webhook endpoint 0 has no name"),
+		table.Entry("duplicate name", `{"endpoints": [{"name": "a", "url": "https://cmdb", "secret": "s"}, {"name": "a", "url": "https://cmdb", "secret": "s"}]}`, `webhook endpoint "a" is configured twice`),
+		table.Entry("relative url", `{"endpoints": [{"name": "a", "url": "/events", "secret": "s"}]}`, `webhook endpoint "a": url must be an absolute http or https URL`),
+		table.Entry("no secret", `{"endpoints": [{"name": "a", "url": "https://cmdb"}]}`, `webhook endpoint "a" has no secret`),
+		table.Entry("unknown event", `{"endpoints": [{"name": "a", "url": "https://cmdb", "secret": "s", "events": ["instance.created"]}]}`, `webhook endpoint "a": unknown event type "instance.created"`),
+	)
+})